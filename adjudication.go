@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// planRules
+// summary: the cost sharing of an insurance plan, published by the insurer under the composite key planRules~plan.
+// amounts are integer cents and percentages whole numbers
+type planRules struct {
+	ObjectType     string      `json:"objType"`
+	Plan           string      `json:"plan"`
+	AllowedPercent int         `json:"allowedPercent"` // share of the billed amount the plan allows, 100 when not given
+	Deductible     int         `json:"deductible"`     // paid by the patient each year before the plan pays
+	Copays         map[int]int `json:"copays"`         // by formulary tier, paid by the patient per claim after the deductible
+	Coinsurance    int         `json:"coinsurance"`    // share of the rest the patient pays after the copay
+	OutOfPocketMax int         `json:"outOfPocketMax"` // most the patient pays each year, 0 for no limit
+}
+
+// accumulator
+// summary: what a patient has paid toward a plan's deductible and out of pocket maximum in a calendar year,
+// stored under the composite key accumulator~patientID~plan~year
+type accumulator struct {
+	ObjectType  string `json:"objType"`
+	PatientID   string `json:"patientID"`
+	Plan        string `json:"plan"`
+	Year        int    `json:"year"`
+	Deductible  int    `json:"deductible"`
+	OutOfPocket int    `json:"outOfPocket"`
+}
+
+// explanationOfBenefits
+// summary: how a claim was adjudicated, the amounts are integer cents
+type explanationOfBenefits struct {
+	AllowedAmount         int      `json:"allowedAmount"`
+	Deductible            int      `json:"deductible"` // part of the patient responsibility applied to the deductible
+	Copay                 int      `json:"copay"`
+	Coinsurance           int      `json:"coinsurance"`
+	PatientResponsibility int      `json:"patientResponsibility"`
+	PayerPayment          int      `json:"payerPayment"`
+	Tier                  int      `json:"tier,omitempty"`
+	DeductibleMet         int      `json:"deductibleMet"`     // accumulated deductible of the year after this claim
+	OutOfPocketMet        int      `json:"outOfPocketMet"`    // accumulated out of pocket of the year after this claim
+	Reasons               []string `json:"reasons,omitempty"` // why the claim was denied, see checkCoverage
+	AdjudicatedBy         string   `json:"adjudicatedBy"`
+	AdjudicatedAt         int      `json:"adjudicatedAt"`
+}
+
+// setPlanRules
+// input: plan, the rules as json, {"deductible": 50000, "copays": {"1": 1000, "2": 3500}, "coinsurance": 20, "outOfPocketMax": 300000}
+// output: confirmation of record saved
+// summary: replace the plan's cost sharing rules, only insurers of the plan may set them
+func (t *Chaincode) setPlanRules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0		1
+	// "plan", "rules"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(strings.TrimSpace(args[0])) <= 0 {
+		return invalidArgument("plan", "1st argument must be a non-empty string")
+	}
+
+	if _, cerr := requireInsurer(stub, args[0]); cerr != nil {
+		return cerr.response()
+	}
+
+	rules := planRules{AllowedPercent: 100}
+	if err := json.Unmarshal([]byte(args[1]), &rules); err != nil {
+		return invalidArgument("rules", "2nd argument must be json plan rules: "+err.Error())
+	}
+
+	if rules.AllowedPercent <= 0 || rules.AllowedPercent > 100 {
+		return invalidArgument("rules", "allowedPercent must be between 1 and 100")
+	}
+	if rules.Coinsurance < 0 || rules.Coinsurance > 100 {
+		return invalidArgument("rules", "coinsurance must be between 0 and 100")
+	}
+	if rules.Deductible < 0 || rules.OutOfPocketMax < 0 {
+		return invalidArgument("rules", "deductible and outOfPocketMax must not be negative")
+	}
+	for tier, copay := range rules.Copays {
+		if tier < 1 || tier > maxFormularyTier || copay < 0 {
+			return invalidArgument("rules", "copays must be non-negative amounts by tier 1 to "+strconv.Itoa(maxFormularyTier))
+		}
+	}
+
+	rules.ObjectType = objTypePlanRules
+	rules.Plan = strings.ToLower(strings.TrimSpace(args[0]))
+
+	rulesKey, err := stub.CreateCompositeKey(objTypePlanRules, []string{rules.Plan})
+	if err != nil {
+		return ledgerError("unable to create plan rules key", err)
+	}
+
+	if cerr := t.putRecord(stub, rulesKey, rules); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getPlanRules
+// input: plan
+// output: the plan's cost sharing rules
+func (t *Chaincode) getPlanRules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "plan"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(strings.TrimSpace(args[0])) <= 0 {
+		return invalidArgument("plan", "1st argument must be a non-empty string")
+	}
+
+	rules, cerr := t.getRules(stub, args[0])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	rulesAsBytes, err := json.Marshal(rules)
+	if err != nil {
+		return serializationError("unable to marshal plan rules", err)
+	}
+
+	return shim.Success(rulesAsBytes)
+}
+
+// getRules
+// input: plan
+// output: the plan's rules or NOT_FOUND if the insurer has not set them
+func (t *Chaincode) getRules(stub shim.ChaincodeStubInterface, plan string) (planRules, *chaincodeError) {
+	rulesKey, err := stub.CreateCompositeKey(objTypePlanRules, []string{strings.ToLower(strings.TrimSpace(plan))})
+	if err != nil {
+		return planRules{}, newError(errCodeLedger, "unable to create plan rules key").withDetail("cause", err.Error())
+	}
+
+	rules := planRules{}
+	if cerr := t.getRecord(stub, rulesKey, objTypePlanRules, &rules); cerr != nil {
+		return planRules{}, cerr
+	}
+
+	return rules, nil
+}
+
+// adjudicateClaim
+// input: patientID, claimID
+// output: the explanation of benefits
+// summary: price a submitted claim with the rules of the plan it was filed with and the patient's accumulators
+// of the fill's year, then mark it paid or denied. a claim the plan does not cover at the fill is denied.
+// only insurers of the claim's plan may adjudicate, see payerPlan
+func (t *Chaincode) adjudicateClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1
+	// "patientID", "claimID"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("claimID", "2nd argument must be a non-empty string")
+	}
+
+	submitted, claimKey, cerr := t.getPatientClaim(stub, args[0], args[1])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, submitted.PatientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	c, cerr := requireInsurer(stub, submitted.payerPlan(patientRecord))
+	if cerr != nil {
+		return cerr.response()
+	}
+	if submitted.Status == claimInReview {
+		return failedPrecondition("claim is held for review: "+submitted.ClaimID, submitted.ClaimID)
+	}
+	if submitted.Status != claimSubmitted {
+		return failedPrecondition("claim is already "+submitted.Status+": "+submitted.ClaimID, submitted.ClaimID)
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	eob := &explanationOfBenefits{AdjudicatedBy: c.ID, AdjudicatedAt: now}
+
+	// coverage is decided as of the fill
+	covered, cerr := t.coverageOf(stub, patientRecord, submitted.Prescription, submitted.Quantity, submitted.FillTimestamp)
+	if cerr != nil {
+		return cerr.response()
+	}
+	if covered.Covered && covered.PriorAuthRequired {
+		filled := rx{RXID: submitted.RXID, Prescription: submitted.Prescription, Quantity: submitted.Quantity}
+		if cerr := t.checkPriorAuth(stub, patientRecord, filled, submitted.FillTimestamp); cerr != nil {
+			covered.Covered = false
+			covered.Reasons = append(covered.Reasons, coverageNoPriorAuth)
+		}
+	}
+
+	if !covered.Covered {
+		eob.Reasons = covered.Reasons
+		eob.PatientResponsibility = submitted.BilledAmount
+		submitted.Status = claimDenied
+	} else {
+		rules, cerr := t.getRules(stub, covered.Plan)
+		if cerr != nil && cerr.Code == errCodeNotFound {
+			return failedPrecondition("plan has no rules: "+covered.Plan, covered.Plan)
+		} else if cerr != nil {
+			return cerr.response()
+		}
+
+		year := time.Unix(0, int64(submitted.FillTimestamp)*int64(time.Millisecond)).UTC().Year()
+		totals, totalsKey, cerr := t.getAccumulator(stub, submitted.PatientID, covered.Plan, year)
+		if cerr != nil {
+			return cerr.response()
+		}
+
+		*eob = rules.adjudicate(submitted.BilledAmount, covered.Tier, totals)
+		eob.AdjudicatedBy = c.ID
+		eob.AdjudicatedAt = now
+
+		totals.Deductible += eob.Deductible
+		totals.OutOfPocket += eob.PatientResponsibility
+		eob.DeductibleMet = totals.Deductible
+		eob.OutOfPocketMet = totals.OutOfPocket
+		if cerr := t.putRecord(stub, totalsKey, totals); cerr != nil {
+			return cerr.response()
+		}
+
+		submitted.Plan = covered.Plan
+		submitted.PolicyID = covered.PolicyID
+		submitted.Status = claimPaid
+	}
+
+	submitted.EOB = eob
+	if cerr := t.putRecord(stub, claimKey, submitted); cerr != nil {
+		return cerr.response()
+	}
+
+	eobAsBytes, err := json.Marshal(eob)
+	if err != nil {
+		return serializationError("unable to marshal explanation of benefits", err)
+	}
+
+	return shim.Success(eobAsBytes)
+}
+
+// adjudicate
+// input: billed amount, formulary tier of the drug and what the patient has paid this year
+// output: the allowed amount split into patient responsibility and payer payment
+// summary: the deductible is paid first, then the tier's copay, then coinsurance of the rest,
+// and the patient never pays more than what is left of the out of pocket maximum
+func (r planRules) adjudicate(billedAmount int, tier int, totals accumulator) explanationOfBenefits {
+	eob := explanationOfBenefits{Tier: tier}
+	eob.AllowedAmount = billedAmount * r.AllowedPercent / 100
+
+	rest := eob.AllowedAmount
+	if remaining := r.Deductible - totals.Deductible; remaining > 0 {
+		eob.Deductible = minInt(rest, remaining)
+		rest -= eob.Deductible
+	}
+
+	eob.Copay = minInt(rest, r.Copays[tier])
+	rest -= eob.Copay
+
+	// rounded down, the payer covers the fraction of a cent
+	eob.Coinsurance = rest * r.Coinsurance / 100
+
+	eob.PatientResponsibility = eob.Deductible + eob.Copay + eob.Coinsurance
+	if r.OutOfPocketMax > 0 {
+		remaining := r.OutOfPocketMax - totals.OutOfPocket
+		if remaining < 0 {
+			remaining = 0
+		}
+		if eob.PatientResponsibility > remaining {
+			// the reduction comes off coinsurance first, then the copay, then the deductible
+			over := eob.PatientResponsibility - remaining
+			for _, part := range []*int{&eob.Coinsurance, &eob.Copay, &eob.Deductible} {
+				reduction := minInt(over, *part)
+				*part -= reduction
+				over -= reduction
+			}
+			eob.PatientResponsibility = remaining
+		}
+	}
+
+	eob.PayerPayment = eob.AllowedAmount - eob.PatientResponsibility
+	return eob
+}
+
+// getAccumulators
+// input: patientID, plan, year
+// output: what the patient has paid toward the plan's deductible and out of pocket maximum in the year
+func (t *Chaincode) getAccumulators(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1		2
+	// "patientID", "plan", year
+	if len(args) < 3 {
+		return incorrectArgCount("3")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(strings.TrimSpace(args[1])) <= 0 {
+		return invalidArgument("plan", "2nd argument must be a non-empty string")
+	}
+	year, err := strconv.Atoi(args[2])
+	if err != nil {
+		return invalidArgument("year", "3rd argument must be an integer string")
+	}
+
+	totals, _, cerr := t.getAccumulator(stub, strings.ToLower(args[0]), strings.ToLower(strings.TrimSpace(args[1])), year)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	totalsAsBytes, err := json.Marshal(totals)
+	if err != nil {
+		return serializationError("unable to marshal accumulator", err)
+	}
+
+	return shim.Success(totalsAsBytes)
+}
+
+// getAccumulator
+// input: patientID, plan, year
+// output: the accumulator and its key, a new one with nothing paid if none is stored yet
+func (t *Chaincode) getAccumulator(stub shim.ChaincodeStubInterface, patientID string, plan string, year int) (accumulator, string, *chaincodeError) {
+	key, err := stub.CreateCompositeKey(objTypeAccumulator, []string{patientID, plan, strconv.Itoa(year)})
+	if err != nil {
+		return accumulator{}, "", newError(errCodeLedger, "unable to create accumulator key").withDetail("cause", err.Error())
+	}
+
+	totals := accumulator{ObjectType: objTypeAccumulator, PatientID: patientID, Plan: plan, Year: year}
+	cerr := t.getRecord(stub, key, objTypeAccumulator, &totals)
+	if cerr != nil && cerr.Code != errCodeNotFound {
+		return accumulator{}, "", cerr
+	}
+
+	return totals, key, nil
+}
+
+// minInt returns the smaller of two ints
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+)
+
+// adjudicationFills are the timestamps newAdjudicationStub fills rx01 at
+var adjudicationFills = []string{"1541500000000", "1541500000001", "1541500000002", "1541500000003", "1550000000000", "1600000000000"}
+
+// newAdjudicationStub returns a claim stub with the test rules where ph01 filled rx01 at each of adjudicationFills
+func newAdjudicationStub(t *testing.T) *historyStub {
+	return newClaimStub(t, testPlanRules, adjudicationFills...)
+}
+
+func TestAdjudicateClaim(t *testing.T) {
+	stub := newAdjudicationStub(t)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	for i, id := range []string{"c01", "c02", "c03", "c04"} {
+		billed := "8000"
+		if id == "c03" {
+			billed = "20000"
+		}
+		mustInvoke(t, stub, "newClaim", "p01", id, "rx01", adjudicationFills[i], billed)
+	}
+	// a fill in the next year starts new accumulators
+	mustInvoke(t, stub, "newClaim", "p01", "c05", "rx01", "1550000000000", "8000")
+
+	expectError(t, invoke(stub, "adjudicateClaim", "p01", "c01"), errCodePermissionDenied)
+	setRole(t, stub, roleInsurer, map[string]string{attrPlans: "cigna"})
+	expectError(t, invoke(stub, "adjudicateClaim", "p01", "c01"), errCodePermissionDenied)
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+
+	expectGolden(t, "adjudicateClaim", mustInvoke(t, stub, "adjudicateClaim", "p01", "c01"))
+	expectError(t, invoke(stub, "adjudicateClaim", "p01", "c01"), errCodeFailedPrecondition)
+
+	for _, c := range []struct {
+		claimID     string
+		deductible  int
+		copay       int
+		coinsurance int
+		payer       int
+		oopMet      int
+	}{
+		{"c02", 0, 1000, 1400, 5600, 8800},  // deductible met
+		{"c03", 0, 1000, 200, 18800, 10000}, // out of pocket maximum reached, coinsurance reduced
+		{"c04", 0, 0, 0, 8000, 10000},       // the plan pays everything
+		{"c05", 5000, 1000, 400, 1600, 6400},
+	} {
+		eob := explanationOfBenefits{}
+		mustUnmarshal(t, mustInvoke(t, stub, "adjudicateClaim", "p01", c.claimID), &eob)
+		if eob.Deductible != c.deductible || eob.Copay != c.copay || eob.Coinsurance != c.coinsurance ||
+			eob.PayerPayment != c.payer || eob.OutOfPocketMet != c.oopMet ||
+			eob.PatientResponsibility+eob.PayerPayment != eob.AllowedAmount {
+			t.Errorf("%s: unexpected explanation of benefits %+v", c.claimID, eob)
+		}
+	}
+
+	expectGolden(t, "getAccumulators", mustInvoke(t, stub, "getAccumulators", "p01", "aetna", "2018"))
+	expectInvalidArgs(t, "getAccumulators", []argCase{
+		{"too few args", []string{"p01", "aetna"}, ""},
+		{"bad year", []string{"p01", "aetna", "this year"}, "year"},
+	})
+}
+
+func TestAdjudicateClaimDenied(t *testing.T) {
+	stub := newAdjudicationStub(t)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	// rx02 can not be filled without a prior authorization, the claim is held until it is released
+	mustInvoke(t, stub, "newClaim", "p01", "c01", "rx02", "1541500000000", "500000")
+	// the claim is for a fill after the policy expired, the insurer of the expired policy decides on it
+	mustInvoke(t, stub, "newClaim", "p01", "c02", "rx01", "1600000000000", "8000")
+
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	mustInvoke(t, stub, "reviewClaim", "p01", "c01", "release", "fill confirmed by the pharmacy")
+	for claimID, reason := range map[string]string{"c01": coverageNoPriorAuth, "c02": coverageExpired} {
+		eob := explanationOfBenefits{}
+		mustUnmarshal(t, mustInvoke(t, stub, "adjudicateClaim", "p01", claimID), &eob)
+		if eob.PayerPayment != 0 || len(eob.Reasons) != 1 || eob.Reasons[0] != reason {
+			t.Errorf("%s: expected a denial for %s, got %+v", claimID, reason, eob)
+		}
+		var denied claim
+		mustUnmarshal(t, mustInvoke(t, stub, "getClaim", "p01", claimID), &denied)
+		if denied.Status != claimDenied {
+			t.Errorf("%s: expected a denied claim, got %s", claimID, denied.Status)
+		}
+	}
+}
+
+func TestSetPlanRules(t *testing.T) {
+	stub := newTestStub(t)
+	expectError(t, invoke(stub, "setPlanRules", "aetna", testPlanRules), errCodePermissionDenied)
+	setRole(t, stub, roleInsurer, map[string]string{attrPlans: "cigna"})
+	expectError(t, invoke(stub, "setPlanRules", "aetna", testPlanRules), errCodePermissionDenied)
+
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	expectError(t, invoke(stub, "getPlanRules", "aetna"), errCodeNotFound)
+	mustInvoke(t, stub, "setPlanRules", "Aetna", testPlanRules)
+	expectGolden(t, "getPlanRules", mustInvoke(t, stub, "getPlanRules", "aetna"))
+
+	for name, rules := range map[string]string{
+		"not json":            "{",
+		"allowed percent":     `{"allowedPercent": 120}`,
+		"coinsurance":         `{"coinsurance": -5}`,
+		"negative deductible": `{"deductible": -1}`,
+		"unknown tier":        `{"copays": {"9": 100}}`,
+	} {
+		if cerr := expectError(t, invoke(stub, "setPlanRules", "aetna", rules), errCodeInvalidArgument); cerr.Field != "rules" {
+			t.Errorf("%s: expected field rules, got %s", name, cerr.Field)
+		}
+	}
+}
+
+// a plan without rules can not adjudicate covered claims
+func TestAdjudicateClaimWithoutRules(t *testing.T) {
+	stub := newClaimStub(t, "", "1541500000000")
+	mustInvoke(t, stub, "newClaim", "p01", "c01", "rx01", "1541500000000", "8000")
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	expectError(t, invoke(stub, "adjudicateClaim", "p01", "c01"), errCodeFailedPrecondition)
+}
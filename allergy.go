@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// allergy
+// summary: an allergy or intolerance to a substance, checked when a prescription is inserted
+type allergy struct {
+	AllergyID string `json:"allergyID"`
+	Substance string `json:"substance"`          // drug, drug class or other substance, will be lowercase
+	Reaction  string `json:"reaction,omitempty"` // e.g. hives, anaphylaxis
+	Severity  string `json:"severity"`           // mild, moderate or severe
+	Source    string `json:"source"`             // who reported it, e.g. patient, doctor, pharmacist
+	Timestamp int    `json:"timestamp"`          // timestamp of when the allergy was recorded
+}
+
+// allergySeverities are the accepted values of allergy.Severity
+var allergySeverities = []string{"mild", "moderate", "severe"}
+
+// allergyClasses maps a drug class to the drugs that belong to it,
+// so an allergy recorded as the class matches a prescription of one of its drugs
+var allergyClasses = map[string][]string{
+	"penicillin":      {"penicillin", "amoxicillin", "ampicillin", "augmentin", "dicloxacillin", "nafcillin", "oxacillin", "piperacillin"},
+	"cephalosporin":   {"cephalexin", "cefazolin", "cefuroxime", "ceftriaxone", "cefdinir", "cefepime"},
+	"sulfa":           {"sulfamethoxazole", "bactrim", "sulfasalazine", "sulfadiazine"},
+	"nsaid":           {"ibuprofen", "naproxen", "aspirin", "diclofenac", "celecoxib", "ketorolac", "meloxicam"},
+	"opioid":          {"morphine", "codeine", "oxycodone", "hydrocodone", "hydromorphone", "fentanyl", "tramadol"},
+	"macrolide":       {"erythromycin", "azithromycin", "clarithromycin"},
+	"fluoroquinolone": {"ciprofloxacin", "levofloxacin", "moxifloxacin"},
+}
+
+// addAllergy
+// input: patientID, allergyID, substance, reaction, severity, source, timestamp
+// output: confirmation of record saved
+// summary: add an allergy or intolerance to the patient's record
+func (t *Chaincode) addAllergy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1			2			3			4			5		6
+	// "patientID", "allergyID", "substance", "reaction", "severity", "source", timestamp
+	if len(args) < 7 {
+		return incorrectArgCount("7")
+	}
+
+	fmt.Println("- start addAllergy")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("allergyID", "2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return invalidArgument("substance", "3rd argument must be a non-empty string")
+	}
+
+	severity := strings.ToLower(args[4])
+	if !containsString(allergySeverities, severity) {
+		return invalidArgument("severity", "5th argument must be one of "+strings.Join(allergySeverities, ", "))
+	}
+
+	if len(args[5]) <= 0 {
+		return invalidArgument("source", "6th argument must be a non-empty string")
+	}
+
+	timestamp, err := strconv.Atoi(args[6])
+	if err != nil {
+		return invalidArgument("timestamp", "7th argument must be an integer string")
+	}
+
+	patientID := args[0]
+	newAllergy := allergy{
+		AllergyID: args[1],
+		Substance: strings.ToLower(strings.TrimSpace(args[2])),
+		Reaction:  strings.ToLower(args[3]),
+		Severity:  severity,
+		Source:    strings.ToLower(args[5]),
+		Timestamp: timestamp,
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	for _, existing := range patientRecord.Allergies {
+		if existing.AllergyID == newAllergy.AllergyID {
+			return alreadyExists("allergyID already exists: "+existing.AllergyID, existing.AllergyID)
+		}
+	}
+
+	patientRecord.Allergies = append(patientRecord.Allergies, newAllergy)
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	fmt.Println("- end addAllergy (success)")
+	return shim.Success(nil)
+}
+
+// removeAllergy
+// input: patientID, allergyID
+// output: confirmation of record saved
+// summary: remove an allergy that was recorded in error or has been ruled out
+func (t *Chaincode) removeAllergy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1
+	// "patientID", "allergyID"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("allergyID", "2nd argument must be a non-empty string")
+	}
+
+	patientID := args[0]
+	allergyID := args[1]
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	allergies := []allergy{}
+	for _, existing := range patientRecord.Allergies {
+		if existing.AllergyID != allergyID {
+			allergies = append(allergies, existing)
+		}
+	}
+
+	if len(allergies) == len(patientRecord.Allergies) {
+		return notFound("allergyID does not exist: "+allergyID, allergyID)
+	}
+
+	patientRecord.Allergies = allergies
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getAllergies
+// input: patientID
+// output: the patient's allergies
+func (t *Chaincode) getAllergies(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "patientID"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := args[0]
+
+	// get current state of the given patient record
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// create custom struct for response of allergies for a patient
+	response := struct {
+		PatientID string    `json:"patientID"`
+		Allergies []allergy `json:"allergies"`
+	}{
+		PatientID: patientRecord.PatientID,
+		Allergies: patientRecord.Allergies,
+	}
+	if response.Allergies == nil {
+		response.Allergies = []allergy{}
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal allergies response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// allergyConflicts returns the patient's allergies that match the prescription,
+// either by name or because the prescribed drug belongs to an allergy's drug class
+func allergyConflicts(allergies []allergy, prescription string) []allergy {
+	prescription = strings.ToLower(prescription)
+
+	conflicts := []allergy{}
+	for _, a := range allergies {
+		if a.Substance == "" {
+			continue
+		}
+		matched := strings.Contains(prescription, a.Substance)
+		for _, drug := range allergyClasses[a.Substance] {
+			if strings.Contains(prescription, drug) {
+				matched = true
+			}
+		}
+		if matched {
+			conflicts = append(conflicts, a)
+		}
+	}
+
+	return conflicts
+}
+
+// allergyConflictError describes the allergies a prescription conflicts with
+func allergyConflictError(prescription string, conflicts []allergy) *chaincodeError {
+	cerr := newError(errCodeAllergyConflict, "prescription conflicts with the patient's allergies: "+prescription).
+		withField("prescription")
+	for _, a := range conflicts {
+		cerr.withDetail(a.AllergyID, a.Substance+" ("+a.Severity+")")
+	}
+	return cerr
+}
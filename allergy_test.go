@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAddAllergy(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "addAllergy", "p01", "al01", "Penicillin", "Hives", "Severe", "Patient", "1541440675318")
+	mustInvoke(t, stub, "addAllergy", "p01", "al02", "latex", "", "mild", "doctor", "1541440675318")
+	expectError(t, invoke(stub, "addAllergy", "p01", "al01", "sulfa", "rash", "mild", "patient", "1541440675318"), errCodeAlreadyExists)
+	expectError(t, invoke(stub, "addAllergy", "p99", "al01", "sulfa", "rash", "mild", "patient", "1541440675318"), errCodeNotFound)
+
+	expectGolden(t, "getAllergies", mustInvoke(t, stub, "getAllergies", "p01"))
+	expectGolden(t, "getAllergies-empty", mustInvoke(t, stub, "getAllergies", "p02"))
+
+	mustInvoke(t, stub, "removeAllergy", "p01", "al02")
+	expectError(t, invoke(stub, "removeAllergy", "p01", "al02"), errCodeNotFound)
+
+	expectInvalidArgs(t, "addAllergy", []argCase{
+		{"too few args", []string{"p01", "al01"}, ""},
+		{"empty allergyID", []string{"p01", "", "sulfa", "rash", "mild", "patient", "1"}, "allergyID"},
+		{"empty substance", []string{"p01", "al03", "", "rash", "mild", "patient", "1"}, "substance"},
+		{"bad severity", []string{"p01", "al03", "sulfa", "rash", "deadly", "patient", "1"}, "severity"},
+		{"empty source", []string{"p01", "al03", "sulfa", "rash", "mild", "", "1"}, "source"},
+		{"bad timestamp", []string{"p01", "al03", "sulfa", "rash", "mild", "patient", "now"}, "timestamp"},
+	})
+	expectInvalidArgs(t, "removeAllergy", []argCase{
+		{"too few args", []string{"p01"}, ""},
+		{"empty allergyID", []string{"p01", ""}, "allergyID"},
+	})
+}
+
+func TestInsertRxAllergyScreening(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "addAllergy", "p01", "al01", "penicillin", "anaphylaxis", "severe", "patient", "1541440675318")
+
+	// amoxicillin is a penicillin
+	cerr := expectError(t, invoke(stub, "insertRx", insertRxArgs...), errCodeAllergyConflict)
+	if cerr.Field != "prescription" || cerr.Details["al01"] != "penicillin (severe)" {
+		t.Errorf("unexpected conflict %+v", cerr)
+	}
+	expectGolden(t, "getRxForPatient-empty", mustInvoke(t, stub, "getRxForPatient", "p01"))
+
+	// an empty override reason is not an override
+	expectError(t, invoke(stub, "insertRx", append(insertRxArgs, " ")...), errCodeAllergyConflict)
+
+	mustInvoke(t, stub, "insertRx", append(insertRxArgs, "mild reaction in childhood, tolerated since")...)
+	expectGolden(t, "getRxForPatient-override", mustInvoke(t, stub, "getRxForPatient", "p01"))
+
+	// unrelated prescriptions are not affected and do not keep an override reason
+	mustInvoke(t, stub, "insertRx", "p01", "rx02", "1541440675318", "dr smith", "doc01", "metformin", "2", "60", "1572976675318", "prescribed", "not needed")
+	var rxs struct{ RxList []rx }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRxForPatient", "p01"), &rxs)
+	if len(rxs.RxList) != 2 || rxs.RxList[1].AllergyOverride != "" {
+		t.Errorf("unexpected prescriptions %+v", rxs.RxList)
+	}
+}
+
+func TestAllergyConflicts(t *testing.T) {
+	allergies := []allergy{
+		{AllergyID: "al01", Substance: "penicillin"},
+		{AllergyID: "al02", Substance: "sulfa"},
+		{AllergyID: "al03", Substance: "codeine"},
+	}
+
+	for prescription, expected := range map[string]int{
+		"Amoxicillin 500mg":          1,
+		"penicillin v potassium":     1,
+		"Bactrim DS":                 1,
+		"acetaminophen with codeine": 1,
+		"metformin":                  0,
+		"ibuprofen":                  0,
+	} {
+		if got := allergyConflicts(allergies, prescription); len(got) != expected {
+			t.Errorf("%s: expected %d conflicts, got %v", prescription, expected, got)
+		}
+	}
+}
@@ -23,13 +23,13 @@ func (t *Chaincode) newBloodPressure(stub shim.ChaincodeStubInterface, args []st
 	// 0			1	2		3
 	// "patientID", low, high, timestamp
 	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguements. Expected 4")
+		return incorrectArgCount("4")
 	}
 
 	// input sanitation
 	fmt.Println("- start newBloodPressure")
 	if len(args[0]) <= 0 {
-		return shim.Error("1st arguement must be a non-empty string")
+		return invalidArgument("patientID", "1st arguement must be a non-empty string")
 	}
 
 	// convert patientID to lowercase
@@ -38,57 +38,31 @@ func (t *Chaincode) newBloodPressure(stub shim.ChaincodeStubInterface, args []st
 	// convert high blood pressure from string to int
 	high, err := strconv.Atoi(args[1])
 	if err != nil {
-		return shim.Error("2nd arguement must be a integer string")
+		return invalidArgument("high", "2nd arguement must be a integer string")
 	}
 
 	// convert low blood pressure from string to int
 	low, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("3rd arguement must be a integer string")
+		return invalidArgument("low", "3rd arguement must be a integer string")
 	}
 
 	timestamp, err := strconv.Atoi(args[3])
 	if err != nil {
-		return shim.Error("4th arguement must be an integer string")
+		return invalidArgument("timestamp", "4th arguement must be an integer string")
 	}
 
-	// create blood pressure struct from args variables
-	initialBP := bloodPressure{
-		High:      high,
-		Low:       low,
-		Timestamp: timestamp,
-	}
-
-	// create initialEMR with patientID
-	initialEMR := EMR{
-		PatientID: patientID,
-	}
-
-	// get EMR record with patient ID
-	initialEMRAsBytes, err := stub.GetState(initialEMR.PatientID)
-	if err != nil {
-		return shim.Error("unable to get state" + err.Error())
-	}
-
-	// unmarshal EMR bytes to initialEMR struct
-	if err = json.Unmarshal(initialEMRAsBytes, &initialEMR); err != nil {
-		return shim.Error("unable to unmarshal struct: " + err.Error())
-	}
-
-	// modify blood pressure attribute with new blood pressure
-	initialEMR.BloodPressure = initialBP
-
-	// convert EMR to bytes
-	modifiedEMRAsBytes, err := json.Marshal(initialEMR)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	// submit new EMR record
-	if err = stub.PutState(initialEMR.PatientID, modifiedEMRAsBytes); err != nil {
-		return shim.Error("error putting state" + err.Error())
+	// record the reading as a vital sign, fails if it is out of range or the patient does not exist
+	vt, _ := lookupVitalType(vitalBloodPressure)
+	if cerr := t.recordVital(stub, patientID, vt, timestamp, []float64{float64(high), float64(low)}); cerr != nil {
+		// report the range errors with the argument names of this function
+		if cerr.Field == "systolic" {
+			cerr.Field = "high"
+		} else if cerr.Field == "diastolic" {
+			cerr.Field = "low"
+		}
+		return cerr.response()
 	}
-	// return success
 
 	return shim.Success(nil)
 }
@@ -103,61 +77,76 @@ func (t *Chaincode) getBloodPressureHistory(stub shim.ChaincodeStubInterface, ar
 
 	// check that there is the correct number of arguements
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguements, expecting 1")
+		return incorrectArgCount("1")
 	}
 
 	// check that the arguement is non empty
 	if len(args[0]) <= 0 {
-		return shim.Error("1st arguement must be a non empty string")
+		return invalidArgument("patientID", "1st arguement must be a non empty string")
 	}
 
 	// convert args to patientID
 	patientID := strings.ToLower(args[0])
 
-	// get patient history
-	resultsIterator, err := stub.GetHistoryForKey(patientID)
-	if err != nil {
-		return shim.Error("Patient record does not exist: " + err.Error())
+	// get blood pressure history
+	bloodPressureHistory, cerr := t.bloodPressureHistory(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
 	}
-	defer resultsIterator.Close()
 
 	// create patient record with just patientID and blood pressure history
 	patientBloodPressureHistory := struct {
 		PatientID            string          `json:"patientID,omitempty"`
 		BloodPressureHistory []bloodPressure `json:"bloodPressureHistory,omitempty"`
 	}{
-		PatientID: patientID,
+		PatientID:            patientID,
+		BloodPressureHistory: bloodPressureHistory,
 	}
 
-	// iterate through patient history
-	for resultsIterator.HasNext() {
-		// create empty EMR record to marshall
-		patientRecord := EMR{}
+	bloodPressureHistoryAsBytes, err := json.Marshal(patientBloodPressureHistory)
+	if err != nil {
+		return serializationError("error marshalling blood pressure history", err)
+	}
 
-		// get iterators result
-		result, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+	return shim.Success(bloodPressureHistoryAsBytes)
+}
 
-		// unmarshal result's value to patientRecord interface
-		if err := json.Unmarshal(result.Value, &patientRecord); err != nil {
-			return shim.Error("unable to unmarshal value" + err.Error())
+// bloodPressureHistory
+// input: patientID
+// output: every blood pressure reading the patient record has held followed by the bloodPressure vital signs, oldest first
+func (t *Chaincode) bloodPressureHistory(stub shim.ChaincodeStubInterface, patientID string) ([]bloodPressure, *chaincodeError) {
+	// readings recorded before vital signs were stored on their own keys are in the patient record's history
+	bloodPressureHistory := []bloodPressure{}
+	cerr := walkEMRHistory(stub, patientID, func(version emrVersion) *chaincodeError {
+		if version.IsDelete {
+			return nil
 		}
+		patientRecord := version.Record
 
 		// check if blood history is not the same as last
-		if len(patientBloodPressureHistory.BloodPressureHistory) == 0 && patientRecord.BloodPressure.Timestamp != 0 {
-			patientBloodPressureHistory.BloodPressureHistory = append(patientBloodPressureHistory.BloodPressureHistory, patientRecord.BloodPressure)
-		} else if len(patientBloodPressureHistory.BloodPressureHistory) > 0 &&
-			patientBloodPressureHistory.BloodPressureHistory[len(patientBloodPressureHistory.BloodPressureHistory)-1].Timestamp != patientRecord.BloodPressure.Timestamp {
-			patientBloodPressureHistory.BloodPressureHistory = append(patientBloodPressureHistory.BloodPressureHistory, patientRecord.BloodPressure)
+		if len(bloodPressureHistory) == 0 && patientRecord.BloodPressure.Timestamp != 0 {
+			bloodPressureHistory = append(bloodPressureHistory, patientRecord.BloodPressure)
+		} else if len(bloodPressureHistory) > 0 &&
+			bloodPressureHistory[len(bloodPressureHistory)-1].Timestamp != patientRecord.BloodPressure.Timestamp {
+			bloodPressureHistory = append(bloodPressureHistory, patientRecord.BloodPressure)
 		}
+		return nil
+	})
+	if cerr != nil {
+		return nil, cerr
 	}
 
-	bloodPressureHistoryAsBytes, err := json.Marshal(patientBloodPressureHistory)
-	if err != nil {
-		return shim.Error("error marshalling blood pressure history" + err.Error())
+	readings, cerr := t.vitals(stub, patientID, vitalBloodPressure, 0, maxTimestamp)
+	if cerr != nil {
+		return nil, cerr
+	}
+	for _, reading := range readings {
+		bloodPressureHistory = append(bloodPressureHistory, bloodPressure{
+			High:      int(reading.Components["systolic"]),
+			Low:       int(reading.Components["diastolic"]),
+			Timestamp: reading.Timestamp,
+		})
 	}
 
-	return shim.Success(bloodPressureHistoryAsBytes)
+	return bloodPressureHistory, nil
 }
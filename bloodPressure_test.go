@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewBloodPressure(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "newBloodPressure", "P01", "120", "80", "1541440675318")
+	expectError(t, invoke(stub, "newBloodPressure", "p99", "120", "80", "1541440675318"), errCodeNotFound)
+
+	expectInvalidArgs(t, "newBloodPressure", []argCase{
+		{"wrong arg count", []string{"p01", "120", "80"}, ""},
+		{"empty patientID", []string{"", "120", "80", "1"}, "patientID"},
+		{"bad high", []string{"p01", "high", "80", "1"}, "high"},
+		{"bad low", []string{"p01", "120", "low", "1"}, "low"},
+		{"bad timestamp", []string{"p01", "120", "80", "now"}, "timestamp"},
+	})
+}
+
+func TestGetBloodPressureHistory(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "newBloodPressure", "p01", "120", "80", "1541440675318")
+	// other updates to the record must not show up as blood pressure readings
+	mustInvoke(t, stub, "newHeartRateMessage", "p01", "72", "1541440735318")
+	mustInvoke(t, stub, "newBloodPressure", "p01", "135", "85", "1541440795318")
+
+	expectGolden(t, "getBloodPressureHistory", mustInvoke(t, stub, "getBloodPressureHistory", "p01"))
+	expectGolden(t, "getBloodPressureHistory-empty", mustInvoke(t, stub, "getBloodPressureHistory", "p02"))
+
+	expectInvalidArgs(t, "getBloodPressureHistory", []argCase{
+		{"no args", nil, ""},
+		{"empty patientID", []string{""}, "patientID"},
+	})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// claim
+// summary: a pharmacy's bill to the patient's insurer for one fill of a prescription, stored under
+// the composite key claim~patientID~claimID. amounts are integer cents
+type claim struct {
+	ObjectType    string                 `json:"objType"`
+	ClaimID       string                 `json:"claimID"`
+	PatientID     string                 `json:"patientID"`
+	RXID          string                 `json:"rxid"`
+	Prescription  string                 `json:"prescription"`
+	Quantity      float64                `json:"quantity"`
+	DiagnosisCode string                 `json:"diagnosisCode"` // ICD-10 code of the diagnosis the rx is linked to
+	FillTimestamp int                    `json:"fillTimestamp"` // timestamp of the fill being billed
+	Provider      string                 `json:"provider"`      // license of the pharmacist who filed the claim
+	BilledAmount  int                    `json:"billedAmount"`
+	Plan          string                 `json:"plan,omitempty"` // plan and policy of the primary policy at the fill
+	PolicyID      string                 `json:"policyID,omitempty"`
+	Status        string                 `json:"status"` // submitted, review, paid or denied
+	SubmittedAt   int                    `json:"submittedAt"`
+	Flags         []string               `json:"flags,omitempty"`  // reasons the claim was held for review
+	Review        *claimReview           `json:"review,omitempty"` // set by reviewClaim
+	EOB           *explanationOfBenefits `json:"eob,omitempty"`    // set by adjudicateClaim
+}
+
+// status values of a claim
+const (
+	claimSubmitted = "submitted"
+	claimInReview  = "review"
+	claimPaid      = "paid"
+	claimDenied    = "denied"
+)
+
+// newClaim
+// input: patientID, claimID, rxid, fill timestamp, billed amount in cents
+// output: confirmation of record saved
+// summary: file a claim for a fill with the insurer of the patient's primary policy at the fill timestamp,
+// only callers with the pharmacist role may file and the caller's license is the provider, the patient must have a policy
+// and the rx must be linked to a diagnosis.
+// a duplicate, a claim without a matching fill, from an unregistered provider or from a provider
+// filing unusually many claims is held for review, see screenClaim
+func (t *Chaincode) newClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1			2		3				4
+	// "patientID", "claimID", "rxid", fillTimestamp, billedAmount
+	if len(args) < 5 {
+		return incorrectArgCount("5")
+	}
+
+	fmt.Println("- start newClaim")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("claimID", "2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return invalidArgument("rxid", "3rd argument must be a non-empty string")
+	}
+
+	fillTimestamp, err := strconv.Atoi(args[3])
+	if err != nil || fillTimestamp < 0 {
+		return invalidArgument("fillTimestamp", "4th argument must be a non-negative integer string")
+	}
+
+	billedAmount, err := strconv.Atoi(args[4])
+	if err != nil || billedAmount <= 0 {
+		return invalidArgument("billedAmount", "5th argument must be a positive integer string of cents")
+	}
+
+	c, cerr := requireRole(stub, rolePharmacist)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, strings.ToLower(args[0]))
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	index := patientRecord.rxIndex(args[2])
+	if index < 0 {
+		return notFound("RXID does not exist: "+args[2], args[2])
+	}
+	prescription := patientRecord.RxList[index]
+
+	// a claim needs an insurer to decide on it, see payerPlan
+	if len(patientRecord.policies()) == 0 {
+		return failedPrecondition("patient has no insurance: "+patientRecord.PatientID, patientRecord.PatientID)
+	}
+
+	// and the diagnosis that justifies the prescription
+	if prescription.DiagnosisID == "" {
+		return failedPrecondition("rx is not linked to a diagnosis: "+prescription.RXID, prescription.RXID)
+	}
+	diagnosisIndex := patientRecord.diagnosisIndex(prescription.DiagnosisID)
+	if diagnosisIndex < 0 {
+		return failedPrecondition("diagnosis of the rx does not exist: "+prescription.DiagnosisID, prescription.DiagnosisID)
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	provider := c.License
+	if provider == "" {
+		provider = c.ID
+	}
+
+	newClaim := claim{
+		ObjectType:    objTypeClaim,
+		ClaimID:       args[1],
+		PatientID:     patientRecord.PatientID,
+		RXID:          prescription.RXID,
+		Prescription:  prescription.Prescription,
+		Quantity:      prescription.Quantity,
+		DiagnosisCode: patientRecord.ProblemList[diagnosisIndex].Code,
+		FillTimestamp: fillTimestamp,
+		Provider:      provider,
+		BilledAmount:  billedAmount,
+		Status:        claimSubmitted,
+		SubmittedAt:   now,
+	}
+	if policy, active := patientRecord.primaryPolicy(fillTimestamp); active {
+		newClaim.Plan = strings.ToLower(policy.Name)
+		newClaim.PolicyID = policy.PolicyID
+	}
+
+	claimKey, err := claimKey(stub, newClaim.PatientID, newClaim.ClaimID)
+	if err != nil {
+		return ledgerError("unable to create claim key", err)
+	}
+
+	existing, err := stub.GetState(claimKey)
+	if err != nil {
+		return ledgerError("unable to get claim", err)
+	}
+	if len(existing) > 0 {
+		return alreadyExists("claim already exists: "+newClaim.ClaimID, newClaim.ClaimID)
+	}
+
+	flags, cerr := t.screenClaim(stub, newClaim)
+	if cerr != nil {
+		return cerr.response()
+	}
+	if len(flags) > 0 {
+		newClaim.Status = claimInReview
+		newClaim.Flags = flags
+	}
+
+	if cerr := t.putRecord(stub, claimKey, newClaim); cerr != nil {
+		return cerr.response()
+	}
+
+	// index the claim by provider to count the provider's claims, by fill to find duplicates
+	// and by status when it is held for review
+	err = t.createIndex(stub, indexClaimProvider, claimProviderAttributes(newClaim))
+	if err != nil {
+		return ledgerError("unable to create claim provider index", err)
+	}
+	err = t.createIndex(stub, indexClaimFill, claimFillAttributes(newClaim))
+	if err != nil {
+		return ledgerError("unable to create claim fill index", err)
+	}
+	if newClaim.Status == claimInReview {
+		err = t.createIndex(stub, indexClaimReviewStatus, claimReviewStatusAttributes(newClaim, claimInReview))
+		if err != nil {
+			return ledgerError("unable to create claim review status index", err)
+		}
+	}
+
+	fmt.Println("- end newClaim (success)")
+	return shim.Success(nil)
+}
+
+// getClaim
+// input: patientID, claimID
+// output: the claim with its explanation of benefits once adjudicated
+func (t *Chaincode) getClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1
+	// "patientID", "claimID"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("claimID", "2nd argument must be a non-empty string")
+	}
+
+	existing, _, cerr := t.getPatientClaim(stub, args[0], args[1])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	claimAsBytes, err := json.Marshal(existing)
+	if err != nil {
+		return serializationError("unable to marshal claim", err)
+	}
+
+	return shim.Success(claimAsBytes)
+}
+
+// getClaimHistory
+// input: patientID, claimID
+// output: every version of the claim oldest first with the transaction that wrote it
+func (t *Chaincode) getClaimHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1
+	// "patientID", "claimID"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("claimID", "2nd argument must be a non-empty string")
+	}
+
+	// the claim must exist, fails if it is missing, corrupt or not a claim
+	_, key, cerr := t.getPatientClaim(stub, args[0], args[1])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return ledgerError("unable to get claim history", err)
+	}
+	defer resultsIterator.Close()
+
+	type claimVersion struct {
+		TxID  string `json:"txID"`
+		Claim claim  `json:"claim"`
+	}
+	response := struct {
+		ClaimID string         `json:"claimID"`
+		History []claimVersion `json:"history"`
+	}{
+		ClaimID: args[1],
+		History: []claimVersion{},
+	}
+
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError("error iterating claim history", err)
+		}
+
+		version := claimVersion{TxID: modification.TxId}
+		if err := json.Unmarshal(modification.Value, &version.Claim); err != nil {
+			return serializationError("unable to unmarshal claim history", err)
+		}
+		response.History = append(response.History, version)
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal claim history response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// getPatientClaim
+// input: patientID, claimID
+// output: the claim and its key, or an error if it is missing, corrupt or not a claim
+func (t *Chaincode) getPatientClaim(stub shim.ChaincodeStubInterface, patientID string, claimID string) (claim, string, *chaincodeError) {
+	key, err := claimKey(stub, strings.ToLower(patientID), claimID)
+	if err != nil {
+		return claim{}, "", newError(errCodeLedger, "unable to create claim key").withDetail("cause", err.Error())
+	}
+
+	existing := claim{}
+	if cerr := t.getRecord(stub, key, objTypeClaim, &existing); cerr != nil {
+		return claim{}, "", cerr
+	}
+
+	return existing, key, nil
+}
+
+// payerPlan returns the plan whose insurers decide on the claim, the plan it was filed with or for a fill
+// outside every policy the plan of the patient's first policy. empty when the patient has no policy
+func (c claim) payerPlan(patientRecord EMR) string {
+	if c.Plan != "" {
+		return c.Plan
+	}
+	if policies := patientRecord.policies(); len(policies) > 0 {
+		return strings.ToLower(policies[0].Name)
+	}
+	return ""
+}
+
+// claimKey returns the composite key of a patient's claim
+func claimKey(stub shim.ChaincodeStubInterface, patientID string, claimID string) (string, error) {
+	return stub.CreateCompositeKey(objTypeClaim, []string{patientID, claimID})
+}
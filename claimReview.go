@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// reasons a claim is held for review when it is filed
+const (
+	flagDuplicateClaim       = "duplicateClaim"       // another claim was filed for the same fill
+	flagNoMatchingFill       = "noMatchingFill"       // fillRx never indexed a fill of the rx at the fill timestamp
+	flagUnregisteredProvider = "unregisteredProvider" // the provider is not in the registry
+	flagRevokedProvider      = "revokedProvider"      // the provider's registration was revoked
+	flagProviderVolume       = "providerVolume"       // the provider filed too many claims in the last day
+)
+
+// claims a provider may file in providerVolumeWindow before its next claim is held for review
+const (
+	maxProviderClaims    = 50
+	providerVolumeWindow = 24 * 60 * 60 * 1000
+)
+
+// index of claims by provider, claimProvider~provider~window~submittedAt~patientID~claimID.
+// window is submittedAt divided by providerVolumeWindow, the claims of a provider in the last window are in
+// the entries of two windows
+const indexClaimProvider = "claimProvider"
+
+// index of claims by fill, claimFill~patientID~rxid~fillTimestamp
+const indexClaimFill = "claimFill"
+
+// index of claims by review status, claimReviewStatus~status~patientID~claimID.
+// only claims held for review have an entry, reviewClaim deletes it
+const indexClaimReviewStatus = "claimReviewStatus"
+
+// decisions of a claim review
+const (
+	reviewRelease = "release" // the claim goes back to submitted and can be adjudicated
+	reviewReject  = "reject"  // the claim is denied
+)
+
+// claimReview
+// summary: the insurer's decision on a claim that was held for review
+type claimReview struct {
+	Decision   string `json:"decision"`
+	Reason     string `json:"reason"`
+	ReviewedBy string `json:"reviewedBy"`
+	ReviewedAt int    `json:"reviewedAt"`
+}
+
+// screenClaim
+// input: the claim being filed
+// output: the reasons to hold the claim for review, empty if there are none
+func (t *Chaincode) screenClaim(stub shim.ChaincodeStubInterface, filed claim) ([]string, *chaincodeError) {
+	flags := []string{}
+
+	// one claim per fill
+	fillKey, err := stub.CreateCompositeKey(indexClaimFill, claimFillAttributes(filed))
+	if err != nil {
+		return nil, newError(errCodeLedger, "unable to create claim fill key").withDetail("cause", err.Error())
+	}
+	claimed, err := stub.GetState(fillKey)
+	if err != nil {
+		return nil, newError(errCodeLedger, "unable to get claim fill index").withDetail("cause", err.Error())
+	}
+	if len(claimed) > 0 {
+		flags = append(flags, flagDuplicateClaim)
+	}
+
+	// fillRx indexes every fill
+	filledKey, err := stub.CreateCompositeKey(indexRxFill, []string{filed.PatientID, filed.RXID, fmt.Sprintf("%013d", filed.FillTimestamp)})
+	if err != nil {
+		return nil, newError(errCodeLedger, "unable to create rx fill key").withDetail("cause", err.Error())
+	}
+	fill, err := stub.GetState(filledKey)
+	if err != nil {
+		return nil, newError(errCodeLedger, "unable to get rx fill index").withDetail("cause", err.Error())
+	}
+	filled := len(fill) > 0
+	if !filled {
+		flags = append(flags, flagNoMatchingFill)
+	}
+
+	status, cerr := t.providerStatus(stub, filed.Provider)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if status == "" {
+		flags = append(flags, flagUnregisteredProvider)
+	} else if status != providerActive {
+		flags = append(flags, flagRevokedProvider)
+	}
+
+	recent, cerr := providerClaimsSince(stub, filed.Provider, filed.SubmittedAt-providerVolumeWindow, filed.SubmittedAt)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if recent >= maxProviderClaims {
+		flags = append(flags, flagProviderVolume)
+	}
+
+	return flags, nil
+}
+
+// providerClaimsSince counts the claims the provider filed after since and up to now,
+// only the index entries of the windows between the two are read
+func providerClaimsSince(stub shim.ChaincodeStubInterface, license string, since int, now int) (int, *chaincodeError) {
+	count := 0
+	for window := since / providerVolumeWindow; window <= now/providerVolumeWindow; window++ {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(indexClaimProvider, []string{license, strconv.Itoa(window)})
+		if err != nil {
+			return 0, newError(errCodeLedger, "unable to query claims of provider").withDetail("cause", err.Error())
+		}
+
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return 0, newError(errCodeLedger, "error iterating claims of provider").withDetail("cause", err.Error())
+			}
+
+			_, components, err := stub.SplitCompositeKey(queryResponse.Key)
+			if err != nil || len(components) < 3 {
+				resultsIterator.Close()
+				return 0, newError(errCodeCorruptRecord, "invalid claim provider index key").withDetail("key", queryResponse.Key)
+			}
+			submittedAt, err := strconv.Atoi(components[2])
+			if err != nil {
+				resultsIterator.Close()
+				return 0, newError(errCodeCorruptRecord, "invalid claim provider index key").withDetail("key", queryResponse.Key)
+			}
+			if submittedAt > since && submittedAt <= now {
+				count++
+			}
+		}
+		resultsIterator.Close()
+	}
+
+	return count, nil
+}
+
+// claimProviderAttributes returns the attributes of a claim's entry in the provider index
+func claimProviderAttributes(filed claim) []string {
+	return []string{filed.Provider, strconv.Itoa(filed.SubmittedAt / providerVolumeWindow), fmt.Sprintf("%013d", filed.SubmittedAt), filed.PatientID, filed.ClaimID}
+}
+
+// claimReviewStatusAttributes returns the attributes of a claim's entry in the review status index
+func claimReviewStatusAttributes(filed claim, status string) []string {
+	return []string{status, filed.PatientID, filed.ClaimID}
+}
+
+// claimFillAttributes returns the attributes of a claim's entry in the fill index
+func claimFillAttributes(filed claim) []string {
+	return []string{filed.PatientID, filed.RXID, fmt.Sprintf("%013d", filed.FillTimestamp)}
+}
+
+// reviewClaim
+// input: patientID, claimID, decision (release or reject), reason
+// output: confirmation of record saved
+// summary: decide on a claim held for review, a released claim can be adjudicated and a rejected one is denied.
+// only insurers of the claim's plan may review, see payerPlan
+func (t *Chaincode) reviewClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1			2			3
+	// "patientID", "claimID", "decision", "reason"
+	if len(args) < 4 {
+		return incorrectArgCount("4")
+	}
+
+	fmt.Println("- start reviewClaim")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("claimID", "2nd argument must be a non-empty string")
+	}
+	decision := strings.ToLower(args[2])
+	if decision != reviewRelease && decision != reviewReject {
+		return invalidArgument("decision", "3rd argument must be release or reject")
+	}
+	if len(strings.TrimSpace(args[3])) <= 0 {
+		return invalidArgument("reason", "4th argument must be a non-empty string")
+	}
+
+	flagged, claimKey, cerr := t.getPatientClaim(stub, args[0], args[1])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, flagged.PatientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	c, cerr := requireInsurer(stub, flagged.payerPlan(patientRecord))
+	if cerr != nil {
+		return cerr.response()
+	}
+	if flagged.Status != claimInReview {
+		return failedPrecondition("claim is not under review: "+flagged.ClaimID, flagged.ClaimID)
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	flagged.Review = &claimReview{
+		Decision:   decision,
+		Reason:     strings.TrimSpace(args[3]),
+		ReviewedBy: c.ID,
+		ReviewedAt: now,
+	}
+	if decision == reviewRelease {
+		flagged.Status = claimSubmitted
+	} else {
+		flagged.Status = claimDenied
+	}
+
+	if cerr := t.putRecord(stub, claimKey, flagged); cerr != nil {
+		return cerr.response()
+	}
+
+	statusKey, err := stub.CreateCompositeKey(indexClaimReviewStatus, claimReviewStatusAttributes(flagged, claimInReview))
+	if err != nil {
+		return ledgerError("unable to create claim review status key", err)
+	}
+	if err := stub.DelState(statusKey); err != nil {
+		return ledgerError("unable to delete claim review status index", err)
+	}
+
+	fmt.Println("- end reviewClaim (success)")
+	return shim.Success(nil)
+}
+
+// getFlaggedClaims
+// input: optional patientID
+// output: the claims held for review, of every patient when no patientID is given
+func (t *Chaincode) getFlaggedClaims(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0 (optional)
+	// "patientID"
+	attributes := []string{claimInReview}
+	if len(args) > 0 && len(args[0]) > 0 {
+		attributes = append(attributes, strings.ToLower(args[0]))
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexClaimReviewStatus, attributes)
+	if err != nil {
+		return ledgerError("unable to query claims under review", err)
+	}
+	defer resultsIterator.Close()
+
+	response := struct {
+		Claims []claim `json:"claims"`
+	}{
+		Claims: []claim{},
+	}
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError("error iterating claims under review", err)
+		}
+
+		_, components, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(components) < 3 {
+			return newError(errCodeCorruptRecord, "invalid claim review status index key").withDetail("key", queryResponse.Key).response()
+		}
+		flagged, _, cerr := t.getPatientClaim(stub, components[1], components[2])
+		if cerr != nil {
+			return cerr.response()
+		}
+		response.Claims = append(response.Claims, flagged)
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal flagged claims response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
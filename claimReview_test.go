@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newReviewStub returns a claim stub with the test rules where ph01 filled rx01 at 1541500000000, 1541500000001 and 1541500000002
+func newReviewStub(t *testing.T) *historyStub {
+	return newClaimStub(t, testPlanRules, "1541500000000", "1541500000001", "1541500000002")
+}
+
+func TestScreenClaim(t *testing.T) {
+	stub := newReviewStub(t)
+	mustInvoke(t, stub, "insertRx", "p01", "rx03", "1541440675318", "dr smith", "doc01", "amoxicillin 875mg", "1", "20", "1572976675318", "prescribed")
+	mustInvoke(t, stub, "linkRxToDiagnosis", "p01", "rx03", "dx01")
+	mustInvoke(t, stub, "approveRx", "p01", "rx01", "1541500000009", "true")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+
+	mustInvoke(t, stub, "newClaim", "p01", "c01", "rx01", "1541500000000", "8000")
+	for _, c := range []struct {
+		claimID   string
+		rxid      string
+		timestamp string
+		flags     []string
+	}{
+		{"c01", "rx01", "1541500000000", nil},
+		{"c02", "rx01", "1541500000000", []string{flagDuplicateClaim}},
+		{"c03", "rx03", "1541500000000", []string{flagNoMatchingFill}}, // rx03 was never filled
+		{"c04", "rx01", "1541500000009", []string{flagNoMatchingFill}}, // rx01 was approved, not filled, at the timestamp
+	} {
+		if c.claimID != "c01" {
+			mustInvoke(t, stub, "newClaim", "p01", c.claimID, c.rxid, c.timestamp, "8000")
+		}
+		var filed claim
+		mustUnmarshal(t, mustInvoke(t, stub, "getClaim", "p01", c.claimID), &filed)
+		if !reflect.DeepEqual(filed.Flags, c.flags) {
+			t.Errorf("%s: expected flags %v, got %v", c.claimID, c.flags, filed.Flags)
+		}
+		expected := claimSubmitted
+		if c.flags != nil {
+			expected = claimInReview
+		}
+		if filed.Status != expected {
+			t.Errorf("%s: expected status %s, got %s", c.claimID, expected, filed.Status)
+		}
+	}
+
+	// a pharmacist outside the registry, then one whose registration was revoked
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	mustInvoke(t, stub, "newClaim", "p01", "c05", "rx01", "1541500000001", "8000")
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "revokeProvider", "ph01")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "newClaim", "p01", "c06", "rx01", "1541500000002", "8000")
+
+	expectGolden(t, "getFlaggedClaims", mustInvoke(t, stub, "getFlaggedClaims", "P01"))
+
+	var all struct{ Claims []claim }
+	mustUnmarshal(t, mustInvoke(t, stub, "getFlaggedClaims"), &all)
+	if len(all.Claims) != 5 {
+		t.Errorf("expected 5 flagged claims, got %d", len(all.Claims))
+	}
+}
+
+func TestProviderVolume(t *testing.T) {
+	stub := newReviewStub(t)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	// only the first timestamp was filled, the claims after it are held anyway
+	for i := 0; i < maxProviderClaims; i++ {
+		mustInvoke(t, stub, "newClaim", "p01", "c"+strconv.Itoa(i), "rx01", strconv.Itoa(1541500000000+i), "8000")
+	}
+	mustInvoke(t, stub, "newClaim", "p01", "next", "rx01", "1541500000100", "8000")
+
+	var filed claim
+	mustUnmarshal(t, mustInvoke(t, stub, "getClaim", "p01", "next"), &filed)
+	if !containsString(filed.Flags, flagProviderVolume) {
+		t.Errorf("expected the claim over the daily volume to be flagged, got %v", filed.Flags)
+	}
+	var first claim
+	mustUnmarshal(t, mustInvoke(t, stub, "getClaim", "p01", "c0"), &first)
+	if first.Status != claimSubmitted {
+		t.Errorf("expected the first claim to be submitted, got %s %v", first.Status, first.Flags)
+	}
+
+	// a day later the earlier claims no longer count
+	next := stub.now
+	stub.now = func() time.Time { return next().Add(providerVolumeWindow * time.Millisecond) }
+	mustInvoke(t, stub, "newClaim", "p01", "later", "rx01", "1541500000002", "8000")
+	mustUnmarshal(t, mustInvoke(t, stub, "getClaim", "p01", "later"), &filed)
+	if containsString(filed.Flags, flagProviderVolume) {
+		t.Errorf("expected the claim a day later not to be flagged for volume, got %v", filed.Flags)
+	}
+}
+
+func TestReviewClaim(t *testing.T) {
+	stub := newReviewStub(t)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "newClaim", "p01", "c01", "rx01", "1541500000000", "8000")
+	mustInvoke(t, stub, "newClaim", "p01", "c02", "rx01", "1541500000000", "8000")
+	mustInvoke(t, stub, "newClaim", "p01", "c03", "rx01", "1541500000000", "8000")
+
+	expectError(t, invoke(stub, "reviewClaim", "p01", "c02", "release", "checked"), errCodePermissionDenied)
+	setRole(t, stub, roleInsurer, map[string]string{attrPlans: "cigna"})
+	expectError(t, invoke(stub, "reviewClaim", "p01", "c02", "release", "checked"), errCodePermissionDenied)
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	expectError(t, invoke(stub, "adjudicateClaim", "p01", "c02"), errCodeFailedPrecondition)
+	expectError(t, invoke(stub, "reviewClaim", "p01", "c01", "release", "checked"), errCodeFailedPrecondition)
+	expectError(t, invoke(stub, "reviewClaim", "p01", "c99", "release", "checked"), errCodeNotFound)
+
+	mustInvoke(t, stub, "reviewClaim", "p01", "c02", "Release", "refill billed separately")
+	mustInvoke(t, stub, "adjudicateClaim", "p01", "c02")
+	mustInvoke(t, stub, "reviewClaim", "p01", "c03", "reject", "duplicate of c01")
+	expectError(t, invoke(stub, "adjudicateClaim", "p01", "c03"), errCodeFailedPrecondition)
+
+	var rejected claim
+	mustUnmarshal(t, mustInvoke(t, stub, "getClaim", "p01", "c03"), &rejected)
+	if rejected.Status != claimDenied || rejected.Review == nil || rejected.Review.Decision != reviewReject {
+		t.Errorf("expected a denied claim with the review, got %+v", rejected)
+	}
+
+	var flagged struct{ Claims []claim }
+	mustUnmarshal(t, mustInvoke(t, stub, "getFlaggedClaims", "p01"), &flagged)
+	if len(flagged.Claims) != 0 {
+		t.Errorf("expected no claims left for review, got %+v", flagged.Claims)
+	}
+
+	expectInvalidArgs(t, "reviewClaim", []argCase{
+		{"too few args", []string{"p01", "c01", "release"}, ""},
+		{"empty claimID", []string{"p01", "", "release", "checked"}, "claimID"},
+		{"unknown decision", []string{"p01", "c01", "approve", "checked"}, "decision"},
+		{"empty reason", []string{"p01", "c01", "reject", " "}, "reason"},
+	})
+}
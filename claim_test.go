@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewClaim(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertInsurance", "p01", "Aetna", "1572976675318", "pol01")
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	mustInvoke(t, stub, "insertRx", append([]string{"p02"}, insertRxArgs[1:]...)...)
+	mustInvoke(t, stub, "addDiagnosis", "p01", "dx01", "J02.9", "acute pharyngitis", "1541440675318", "dr smith", "doc01")
+
+	expectError(t, invoke(stub, "newClaim", "p01", "c01", "rx01", "1541500000000", "8000"), errCodePermissionDenied)
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	// the claim carries the code of the diagnosis that justifies the rx
+	expectError(t, invoke(stub, "newClaim", "p01", "c01", "rx01", "1541500000000", "8000"), errCodeFailedPrecondition)
+	mustInvoke(t, stub, "linkRxToDiagnosis", "p01", "rx01", "dx01")
+	mustInvoke(t, stub, "newClaim", "P01", "c01", "rx01", "1541500000000", "8000")
+	expectError(t, invoke(stub, "newClaim", "p01", "c01", "rx01", "1541500000000", "8000"), errCodeAlreadyExists)
+	expectError(t, invoke(stub, "newClaim", "p01", "c02", "rx99", "1541500000000", "8000"), errCodeNotFound)
+	expectError(t, invoke(stub, "newClaim", "p99", "c02", "rx01", "1541500000000", "8000"), errCodeNotFound)
+	// p02 has no insurer to bill
+	expectError(t, invoke(stub, "newClaim", "p02", "c02", "rx01", "1541500000000", "8000"), errCodeFailedPrecondition)
+
+	expectGolden(t, "getClaim", mustInvoke(t, stub, "getClaim", "p01", "c01"))
+	expectError(t, invoke(stub, "getClaim", "p01", "c99"), errCodeNotFound)
+
+	expectInvalidArgs(t, "newClaim", []argCase{
+		{"too few args", []string{"p01", "c02", "rx01", "1"}, ""},
+		{"empty claimID", []string{"p01", "", "rx01", "1", "1"}, "claimID"},
+		{"bad fillTimestamp", []string{"p01", "c02", "rx01", "today", "1"}, "fillTimestamp"},
+		{"bad billedAmount", []string{"p01", "c02", "rx01", "1", "12.50"}, "billedAmount"},
+		{"zero billedAmount", []string{"p01", "c02", "rx01", "1", "0"}, "billedAmount"},
+	})
+	expectInvalidArgs(t, "getClaim", []argCase{
+		{"too few args", []string{"p01"}, ""},
+		{"empty claimID", []string{"p01", ""}, "claimID"},
+	})
+}
+
+func TestGetClaimHistory(t *testing.T) {
+	stub := newClaimStub(t, testPlanRules, "1541500000000")
+
+	mustInvoke(t, stub, "newClaim", "p01", "c01", "rx01", "1541500000000", "8000")
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	mustInvoke(t, stub, "adjudicateClaim", "p01", "c01")
+
+	var response struct {
+		History []struct {
+			TxID  string
+			Claim claim
+		}
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "getClaimHistory", "p01", "c01"), &response)
+	if len(response.History) != 2 || response.History[0].Claim.Status != claimSubmitted || response.History[1].Claim.Status != claimPaid {
+		t.Errorf("expected the submitted and the paid claim, got %+v", response.History)
+	}
+	expectError(t, invoke(stub, "getClaimHistory", "p01", "c99"), errCodeNotFound)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// diagnosis
+// summary: one entry of the patient's problem list, coded with ICD-10
+type diagnosis struct {
+	DiagnosisID  string `json:"diagnosisID"`
+	Code         string `json:"code"`                   // ICD-10 code, e.g. E11.9
+	Description  string `json:"description,omitempty"`  // e.g. type 2 diabetes mellitus
+	OnsetDate    int    `json:"onsetDate"`              // timestamp of the onset of the condition
+	Status       string `json:"status"`                 // active or resolved
+	ResolvedDate int    `json:"resolvedDate,omitempty"` // timestamp of when the condition was resolved
+	Doctor       string `json:"doctor"`                 // name of the diagnosing doctor
+	DocLicense   string `json:"docLicense"`
+}
+
+// status values of a diagnosis
+const (
+	diagnosisActive   = "active"
+	diagnosisResolved = "resolved"
+)
+
+// icd10Pattern matches an ICD-10 code, a letter, two characters and an optional extension after a dot
+var icd10Pattern = regexp.MustCompile(`^[A-Z][0-9][0-9A-Z](\.[0-9A-Z]{1,4})?$`)
+
+// addDiagnosis
+// input: patientID, diagnosisID, ICD-10 code, description, onset date, doctor, doctor's license
+// output: confirmation of record saved
+// summary: add an active diagnosis to the patient's problem list
+func (t *Chaincode) addDiagnosis(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1				2		3				4			5			6
+	// "patientID", "diagnosisID", "code", "description", onsetDate, "doctor", "docLicense"
+	if len(args) < 7 {
+		return incorrectArgCount("7")
+	}
+
+	fmt.Println("- start addDiagnosis")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("diagnosisID", "2nd argument must be a non-empty string")
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(args[2]))
+	if !icd10Pattern.MatchString(code) {
+		return invalidArgument("code", "3rd argument must be an ICD-10 code, e.g. E11.9")
+	}
+
+	onsetDate, err := strconv.Atoi(args[4])
+	if err != nil {
+		return invalidArgument("onsetDate", "5th argument must be an integer string")
+	}
+
+	if len(args[5]) <= 0 {
+		return invalidArgument("doctor", "6th argument must be a non-empty string")
+	}
+	if len(args[6]) <= 0 {
+		return invalidArgument("docLicense", "7th argument must be a non-empty string")
+	}
+
+	patientID := args[0]
+	newDiagnosis := diagnosis{
+		DiagnosisID: args[1],
+		Code:        code,
+		Description: strings.ToLower(args[3]),
+		OnsetDate:   onsetDate,
+		Status:      diagnosisActive,
+		Doctor:      args[5],
+		DocLicense:  args[6],
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	for _, existing := range patientRecord.ProblemList {
+		if existing.DiagnosisID == newDiagnosis.DiagnosisID {
+			return alreadyExists("diagnosisID already exists: "+existing.DiagnosisID, existing.DiagnosisID)
+		}
+	}
+
+	patientRecord.ProblemList = append(patientRecord.ProblemList, newDiagnosis)
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	fmt.Println("- end addDiagnosis (success)")
+	return shim.Success(nil)
+}
+
+// resolveDiagnosis
+// input: patientID, diagnosisID, resolved date
+// output: confirmation of record saved
+// summary: mark an active diagnosis as resolved, it stays on the problem list
+func (t *Chaincode) resolveDiagnosis(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1				2
+	// "patientID", "diagnosisID", resolvedDate
+	if len(args) < 3 {
+		return incorrectArgCount("3")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("diagnosisID", "2nd argument must be a non-empty string")
+	}
+
+	resolvedDate, err := strconv.Atoi(args[2])
+	if err != nil {
+		return invalidArgument("resolvedDate", "3rd argument must be an integer string")
+	}
+
+	patientID := args[0]
+	diagnosisID := args[1]
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	index := patientRecord.diagnosisIndex(diagnosisID)
+	if index < 0 {
+		return notFound("diagnosisID does not exist: "+diagnosisID, diagnosisID)
+	}
+
+	if patientRecord.ProblemList[index].Status == diagnosisResolved {
+		return failedPrecondition("diagnosis is already resolved: "+diagnosisID, diagnosisID)
+	}
+
+	if resolvedDate < patientRecord.ProblemList[index].OnsetDate {
+		return invalidArgument("resolvedDate", "3rd argument must not be before the onset date")
+	}
+
+	patientRecord.ProblemList[index].Status = diagnosisResolved
+	patientRecord.ProblemList[index].ResolvedDate = resolvedDate
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getProblemList
+// input: patientID, optional status (active or resolved)
+// output: the patient's diagnoses, all of them when no status is given
+func (t *Chaincode) getProblemList(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)
+	// "patientID", "status"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := args[0]
+
+	status := ""
+	if len(args) > 1 {
+		status = strings.ToLower(args[1])
+	}
+	if status != "" && status != diagnosisActive && status != diagnosisResolved {
+		return invalidArgument("status", "2nd argument must be active, resolved or empty")
+	}
+
+	// get current state of the given patient record
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID   string      `json:"patientID"`
+		ProblemList []diagnosis `json:"problemList"`
+	}{
+		PatientID:   patientRecord.PatientID,
+		ProblemList: []diagnosis{},
+	}
+	for _, d := range patientRecord.ProblemList {
+		if status == "" || d.Status == status {
+			response.ProblemList = append(response.ProblemList, d)
+		}
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal problem list response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// linkRxToDiagnosis
+// input: patientID, rxid, diagnosisID
+// output: confirmation of record saved
+// summary: record the active diagnosis that justifies a prescription, insurers require it for claims
+func (t *Chaincode) linkRxToDiagnosis(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1		2
+	// "patientID", "rxid", "diagnosisID"
+	if len(args) < 3 {
+		return incorrectArgCount("3")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return invalidArgument("diagnosisID", "3rd argument must be a non-empty string")
+	}
+
+	patientID := args[0]
+	rxid := args[1]
+	diagnosisID := args[2]
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	index := patientRecord.diagnosisIndex(diagnosisID)
+	if index < 0 {
+		return notFound("diagnosisID does not exist: "+diagnosisID, diagnosisID)
+	}
+	if patientRecord.ProblemList[index].Status != diagnosisActive {
+		return failedPrecondition("diagnosis is not active: "+diagnosisID, diagnosisID)
+	}
+
+	IfExists := false
+	for key, tempRx := range patientRecord.RxList {
+		if tempRx.RXID == rxid {
+			patientRecord.RxList[key].DiagnosisID = diagnosisID
+			IfExists = true
+		}
+	}
+
+	if IfExists == false {
+		return notFound("RXID does not exist: "+rxid, rxid)
+	}
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// diagnosisIndex returns the position of the diagnosis in the problem list or -1
+func (e EMR) diagnosisIndex(diagnosisID string) int {
+	for index, d := range e.ProblemList {
+		if d.DiagnosisID == diagnosisID {
+			return index
+		}
+	}
+	return -1
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProblemList(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "addDiagnosis", "p01", "dx01", "e11.9", "Type 2 diabetes mellitus without complications", "1541440675318", "dr smith", "doc01")
+	mustInvoke(t, stub, "addDiagnosis", "p01", "dx02", "J02.9", "Acute pharyngitis", "1541440675318", "dr smith", "doc01")
+	expectError(t, invoke(stub, "addDiagnosis", "p01", "dx01", "I10", "", "1541440675318", "dr smith", "doc01"), errCodeAlreadyExists)
+	expectError(t, invoke(stub, "addDiagnosis", "p99", "dx01", "I10", "", "1541440675318", "dr smith", "doc01"), errCodeNotFound)
+
+	mustInvoke(t, stub, "resolveDiagnosis", "p01", "dx02", "1542440675318")
+	expectError(t, invoke(stub, "resolveDiagnosis", "p01", "dx02", "1542440675318"), errCodeFailedPrecondition)
+	expectError(t, invoke(stub, "resolveDiagnosis", "p01", "dx99", "1542440675318"), errCodeNotFound)
+
+	expectGolden(t, "getProblemList", mustInvoke(t, stub, "getProblemList", "p01"))
+	expectGolden(t, "getProblemList-active", mustInvoke(t, stub, "getProblemList", "p01", "active"))
+	expectGolden(t, "getProblemList-empty", mustInvoke(t, stub, "getProblemList", "p02"))
+
+	expectInvalidArgs(t, "addDiagnosis", []argCase{
+		{"too few args", []string{"p01", "dx01"}, ""},
+		{"empty diagnosisID", []string{"p01", "", "I10", "", "1", "dr", "doc01"}, "diagnosisID"},
+		{"not icd-10", []string{"p01", "dx03", "401.9", "", "1", "dr", "doc01"}, "code"},
+		{"bad onsetDate", []string{"p01", "dx03", "I10", "", "yesterday", "dr", "doc01"}, "onsetDate"},
+		{"empty docLicense", []string{"p01", "dx03", "I10", "", "1", "dr", ""}, "docLicense"},
+	})
+	expectInvalidArgs(t, "resolveDiagnosis", []argCase{
+		{"too few args", []string{"p01", "dx01"}, ""},
+		{"bad resolvedDate", []string{"p01", "dx01", "today"}, "resolvedDate"},
+	})
+	expectInvalidArgs(t, "getProblemList", []argCase{
+		{"no args", nil, ""},
+		{"bad status", []string{"p01", "chronic"}, "status"},
+	})
+}
+
+func TestLinkRxToDiagnosis(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	mustInvoke(t, stub, "addDiagnosis", "p01", "dx01", "J02.9", "acute pharyngitis", "1541440675318", "dr smith", "doc01")
+	mustInvoke(t, stub, "addDiagnosis", "p01", "dx02", "J01.90", "acute sinusitis", "1541440675318", "dr smith", "doc01")
+	mustInvoke(t, stub, "resolveDiagnosis", "p01", "dx02", "1541440675318")
+
+	expectError(t, invoke(stub, "linkRxToDiagnosis", "p01", "rx01", "dx02"), errCodeFailedPrecondition)
+	expectError(t, invoke(stub, "linkRxToDiagnosis", "p01", "rx99", "dx01"), errCodeNotFound)
+	expectError(t, invoke(stub, "linkRxToDiagnosis", "p01", "rx01", "dx99"), errCodeNotFound)
+
+	mustInvoke(t, stub, "linkRxToDiagnosis", "p01", "rx01", "dx01")
+	expectGolden(t, "getRxForPatient-diagnosis", mustInvoke(t, stub, "getRxForPatient", "p01"))
+
+	expectInvalidArgs(t, "linkRxToDiagnosis", []argCase{
+		{"too few args", []string{"p01", "rx01"}, ""},
+		{"empty diagnosisID", []string{"p01", "rx01", ""}, "diagnosisID"},
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// error codes returned in the code attribute of a chaincodeError
+// codes are part of the API contract with clients, never rename or reuse them
+const (
+	errCodeInvalidArgument    = "INVALID_ARGUMENT"    // an argument is missing, empty or malformed
+	errCodeNotFound           = "NOT_FOUND"           // the requested record does not exist
+	errCodeAlreadyExists      = "ALREADY_EXISTS"      // the record being created already exists
+	errCodeLedger             = "LEDGER_ERROR"        // reading from or writing to the ledger failed
+	errCodeSerialization      = "SERIALIZATION"       // a record could not be converted to or from json
+	errCodeUnknownFunction    = "UNKNOWN_FUNCTION"    // the invoked function is not routed by the chaincode
+	errCodeCorruptRecord      = "CORRUPT_RECORD"      // a stored record is not valid json for its type
+	errCodeWrongRecordType    = "WRONG_RECORD_TYPE"   // the key holds a record of a different objType
+	errCodeRejected           = "REJECTED"            // one or more items of a batch failed, details has one entry per item
+	errCodeAllergyConflict    = "ALLERGY_CONFLICT"    // the prescription matches an allergy of the patient and no override reason was given
+	errCodeFailedPrecondition = "FAILED_PRECONDITION" // the record is not in a state that allows the change
+	errCodePermissionDenied   = "PERMISSION_DENIED"   // the caller's identity or role does not allow the call
+	errCodePriorAuthRequired  = "PRIOR_AUTH_REQUIRED" // the patient's formulary restricts the drug and the rx has no valid approval
+)
+
+// errorCodes documents every error code for the getErrorCodes query
+var errorCodes = []struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}{
+	{errCodeInvalidArgument, "an argument is missing, empty or malformed; field names the argument"},
+	{errCodeNotFound, "the requested record does not exist"},
+	{errCodeAlreadyExists, "the record being created already exists"},
+	{errCodeLedger, "reading from or writing to the ledger failed"},
+	{errCodeSerialization, "a record could not be converted to or from json"},
+	{errCodeUnknownFunction, "the invoked function is not routed by the chaincode"},
+	{errCodeCorruptRecord, "a stored record is not valid json for its type"},
+	{errCodeWrongRecordType, "the key holds a record of a different objType than the function expects"},
+	{errCodeRejected, "one or more items of a batch failed and nothing was written; details has one entry per failed item"},
+	{errCodeAllergyConflict, "the prescription matches an allergy of the patient; details has one entry per allergy, retry with an override reason to prescribe anyway"},
+	{errCodeFailedPrecondition, "the record is not in a state that allows the change, e.g. resolving a diagnosis twice"},
+	{errCodePermissionDenied, "the caller's certificate has no identity or its role attribute does not allow the call"},
+	{errCodePriorAuthRequired, "the patient's formulary requires prior authorization for the drug and the rx has no approval valid at the fill timestamp; request one with requestPriorAuth"},
+}
+
+// chaincodeError
+// summary: typed error that is serialized as json into the message of an error response
+// so clients can tell a validation failure from a missing record or a conflict
+type chaincodeError struct {
+	Code    string            `json:"code"`              // one of the errCode constants
+	Message string            `json:"message"`           // human readable description
+	Field   string            `json:"field,omitempty"`   // argument or attribute the error is about
+	Details map[string]string `json:"details,omitempty"` // extra context such as ids or underlying errors
+}
+
+// newError creates a chaincodeError with the given code and message
+func newError(code string, message string) *chaincodeError {
+	return &chaincodeError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Error implements the error interface
+func (e *chaincodeError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// withField sets the argument or attribute the error is about
+func (e *chaincodeError) withField(field string) *chaincodeError {
+	e.Field = field
+	return e
+}
+
+// withDetail adds a key value pair of extra context to the error
+func (e *chaincodeError) withDetail(key string, value string) *chaincodeError {
+	if e.Details == nil {
+		e.Details = map[string]string{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+// response converts the error to an error response with the json encoded error as message
+func (e *chaincodeError) response() pb.Response {
+	errorAsBytes, err := json.Marshal(e)
+	if err != nil {
+		return shim.Error(e.Error())
+	}
+	return shim.Error(string(errorAsBytes))
+}
+
+// invalidArgument returns an error response for a missing, empty or malformed argument
+func invalidArgument(field string, message string) pb.Response {
+	return newError(errCodeInvalidArgument, message).withField(field).response()
+}
+
+// incorrectArgCount returns an error response for a call with the wrong number of arguments
+func incorrectArgCount(expected string) pb.Response {
+	return newError(errCodeInvalidArgument, "Incorrect number of arguments. Expecting "+expected).
+		withDetail("expected", expected).response()
+}
+
+// notFound returns an error response for a record that does not exist
+func notFound(message string, id string) pb.Response {
+	return newError(errCodeNotFound, message).withDetail("id", id).response()
+}
+
+// alreadyExists returns an error response for a record that is created twice
+func alreadyExists(message string, id string) pb.Response {
+	return newError(errCodeAlreadyExists, message).withDetail("id", id).response()
+}
+
+// failedPrecondition returns an error response for a change the record's current state does not allow
+func failedPrecondition(message string, id string) pb.Response {
+	return newError(errCodeFailedPrecondition, message).withDetail("id", id).response()
+}
+
+// ledgerError returns an error response for a failed ledger read or write
+func ledgerError(message string, err error) pb.Response {
+	return newError(errCodeLedger, message).withDetail("cause", err.Error()).response()
+}
+
+// serializationError returns an error response for a failed json conversion
+func serializationError(message string, err error) pb.Response {
+	return newError(errCodeSerialization, message).withDetail("cause", err.Error()).response()
+}
+
+// responseError
+// input: error response returned by a chaincode function
+// output: the chaincodeError in its message, for functions that call other functions
+func responseError(response pb.Response) *chaincodeError {
+	cerr := &chaincodeError{}
+	if err := json.Unmarshal([]byte(response.Message), cerr); err != nil || cerr.Code == "" {
+		return newError(errCodeLedger, response.Message)
+	}
+	return cerr
+}
+
+// getErrorCodes
+// input: none
+// output: list of every error code the chaincode can return with its description
+func (t *Chaincode) getErrorCodes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	errorCodesAsBytes, err := json.Marshal(errorCodes)
+	if err != nil {
+		return serializationError("error marshalling error codes", err)
+	}
+
+	return shim.Success(errorCodesAsBytes)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// index of expiration dates, expiration~expDate~patientID~kind~id with the date zero padded so entries sort by date
+const indexExpiration = "expiration"
+
+// kinds of records in the expiration index
+const (
+	expiringRx     = "rx"
+	expiringPolicy = "insurance"
+)
+
+// status of a prescription or policy past its expiration date
+const statusExpired = "expired"
+
+// recordsExpiredEvent is the name of the chaincode event sent by expireRecords, the payload lists what expired
+const recordsExpiredEvent = "recordsExpired"
+
+// expireRecords marks at most this many records per call unless the call gives a limit
+const defaultExpirationLimit = 100
+
+// expiredRecord
+// summary: a prescription or policy marked expired by expireRecords
+type expiredRecord struct {
+	PatientID string `json:"patientID"`
+	Kind      string `json:"kind"` // rx or insurance
+	ID        string `json:"id"`   // rxid or policyID
+	ExpDate   int    `json:"expDate"`
+	Pharmacy  string `json:"pharmacy,omitempty"` // pharmacy holding an expired rx
+}
+
+// expiration
+// summary: the effective status of a prescription or policy, see getExpirations
+type expiration struct {
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	ExpDate int    `json:"expDate,omitempty"`
+	Status  string `json:"status"`
+}
+
+// expireRecords
+// input: optional asOf timestamp, the transaction time when empty, and optional limit
+// output: the records marked expired and whether more are left
+// summary: mark the prescriptions and policies that expired before asOf, found through the expiration index,
+// and send the recordsExpired event listing them. only callers with the admin role may sweep
+func (t *Chaincode) expireRecords(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0 (optional)	1 (optional)
+	// asOf,			limit
+	if _, cerr := requireRole(stub, roleAdmin); cerr != nil {
+		return cerr.response()
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// records can not be expired ahead of time
+	asOf := now
+	if len(args) > 0 && len(args[0]) > 0 {
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value > now {
+			return invalidArgument("asOf", "1st argument must be empty or an integer string not after the transaction time")
+		}
+		asOf = value
+	}
+
+	limit := defaultExpirationLimit
+	if len(args) > 1 && len(args[1]) > 0 {
+		value, err := strconv.Atoi(args[1])
+		if err != nil || value < 1 {
+			return invalidArgument("limit", "2nd argument must be empty or a positive integer string")
+		}
+		limit = value
+	}
+
+	fmt.Println("- start expireRecords")
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexExpiration, []string{})
+	if err != nil {
+		return ledgerError("unable to query expiration index", err)
+	}
+	defer resultsIterator.Close()
+
+	response := struct {
+		AsOf    int             `json:"asOf"`
+		Expired []expiredRecord `json:"expired"`
+		More    bool            `json:"more"`
+	}{
+		AsOf:    asOf,
+		Expired: []expiredRecord{},
+	}
+
+	// entries are ordered by date, a record is expired once asOf is past its date
+	patients := map[string]*EMR{}
+	order := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError("error iterating expiration index", err)
+		}
+
+		_, components, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(components) < 4 {
+			return newError(errCodeCorruptRecord, "invalid expiration index key").withDetail("key", queryResponse.Key).response()
+		}
+		expDate, err := strconv.Atoi(components[0])
+		if err != nil {
+			return newError(errCodeCorruptRecord, "invalid expiration index key").withDetail("key", queryResponse.Key).response()
+		}
+		if expDate >= asOf {
+			break
+		}
+		if len(response.Expired) == limit {
+			response.More = true
+			break
+		}
+
+		patientID, kind, id := components[1], components[2], components[3]
+		patientRecord, loaded := patients[patientID]
+		if !loaded {
+			current, cerr := t.getEMR(stub, patientID)
+			if cerr != nil {
+				return cerr.response()
+			}
+			patientRecord = &current
+			patients[patientID] = patientRecord
+			order = append(order, patientID)
+		}
+
+		if expired, marked := patientRecord.expire(kind, id, expDate); marked {
+			expired.PatientID = patientRecord.PatientID
+			response.Expired = append(response.Expired, expired)
+		}
+		// an expired record can not expire again and an entry the record no longer matches is stale
+		if err := stub.DelState(queryResponse.Key); err != nil {
+			return ledgerError("unable to delete expiration index", err)
+		}
+	}
+
+	for _, patientID := range order {
+		if cerr := t.putRecord(stub, patientID, *patients[patientID]); cerr != nil {
+			return cerr.response()
+		}
+	}
+
+	if len(response.Expired) > 0 {
+		eventAsBytes, err := json.Marshal(response.Expired)
+		if err != nil {
+			return serializationError("unable to marshal records expired event", err)
+		}
+		if err := stub.SetEvent(recordsExpiredEvent, eventAsBytes); err != nil {
+			return ledgerError("unable to set records expired event", err)
+		}
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal expire records response", err)
+	}
+
+	fmt.Println("- end expireRecords (success)")
+	return shim.Success(responseAsBytes)
+}
+
+// getExpirations
+// input: patientID, optional asOf timestamp, the transaction time when empty
+// output: the effective status of each of the patient's prescriptions and policies at asOf
+// summary: computed from the dates, so a record past its date shows as expired before expireRecords marks it
+func (t *Chaincode) getExpirations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)
+	// "patientID", asOf
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	asOf := 0
+	if len(args) > 1 && len(args[1]) > 0 {
+		value, err := strconv.Atoi(args[1])
+		if err != nil {
+			return invalidArgument("asOf", "2nd argument must be empty or an integer string")
+		}
+		asOf = value
+	} else {
+		now, cerr := txMillis(stub)
+		if cerr != nil {
+			return cerr.response()
+		}
+		asOf = now
+	}
+
+	// get current state of the given patient record
+	patientRecord, cerr := t.getEMR(stub, args[0])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID   string       `json:"patientID"`
+		AsOf        int          `json:"asOf"`
+		Expirations []expiration `json:"expirations"`
+	}{
+		PatientID:   patientRecord.PatientID,
+		AsOf:        asOf,
+		Expirations: []expiration{},
+	}
+	for _, prescription := range patientRecord.RxList {
+		response.Expirations = append(response.Expirations, expiration{
+			Kind:    expiringRx,
+			ID:      prescription.RXID,
+			ExpDate: prescription.ExpirateDate,
+			Status:  prescription.statusAt(asOf),
+		})
+	}
+	for _, policy := range patientRecord.policies() {
+		response.Expirations = append(response.Expirations, expiration{
+			Kind:    expiringPolicy,
+			ID:      policy.PolicyID,
+			ExpDate: policy.ExpirationDate,
+			Status:  policy.statusAt(asOf),
+		})
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal expirations response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// reindexExpirations
+// input: none
+// output: the number of patient records indexed
+// summary: add the prescriptions and policies of every patient to the expiration index, records written before
+// the index existed are otherwise only indexed by their next change. only callers with the admin role may reindex
+func (t *Chaincode) reindexExpirations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	// no input
+	if _, cerr := requireRole(stub, roleAdmin); cerr != nil {
+		return cerr.response()
+	}
+
+	personIterator, err := stub.GetStateByPartialCompositeKey("people", []string{"people"})
+	if err != nil {
+		return ledgerError("error getting people query result", err)
+	}
+	defer personIterator.Close()
+
+	count := 0
+	for personIterator.HasNext() {
+		response, err := personIterator.Next()
+		if err != nil {
+			return ledgerError("error iterating people index", err)
+		}
+
+		_, components, err := stub.SplitCompositeKey(response.Key)
+		if err != nil || len(components) < 2 {
+			return newError(errCodeCorruptRecord, "invalid people index key").withDetail("key", response.Key).response()
+		}
+
+		patientRecord, cerr := t.getEMR(stub, components[1])
+		if cerr != nil {
+			return cerr.response()
+		}
+		// entries the record already has are written again
+		if cerr := t.indexExpirations(stub, components[1], nil, patientRecord); cerr != nil {
+			return cerr.response()
+		}
+		count++
+	}
+
+	return shim.Success([]byte(strconv.Itoa(count)))
+}
+
+// indexExpirations
+// input: key of a patient record, the index entries of the record before the change from expirationEntries
+// and the record as it was written
+// output: nil or an error if the index could not be updated
+// summary: called by the functions that change the dates or statuses of prescriptions and policies, adds the
+// entries the record gained and removes the ones it lost. the previous entries are taken from the version the
+// function changed, so several changes in one transaction each see the one before
+func (t *Chaincode) indexExpirations(stub shim.ChaincodeStubInterface, key string, previous [][]string, patientRecord EMR) *chaincodeError {
+	kept := map[string]bool{}
+	for _, attributes := range previous {
+		indexKey, err := stub.CreateCompositeKey(indexExpiration, attributes)
+		if err != nil {
+			return newError(errCodeLedger, "unable to create expiration index key").withDetail("cause", err.Error())
+		}
+		kept[indexKey] = false
+	}
+
+	for _, attributes := range patientRecord.expirationEntries(key) {
+		indexKey, err := stub.CreateCompositeKey(indexExpiration, attributes)
+		if err != nil {
+			return newError(errCodeLedger, "unable to create expiration index key").withDetail("cause", err.Error())
+		}
+		if _, indexed := kept[indexKey]; indexed {
+			kept[indexKey] = true
+			continue
+		}
+		if err := stub.PutState(indexKey, []byte{0x00}); err != nil {
+			return newError(errCodeLedger, "unable to put expiration index").withDetail("cause", err.Error())
+		}
+	}
+
+	for indexKey, stillExpires := range kept {
+		if stillExpires {
+			continue
+		}
+		if err := stub.DelState(indexKey); err != nil {
+			return newError(errCodeLedger, "unable to delete expiration index").withDetail("cause", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// expirationEntries returns the index attributes of the prescriptions and policies that can still expire
+func (e EMR) expirationEntries(patientID string) [][]string {
+	entries := [][]string{}
+	for _, prescription := range e.RxList {
+		if prescription.ExpirateDate != 0 && !prescription.stopped() && prescription.Status != statusExpired {
+			entries = append(entries, []string{fmt.Sprintf("%013d", prescription.ExpirateDate), patientID, expiringRx, prescription.RXID})
+		}
+	}
+	for _, policy := range e.policies() {
+		if policy.ExpirationDate != 0 && policy.TerminatedDate == 0 && policy.Status != statusExpired {
+			entries = append(entries, []string{fmt.Sprintf("%013d", policy.ExpirationDate), patientID, expiringPolicy, policy.PolicyID})
+		}
+	}
+	return entries
+}
+
+// expire marks the prescription or policy expired if it still has the indexed date
+func (e *EMR) expire(kind string, id string, expDate int) (expiredRecord, bool) {
+	expired := expiredRecord{Kind: kind, ID: id, ExpDate: expDate}
+
+	switch kind {
+	case expiringRx:
+		index := e.rxIndex(id)
+		if index < 0 || e.RxList[index].ExpirateDate != expDate || e.RxList[index].stopped() || e.RxList[index].Status == statusExpired {
+			return expiredRecord{}, false
+		}
+		e.RxList[index].Status = statusExpired
+		expired.Pharmacy = e.RxList[index].holder()
+		return expired, true
+	case expiringPolicy:
+		// the single policy of a record written before patients could have several moves to the list
+		policies := e.policies()
+		for i, policy := range policies {
+			if policy.PolicyID == id && policy.ExpirationDate == expDate && policy.TerminatedDate == 0 && policy.Status != statusExpired {
+				policies[i].Status = statusExpired
+				e.InsuranceList = policies
+				e.Insurance = insurance{}
+				return expired, true
+			}
+		}
+	}
+
+	return expiredRecord{}, false
+}
+
+// statusAt returns the status of the prescription at the timestamp, expired once the timestamp is past
+// its expiration date even when expireRecords has not marked it yet
+func (r rx) statusAt(timestamp int) string {
+	if r.stopped() {
+		return r.Status
+	}
+	if r.Status == statusExpired || (r.ExpirateDate != 0 && timestamp > r.ExpirateDate) {
+		return statusExpired
+	}
+	return r.Status
+}
+
+// statusAt returns pending, active, expired or terminated for the policy at the timestamp, like activeAt
+// it only depends on the dates
+func (i insurance) statusAt(timestamp int) string {
+	switch {
+	case i.TerminatedDate != 0 && timestamp > i.TerminatedDate:
+		return "terminated"
+	case i.ExpirationDate != 0 && timestamp > i.ExpirationDate:
+		return statusExpired
+	case i.EffectiveDate != 0 && timestamp < i.EffectiveDate:
+		return "pending"
+	default:
+		return "active"
+	}
+}
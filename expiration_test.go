@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpireRecords(t *testing.T) {
+	stub := newTestStub(t)
+	// the clock starts at 1541419200000 and moves a minute per transaction, pol01 and rx03 expire during the test
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1541419300000", "pol01")
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	mustInvoke(t, stub, "insertRx", "p01", "rx03", "1541419200000", "dr smith", "doc01", "ibuprofen", "1", "20", "1541419530000", "prescribed")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "fillRx", "p01", "rx03", "1541419500000", "ph jones", "ph01", "ibuprofen", "0", "1541419530000", "filled")
+
+	// the status is computed before the records are marked
+	expectGolden(t, "getExpirations", mustInvoke(t, stub, "getExpirations", "p01"))
+	var prescriptions struct{ RxList []rx }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRxForPatient", "p01"), &prescriptions)
+	if len(prescriptions.RxList) != 2 || prescriptions.RxList[0].Status != "prescribed" || prescriptions.RxList[1].Status != statusExpired {
+		t.Errorf("expected rx03 to show as expired, got %+v", prescriptions.RxList)
+	}
+	expectError(t, invoke(stub, "fillRx", "p01", "rx03", "1541419600000", "ph jones", "ph01", "ibuprofen", "0", "1541419530000", "filled"), errCodeFailedPrecondition)
+
+	expectError(t, invoke(stub, "expireRecords"), errCodePermissionDenied)
+	setRole(t, stub, roleAdmin, nil)
+	expectError(t, invoke(stub, "expireRecords", "1600000000000"), errCodeInvalidArgument)
+
+	// the index is ordered by date, pol01 expired first
+	var sweep struct {
+		Expired []expiredRecord
+		More    bool
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "expireRecords", "", "1"), &sweep)
+	if len(sweep.Expired) != 1 || sweep.Expired[0].ID != "pol01" || !sweep.More {
+		t.Errorf("expected pol01 and more to come, got %+v", sweep)
+	}
+	expectGolden(t, "expireRecords", mustInvoke(t, stub, "expireRecords"))
+
+	event := stub.events[len(stub.events)-1]
+	var expired []expiredRecord
+	mustUnmarshal(t, event.Payload, &expired)
+	if event.EventName != recordsExpiredEvent || len(expired) != 1 || expired[0].Pharmacy != "ph01" {
+		t.Errorf("expected the recordsExpired event for rx03 held by ph01, got %s %+v", event.EventName, expired)
+	}
+
+	// nothing is left to expire
+	events := len(stub.events)
+	mustUnmarshal(t, mustInvoke(t, stub, "expireRecords"), &sweep)
+	if len(sweep.Expired) != 0 || sweep.More || len(stub.events) != events {
+		t.Errorf("expected an empty sweep without an event, got %+v", sweep)
+	}
+
+	// a renewal clears the mark and indexes the new date
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1572976675318", "pol01")
+	var statuses struct{ Expirations []expiration }
+	mustUnmarshal(t, mustInvoke(t, stub, "getExpirations", "p01"), &statuses)
+	if policy := statuses.Expirations[2]; policy.ID != "pol01" || policy.Status != "active" {
+		t.Errorf("expected the renewed policy to be active, got %+v", policy)
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "expireRecords", "", ""), &sweep)
+	if len(sweep.Expired) != 0 {
+		t.Errorf("expected the renewed policy not to expire, got %+v", sweep.Expired)
+	}
+
+	expectInvalidArgs(t, "getExpirations", []argCase{
+		{"too few args", []string{}, ""},
+		{"bad asOf", []string{"p01", "today"}, "asOf"},
+	})
+}
+
+// records written before the index existed are swept once they are reindexed
+func TestReindexExpirations(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "p02", `{"objType":"emr","id":"p02","firstName":"mary","lastName":"jane",`+
+		`"rxList":[{"rxid":"rx01","timestamp":1541000000000,"prescription":"amoxicillin","expDate":1541000000001,"status":"prescribed"}]}`)
+
+	setRole(t, stub, roleAdmin, nil)
+	var sweep struct{ Expired []expiredRecord }
+	mustUnmarshal(t, mustInvoke(t, stub, "expireRecords"), &sweep)
+	if len(sweep.Expired) != 0 {
+		t.Fatalf("expected the unindexed record to be missed, got %+v", sweep.Expired)
+	}
+
+	if indexed := string(mustInvoke(t, stub, "reindexExpirations")); indexed != "2" {
+		t.Errorf("expected 2 patients to be indexed, got %s", indexed)
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "expireRecords"), &sweep)
+	if len(sweep.Expired) != 1 || sweep.Expired[0].PatientID != "p02" || sweep.Expired[0].ID != "rx01" {
+		t.Errorf("expected p02's rx01 to expire, got %+v", sweep.Expired)
+	}
+}
+
+// a policy renewed twice in one transaction keeps a single entry for its last date
+func TestIndexExpirationsInOneTransaction(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1541419300000", "pol01")
+
+	setRole(t, stub, roleAdmin, nil)
+	stub.MockTransactionStart(stub.nextTxID())
+	expectSuccess(t, new(Chaincode).insertInsurance(stub, []string{"p01", "aetna", "1541419400000", "pol01"}))
+	expectSuccess(t, new(Chaincode).insertInsurance(stub, []string{"p01", "aetna", "1572976675318", "pol01"}))
+	entries, err := stub.GetStateByPartialCompositeKey(indexExpiration, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for entries.HasNext() {
+		entry, err := entries.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, entry.Key)
+	}
+	entries.Close()
+	stub.MockTransactionEnd(stub.TxID)
+
+	if len(keys) != 1 || !strings.Contains(keys[0], "1572976675318") {
+		t.Errorf("expected only the last date to be indexed, got %q", keys)
+	}
+}
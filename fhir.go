@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// code systems and identifier systems used in FHIR resources
+const (
+	fhirSystemLOINC                  = "http://loinc.org"
+	fhirSystemUCUM                   = "http://unitsofmeasure.org"
+	fhirSystemObservationCategory    = "http://terminology.hl7.org/CodeSystem/observation-category"
+	fhirSystemSubscriberRelationship = "http://terminology.hl7.org/CodeSystem/subscriber-relationship"
+	fhirSystemPatientID              = "urn:emrcc:patientID"  // EMR.PatientID
+	fhirSystemRxID                   = "urn:emrcc:rxid"       // rx.RXID
+	fhirSystemDocLicense             = "urn:emrcc:docLicense" // rx.DocLicense
+	fhirSystemPhLicense              = "urn:emrcc:phLicense"  // rx.PhLicense
+	fhirSystemPolicyID               = "urn:emrcc:policyID"   // insurance.PolicyID
+)
+
+// LOINC codes of the vital signs stored on the EMR
+const (
+	loincHeartRate          = "8867-4"
+	loincBloodPressurePanel = "85354-9"
+	loincSystolic           = "8480-6"
+	loincDiastolic          = "8462-4"
+)
+
+// FHIR date formats, EMR.DOB is stored as MM/DD/YYYY
+const (
+	fhirDateFormat     = "2006-01-02"
+	fhirDateTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+	emrDateFormat      = "01/02/2006"
+)
+
+// FHIR R4 data types, only the elements the EMR can fill are declared
+
+type fhirCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type fhirIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type fhirReference struct {
+	Reference  string          `json:"reference,omitempty"`
+	Identifier *fhirIdentifier `json:"identifier,omitempty"`
+	Display    string          `json:"display,omitempty"`
+}
+
+type fhirHumanName struct {
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+type fhirContactPoint struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type fhirAddress struct {
+	Text       string   `json:"text,omitempty"`
+	Line       []string `json:"line,omitempty"`
+	City       string   `json:"city,omitempty"`
+	State      string   `json:"state,omitempty"`
+	PostalCode string   `json:"postalCode,omitempty"`
+}
+
+type fhirQuantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+type fhirPeriod struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// FHIR R4 resources
+
+type fhirPatient struct {
+	ResourceType string             `json:"resourceType"`
+	ID           string             `json:"id,omitempty"`
+	Identifier   []fhirIdentifier   `json:"identifier,omitempty"`
+	Name         []fhirHumanName    `json:"name,omitempty"`
+	Telecom      []fhirContactPoint `json:"telecom,omitempty"`
+	BirthDate    string             `json:"birthDate,omitempty"`
+	Address      []fhirAddress      `json:"address,omitempty"`
+}
+
+type fhirDispenseRequest struct {
+	ValidityPeriod         *fhirPeriod   `json:"validityPeriod,omitempty"`
+	NumberOfRepeatsAllowed int           `json:"numberOfRepeatsAllowed"`
+	Quantity               *fhirQuantity `json:"quantity,omitempty"`
+}
+
+type fhirMedicationRequest struct {
+	ResourceType              string               `json:"resourceType"`
+	ID                        string               `json:"id,omitempty"`
+	Identifier                []fhirIdentifier     `json:"identifier,omitempty"`
+	Status                    string               `json:"status"`
+	Intent                    string               `json:"intent"`
+	MedicationCodeableConcept fhirCodeableConcept  `json:"medicationCodeableConcept"`
+	Subject                   fhirReference        `json:"subject"`
+	AuthoredOn                string               `json:"authoredOn,omitempty"`
+	Requester                 *fhirReference       `json:"requester,omitempty"`
+	DispenseRequest           *fhirDispenseRequest `json:"dispenseRequest,omitempty"`
+}
+
+type fhirDispensePerformer struct {
+	Actor fhirReference `json:"actor"`
+}
+
+type fhirMedicationDispense struct {
+	ResourceType              string                  `json:"resourceType"`
+	ID                        string                  `json:"id,omitempty"`
+	Status                    string                  `json:"status"`
+	MedicationCodeableConcept fhirCodeableConcept     `json:"medicationCodeableConcept"`
+	Subject                   fhirReference           `json:"subject"`
+	Performer                 []fhirDispensePerformer `json:"performer,omitempty"`
+	AuthorizingPrescription   []fhirReference         `json:"authorizingPrescription,omitempty"`
+	Quantity                  *fhirQuantity           `json:"quantity,omitempty"`
+	WhenHandedOver            string                  `json:"whenHandedOver,omitempty"`
+}
+
+type fhirCoverage struct {
+	ResourceType string               `json:"resourceType"`
+	ID           string               `json:"id,omitempty"`
+	Identifier   []fhirIdentifier     `json:"identifier,omitempty"`
+	Status       string               `json:"status"`
+	Beneficiary  fhirReference        `json:"beneficiary"`
+	SubscriberID string               `json:"subscriberId,omitempty"`
+	Relationship *fhirCodeableConcept `json:"relationship,omitempty"`
+	Period       *fhirPeriod          `json:"period,omitempty"`
+	Payor        []fhirReference      `json:"payor"`
+	Order        int                  `json:"order,omitempty"` // order of benefits, 1 is the primary policy
+}
+
+type fhirObservationComponent struct {
+	Code          fhirCodeableConcept `json:"code"`
+	ValueQuantity *fhirQuantity       `json:"valueQuantity,omitempty"`
+}
+
+type fhirObservation struct {
+	ResourceType      string                     `json:"resourceType"`
+	ID                string                     `json:"id,omitempty"`
+	Status            string                     `json:"status"`
+	Category          []fhirCodeableConcept      `json:"category,omitempty"`
+	Code              fhirCodeableConcept        `json:"code"`
+	Subject           fhirReference              `json:"subject"`
+	EffectiveDateTime string                     `json:"effectiveDateTime,omitempty"`
+	ValueQuantity     *fhirQuantity              `json:"valueQuantity,omitempty"`
+	Component         []fhirObservationComponent `json:"component,omitempty"`
+}
+
+type fhirBundleEntry struct {
+	Resource interface{} `json:"resource"`
+}
+
+type fhirBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp,omitempty"`
+	Entry        []fhirBundleEntry `json:"entry"`
+}
+
+// exportFHIR
+// input: patientID
+// output: FHIR R4 collection Bundle of the patient's record
+// summary: Patient from demographics, MedicationRequest for each rx, MedicationDispense for each fill,
+// Coverage from insurance and LOINC coded Observations from the heart rate and blood pressure history
+func (t *Chaincode) exportFHIR(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "patientID"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	bundle := fhirBundle{
+		ResourceType: "Bundle",
+		Type:         "collection",
+		Entry:        []fhirBundleEntry{},
+	}
+
+	// the bundle is stamped with the transaction time so every peer returns the same bundle
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return ledgerError("unable to get transaction timestamp", err)
+	}
+	if txTime, err := ptypes.Timestamp(txTimestamp); err == nil {
+		bundle.Timestamp = txTime.Format(fhirDateTimeFormat)
+	}
+
+	bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: fhirPatientFromEMR(patientRecord)})
+
+	// prescriptions and their fills come from the history of the patient record
+	authoredOn, fills, cerr := t.rxFillHistory(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+	for _, prescription := range patientRecord.RxList {
+		bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: fhirMedicationRequestFromRx(patientID, prescription, authoredOn[prescription.RXID])})
+	}
+	fillCount := map[string]int{}
+	for _, fill := range fills {
+		fillCount[fill.RXID]++
+		bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: fhirMedicationDispenseFromRx(patientID, fill, fillCount[fill.RXID])})
+	}
+
+	for _, policy := range patientRecord.policies() {
+		bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: fhirCoverageFromInsurance(patientID, policy)})
+	}
+
+	heartRateHistory, cerr := t.heartRateHistory(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+	for _, heartRate := range heartRateHistory {
+		bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: fhirObservationFromHeartRate(patientID, heartRate)})
+	}
+
+	bloodPressureHistory, cerr := t.bloodPressureHistory(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+	for _, reading := range bloodPressureHistory {
+		bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: fhirObservationFromBloodPressure(patientID, reading)})
+	}
+
+	// the other vital signs, heart rate and blood pressure are exported from their histories above
+	for _, vt := range vitalTypes {
+		if vt.Name == vitalHeartRate || vt.Name == vitalBloodPressure {
+			continue
+		}
+		readings, cerr := t.vitals(stub, patientID, vt.Name, 0, maxTimestamp)
+		if cerr != nil {
+			return cerr.response()
+		}
+		for _, reading := range readings {
+			bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: fhirObservationFromVital(patientID, vt, reading)})
+		}
+	}
+
+	bundleAsBytes, err := json.Marshal(bundle)
+	if err != nil {
+		return serializationError("unable to marshal FHIR bundle", err)
+	}
+
+	return shim.Success(bundleAsBytes)
+}
+
+// rxFillHistory
+// input: patientID
+// output: the timestamp each rx was first prescribed at and every fill of every rx, oldest first
+// summary: fillRx overwrites the rx in RxList, so fills are found by walking the record's history.
+// a fill is a version of an rx with a pharmacist and a new timestamp that was not an approval
+func (t *Chaincode) rxFillHistory(stub shim.ChaincodeStubInterface, patientID string) (map[string]int, []rx, *chaincodeError) {
+	authoredOn := map[string]int{}
+	fills := []rx{}
+	previous := map[string]rx{}
+
+	cerr := walkEMRHistory(stub, patientID, func(version emrVersion) *chaincodeError {
+		for _, current := range version.Record.RxList {
+			last, seen := previous[current.RXID]
+			if !seen {
+				authoredOn[current.RXID] = current.Timestamp
+			}
+			if current.Pharmacist != "" && (!seen || (last.Timestamp != current.Timestamp && last.Approved == current.Approved)) {
+				fills = append(fills, current)
+			}
+			previous[current.RXID] = current
+		}
+		return nil
+	})
+	if cerr != nil {
+		return nil, nil, cerr
+	}
+
+	return authoredOn, fills, nil
+}
+
+// fhirPatientReference returns the reference to the patient's Patient resource
+func fhirPatientReference(patientID string) fhirReference {
+	return fhirReference{Reference: "Patient/" + patientID}
+}
+
+// fhirDateTime converts a millisecond timestamp to a FHIR dateTime
+func fhirDateTime(timestamp int) string {
+	return time.Unix(0, int64(timestamp)*int64(time.Millisecond)).UTC().Format(fhirDateTimeFormat)
+}
+
+// fhirPatientFromEMR maps the demographics of the EMR to a Patient
+func fhirPatientFromEMR(patientRecord EMR) fhirPatient {
+	patient := fhirPatient{
+		ResourceType: "Patient",
+		ID:           patientRecord.PatientID,
+		Identifier:   []fhirIdentifier{{System: fhirSystemPatientID, Value: patientRecord.PatientID}},
+		Name:         []fhirHumanName{{Family: patientRecord.LastName, Given: []string{patientRecord.FirstName}}},
+	}
+
+	if patientRecord.Phone != "" {
+		patient.Telecom = []fhirContactPoint{{System: "phone", Value: patientRecord.Phone}}
+	}
+	if patientRecord.Address != "" {
+		patient.Address = []fhirAddress{{Text: patientRecord.Address}}
+	}
+	// a dob that is not MM/DD/YYYY is left out rather than exported wrong
+	if dob, err := time.Parse(emrDateFormat, patientRecord.DOB); err == nil {
+		patient.BirthDate = dob.Format(fhirDateFormat)
+	}
+
+	return patient
+}
+
+// fhirMedicationRequestStatus maps rx.Status to a MedicationRequest status
+func fhirMedicationRequestStatus(status string) string {
+	switch strings.ToLower(status) {
+	case "prescribed", "filled", "active":
+		return "active"
+	case "completed":
+		return "completed"
+	case rxCancelled:
+		return "cancelled"
+	case rxDiscontinued:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// fhirMedicationRequestFromRx maps a prescription to a MedicationRequest
+func fhirMedicationRequestFromRx(patientID string, prescription rx, authoredOn int) fhirMedicationRequest {
+	medicationRequest := fhirMedicationRequest{
+		ResourceType:              "MedicationRequest",
+		ID:                        prescription.RXID,
+		Identifier:                []fhirIdentifier{{System: fhirSystemRxID, Value: prescription.RXID}},
+		Status:                    fhirMedicationRequestStatus(prescription.Status),
+		Intent:                    "order",
+		MedicationCodeableConcept: fhirCodeableConcept{Text: prescription.Prescription},
+		Subject:                   fhirPatientReference(patientID),
+		Requester: &fhirReference{
+			Identifier: &fhirIdentifier{System: fhirSystemDocLicense, Value: prescription.DocLicense},
+			Display:    prescription.Doctor,
+		},
+		DispenseRequest: &fhirDispenseRequest{
+			NumberOfRepeatsAllowed: prescription.Refills,
+		},
+	}
+
+	if authoredOn != 0 {
+		medicationRequest.AuthoredOn = fhirDateTime(authoredOn)
+	}
+	if prescription.Quantity != 0 {
+		medicationRequest.DispenseRequest.Quantity = &fhirQuantity{Value: prescription.Quantity}
+	}
+	if prescription.ExpirateDate != 0 {
+		medicationRequest.DispenseRequest.ValidityPeriod = &fhirPeriod{End: fhirDateTime(prescription.ExpirateDate)}
+	}
+
+	return medicationRequest
+}
+
+// fhirMedicationDispenseFromRx maps a fill of a prescription to a MedicationDispense
+// fills of one rx are numbered in the order they happened
+func fhirMedicationDispenseFromRx(patientID string, fill rx, number int) fhirMedicationDispense {
+	medicationDispense := fhirMedicationDispense{
+		ResourceType:              "MedicationDispense",
+		ID:                        fill.RXID + "-fill-" + strconv.Itoa(number),
+		Status:                    "completed",
+		MedicationCodeableConcept: fhirCodeableConcept{Text: fill.Prescription},
+		Subject:                   fhirPatientReference(patientID),
+		Performer: []fhirDispensePerformer{{Actor: fhirReference{
+			Identifier: &fhirIdentifier{System: fhirSystemPhLicense, Value: fill.PhLicense},
+			Display:    fill.Pharmacist,
+		}}},
+		AuthorizingPrescription: []fhirReference{{Reference: "MedicationRequest/" + fill.RXID}},
+		WhenHandedOver:          fhirDateTime(fill.Timestamp),
+	}
+
+	if fill.Quantity != 0 {
+		medicationDispense.Quantity = &fhirQuantity{Value: fill.Quantity}
+	}
+
+	return medicationDispense
+}
+
+// fhirCoverageFromInsurance maps the patient's insurance to a Coverage
+func fhirCoverageFromInsurance(patientID string, policy insurance) fhirCoverage {
+	coverage := fhirCoverage{
+		ResourceType: "Coverage",
+		ID:           policy.PolicyID,
+		Identifier:   []fhirIdentifier{{System: fhirSystemPolicyID, Value: policy.PolicyID}},
+		Status:       "active",
+		Beneficiary:  fhirPatientReference(patientID),
+		Payor:        []fhirReference{{Display: policy.Name}},
+		Order:        policy.Priority,
+	}
+
+	// a terminated policy ends on its termination date
+	end := policy.ExpirationDate
+	if policy.TerminatedDate != 0 {
+		coverage.Status = "cancelled"
+		if end == 0 || policy.TerminatedDate < end {
+			end = policy.TerminatedDate
+		}
+	}
+	if policy.EffectiveDate != 0 || end != 0 {
+		coverage.Period = &fhirPeriod{}
+		if policy.EffectiveDate != 0 {
+			coverage.Period.Start = fhirDateTime(policy.EffectiveDate)
+		}
+		if end != 0 {
+			coverage.Period.End = fhirDateTime(end)
+		}
+	}
+	if policy.Subscriber != "" {
+		coverage.SubscriberID = policy.Subscriber
+	}
+	if policy.Relationship != "" {
+		coverage.Relationship = &fhirCodeableConcept{
+			Coding: []fhirCoding{{System: fhirSystemSubscriberRelationship, Code: policy.Relationship}},
+		}
+	}
+
+	return coverage
+}
+
+// fhirVitalSignsCategory is the category of every vital sign Observation
+var fhirVitalSignsCategory = []fhirCodeableConcept{{
+	Coding: []fhirCoding{{System: fhirSystemObservationCategory, Code: "vital-signs", Display: "Vital Signs"}},
+}}
+
+// fhirLOINC returns a codeable concept for a LOINC code
+func fhirLOINC(code string, display string) fhirCodeableConcept {
+	return fhirCodeableConcept{
+		Coding: []fhirCoding{{System: fhirSystemLOINC, Code: code, Display: display}},
+		Text:   display,
+	}
+}
+
+// fhirObservationFromHeartRate maps a heart rate message to a heart rate Observation
+func fhirObservationFromHeartRate(patientID string, heartRate heartRateMessage) fhirObservation {
+	return fhirObservation{
+		ResourceType:      "Observation",
+		ID:                patientID + "-heartrate-" + strconv.Itoa(heartRate.Timestamp),
+		Status:            "final",
+		Category:          fhirVitalSignsCategory,
+		Code:              fhirLOINC(loincHeartRate, "Heart rate"),
+		Subject:           fhirPatientReference(patientID),
+		EffectiveDateTime: fhirDateTime(heartRate.Timestamp),
+		ValueQuantity:     &fhirQuantity{Value: float64(heartRate.HeartRate), Unit: "beats/minute", System: fhirSystemUCUM, Code: "/min"},
+	}
+}
+
+// fhirObservationFromVital maps a reading of a vital sign measured as a single value to an Observation
+func fhirObservationFromVital(patientID string, vt vitalType, reading vitalSign) fhirObservation {
+	return fhirObservation{
+		ResourceType:      "Observation",
+		ID:                patientID + "-" + strings.ToLower(vt.Name) + "-" + strconv.Itoa(reading.Timestamp),
+		Status:            "final",
+		Category:          fhirVitalSignsCategory,
+		Code:              fhirLOINC(vt.Code, vt.Display),
+		Subject:           fhirPatientReference(patientID),
+		EffectiveDateTime: fhirDateTime(reading.Timestamp),
+		ValueQuantity:     &fhirQuantity{Value: reading.Value, Unit: vt.Unit, System: fhirSystemUCUM, Code: vt.Unit},
+	}
+}
+
+// fhirObservationFromBloodPressure maps a blood pressure reading to a blood pressure panel Observation
+func fhirObservationFromBloodPressure(patientID string, reading bloodPressure) fhirObservation {
+	return fhirObservation{
+		ResourceType:      "Observation",
+		ID:                patientID + "-bloodpressure-" + strconv.Itoa(reading.Timestamp),
+		Status:            "final",
+		Category:          fhirVitalSignsCategory,
+		Code:              fhirLOINC(loincBloodPressurePanel, "Blood pressure panel with all children optional"),
+		Subject:           fhirPatientReference(patientID),
+		EffectiveDateTime: fhirDateTime(reading.Timestamp),
+		Component: []fhirObservationComponent{
+			{
+				Code:          fhirLOINC(loincSystolic, "Systolic blood pressure"),
+				ValueQuantity: &fhirQuantity{Value: float64(reading.High), Unit: "mmHg", System: fhirSystemUCUM, Code: "mm[Hg]"},
+			},
+			{
+				Code:          fhirLOINC(loincDiastolic, "Diastolic blood pressure"),
+				ValueQuantity: &fhirQuantity{Value: float64(reading.Low), Unit: "mmHg", System: fhirSystemUCUM, Code: "mm[Hg]"},
+			},
+		},
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// fhirImportBundle is a Bundle whose resources are decoded once their resourceType is known
+type fhirImportBundle struct {
+	ResourceType string `json:"resourceType"`
+	Entry        []struct {
+		Resource json.RawMessage `json:"resource"`
+	} `json:"entry"`
+}
+
+// fhirImportOutcome
+// summary: what importFHIR did with one entry of the bundle
+type fhirImportOutcome struct {
+	Entry        int    `json:"entry"`        // index of the entry in the bundle
+	ResourceType string `json:"resourceType"` // FHIR resource type of the entry
+	ID           string `json:"id"`           // patientID, rxid, policyID or Observation id
+	Function     string `json:"function"`     // chaincode function the resource was applied with
+	Action       string `json:"action"`       // created or updated
+}
+
+// FHIR dateTime formats accepted on import, the most precise first
+var fhirImportDateTimeFormats = []string{time.RFC3339Nano, "2006-01-02T15:04:05", fhirDateFormat}
+
+// importFHIR
+// input: FHIR R4 Bundle as json containing Patient, MedicationRequest, Coverage and Observation resources
+// output: the outcome of every entry
+// summary: applies each resource with the semantics of initPerson, insertRx, insertInsurance,
+// newHeartRateMessage and newBloodPressure in one transaction. Patients are applied first and an
+// existing patient's demographics are updated. If any entry fails nothing is written and the
+// error lists every failed entry
+func (t *Chaincode) importFHIR(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "bundle"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("bundle", "1st argument must be a non empty string")
+	}
+
+	bundle := fhirImportBundle{}
+	if err := json.Unmarshal([]byte(args[0]), &bundle); err != nil {
+		return newError(errCodeInvalidArgument, "bundle is not valid json").
+			withField("bundle").withDetail("cause", err.Error()).response()
+	}
+	if bundle.ResourceType != "Bundle" {
+		return invalidArgument("bundle", "resourceType must be Bundle")
+	}
+
+	// read the resourceType of each entry so patients can be created before what refers to them
+	resourceTypes := make([]string, len(bundle.Entry))
+	for key, entry := range bundle.Entry {
+		header := struct {
+			ResourceType string `json:"resourceType"`
+		}{}
+		json.Unmarshal(entry.Resource, &header)
+		resourceTypes[key] = header.ResourceType
+	}
+	order := []int{}
+	for key := range bundle.Entry {
+		if resourceTypes[key] == "Patient" {
+			order = append(order, key)
+		}
+	}
+	for key := range bundle.Entry {
+		if resourceTypes[key] != "Patient" {
+			order = append(order, key)
+		}
+	}
+
+	// later entries must see the patients and prescriptions written by earlier ones
+	importStub := newTxStub(stub)
+
+	outcomes := []fhirImportOutcome{}
+	rejected := newError(errCodeRejected, "bundle rejected, nothing was imported")
+
+	for _, key := range order {
+		outcome := fhirImportOutcome{Entry: key, ResourceType: resourceTypes[key]}
+
+		var cerr *chaincodeError
+		switch resourceTypes[key] {
+		case "Patient":
+			cerr = t.importFHIRPatient(importStub, bundle.Entry[key].Resource, &outcome)
+		case "MedicationRequest":
+			cerr = t.importFHIRMedicationRequest(importStub, bundle.Entry[key].Resource, &outcome)
+		case "Coverage":
+			cerr = t.importFHIRCoverage(importStub, bundle.Entry[key].Resource, &outcome)
+		case "Observation":
+			cerr = t.importFHIRObservation(importStub, bundle.Entry[key].Resource, &outcome)
+		default:
+			cerr = newError(errCodeInvalidArgument, "unsupported resourceType: "+resourceTypes[key]).withField("resourceType")
+		}
+
+		if cerr != nil {
+			rejected.withDetail(fmt.Sprintf("entry[%d] %s/%s", key, outcome.ResourceType, outcome.ID), cerr.Code+": "+cerr.Message)
+			continue
+		}
+		outcomes = append(outcomes, outcome)
+	}
+
+	// returning an error response keeps the peer from endorsing any of the writes
+	if len(rejected.Details) > 0 {
+		return rejected.response()
+	}
+
+	outcomesAsBytes, err := json.Marshal(struct {
+		Outcomes []fhirImportOutcome `json:"outcomes"`
+	}{
+		Outcomes: outcomes,
+	})
+	if err != nil {
+		return serializationError("unable to marshal import outcomes", err)
+	}
+
+	return shim.Success(outcomesAsBytes)
+}
+
+// importFHIRPatient creates the patient with initPerson or updates an existing patient's demographics
+func (t *Chaincode) importFHIRPatient(stub shim.ChaincodeStubInterface, resource json.RawMessage, outcome *fhirImportOutcome) *chaincodeError {
+	patient := fhirPatient{}
+	if err := json.Unmarshal(resource, &patient); err != nil {
+		return newError(errCodeInvalidArgument, "invalid Patient: "+err.Error())
+	}
+
+	patientID := strings.ToLower(fhirIdentifierValue(patient.ID, patient.Identifier, fhirSystemPatientID))
+	outcome.ID = patientID
+	if patientID == "" {
+		return newError(errCodeInvalidArgument, "Patient must have an id").withField("id")
+	}
+
+	firstName, lastName := "", ""
+	if len(patient.Name) > 0 {
+		firstName = strings.Join(patient.Name[0].Given, " ")
+		lastName = patient.Name[0].Family
+	}
+
+	dob := ""
+	if patient.BirthDate != "" {
+		birthDate, err := time.Parse(fhirDateFormat, patient.BirthDate)
+		if err != nil {
+			return newError(errCodeInvalidArgument, "birthDate must be YYYY-MM-DD").withField("birthDate")
+		}
+		dob = birthDate.Format(emrDateFormat)
+	}
+
+	address := ""
+	if len(patient.Address) > 0 {
+		address = fhirAddressText(patient.Address[0])
+	}
+
+	phone := ""
+	for _, telecom := range patient.Telecom {
+		if telecom.System == "phone" {
+			phone = telecom.Value
+			break
+		}
+	}
+
+	personArgs := []string{patientID, firstName, lastName, dob, address, phone}
+
+	_, cerr := t.getEMR(stub, patientID)
+	if cerr != nil && cerr.Code != errCodeNotFound {
+		return cerr
+	}
+
+	// new patients are created with initPerson, existing ones get the resource's demographics
+	response := pb.Response{}
+	if cerr != nil {
+		outcome.Function = "initPerson"
+		outcome.Action = "created"
+		response = t.initPerson(stub, personArgs)
+	} else {
+		outcome.Function = "updatePerson"
+		outcome.Action = "updated"
+		response = t.updatePerson(stub, personArgs)
+	}
+	if response.Status != shim.OK {
+		return responseError(response)
+	}
+
+	return nil
+}
+
+// importFHIRMedicationRequest adds the prescription with insertRx
+func (t *Chaincode) importFHIRMedicationRequest(stub shim.ChaincodeStubInterface, resource json.RawMessage, outcome *fhirImportOutcome) *chaincodeError {
+	medicationRequest := fhirMedicationRequest{}
+	if err := json.Unmarshal(resource, &medicationRequest); err != nil {
+		return newError(errCodeInvalidArgument, "invalid MedicationRequest: "+err.Error())
+	}
+
+	rxid := fhirIdentifierValue(medicationRequest.ID, medicationRequest.Identifier, fhirSystemRxID)
+	outcome.ID = rxid
+	outcome.Function = "insertRx"
+	outcome.Action = "created"
+
+	patientID, cerr := fhirPatientID(medicationRequest.Subject, "subject")
+	if cerr != nil {
+		return cerr
+	}
+
+	// only requests that can still be dispensed become prescriptions
+	if medicationRequest.Status != "active" && medicationRequest.Status != "draft" {
+		return newError(errCodeInvalidArgument, "MedicationRequest status must be active or draft").withField("status")
+	}
+	if medicationRequest.Intent != "order" && medicationRequest.Intent != "original-order" {
+		return newError(errCodeInvalidArgument, "MedicationRequest intent must be order").withField("intent")
+	}
+
+	authoredOn, cerr := fhirTimestamp(medicationRequest.AuthoredOn, "authoredOn")
+	if cerr != nil {
+		return cerr
+	}
+
+	prescription := medicationRequest.MedicationCodeableConcept.Text
+	if prescription == "" && len(medicationRequest.MedicationCodeableConcept.Coding) > 0 {
+		prescription = medicationRequest.MedicationCodeableConcept.Coding[0].Display
+	}
+
+	doctor, docLicense := "", ""
+	if medicationRequest.Requester != nil {
+		doctor = medicationRequest.Requester.Display
+		if medicationRequest.Requester.Identifier != nil {
+			docLicense = medicationRequest.Requester.Identifier.Value
+		}
+	}
+
+	refills, quantity, expDate := 0, 0.0, 0
+	if dispenseRequest := medicationRequest.DispenseRequest; dispenseRequest != nil {
+		refills = dispenseRequest.NumberOfRepeatsAllowed
+		if dispenseRequest.Quantity != nil {
+			quantity = dispenseRequest.Quantity.Value
+		}
+		if dispenseRequest.ValidityPeriod != nil {
+			if expDate, cerr = fhirTimestamp(dispenseRequest.ValidityPeriod.End, "dispenseRequest.validityPeriod.end"); cerr != nil {
+				return cerr
+			}
+		}
+	}
+
+	response := t.insertRx(stub, []string{
+		patientID,
+		rxid,
+		strconv.Itoa(authoredOn),
+		doctor,
+		docLicense,
+		prescription,
+		strconv.Itoa(refills),
+		strconv.FormatFloat(quantity, 'f', -1, 64),
+		strconv.Itoa(expDate),
+		"prescribed",
+	})
+	if response.Status != shim.OK {
+		return responseError(response)
+	}
+
+	return nil
+}
+
+// importFHIRCoverage sets the patient's insurance with insertInsurance
+func (t *Chaincode) importFHIRCoverage(stub shim.ChaincodeStubInterface, resource json.RawMessage, outcome *fhirImportOutcome) *chaincodeError {
+	coverage := fhirCoverage{}
+	if err := json.Unmarshal(resource, &coverage); err != nil {
+		return newError(errCodeInvalidArgument, "invalid Coverage: "+err.Error())
+	}
+
+	policyID := fhirIdentifierValue(coverage.ID, coverage.Identifier, fhirSystemPolicyID)
+	outcome.ID = policyID
+	outcome.Function = "insertInsurance"
+	outcome.Action = "updated"
+
+	patientID, cerr := fhirPatientID(coverage.Beneficiary, "beneficiary")
+	if cerr != nil {
+		return cerr
+	}
+
+	if coverage.Status != "active" {
+		return newError(errCodeInvalidArgument, "Coverage status must be active").withField("status")
+	}
+
+	insuranceName := ""
+	if len(coverage.Payor) > 0 {
+		insuranceName = coverage.Payor[0].Display
+	}
+
+	expirationDate, effectiveDate := 0, ""
+	if coverage.Period != nil {
+		if coverage.Period.End != "" {
+			if expirationDate, cerr = fhirTimestamp(coverage.Period.End, "period.end"); cerr != nil {
+				return cerr
+			}
+		}
+		if coverage.Period.Start != "" {
+			start, cerr := fhirTimestamp(coverage.Period.Start, "period.start")
+			if cerr != nil {
+				return cerr
+			}
+			effectiveDate = strconv.Itoa(start)
+		}
+	}
+
+	priority := ""
+	if coverage.Order > 0 {
+		priority = strconv.Itoa(coverage.Order)
+	}
+
+	relationship := ""
+	if coverage.Relationship != nil && len(coverage.Relationship.Coding) > 0 {
+		relationship = coverage.Relationship.Coding[0].Code
+	}
+
+	response := t.insertInsurance(stub, []string{patientID, insuranceName, strconv.Itoa(expirationDate), policyID, priority, coverage.SubscriberID, relationship, effectiveDate})
+	if response.Status != shim.OK {
+		return responseError(response)
+	}
+
+	return nil
+}
+
+// importFHIRObservation adds a heart rate with newHeartRateMessage, a blood pressure panel with newBloodPressure
+// and any other vital sign of the registry with newVital
+func (t *Chaincode) importFHIRObservation(stub shim.ChaincodeStubInterface, resource json.RawMessage, outcome *fhirImportOutcome) *chaincodeError {
+	observation := fhirObservation{}
+	if err := json.Unmarshal(resource, &observation); err != nil {
+		return newError(errCodeInvalidArgument, "invalid Observation: "+err.Error())
+	}
+
+	outcome.ID = observation.ID
+	outcome.Action = "created"
+
+	patientID, cerr := fhirPatientID(observation.Subject, "subject")
+	if cerr != nil {
+		return cerr
+	}
+
+	if observation.Status != "final" && observation.Status != "amended" && observation.Status != "corrected" {
+		return newError(errCodeInvalidArgument, "Observation status must be final, amended or corrected").withField("status")
+	}
+
+	timestamp, cerr := fhirTimestamp(observation.EffectiveDateTime, "effectiveDateTime")
+	if cerr != nil {
+		return cerr
+	}
+
+	switch fhirLOINCCode(observation.Code) {
+	case loincHeartRate:
+		outcome.Function = "newHeartRateMessage"
+		heartRate, cerr := fhirQuantityValue(observation.ValueQuantity, "/min", "valueQuantity")
+		if cerr != nil {
+			return cerr
+		}
+		if response := t.newHeartRateMessage(stub, []string{patientID, strconv.Itoa(heartRate), strconv.Itoa(timestamp)}); response.Status != shim.OK {
+			return responseError(response)
+		}
+
+	case loincBloodPressurePanel:
+		outcome.Function = "newBloodPressure"
+		var systolic, diastolic *fhirQuantity
+		for _, component := range observation.Component {
+			switch fhirLOINCCode(component.Code) {
+			case loincSystolic:
+				systolic = component.ValueQuantity
+			case loincDiastolic:
+				diastolic = component.ValueQuantity
+			}
+		}
+		high, cerr := fhirQuantityValue(systolic, "mm[Hg]", "component["+loincSystolic+"]")
+		if cerr != nil {
+			return cerr
+		}
+		low, cerr := fhirQuantityValue(diastolic, "mm[Hg]", "component["+loincDiastolic+"]")
+		if cerr != nil {
+			return cerr
+		}
+		if response := t.newBloodPressure(stub, []string{patientID, strconv.Itoa(high), strconv.Itoa(low), strconv.Itoa(timestamp)}); response.Status != shim.OK {
+			return responseError(response)
+		}
+
+	default:
+		// any other vital sign in the registry measured as a single value
+		vt, found := lookupVitalTypeByCode(fhirLOINCCode(observation.Code))
+		if !found || len(vt.Components) > 0 {
+			return newError(errCodeInvalidArgument, "Observation code must be the LOINC code of a vital sign in getVitalTypes").withField("code")
+		}
+		outcome.Function = "newVital"
+		quantity := observation.ValueQuantity
+		if _, cerr := fhirQuantityValue(quantity, vt.Unit, "valueQuantity"); cerr != nil {
+			return cerr
+		}
+		if cerr := t.recordVital(stub, patientID, vt, timestamp, []float64{quantity.Value}); cerr != nil {
+			return cerr
+		}
+	}
+
+	return nil
+}
+
+// fhirIdentifierValue returns the value of the identifier with the system, or the resource id
+func fhirIdentifierValue(id string, identifiers []fhirIdentifier, system string) string {
+	for _, identifier := range identifiers {
+		if identifier.System == system && identifier.Value != "" {
+			return identifier.Value
+		}
+	}
+	return id
+}
+
+// fhirPatientID returns the patientID of a Patient/<patientID> reference
+func fhirPatientID(reference fhirReference, field string) (string, *chaincodeError) {
+	if !strings.HasPrefix(reference.Reference, "Patient/") || len(reference.Reference) <= len("Patient/") {
+		return "", newError(errCodeInvalidArgument, field+" must reference Patient/<patientID>").withField(field)
+	}
+	return strings.ToLower(strings.TrimPrefix(reference.Reference, "Patient/")), nil
+}
+
+// fhirTimestamp converts a FHIR date or dateTime to a millisecond timestamp
+func fhirTimestamp(dateTime string, field string) (int, *chaincodeError) {
+	for _, format := range fhirImportDateTimeFormats {
+		if parsed, err := time.Parse(format, dateTime); err == nil {
+			return int(parsed.UnixNano() / int64(time.Millisecond)), nil
+		}
+	}
+	return 0, newError(errCodeInvalidArgument, field+" must be a FHIR dateTime").withField(field)
+}
+
+// fhirLOINCCode returns the LOINC code of the concept, or empty if it has none
+func fhirLOINCCode(concept fhirCodeableConcept) string {
+	for _, coding := range concept.Coding {
+		if coding.System == fhirSystemLOINC {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+// fhirQuantityValue returns the quantity as a whole number after checking its UCUM unit
+func fhirQuantityValue(quantity *fhirQuantity, ucumCode string, field string) (int, *chaincodeError) {
+	if quantity == nil {
+		return 0, newError(errCodeInvalidArgument, field+" is required").withField(field)
+	}
+	if quantity.Code != "" && (quantity.System != fhirSystemUCUM || quantity.Code != ucumCode) {
+		return 0, newError(errCodeInvalidArgument, field+" must be in UCUM "+ucumCode).withField(field)
+	}
+	return int(quantity.Value + 0.5), nil
+}
+
+// fhirAddressText returns the address as "street address city, state, zip" like EMR.Address
+func fhirAddressText(address fhirAddress) string {
+	if address.Text != "" {
+		return address.Text
+	}
+	text := strings.Join(append(address.Line, address.City), " ")
+	if address.State != "" {
+		text += ", " + address.State
+	}
+	if address.PostalCode != "" {
+		text += ", " + address.PostalCode
+	}
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const importBundle = `{
+  "resourceType": "Bundle",
+  "type": "collection",
+  "entry": [
+    {"resource": {
+      "resourceType": "MedicationRequest",
+      "id": "rx10",
+      "status": "active",
+      "intent": "order",
+      "medicationCodeableConcept": {"text": "metformin"},
+      "subject": {"reference": "Patient/P03"},
+      "authoredOn": "2018-11-05T17:57:55.318Z",
+      "requester": {"identifier": {"system": "urn:emrcc:docLicense", "value": "doc01"}, "display": "dr smith"},
+      "dispenseRequest": {"validityPeriod": {"end": "2019-11-05"}, "numberOfRepeatsAllowed": 3, "quantity": {"value": 60}}
+    }},
+    {"resource": {
+      "resourceType": "Patient",
+      "id": "P03",
+      "name": [{"family": "Roe", "given": ["Jane"]}],
+      "telecom": [{"system": "email", "value": "jane@example.com"}, {"system": "phone", "value": "222-222-2222"}],
+      "birthDate": "1990-02-02",
+      "address": [{"line": ["1 Main St"], "city": "Springfield", "state": "IL", "postalCode": "62701"}]
+    }},
+    {"resource": {
+      "resourceType": "Coverage",
+      "identifier": [{"system": "urn:emrcc:policyID", "value": "pol10"}],
+      "status": "active",
+      "beneficiary": {"reference": "Patient/p03"},
+      "period": {"end": "2019-12-31"},
+      "payor": [{"display": "aetna"}]
+    }},
+    {"resource": {
+      "resourceType": "Observation",
+      "id": "hr1",
+      "status": "final",
+      "code": {"coding": [{"system": "http://loinc.org", "code": "8867-4"}]},
+      "subject": {"reference": "Patient/p03"},
+      "effectiveDateTime": "2018-11-05T18:00:00Z",
+      "valueQuantity": {"value": 72, "unit": "beats/minute", "system": "http://unitsofmeasure.org", "code": "/min"}
+    }},
+    {"resource": {
+      "resourceType": "Observation",
+      "id": "bp1",
+      "status": "final",
+      "code": {"coding": [{"system": "http://loinc.org", "code": "85354-9"}]},
+      "subject": {"reference": "Patient/p03"},
+      "effectiveDateTime": "2018-11-05T18:01:00Z",
+      "component": [
+        {"code": {"coding": [{"system": "http://loinc.org", "code": "8480-6"}]}, "valueQuantity": {"value": 120, "system": "http://unitsofmeasure.org", "code": "mm[Hg]"}},
+        {"code": {"coding": [{"system": "http://loinc.org", "code": "8462-4"}]}, "valueQuantity": {"value": 80, "system": "http://unitsofmeasure.org", "code": "mm[Hg]"}}
+      ]
+    }}
+  ]
+}`
+
+func TestImportFHIR(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "importFHIR", mustInvoke(t, stub, "importFHIR", importBundle))
+	expectGolden(t, "importFHIR-export", mustInvoke(t, stub, "exportFHIR", "p03"))
+
+	// importing the same patient again updates the demographics, the caller must be allowed to update them
+	update := `{"resourceType": "Bundle", "entry": [{"resource": {"resourceType": "Patient", "id": "p03",
+		"name": [{"family": "Roe", "given": ["Janet"]}], "telecom": [{"system": "phone", "value": "333-333-3333"}],
+		"birthDate": "1990-02-02", "address": [{"text": "2 Main St Springfield, IL, 62701"}]}}]}`
+	expectError(t, invoke(stub, "importFHIR", update), errCodeRejected)
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "importFHIR", update)
+	expectGolden(t, "importFHIR-updated", mustInvoke(t, stub, "getPerson", "p03"))
+}
+
+// an export imported into another ledger recreates the same record
+func TestImportFHIRRoundTrip(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "importFHIR", importBundle)
+	exported := mustInvoke(t, stub, "exportFHIR", "p03")
+
+	other := newTestStub(t)
+	mustInvoke(t, other, "importFHIR", string(exported))
+
+	// getInsurance is asked about a fixed time, the two ledgers are at different transaction times
+	for function, args := range map[string][]string{
+		"getPerson":               {"p03"},
+		"getRxForPatient":         {"p03"},
+		"getInsurance":            {"p03", "1541440675318"},
+		"getHeartRateHistory":     {"p03"},
+		"getBloodPressureHistory": {"p03"},
+	} {
+		expected := mustInvoke(t, stub, function, args...)
+		if got := mustInvoke(t, other, function, args...); string(got) != string(expected) {
+			t.Errorf("%s differs after round trip\nexpected: %s\ngot: %s", function, expected, got)
+		}
+	}
+}
+
+func TestImportFHIRRejected(t *testing.T) {
+	stub := newTestStub(t)
+
+	bundle := `{"resourceType": "Bundle", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "p03", "name": [{"family": "roe", "given": ["jane"]}],
+			"telecom": [{"system": "phone", "value": "222-222-2222"}], "birthDate": "1990-02-02", "address": [{"text": "1 main st"}]}},
+		{"resource": {"resourceType": "Observation", "id": "cholesterol", "status": "final",
+			"code": {"coding": [{"system": "http://loinc.org", "code": "2093-3"}]}, "subject": {"reference": "Patient/p03"},
+			"effectiveDateTime": "2018-11-05T18:00:00Z", "valueQuantity": {"value": 95}}},
+		{"resource": {"resourceType": "Observation", "id": "hr", "status": "final",
+			"code": {"coding": [{"system": "http://loinc.org", "code": "8867-4"}]}, "subject": {"reference": "Patient/p03"},
+			"effectiveDateTime": "2018-11-05T18:00:00Z", "valueQuantity": {"value": 72, "system": "http://unitsofmeasure.org", "code": "mm[Hg]"}}},
+		{"resource": {"resourceType": "MedicationRequest", "id": "rx01", "status": "active", "intent": "order",
+			"subject": {"reference": "Patient/p99"}, "authoredOn": "2018-11-05", "medicationCodeableConcept": {"text": "x"},
+			"requester": {"identifier": {"value": "doc01"}, "display": "dr"}}},
+		{"resource": {"resourceType": "Encounter", "id": "e1"}}
+	]}`
+
+	cerr := expectError(t, invoke(stub, "importFHIR", bundle), errCodeRejected)
+	detailsAsBytes, _ := json.MarshalIndent(cerr.Details, "", "  ")
+	expectGolden(t, "importFHIR-rejected", detailsAsBytes)
+
+	// the valid patient in the rejected bundle was not written
+	expectError(t, invoke(stub, "getPerson", "p03"), errCodeNotFound)
+
+	expectInvalidArgs(t, "importFHIR", []argCase{
+		{"no args", nil, ""},
+		{"empty bundle", []string{""}, "bundle"},
+		{"not json", []string{"<Bundle/>"}, "bundle"},
+		{"not a bundle", []string{`{"resourceType": "Patient"}`}, "bundle"},
+	})
+}
+
+func TestUpdatePerson(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	expectError(t, invoke(stub, "updatePerson", "p01", "a", "b", "01/01/2000", "c", "d"), errCodePermissionDenied)
+	setRole(t, stub, rolePatient, map[string]string{attrPatientID: "p01"})
+	expectError(t, invoke(stub, "updatePerson", "p01", "a", "b", "01/01/2000", "c", "d"), errCodePermissionDenied)
+
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	mustInvoke(t, stub, "updatePerson", "P01", "John", "Doe", "01/01/2000", "222 Address City, State, Zip", "222-222-2222")
+	expectGolden(t, "updatePerson", mustInvoke(t, stub, "getPerson", "p01"))
+	// the rest of the record is kept
+	expectGolden(t, "getRxForPatient-inserted", mustInvoke(t, stub, "getRxForPatient", "p01"))
+
+	expectError(t, invoke(stub, "updatePerson", "p99", "a", "b", "01/01/2000", "c", "d"), errCodeNotFound)
+	expectInvalidArgs(t, "updatePerson", []argCase{
+		{"too few args", []string{"p01", "john"}, ""},
+		{"empty lastName", []string{"p01", "john", "", "01/01/2000", "c", "d"}, "lastName"},
+	})
+}
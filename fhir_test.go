@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExportFHIR(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	mustInvoke(t, stub, "approveRx", "p01", "rx01", "1541440690000", "true")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "fillRx", "p01", "rx01", "1541440700000", "ph jones", "ph01", "amoxicillin", "1", "1572976675318", "filled")
+	mustInvoke(t, stub, "fillRx", "p01", "rx01", "1544032700000", "ph jones", "ph01", "amoxicillin", "0", "1572976675318", "filled")
+	mustInvoke(t, stub, "insertRx", "p01", "rx02", "1541440800000", "dr smith", "doc01", "lisinopril", "0", "90", "1572976675318", "prescribed")
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1572976675318", "pol01")
+	mustInvoke(t, stub, "newHeartRateMessage", "p01", "72", "1541440675318")
+	mustInvoke(t, stub, "newBloodPressure", "p01", "120", "80", "1541440735318")
+	mustInvoke(t, stub, "newHeartRateMessage", "p01", "80", "1541440795318")
+
+	expectGolden(t, "exportFHIR", mustInvoke(t, stub, "exportFHIR", "p01"))
+	expectGolden(t, "exportFHIR-demographics", mustInvoke(t, stub, "exportFHIR", "P02"))
+	expectError(t, invoke(stub, "exportFHIR", "p99"), errCodeNotFound)
+
+	expectInvalidArgs(t, "exportFHIR", []argCase{
+		{"no args", nil, ""},
+		{"empty patientID", []string{""}, "patientID"},
+	})
+}
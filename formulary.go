@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// formulary
+// summary: the drugs an insurance plan covers, published by the insurer under the composite key formulary~plan.
+// the plan is the insurance name on the patient's EMR
+type formulary struct {
+	ObjectType  string          `json:"objType"`
+	Plan        string          `json:"plan"`
+	Drugs       []formularyDrug `json:"drugs"`
+	PublishedBy string          `json:"publishedBy"` // id of the insurer's certificate
+	Timestamp   int             `json:"timestamp"`   // timestamp of the transaction that published it
+}
+
+// formularyDrug
+// summary: a covered drug, it matches every prescription whose name contains it
+type formularyDrug struct {
+	Prescription  string  `json:"prescription"`
+	Tier          int     `json:"tier"` // cost sharing tier, 1 is the cheapest
+	PriorAuth     bool    `json:"priorAuth,omitempty"`
+	QuantityLimit float64 `json:"quantityLimit,omitempty"` // largest quantity covered per fill, 0 for no limit
+}
+
+// maxFormularyTier is the highest cost sharing tier a formulary may use
+const maxFormularyTier = 5
+
+// reasons a prescription is not covered
+const (
+	coverageNoInsurance      = "noInsurance"
+	coverageExpired          = "insuranceExpired"
+	coverageNoFormulary      = "noFormulary"
+	coverageNotOnFormulary   = "notOnFormulary"
+	coverageQuantityExceeded = "quantityLimitExceeded"
+	coverageNoPriorAuth      = "priorAuthRequired" // checkCoverage sets the PriorAuthRequired flag, only adjudicateClaim adds this reason
+)
+
+// coverage
+// summary: the answer of checkCoverage, eligible is false when the patient has no active policy
+// and covered is false when any reason is given
+type coverage struct {
+	PatientID         string   `json:"patientID"`
+	Plan              string   `json:"plan,omitempty"`
+	PolicyID          string   `json:"policyID,omitempty"`
+	Prescription      string   `json:"prescription"`
+	Quantity          float64  `json:"quantity"`
+	Eligible          bool     `json:"eligible"`
+	Covered           bool     `json:"covered"`
+	Tier              int      `json:"tier,omitempty"`
+	PriorAuthRequired bool     `json:"priorAuthRequired"`
+	QuantityLimit     float64  `json:"quantityLimit,omitempty"`
+	Reasons           []string `json:"reasons,omitempty"`
+}
+
+// publishFormulary
+// input: plan, the formulary as json, {"drugs": [{"prescription": "amoxicillin", "tier": 1, "priorAuth": false, "quantityLimit": 30}, ...]}
+// output: confirmation of record saved
+// summary: replace the plan's formulary, only insurers of the plan may publish
+func (t *Chaincode) publishFormulary(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0		1
+	// "plan", "formulary"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(strings.TrimSpace(args[0])) <= 0 {
+		return invalidArgument("plan", "1st argument must be a non-empty string")
+	}
+
+	c, cerr := requireInsurer(stub, args[0])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	f := formulary{}
+	if err := json.Unmarshal([]byte(args[1]), &f); err != nil {
+		return invalidArgument("formulary", "2nd argument must be a json formulary: "+err.Error())
+	}
+	if len(f.Drugs) == 0 {
+		return invalidArgument("formulary", "formulary must have at least one drug")
+	}
+
+	names := []string{}
+	for i, drug := range f.Drugs {
+		field := "drugs[" + strconv.Itoa(i) + "]"
+		name := strings.ToLower(strings.TrimSpace(drug.Prescription))
+		if name == "" || containsString(names, name) {
+			return invalidArgument(field, "drug must have a unique prescription name")
+		}
+		names = append(names, name)
+
+		if drug.Tier < 1 || drug.Tier > maxFormularyTier {
+			return invalidArgument(field, "tier of "+name+" must be between 1 and "+strconv.Itoa(maxFormularyTier))
+		}
+		if drug.QuantityLimit < 0 {
+			return invalidArgument(field, "quantityLimit of "+name+" must not be negative")
+		}
+		f.Drugs[i].Prescription = name
+	}
+
+	timestamp, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	f.ObjectType = objTypeFormulary
+	f.Plan = strings.ToLower(strings.TrimSpace(args[0]))
+	f.PublishedBy = c.ID
+	f.Timestamp = timestamp
+
+	formularyKey, err := stub.CreateCompositeKey(objTypeFormulary, []string{f.Plan})
+	if err != nil {
+		return ledgerError("unable to create formulary key", err)
+	}
+
+	if cerr := t.putRecord(stub, formularyKey, f); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getFormulary
+// input: plan
+// output: the plan's formulary
+func (t *Chaincode) getFormulary(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "plan"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(strings.TrimSpace(args[0])) <= 0 {
+		return invalidArgument("plan", "1st argument must be a non-empty string")
+	}
+
+	f, cerr := t.getPlanFormulary(stub, args[0])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	formularyAsBytes, err := json.Marshal(f)
+	if err != nil {
+		return serializationError("unable to marshal formulary", err)
+	}
+
+	return shim.Success(formularyAsBytes)
+}
+
+// getPlanFormulary
+// input: plan
+// output: the plan's formulary or NOT_FOUND if the insurer has not published one
+func (t *Chaincode) getPlanFormulary(stub shim.ChaincodeStubInterface, plan string) (formulary, *chaincodeError) {
+	formularyKey, err := stub.CreateCompositeKey(objTypeFormulary, []string{strings.ToLower(strings.TrimSpace(plan))})
+	if err != nil {
+		return formulary{}, newError(errCodeLedger, "unable to create formulary key").withDetail("cause", err.Error())
+	}
+
+	f := formulary{}
+	if cerr := t.getRecord(stub, formularyKey, objTypeFormulary, &f); cerr != nil {
+		return formulary{}, cerr
+	}
+
+	return f, nil
+}
+
+// lookup returns the formulary drug matching the prescription, the longest name wins
+// so a formulary can list a specific strength apart from the drug
+func (f formulary) lookup(prescription string) (formularyDrug, bool) {
+	prescription = strings.ToLower(prescription)
+
+	match, found := formularyDrug{}, false
+	for _, drug := range f.Drugs {
+		if strings.Contains(prescription, drug.Prescription) && len(drug.Prescription) > len(match.Prescription) {
+			match, found = drug, true
+		}
+	}
+
+	return match, found
+}
+
+// checkCoverage
+// input: patientID, prescription, quantity
+// output: whether the patient's current insurance covers the prescription, at which tier and if it needs prior authorization
+// summary: meant to be queried before insertRx or fillRx, a prescription that is not covered is not an error
+func (t *Chaincode) checkCoverage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1				2
+	// "patientID", "prescription", quantity
+	if len(args) < 3 {
+		return incorrectArgCount("3")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("prescription", "2nd argument must be a non-empty string")
+	}
+
+	quantity, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || quantity <= 0 {
+		return invalidArgument("quantity", "3rd argument must be a positive numeric string")
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, args[0])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	result, cerr := t.coverageOf(stub, patientRecord, args[1], quantity, now)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return serializationError("unable to marshal coverage response", err)
+	}
+
+	return shim.Success(resultAsBytes)
+}
+
+// coverageOf
+// input: patient record, prescription, quantity and the time the patient's policies must be active at
+// output: the coverage of the prescription by the patient's primary policy
+func (t *Chaincode) coverageOf(stub shim.ChaincodeStubInterface, patientRecord EMR, prescription string, quantity float64, now int) (coverage, *chaincodeError) {
+	result := coverage{
+		PatientID:    patientRecord.PatientID,
+		Prescription: prescription,
+		Quantity:     quantity,
+	}
+
+	// eligibility, the primary policy decides coverage
+	policy, active := patientRecord.primaryPolicy(now)
+	if !active {
+		if len(patientRecord.policies()) == 0 {
+			result.Reasons = append(result.Reasons, coverageNoInsurance)
+		} else {
+			result.Reasons = append(result.Reasons, coverageExpired)
+		}
+		return result, nil
+	}
+	result.Plan = strings.ToLower(policy.Name)
+	result.PolicyID = policy.PolicyID
+	result.Eligible = true
+
+	f, cerr := t.getPlanFormulary(stub, policy.Name)
+	if cerr != nil && cerr.Code == errCodeNotFound {
+		result.Reasons = append(result.Reasons, coverageNoFormulary)
+		return result, nil
+	} else if cerr != nil {
+		return coverage{}, cerr
+	}
+
+	drug, found := f.lookup(prescription)
+	if !found {
+		result.Reasons = append(result.Reasons, coverageNotOnFormulary)
+		return result, nil
+	}
+
+	result.Tier = drug.Tier
+	result.PriorAuthRequired = drug.PriorAuth
+	result.QuantityLimit = drug.QuantityLimit
+	if drug.QuantityLimit > 0 && quantity > drug.QuantityLimit {
+		result.Reasons = append(result.Reasons, coverageQuantityExceeded)
+	}
+	result.Covered = len(result.Reasons) == 0
+
+	return result, nil
+}
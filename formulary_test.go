@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPublishFormulary(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectError(t, invoke(stub, "publishFormulary", "aetna", testFormulary), errCodePermissionDenied)
+	expectError(t, invoke(stub, "getFormulary", "aetna"), errCodeNotFound)
+
+	// an insurer of another plan
+	setRole(t, stub, roleInsurer, map[string]string{attrPlans: "cigna"})
+	expectError(t, invoke(stub, "publishFormulary", "aetna", testFormulary), errCodePermissionDenied)
+
+	setRole(t, stub, roleInsurer, map[string]string{attrPlans: "cigna, Aetna"})
+	mustInvoke(t, stub, "publishFormulary", "Aetna", testFormulary)
+	expectGolden(t, "getFormulary", mustInvoke(t, stub, "getFormulary", "aetna"))
+
+	for _, c := range []struct {
+		name  string
+		args  []string
+		field string
+	}{
+		{"empty plan", []string{" ", testFormulary}, "plan"},
+		{"not json", []string{"aetna", "{"}, "formulary"},
+		{"no drugs", []string{"aetna", `{"drugs": []}`}, "formulary"},
+		{"duplicate drug", []string{"aetna", `{"drugs": [{"prescription": "a", "tier": 1}, {"prescription": "A", "tier": 2}]}`}, "drugs[1]"},
+		{"bad tier", []string{"aetna", `{"drugs": [{"prescription": "a", "tier": 6}]}`}, "drugs[0]"},
+		{"negative limit", []string{"aetna", `{"drugs": [{"prescription": "a", "tier": 1, "quantityLimit": -1}]}`}, "drugs[0]"},
+	} {
+		cerr := expectError(t, invoke(stub, "publishFormulary", c.args...), errCodeInvalidArgument)
+		if cerr.Field != c.field {
+			t.Errorf("%s: expected field %s, got %s", c.name, c.field, cerr.Field)
+		}
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	stub := newTestStub(t)
+
+	check := func(args ...string) coverage {
+		result := coverage{}
+		mustUnmarshal(t, mustInvoke(t, stub, "checkCoverage", args...), &result)
+		return result
+	}
+
+	// p01 has no insurance yet
+	if result := check("p01", "amoxicillin", "20"); result.Eligible || result.Covered || result.Reasons[0] != coverageNoInsurance {
+		t.Errorf("expected no insurance, got %+v", result)
+	}
+
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1572976675318", "pol01")
+	if result := check("p01", "amoxicillin", "20"); !result.Eligible || result.Covered || result.Reasons[0] != coverageNoFormulary {
+		t.Errorf("expected no formulary, got %+v", result)
+	}
+
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	mustInvoke(t, stub, "publishFormulary", "aetna", testFormulary)
+
+	expectGolden(t, "checkCoverage", mustInvoke(t, stub, "checkCoverage", "p01", "Adalimumab 40mg", "2"))
+
+	for _, c := range []struct {
+		name         string
+		prescription string
+		quantity     string
+		covered      bool
+		tier         int
+		reason       string
+	}{
+		{"covered", "amoxicillin 500mg", "20", true, 1, ""},
+		{"longest match", "amoxicillin 875mg", "60", true, 2, ""},
+		{"quantity limit", "amoxicillin 500mg", "40", false, 1, coverageQuantityExceeded},
+		{"not listed", "ibuprofen", "20", false, 0, coverageNotOnFormulary},
+	} {
+		result := check("p01", c.prescription, c.quantity)
+		if result.Covered != c.covered || result.Tier != c.tier || (c.reason != "" && (len(result.Reasons) != 1 || result.Reasons[0] != c.reason)) {
+			t.Errorf("%s: unexpected coverage %+v", c.name, result)
+		}
+	}
+
+	// an expired policy is not eligible
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1500000000000", "pol01")
+	if result := check("p01", "amoxicillin", "20"); result.Eligible || result.Reasons[0] != coverageExpired {
+		t.Errorf("expected an expired policy, got %+v", result)
+	}
+
+	expectError(t, invoke(stub, "checkCoverage", "p99", "amoxicillin", "20"), errCodeNotFound)
+	expectInvalidArgs(t, "checkCoverage", []argCase{
+		{"too few args", []string{"p01", "amoxicillin"}, ""},
+		{"empty prescription", []string{"p01", "", "20"}, "prescription"},
+		{"bad quantity", []string{"p01", "amoxicillin", "0"}, "quantity"},
+	})
+}
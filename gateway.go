@@ -0,0 +1,220 @@
+//go:build gateway
+// +build gateway
+
+package main
+
+//go:generate sh -c "(echo '// Code generated by go generate from stub_test.go; DO NOT EDIT.'; echo; sed -e 's|^//go:build !gateway|//go:build gateway|' -e 's|^// +build !gateway|// +build gateway|' stub_test.go) > gatewayStub.go"
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// local REST gateway
+// summary: serves the chaincode over the same REST contract as the OBCS REST proxy so the
+// front end and test.sh can run against it without a Fabric network.
+// the ledger lives in memory on a historyStub and is lost when the gateway stops
+// build and run with
+//	go run -tags gateway . -addr :4001
+// the stub is written in stub_test.go, regenerate the gateway's copy after changing it with
+//	go generate -tags gateway
+
+// gatewayRequest is the body of an invocation or query, same as the OBCS REST proxy
+type gatewayRequest struct {
+	Channel      string   `json:"channel"`
+	Chaincode    string   `json:"chaincode"`
+	ChaincodeVer string   `json:"chaincodeVer,omitempty"`
+	Method       string   `json:"method"`
+	Args         []string `json:"args"`
+}
+
+// gatewayResult holds the chaincode's payload, raw json when the payload is json
+type gatewayResult struct {
+	Payload interface{} `json:"payload"`
+	Encode  string      `json:"encode"`
+}
+
+// gatewayResponse is the body returned for every request
+type gatewayResponse struct {
+	ReturnCode string         `json:"returnCode"`       // Success or Failure
+	Result     *gatewayResult `json:"result,omitempty"` // set on success
+	Info       interface{}    `json:"info,omitempty"`   // error returned by the chaincode or the gateway
+	TxID       string         `json:"txid,omitempty"`
+}
+
+// gateway hosts one chaincode on an in-memory stub
+type gateway struct {
+	sync.Mutex
+	name     string
+	stub     *historyStub
+	identity map[string]string // certificate attributes of requests that do not send their own
+}
+
+// newGateway creates the stub and runs the chaincode's Init
+func newGateway(name string) (*gateway, error) {
+	g := &gateway{
+		name: name,
+		stub: newHistoryStub(name, new(Chaincode)),
+	}
+
+	if response := g.stub.MockInit(g.stub.nextTxID(), nil); response.Status != shim.OK {
+		return nil, fmt.Errorf("chaincode Init failed: %s", response.Message)
+	}
+
+	return g, nil
+}
+
+// handler returns a handler that decodes the request and runs it as an invocation or a query
+func (g *gateway) handler(query bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeGatewayResponse(w, http.StatusMethodNotAllowed, gatewayResponse{ReturnCode: "Failure", Info: "only POST is supported"})
+			return
+		}
+
+		request := gatewayRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeGatewayResponse(w, http.StatusBadRequest, gatewayResponse{ReturnCode: "Failure", Info: "invalid request body: " + err.Error()})
+			return
+		}
+		if request.Chaincode != "" && request.Chaincode != g.name {
+			writeGatewayResponse(w, http.StatusNotFound, gatewayResponse{ReturnCode: "Failure", Info: "chaincode not found: " + request.Chaincode})
+			return
+		}
+		if request.Method == "" {
+			writeGatewayResponse(w, http.StatusBadRequest, gatewayResponse{ReturnCode: "Failure", Info: "method is required"})
+			return
+		}
+
+		attrs := g.requestIdentity(r)
+
+		args := [][]byte{[]byte(request.Method)}
+		for _, arg := range request.Args {
+			args = append(args, []byte(arg))
+		}
+
+		// the stub runs one transaction at a time like a single peer would
+		g.Lock()
+		if err := g.stub.setIdentity("Org1MSP", identityName(attrs), attrs); err != nil {
+			g.Unlock()
+			writeGatewayResponse(w, http.StatusInternalServerError, gatewayResponse{ReturnCode: "Failure", Info: "unable to create identity: " + err.Error()})
+			return
+		}
+		txID := g.stub.nextTxID()
+		var response pb.Response
+		if query {
+			response = g.stub.MockQuery(txID, args)
+		} else {
+			response = g.stub.MockInvoke(txID, args)
+		}
+		g.Unlock()
+
+		log.Printf("%s %s(%v) -> %d", txID, request.Method, request.Args, response.Status)
+
+		if response.Status != shim.OK {
+			writeGatewayResponse(w, http.StatusOK, gatewayResponse{ReturnCode: "Failure", Info: jsonOrString(response.Message), TxID: txID})
+			return
+		}
+
+		result := &gatewayResult{Payload: jsonOrString(string(response.Payload)), Encode: "UTF-8"}
+		if json.Valid(response.Payload) {
+			result.Encode = "JSON"
+		}
+		writeGatewayResponse(w, http.StatusOK, gatewayResponse{ReturnCode: "Success", Result: result, TxID: txID})
+	}
+}
+
+// requestIdentity returns the certificate attributes the request is submitted with. a request that sends X-Role
+// runs as the identity of its X-<attribute> headers, e.g. X-Role: pharmacist and X-License: ph01,
+// any other request runs as the gateway's identity
+func (g *gateway) requestIdentity(r *http.Request) map[string]string {
+	if r.Header.Get("X-"+attrRole) == "" {
+		return g.identity
+	}
+
+	attrs := map[string]string{}
+	for _, name := range callerAttributes {
+		if value := r.Header.Get("X-" + name); value != "" {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// identityName returns the common name of the certificate for the attributes, e.g. pharmacist-ph01,
+// so every set of attributes is its own caller
+func identityName(attrs map[string]string) string {
+	name := []string{}
+	for _, attribute := range callerAttributes {
+		if value := attrs[attribute]; value != "" {
+			name = append(name, value)
+		}
+	}
+	return strings.Join(name, "-")
+}
+
+// jsonOrString returns value as raw json if it is valid json so it is not double encoded
+func jsonOrString(value string) interface{} {
+	if json.Valid([]byte(value)) {
+		return json.RawMessage(value)
+	}
+	return value
+}
+
+// writeGatewayResponse writes the response as json with the status code
+func writeGatewayResponse(w http.ResponseWriter, status int, response gatewayResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error writing response: %s", err)
+	}
+}
+
+// Main
+// starts the local gateway instead of connecting to a peer
+func main() {
+	addr := flag.String("addr", ":4001", "address to listen on")
+	name := flag.String("chaincode", "emrcc", "chaincode name requests must use")
+	role := flag.String("role", roleAdmin, "role attribute of the identity requests without identity headers are submitted with")
+	license := flag.String("license", "", "license attribute of the identity")
+	patientID := flag.String("patientID", "", "patientID attribute of the identity")
+	pharmacy := flag.String("pharmacy", "", "pharmacy attribute of the identity")
+	plans := flag.String("plans", "", "plans attribute of the identity")
+	flag.Parse()
+
+	g, err := newGateway(*name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the gateway has no users, requests without identity headers run as one identity like a single enrolled client
+	g.identity = map[string]string{attrRole: *role}
+	if *license != "" {
+		g.identity[attrLicense] = *license
+	}
+	if *patientID != "" {
+		g.identity[attrPatientID] = *patientID
+	}
+	if *pharmacy != "" {
+		g.identity[attrPharmacy] = *pharmacy
+	}
+	if *plans != "" {
+		g.identity[attrPlans] = *plans
+	}
+
+	http.HandleFunc("/bcsgw/rest/v1/transaction/invocation", g.handler(false))
+	http.HandleFunc("/bcsgw/rest/v1/transaction/query", g.handler(true))
+	// test.sh posts invocations to the root
+	http.HandleFunc("/", g.handler(false))
+
+	log.Printf("serving chaincode %s on %s", *name, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
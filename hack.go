@@ -20,7 +20,7 @@ func (t *Chaincode) isHacked(stub shim.ChaincodeStubInterface, args []string) pb
 
 	hackRecordAsBytes, err := stub.GetState("hack")
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError("unable to get hack record", err)
 	}
 	if hackRecordAsBytes == nil {
 		hackRecord := hack{
@@ -30,11 +30,11 @@ func (t *Chaincode) isHacked(stub shim.ChaincodeStubInterface, args []string) pb
 
 		hackRecordAsBytes, err = json.Marshal(hackRecord)
 		if err != nil {
-			return shim.Error(err.Error())
+			return serializationError("unable to marshal hack record", err)
 		}
 
 		if err := stub.PutState(hackRecord.ObjectType, hackRecordAsBytes); err != nil {
-			return shim.Error(err.Error())
+			return ledgerError("unable to put hack record", err)
 		}
 	}
 
@@ -51,7 +51,7 @@ func (t *Chaincode) hack(stub shim.ChaincodeStubInterface, args []string) pb.Res
 	hackRecord := hack{}
 	hackRecordAsBytes, err := stub.GetState("hack")
 	if err != nil {
-		return shim.Error("Error retrieving state" + err.Error())
+		return ledgerError("Error retrieving state", err)
 	}
 	// there was no hack record to begin with so make a default hack record of IsHacked = false
 	if hackRecordAsBytes == nil {
@@ -60,7 +60,7 @@ func (t *Chaincode) hack(stub shim.ChaincodeStubInterface, args []string) pb.Res
 	} else {
 		// record existed so grabbing current state
 		if err := json.Unmarshal(hackRecordAsBytes, &hackRecord); err != nil {
-			return shim.Error(err.Error())
+			return serializationError("unable to unmarshal hack record", err)
 		}
 	}
 
@@ -72,11 +72,11 @@ func (t *Chaincode) hack(stub shim.ChaincodeStubInterface, args []string) pb.Res
 
 	hackRecordAsBytes, err = json.Marshal(hackRecord)
 	if err != nil {
-		return shim.Error(err.Error())
+		return serializationError("unable to marshal hack record", err)
 	}
 
 	if err := stub.PutState(hackRecord.ObjectType, hackRecordAsBytes); err != nil {
-		return shim.Error(err.Error())
+		return ledgerError("unable to put hack record", err)
 	}
 
 	return shim.Success(hackRecordAsBytes)
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHack(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "isHacked-false", mustInvoke(t, stub, "isHacked"))
+	expectGolden(t, "isHacked-true", mustInvoke(t, stub, "hack"))
+	expectGolden(t, "isHacked-true", mustInvoke(t, stub, "isHacked"))
+	expectGolden(t, "isHacked-false", mustInvoke(t, stub, "hack"))
+}
@@ -20,20 +20,21 @@ type heartRateMessage struct {
 // newHeartRateMessage
 // input: id, heart rate and timestamp
 // output: confirmation of record saved
-// summary: insert each entry of a new heart rate message
+// summary: insert each entry of a new heart rate message.
+// kept for existing clients, the reading is recorded as a heartRate vital sign like newVital does
 func (t *Chaincode) newHeartRateMessage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	fmt.Println("Initiating newHeartRateMessage")
 	//		0			1			2
 	// "patientID", heartRate, timestamp
 	if len(args) < 3 {
-		return shim.Error("Incorrect number of arguements. Expected 3")
+		return incorrectArgCount("3")
 	}
 
 	// Input Sanitation
 	fmt.Println("- start newHeartRateMessage")
 	if len(args[0]) <= 0 {
-		return shim.Error("1st arguement myst be a non-empty string")
+		return invalidArgument("patientID", "1st arguement must be a non-empty string")
 	}
 
 	// convert patiendID to lowercase
@@ -42,53 +43,19 @@ func (t *Chaincode) newHeartRateMessage(stub shim.ChaincodeStubInterface, args [
 	// convert heartrate from string to integer
 	heartRate, err := strconv.Atoi(args[1])
 	if err != nil {
-		return shim.Error("2nd arguement must be a numeric string")
+		return invalidArgument("heartRate", "2nd arguement must be a numeric string")
 	}
 
 	// convert timestamp from string to integer
 	timestamp, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("3rd arguement must be a numeric string")
+		return invalidArgument("timestamp", "3rd arguement must be a numeric string")
 	}
 
-	// create struct from args variables
-	// Record ID is a composotion of both patient id and the timestamp
-	newHeartRateMessage := heartRateMessage{
-		HeartRate: heartRate,
-		Timestamp: timestamp,
-	}
-	fmt.Printf("Converted args to heartRateMessage struct: %v\n", newHeartRateMessage)
-
-	initialEMR := EMR{
-		PatientID: patientID,
-	}
-
-	// check if the patient record exists
-	initialEMRAsBytes, err := stub.GetState(initialEMR.PatientID)
-	if err != nil {
-		return shim.Error("Patient record does not exist")
-	}
-
-	//convert inital EMR bytes to struct
-	err = json.Unmarshal(initialEMRAsBytes, &initialEMR)
-	if err != nil {
-		return shim.Error("unable to marshal emr bytes")
-	}
-
-	// add new heart rate message to initial EMR struct
-	initialEMR.HeartRate = newHeartRateMessage
-
-	// convert modified EMR to JSON bytes
-	modifiedEMRAsBytes, err := json.Marshal(initialEMR)
-	if err != nil {
-		return shim.Error("Error attempting to marshaling iot data")
-	}
-	fmt.Printf("iot data as json %s", string(modifiedEMRAsBytes))
-
-	// submit modified EMR data to ledger
-	err = stub.PutState(initialEMR.PatientID, modifiedEMRAsBytes)
-	if err != nil {
-		return shim.Error("Error inserting iot data: " + err.Error())
+	// record the heart rate as a vital sign, fails if it is out of range or the patient does not exist
+	vt, _ := lookupVitalType(vitalHeartRate)
+	if cerr := t.recordVital(stub, patientID, vt, timestamp, []float64{float64(heartRate)}); cerr != nil {
+		return cerr.response()
 	}
 
 	// return success if reached to this point
@@ -105,61 +72,68 @@ func (t *Chaincode) getHeartRateHistory(stub shim.ChaincodeStubInterface, args [
 	fmt.Println("-------- init getHeartRateHistory-----------")
 	// check for args of patientID
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments, expecting 1")
+		return incorrectArgCount("1")
 	}
 
 	// convert patientID to lowercase
 	patientID := strings.ToLower(args[0])
 
-	// get patient record
-	// output will be list of patient records ( history )
-	resultsIterator, err := stub.GetHistoryForKey(patientID)
-	if err != nil {
-		return shim.Error("Patient record does not exist: " + err.Error())
+	heartRateHistory, cerr := t.heartRateHistory(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
 	}
-	defer resultsIterator.Close()
 
 	// create patient record heart rate history struct
 	patientHeartRateHistory := struct {
 		PatientID        string             `json:"patientID"`
 		HeartRateHistory []heartRateMessage `json:"heartRateHistory,omitempty"`
 	}{
-		PatientID: patientID,
+		PatientID:        patientID,
+		HeartRateHistory: heartRateHistory,
 	}
 
-	for resultsIterator.HasNext() {
-		// create patient record interface
-		patientRecord := EMR{}
+	// convert the heart rate history struct to json bytes to be returned
+	heartRateHistoryAsBytes, err := json.Marshal(patientHeartRateHistory)
+	if err != nil {
+		return serializationError("error marshalling iot data in iot history", err)
+	}
+	fmt.Printf("- getHeartRateHistory returning:\n%s\n", string(heartRateHistoryAsBytes))
 
-		// get response
-		response, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+	return shim.Success(heartRateHistoryAsBytes)
+}
 
-		// unmarshall response's value to patient interface
-		if err := json.Unmarshal(response.Value, &patientRecord); err != nil {
-			return shim.Error(err.Error())
+// heartRateHistory
+// input: patientID
+// output: every heart rate message the patient record has held followed by the heartRate vital signs, oldest first
+func (t *Chaincode) heartRateHistory(stub shim.ChaincodeStubInterface, patientID string) ([]heartRateMessage, *chaincodeError) {
+	// heart rates recorded before vital signs were stored on their own keys are in the patient record's history
+	heartRateHistory := []heartRateMessage{}
+	cerr := walkEMRHistory(stub, patientID, func(version emrVersion) *chaincodeError {
+		if version.IsDelete {
+			return nil
 		}
-
-		fmt.Printf("tempPatientRecord: %v\n", patientRecord)
+		patientRecord := version.Record
 
 		// add new heart rate message if timestamp is not equal to last entry in heart rate history
-		if len(patientHeartRateHistory.HeartRateHistory) == 0 && patientRecord.HeartRate.Timestamp != 0 {
-			patientHeartRateHistory.HeartRateHistory = append(patientHeartRateHistory.HeartRateHistory, patientRecord.HeartRate)
-		} else if len(patientHeartRateHistory.HeartRateHistory) > 0 &&
-			patientHeartRateHistory.HeartRateHistory[len(patientHeartRateHistory.HeartRateHistory)-1].Timestamp != patientRecord.HeartRate.Timestamp {
-			patientHeartRateHistory.HeartRateHistory = append(patientHeartRateHistory.HeartRateHistory, patientRecord.HeartRate)
+		if len(heartRateHistory) == 0 && patientRecord.HeartRate.Timestamp != 0 {
+			heartRateHistory = append(heartRateHistory, patientRecord.HeartRate)
+		} else if len(heartRateHistory) > 0 &&
+			heartRateHistory[len(heartRateHistory)-1].Timestamp != patientRecord.HeartRate.Timestamp {
+			heartRateHistory = append(heartRateHistory, patientRecord.HeartRate)
 		}
-
+		return nil
+	})
+	if cerr != nil {
+		return nil, cerr
 	}
 
-	// convert the heart rate history struct to json bytes to be returned
-	heartRateHistoryAsBytes, err := json.Marshal(patientHeartRateHistory)
-	if err != nil {
-		return shim.Error("error marshalling iot data in iot history")
+	readings, cerr := t.vitals(stub, patientID, vitalHeartRate, 0, maxTimestamp)
+	if cerr != nil {
+		return nil, cerr
+	}
+	for _, reading := range readings {
+		heartRateHistory = append(heartRateHistory, heartRateMessage{HeartRate: int(reading.Value), Timestamp: reading.Timestamp})
 	}
-	fmt.Printf("- getHeartRateHistory returning:\n%s\n", string(heartRateHistoryAsBytes))
 
-	return shim.Success(heartRateHistoryAsBytes)
+	return heartRateHistory, nil
 }
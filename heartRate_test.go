@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewHeartRateMessage(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "newHeartRateMessage", "P01", "72", "1541440675318")
+	expectError(t, invoke(stub, "newHeartRateMessage", "p99", "72", "1541440675318"), errCodeNotFound)
+
+	expectInvalidArgs(t, "newHeartRateMessage", []argCase{
+		{"too few args", []string{"p01", "72"}, ""},
+		{"empty patientID", []string{"", "72", "1"}, "patientID"},
+		{"bad heartRate", []string{"p01", "fast", "1"}, "heartRate"},
+		{"bad timestamp", []string{"p01", "72", "now"}, "timestamp"},
+	})
+}
+
+func TestGetHeartRateHistory(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "newHeartRateMessage", "p01", "72", "1541440675318")
+	mustInvoke(t, stub, "newHeartRateMessage", "p01", "80", "1541440735318")
+	// other updates to the record must not show up as heart rate messages
+	mustInvoke(t, stub, "newBloodPressure", "p01", "120", "80", "1541440795318")
+	mustInvoke(t, stub, "newHeartRateMessage", "p01", "76", "1541440855318")
+
+	expectGolden(t, "getHeartRateHistory", mustInvoke(t, stub, "getHeartRateHistory", "p01"))
+	expectGolden(t, "getHeartRateHistory-empty", mustInvoke(t, stub, "getHeartRateHistory", "p02"))
+	expectError(t, invoke(stub, "getHeartRateHistory"), errCodeInvalidArgument)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// emrVersion
+// summary: one version of a patient record in the history of its key
+type emrVersion struct {
+	TxID      string
+	Timestamp int    // time of the transaction that wrote the version
+	IsDelete  bool   // the transaction deleted the record, Record is empty
+	Record    EMR    // the record as it was stored
+	Value     []byte // the stored json, nil for a delete
+}
+
+// patchOperation
+// summary: a JSON patch (RFC 6902) operation, with the value it replaced or removed
+type patchOperation struct {
+	Op       string      `json:"op"`   // add, remove or replace
+	Path     string      `json:"path"` // JSON pointer of the changed value
+	Value    interface{} `json:"value,omitempty"`
+	OldValue interface{} `json:"oldValue,omitempty"`
+}
+
+// MarshalJSON writes value for add and replace and oldValue for remove and replace, a null value included
+func (op patchOperation) MarshalJSON() ([]byte, error) {
+	operation := struct {
+		Op       string           `json:"op"`
+		Path     string           `json:"path"`
+		Value    *json.RawMessage `json:"value,omitempty"`
+		OldValue *json.RawMessage `json:"oldValue,omitempty"`
+	}{
+		Op:   op.Op,
+		Path: op.Path,
+	}
+
+	var err error
+	if op.Op == "add" || op.Op == "replace" {
+		if operation.Value, err = rawJSON(op.Value); err != nil {
+			return nil, err
+		}
+	}
+	if op.Op == "remove" || op.Op == "replace" {
+		if operation.OldValue, err = rawJSON(op.OldValue); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(operation)
+}
+
+// rawJSON returns the value as json, a nil value is null
+func rawJSON(value interface{}) (*json.RawMessage, error) {
+	valueAsBytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(valueAsBytes)
+	return &raw, nil
+}
+
+// recordChange
+// summary: the operations that turn one version of a patient record into the next
+type recordChange struct {
+	TxID       string           `json:"txID"`
+	Timestamp  int              `json:"timestamp"`
+	ModifiedBy *caller          `json:"modifiedBy,omitempty"` // identity that submitted the transaction
+	Deleted    bool             `json:"deleted,omitempty"`    // the transaction deleted the record
+	Operations []patchOperation `json:"operations"`
+}
+
+// walkEMRHistory
+// input: patientID and the function to call with each version
+// output: nil or the first error of the history query or of visit
+// summary: calls visit with every version of the patient record oldest first, a delete is passed as an
+// empty record with IsDelete set
+func walkEMRHistory(stub shim.ChaincodeStubInterface, patientID string, visit func(version emrVersion) *chaincodeError) *chaincodeError {
+	resultsIterator, err := stub.GetHistoryForKey(patientID)
+	if err != nil {
+		return newError(errCodeLedger, "unable to get patient history").withDetail("cause", err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return newError(errCodeLedger, "error iterating patient history").withDetail("cause", err.Error())
+		}
+
+		version := emrVersion{
+			TxID:      modification.TxId,
+			Timestamp: modificationMillis(modification),
+			IsDelete:  modification.IsDelete,
+		}
+		if !modification.IsDelete {
+			version.Value = modification.Value
+			if err := json.Unmarshal(modification.Value, &version.Record); err != nil {
+				return newError(errCodeSerialization, "unable to unmarshal patient history").withDetail("cause", err.Error())
+			}
+		}
+
+		if cerr := visit(version); cerr != nil {
+			return cerr
+		}
+	}
+
+	return nil
+}
+
+// getRecordChanges
+// input: patientID, optional JSON pointer to filter on, e.g. /rxList or /insuranceList/0/expDate
+// output: the changes of the patient record oldest first as JSON patch operations
+// summary: the first version is a list of adds and a delete a list of removes. with a filter only the
+// operations on the pointer, inside it or on a value containing it are kept and changes left without any are left out
+func (t *Chaincode) getRecordChanges(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)
+	// "patientID", "fieldPathFilter"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	filter := ""
+	if len(args) > 1 && len(args[1]) > 0 {
+		filter = args[1]
+		if !strings.HasPrefix(filter, "/") {
+			filter = "/" + filter
+		}
+		filter = strings.TrimSuffix(filter, "/")
+	}
+
+	response := struct {
+		PatientID string         `json:"patientID"`
+		Filter    string         `json:"filter,omitempty"`
+		Changes   []recordChange `json:"changes"`
+	}{
+		PatientID: patientID,
+		Filter:    filter,
+		Changes:   []recordChange{},
+	}
+
+	var previous interface{} = map[string]interface{}{}
+	cerr := walkEMRHistory(stub, patientID, func(version emrVersion) *chaincodeError {
+		var current interface{} = map[string]interface{}{}
+		if !version.IsDelete {
+			if err := json.Unmarshal(version.Value, &current); err != nil {
+				return newError(errCodeSerialization, "unable to unmarshal patient history").withDetail("cause", err.Error())
+			}
+		}
+		// who wrote a version is part of the change, not of the record
+		if fields, isObject := current.(map[string]interface{}); isObject {
+			delete(fields, "modifiedBy")
+		}
+
+		operations := []patchOperation{}
+		for _, operation := range diffJSON("", previous, current) {
+			if pathMatches(operation.Path, filter) {
+				operations = append(operations, operation)
+			}
+		}
+		previous = current
+
+		if len(operations) == 0 && !(version.IsDelete && filter == "") {
+			return nil
+		}
+		response.Changes = append(response.Changes, recordChange{
+			TxID:       version.TxID,
+			Timestamp:  version.Timestamp,
+			ModifiedBy: version.Record.ModifiedBy,
+			Deleted:    version.IsDelete,
+			Operations: operations,
+		})
+		return nil
+	})
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal record changes", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// diffJSON
+// input: JSON pointer of the values and two decoded json values
+// output: the operations that turn before into after, objects and arrays are compared member by member
+func diffJSON(path string, before interface{}, after interface{}) []patchOperation {
+	beforeObject, beforeIsObject := before.(map[string]interface{})
+	afterObject, afterIsObject := after.(map[string]interface{})
+	if beforeIsObject && afterIsObject {
+		names := []string{}
+		for name := range beforeObject {
+			names = append(names, name)
+		}
+		for name := range afterObject {
+			if _, seen := beforeObject[name]; !seen {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		operations := []patchOperation{}
+		for _, name := range names {
+			memberPath := path + "/" + escapePointer(name)
+			beforeValue, inBefore := beforeObject[name]
+			afterValue, inAfter := afterObject[name]
+			switch {
+			case !inBefore:
+				operations = append(operations, patchOperation{Op: "add", Path: memberPath, Value: afterValue})
+			case !inAfter:
+				operations = append(operations, patchOperation{Op: "remove", Path: memberPath, OldValue: beforeValue})
+			default:
+				operations = append(operations, diffJSON(memberPath, beforeValue, afterValue)...)
+			}
+		}
+		return operations
+	}
+
+	beforeArray, beforeIsArray := before.([]interface{})
+	afterArray, afterIsArray := after.([]interface{})
+	if beforeIsArray && afterIsArray {
+		operations := []patchOperation{}
+		for i := 0; i < len(beforeArray) && i < len(afterArray); i++ {
+			operations = append(operations, diffJSON(path+"/"+strconv.Itoa(i), beforeArray[i], afterArray[i])...)
+		}
+		for i := len(beforeArray); i < len(afterArray); i++ {
+			operations = append(operations, patchOperation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: afterArray[i]})
+		}
+		// removed from the end so every index is valid when its operation is applied
+		for i := len(beforeArray) - 1; i >= len(afterArray); i-- {
+			operations = append(operations, patchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(i), OldValue: beforeArray[i]})
+		}
+		return operations
+	}
+
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	return []patchOperation{{Op: "replace", Path: path, Value: after, OldValue: before}}
+}
+
+// pathMatches reports whether an operation on path is on, inside or contains the filter pointer
+func pathMatches(path string, filter string) bool {
+	return filter == "" || path == filter || strings.HasPrefix(path, filter+"/") || strings.HasPrefix(filter, path+"/")
+}
+
+// escapePointer escapes a member name for a JSON pointer
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// queries return the function's response but leave state and history as they were
+func TestHistoryStubQuery(t *testing.T) {
+	stub := newTestStub(t)
+
+	response := stub.MockQuery(stub.nextTxID(), [][]byte{[]byte("hack")})
+	expectSuccess(t, response)
+	if value, _ := stub.GetState("hack"); value != nil {
+		t.Errorf("query wrote hack record: %s", string(value))
+	}
+	if iterator, _ := stub.GetHistoryForKey("hack"); iterator.HasNext() {
+		t.Error("query wrote hack history")
+	}
+	expectGolden(t, "getPeople", mustInvoke(t, stub, "getPeople"))
+}
+
+func TestHistoryStub(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "key", "1")
+	putRaw(stub, "key", "2")
+	txID := stub.nextTxID()
+	stub.MockTransactionStart(txID)
+	stub.DelState("key")
+	stub.MockTransactionEnd(txID)
+
+	iterator, err := stub.GetHistoryForKey("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []string{}
+	for iterator.HasNext() {
+		modification, err := iterator.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if modification.IsDelete {
+			values = append(values, "deleted")
+			continue
+		}
+		values = append(values, string(modification.Value))
+	}
+	if len(values) != 3 || values[0] != "1" || values[1] != "2" || values[2] != "deleted" {
+		t.Errorf("unexpected history %v", values)
+	}
+}
+
+// the gateway's copy of the stub is the one go generate makes from stub_test.go
+func TestGatewayStubIsGenerated(t *testing.T) {
+	source, err := ioutil.ReadFile("stub_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := ioutil.ReadFile("gatewayStub.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "// Code generated by go generate from stub_test.go; DO NOT EDIT.\n\n" + strings.NewReplacer(
+		"//go:build !gateway\n", "//go:build gateway\n",
+		"// +build !gateway\n", "// +build gateway\n",
+	).Replace(string(source))
+	if string(generated) != expected {
+		t.Error("gatewayStub.go is out of date, run go generate -tags gateway")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGetRecordChanges(t *testing.T) {
+	stub := newTestStub(t)
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "fillRx", rxFillArgs("ph01", "1541500000000")...)
+
+	expectGolden(t, "getRecordChanges", mustInvoke(t, stub, "getRecordChanges", "P01", "rxList"))
+
+	var response struct{ Changes []recordChange }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRecordChanges", "p01"), &response)
+	if len(response.Changes) != 3 {
+		t.Fatalf("expected the init, insertRx and fillRx versions, got %+v", response.Changes)
+	}
+	for _, operation := range response.Changes[0].Operations {
+		if operation.Op != "add" {
+			t.Errorf("expected the first version to be adds, got %+v", operation)
+		}
+		if operation.Path == "/modifiedBy" {
+			t.Errorf("expected modifiedBy to be left out of the operations")
+		}
+	}
+	if response.Changes[1].ModifiedBy == nil || response.Changes[1].ModifiedBy.License != "doc01" {
+		t.Errorf("expected insertRx to be modified by doc01, got %+v", response.Changes[1].ModifiedBy)
+	}
+
+	// a filter below an added value keeps the add
+	mustUnmarshal(t, mustInvoke(t, stub, "getRecordChanges", "p01", "/rxList/0/refills"), &response)
+	if len(response.Changes) != 2 || response.Changes[0].Operations[0].Path != "/rxList" {
+		t.Errorf("expected the add of rxList and the refill change, got %+v", response.Changes)
+	}
+
+	expectInvalidArgs(t, "getRecordChanges", []argCase{
+		{"too few args", []string{}, ""},
+		{"empty patientID", []string{""}, "patientID"},
+	})
+}
+
+// a deleted record is a change that removes every field and does not break the other history walkers
+func TestGetRecordChangesDelete(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "p09", `{"objType":"emr","id":"p09","firstName":"ann"}`)
+	txID := stub.nextTxID()
+	stub.MockTransactionStart(txID)
+	stub.DelState("p09")
+	stub.MockTransactionEnd(txID)
+	putRaw(stub, "p09", `{"objType":"emr","id":"p09","firstName":"anne"}`)
+
+	var response struct{ Changes []recordChange }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRecordChanges", "p09"), &response)
+	if len(response.Changes) != 3 || !response.Changes[1].Deleted || len(response.Changes[1].Operations) != 3 {
+		t.Fatalf("expected a delete removing 3 fields, got %+v", response.Changes)
+	}
+	if operation := response.Changes[2].Operations[0]; operation.Op != "add" || operation.Path != "/firstName" {
+		t.Errorf("expected the record to be added again, got %+v", operation)
+	}
+
+	expectSuccess(t, invoke(stub, "getHeartRateHistory", "p09"))
+	expectSuccess(t, invoke(stub, "getRxHistoryOfPatient", "p09"))
+}
+
+func TestDiffJSON(t *testing.T) {
+	cases := []struct {
+		name     string
+		before   interface{}
+		after    interface{}
+		expected []patchOperation
+	}{
+		{"equal", map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 1.0}, []patchOperation{}},
+		{"replace", map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 2.0},
+			[]patchOperation{{Op: "replace", Path: "/a", Value: 2.0, OldValue: 1.0}}},
+		{"escaped names", map[string]interface{}{}, map[string]interface{}{"a/b~c": true},
+			[]patchOperation{{Op: "add", Path: "/a~1b~0c", Value: true}}},
+		{"array grows", map[string]interface{}{"l": []interface{}{"x"}}, map[string]interface{}{"l": []interface{}{"y", "z"}},
+			[]patchOperation{
+				{Op: "replace", Path: "/l/0", Value: "y", OldValue: "x"},
+				{Op: "add", Path: "/l/1", Value: "z"},
+			}},
+		{"array shrinks from the end", []interface{}{"x", "y", "z"}, []interface{}{"x"},
+			[]patchOperation{
+				{Op: "remove", Path: "/2", OldValue: "z"},
+				{Op: "remove", Path: "/1", OldValue: "y"},
+			}},
+		{"null values", map[string]interface{}{"a": nil, "c": nil}, map[string]interface{}{"a": 1.0, "b": nil},
+			[]patchOperation{
+				{Op: "replace", Path: "/a", Value: 1.0},
+				{Op: "add", Path: "/b"},
+				{Op: "remove", Path: "/c"},
+			}},
+	}
+
+	for _, c := range cases {
+		operations := diffJSON("", c.before, c.after)
+
+		if len(operations) == 0 && len(c.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(operations, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, operations)
+		}
+	}
+}
+
+// an explicit null is a value of the patch, not a missing one
+func TestPatchOperationNull(t *testing.T) {
+	operations := diffJSON("", map[string]interface{}{"a": nil, "c": nil}, map[string]interface{}{"a": 1.0, "b": nil})
+	operationsAsBytes, err := json.Marshal(operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"op":"replace","path":"/a","value":1,"oldValue":null},{"op":"add","path":"/b","value":null},{"op":"remove","path":"/c","oldValue":null}]`
+	if string(operationsAsBytes) != expected {
+		t.Errorf("expected %s, got %s", expected, operationsAsBytes)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HL7 v2 date/time formats, the most precise first. a time zone offset may follow any of them
+var hl7DateTimeFormats = []string{"20060102150405", "200601021504", "2006010215", "20060102"}
+
+// hl7Segment
+// summary: one segment of an HL7 v2 message.
+// Fields[0] is the segment name so Fields[n] is field n, for MSH Fields[1] is the field separator
+type hl7Segment struct {
+	Fields []string
+}
+
+// hl7Message
+// summary: a parsed HL7 v2 message with the encoding characters declared in its MSH segment
+type hl7Message struct {
+	Segments           []hl7Segment
+	componentSeparator string
+	repetitionSep      string
+	escapeCharacter    string
+	subcomponentSep    string
+	fieldSeparator     string
+}
+
+// parseHL7 splits an HL7 v2 message into segments and fields
+// segments may be separated by carriage returns, newlines or both
+func parseHL7(message string) (*hl7Message, error) {
+	message = strings.Replace(message, "\r\n", "\r", -1)
+	message = strings.Replace(message, "\n", "\r", -1)
+	message = strings.TrimSpace(message)
+
+	if !strings.HasPrefix(message, "MSH") || len(message) < 8 {
+		return nil, errors.New("message must start with an MSH segment")
+	}
+
+	// MSH-1 is the field separator and MSH-2 the component, repetition, escape and subcomponent characters
+	parsed := &hl7Message{
+		fieldSeparator:     message[3:4],
+		componentSeparator: message[4:5],
+		repetitionSep:      message[5:6],
+		escapeCharacter:    message[6:7],
+		subcomponentSep:    message[7:8],
+	}
+
+	for _, line := range strings.Split(message, "\r") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, parsed.fieldSeparator)
+		if len(fields[0]) != 3 {
+			return nil, errors.New("invalid segment name: " + fields[0])
+		}
+		// MSH-1 is the separator itself, so insert it to keep field numbers aligned
+		if fields[0] == "MSH" {
+			fields = append([]string{"MSH", parsed.fieldSeparator}, fields[1:]...)
+		}
+		parsed.Segments = append(parsed.Segments, hl7Segment{Fields: fields})
+	}
+
+	return parsed, nil
+}
+
+// name returns the segment name, e.g. PID
+func (s hl7Segment) name() string {
+	return s.Fields[0]
+}
+
+// field returns field n of the segment as sent, or empty if it is not present
+func (s hl7Segment) field(n int) string {
+	if n < len(s.Fields) {
+		return s.Fields[n]
+	}
+	return ""
+}
+
+// component returns component c (starting at 1) of the first repetition of field n, unescaped
+func (m *hl7Message) component(segment hl7Segment, n int, c int) string {
+	value := strings.Split(segment.field(n), m.repetitionSep)[0]
+	components := strings.Split(value, m.componentSeparator)
+	if c > len(components) {
+		return ""
+	}
+	return m.unescape(strings.Split(components[c-1], m.subcomponentSep)[0])
+}
+
+// unescape replaces the HL7 escape sequences for the encoding characters
+func (m *hl7Message) unescape(value string) string {
+	if !strings.Contains(value, m.escapeCharacter) {
+		return value
+	}
+	e := m.escapeCharacter
+	return strings.NewReplacer(
+		e+"F"+e, m.fieldSeparator,
+		e+"S"+e, m.componentSeparator,
+		e+"R"+e, m.repetitionSep,
+		e+"T"+e, m.subcomponentSep,
+		e+"E"+e, m.escapeCharacter,
+	).Replace(value)
+}
+
+// segment returns the first segment with the name
+func (m *hl7Message) segment(name string) (hl7Segment, bool) {
+	for _, segment := range m.Segments {
+		if segment.name() == name {
+			return segment, true
+		}
+	}
+	return hl7Segment{}, false
+}
+
+// messageType returns MSH-9 as type^trigger, e.g. ADT^A04
+func (m *hl7Message) messageType() string {
+	msh := m.Segments[0]
+	return m.component(msh, 9, 1) + "^" + m.component(msh, 9, 2)
+}
+
+// controlID returns MSH-10, the id the sender matches the ACK with
+func (m *hl7Message) controlID() string {
+	return m.component(m.Segments[0], 10, 1)
+}
+
+// parseHL7DateTime converts an HL7 DTM value to a millisecond timestamp, UTC unless an offset is given
+func parseHL7DateTime(value string) (int, error) {
+	offset := ""
+	if index := strings.IndexAny(value, "+-"); index >= 0 {
+		value, offset = value[:index], value[index:]
+	}
+	// fractional seconds are dropped
+	if index := strings.Index(value, "."); index >= 0 {
+		value = value[:index]
+	}
+
+	for _, format := range hl7DateTimeFormats {
+		if len(value) != len(format) {
+			continue
+		}
+		layout, parsedValue := format, value
+		if offset != "" {
+			layout, parsedValue = format+"-0700", value+offset
+		}
+		parsed, err := time.Parse(layout, parsedValue)
+		if err != nil {
+			break
+		}
+		return int(parsed.UnixNano() / int64(time.Millisecond)), nil
+	}
+
+	return 0, errors.New("invalid HL7 date/time: " + value + offset)
+}
+
+// formatHL7DateTime converts a time to an HL7 DTM value in UTC
+func formatHL7DateTime(t time.Time) string {
+	return t.UTC().Format("20060102150405") + "+0000"
+}
+
+// hl7SegmentResult
+// summary: whether one segment of an ingested message was applied and with which function
+type hl7SegmentResult struct {
+	Segment  string `json:"segment"`            // segment name, e.g. OBX
+	Index    int    `json:"index"`              // position of the segment in the message, MSH is 1
+	Function string `json:"function,omitempty"` // chaincode function the segment was applied with
+	Error    string `json:"error,omitempty"`    // why the segment was rejected
+}
+
+// hl7Ack
+// summary: result of ingestHL7, an HL7 ACK plus the accepted and rejected segments as json
+type hl7Ack struct {
+	MessageControlID string             `json:"messageControlID"`
+	MessageType      string             `json:"messageType"`
+	AckCode          string             `json:"ackCode"` // AA all applied, AE some rejected, AR message rejected
+	Ack              string             `json:"ack"`     // the ACK message to return to the sender
+	Accepted         []hl7SegmentResult `json:"accepted"`
+	Rejected         []hl7SegmentResult `json:"rejected"`
+}
+
+// buildAck fills in the ack code and the ACK message for the results
+// the ACK's MSH swaps the sending and receiving application and facility of the original message
+func (m *hl7Message) buildAck(ack *hl7Ack, ackControlID string, timestamp time.Time, errorText string) {
+	switch {
+	case errorText != "":
+		ack.AckCode = "AR"
+	case len(ack.Rejected) > 0:
+		ack.AckCode = "AE"
+	default:
+		ack.AckCode = "AA"
+	}
+
+	msh := m.Segments[0]
+	fs := m.fieldSeparator
+	encodingCharacters := m.componentSeparator + m.repetitionSep + m.escapeCharacter + m.subcomponentSep
+	segments := []string{
+		strings.Join([]string{"MSH", encodingCharacters, msh.field(5), msh.field(6), msh.field(3), msh.field(4),
+			formatHL7DateTime(timestamp), "", "ACK" + m.componentSeparator + m.component(msh, 9, 2) + m.componentSeparator + "ACK",
+			ackControlID, msh.field(11), msh.field(12)}, fs),
+		strings.Join([]string{"MSA", ack.AckCode, ack.MessageControlID, m.escape(errorText)}, fs),
+	}
+
+	// one ERR per rejected segment with its location and the reason
+	for _, rejected := range ack.Rejected {
+		location := rejected.Segment + m.componentSeparator + strconv.Itoa(rejected.Index)
+		code := "207" + m.componentSeparator + "Application internal error" + m.componentSeparator + "HL70357"
+		segments = append(segments, strings.Join([]string{"ERR", "", location, code, "E", "", "", "", m.escape(rejected.Error)}, fs))
+	}
+
+	ack.Ack = strings.Join(segments, "\r")
+}
+
+// escape replaces the encoding characters in free text with HL7 escape sequences
+func (m *hl7Message) escape(value string) string {
+	e := m.escapeCharacter
+	return strings.NewReplacer(
+		m.escapeCharacter, e+"E"+e,
+		m.fieldSeparator, e+"F"+e,
+		m.componentSeparator, e+"S"+e,
+		m.repetitionSep, e+"R"+e,
+		m.subcomponentSep, e+"T"+e,
+	).Replace(value)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ingestHL7
+// input: one HL7 v2 message
+// output: hl7Ack with the ACK message and the accepted and rejected segments
+// summary: applies ADT^A04 (register patient, initPerson), ADT^A08 (update patient, updatePerson),
+// RDE^O11 (new order, insertRx, or dispense when an RXD segment is present, fillRx) and
+// ORU^R01 vitals (heart rate, newHeartRateMessage, blood pressure, newBloodPressure, and the other vital signs, newVital).
+// segments are applied one by one, rejected ones are listed and the rest are kept (ACK code AE)
+func (t *Chaincode) ingestHL7(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "message"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("message", "1st argument must be a non empty string")
+	}
+
+	message, err := parseHL7(args[0])
+	if err != nil {
+		return newError(errCodeInvalidArgument, "message is not HL7 v2: "+err.Error()).withField("message").response()
+	}
+
+	ack := hl7Ack{
+		MessageControlID: message.controlID(),
+		MessageType:      message.messageType(),
+		Accepted:         []hl7SegmentResult{},
+		Rejected:         []hl7SegmentResult{},
+	}
+
+	// segments in one message usually update the same patient record, later ones must see earlier writes
+	ingestStub := newTxStub(stub)
+
+	errorText := ""
+	switch ack.MessageType {
+	case "ADT^A04", "ADT^A08":
+		t.ingestHL7Patient(ingestStub, message, &ack)
+	case "RDE^O11":
+		t.ingestHL7Order(ingestStub, message, &ack)
+	case "ORU^R01":
+		t.ingestHL7Vitals(ingestStub, message, &ack)
+	default:
+		errorText = "unsupported message type: " + ack.MessageType
+	}
+
+	// list the results in message order, blood pressure pairs are applied after the other OBX segments
+	sort.SliceStable(ack.Accepted, func(i, j int) bool { return ack.Accepted[i].Index < ack.Accepted[j].Index })
+	sort.SliceStable(ack.Rejected, func(i, j int) bool { return ack.Rejected[i].Index < ack.Rejected[j].Index })
+
+	// the ACK is stamped with the transaction time and id so every peer builds the same ACK
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return ledgerError("unable to get transaction timestamp", err)
+	}
+	txTime, err := ptypes.Timestamp(txTimestamp)
+	if err != nil {
+		return ledgerError("invalid transaction timestamp", err)
+	}
+	message.buildAck(&ack, stub.GetTxID(), txTime, errorText)
+
+	ackAsBytes, err := json.Marshal(ack)
+	if err != nil {
+		return serializationError("unable to marshal ack", err)
+	}
+
+	return shim.Success(ackAsBytes)
+}
+
+// hl7Result records the outcome of applying a segment with a chaincode function
+func hl7Result(ack *hl7Ack, segment hl7Segment, index int, function string, response pb.Response) {
+	result := hl7SegmentResult{Segment: segment.name(), Index: index + 1, Function: function}
+	if response.Status != shim.OK {
+		cerr := responseError(response)
+		result.Error = cerr.Code + ": " + cerr.Message
+		ack.Rejected = append(ack.Rejected, result)
+		return
+	}
+	ack.Accepted = append(ack.Accepted, result)
+}
+
+// hl7Reject records a segment that could not be mapped to a chaincode function
+func hl7Reject(ack *hl7Ack, segment hl7Segment, index int, reason string) {
+	ack.Rejected = append(ack.Rejected, hl7SegmentResult{Segment: segment.name(), Index: index + 1, Error: reason})
+}
+
+// hl7PatientID returns the patientID in PID-3
+func hl7PatientID(message *hl7Message) (string, bool) {
+	pid, found := message.segment("PID")
+	if !found {
+		return "", false
+	}
+	patientID := strings.ToLower(message.component(pid, 3, 1))
+	return patientID, patientID != ""
+}
+
+// ingestHL7Patient registers (A04) or updates (A08) the patient in the PID segment
+func (t *Chaincode) ingestHL7Patient(stub shim.ChaincodeStubInterface, message *hl7Message, ack *hl7Ack) {
+	for index, pid := range message.Segments {
+		if pid.name() != "PID" {
+			continue
+		}
+
+		// PID-7 is YYYYMMDD, the EMR stores MM/DD/YYYY
+		dob := ""
+		if birthDate := message.component(pid, 7, 1); len(birthDate) >= 8 {
+			dob = birthDate[4:6] + "/" + birthDate[6:8] + "/" + birthDate[0:4]
+		}
+
+		// PID-11 street^other^city^state^zip becomes "street city, state, zip"
+		address := strings.TrimSpace(message.component(pid, 11, 1) + " " + message.component(pid, 11, 3))
+		if state := message.component(pid, 11, 4); state != "" {
+			address += ", " + state
+		}
+		if zip := message.component(pid, 11, 5); zip != "" {
+			address += ", " + zip
+		}
+
+		// PID-13 carries the number in component 1, or area code and number in components 6 and 7
+		phone := message.component(pid, 13, 1)
+		if phone == "" && message.component(pid, 13, 7) != "" {
+			local := message.component(pid, 13, 7)
+			if len(local) == 7 {
+				local = local[:3] + "-" + local[3:]
+			}
+			phone = message.component(pid, 13, 6) + "-" + local
+		}
+
+		personArgs := []string{
+			strings.ToLower(message.component(pid, 3, 1)),
+			message.component(pid, 5, 2),
+			message.component(pid, 5, 1),
+			dob,
+			address,
+			phone,
+		}
+
+		if message.messageType() == "ADT^A04" {
+			hl7Result(ack, pid, index, "initPerson", t.initPerson(stub, personArgs))
+		} else {
+			hl7Result(ack, pid, index, "updatePerson", t.updatePerson(stub, personArgs))
+		}
+	}
+
+	if len(ack.Accepted)+len(ack.Rejected) == 0 {
+		hl7Reject(ack, message.Segments[0], 0, "message has no PID segment")
+	}
+}
+
+// ingestHL7Order adds the order in the ORC and RXE segments with insertRx,
+// or records the dispense in an RXD segment with fillRx
+func (t *Chaincode) ingestHL7Order(stub shim.ChaincodeStubInterface, message *hl7Message, ack *hl7Ack) {
+	patientID, found := hl7PatientID(message)
+	if !found {
+		hl7Reject(ack, message.Segments[0], 0, "message has no PID segment with a patient id")
+		return
+	}
+
+	// each ORC starts an order group, its RXE and RXD follow it
+	var orc, rxe hl7Segment
+	orcIndex := -1
+	for index, segment := range message.Segments {
+		switch segment.name() {
+		case "ORC":
+			orc, orcIndex, rxe = segment, index, hl7Segment{}
+		case "RXE":
+			rxe = segment
+			if orcIndex < 0 {
+				hl7Reject(ack, segment, index, "RXE must follow an ORC segment")
+				continue
+			}
+			if message.component(orc, 1, 1) != "NW" {
+				continue
+			}
+			// ORC-1 NW is a new order
+			timestamp, err := parseHL7DateTime(message.component(orc, 9, 1))
+			if err != nil {
+				hl7Reject(ack, segment, index, "ORC-9 "+err.Error())
+				continue
+			}
+			expDate := 0
+			if end := message.component(rxe, 1, 5); end != "" {
+				if expDate, err = parseHL7DateTime(end); err != nil {
+					hl7Reject(ack, segment, index, "RXE-1.5 "+err.Error())
+					continue
+				}
+			}
+			doctor := strings.TrimSpace(message.component(orc, 12, 3) + " " + message.component(orc, 12, 2))
+
+			hl7Result(ack, segment, index, "insertRx", t.insertRx(stub, []string{
+				patientID,
+				message.component(orc, 2, 1),
+				strconv.Itoa(timestamp),
+				doctor,
+				message.component(orc, 12, 1),
+				hl7CodedText(message, rxe, 2),
+				hl7Number(message.component(rxe, 12, 1)),
+				hl7Number(message.component(rxe, 10, 1)),
+				strconv.Itoa(expDate),
+				"prescribed",
+			}))
+		case "RXD":
+			if orcIndex < 0 {
+				hl7Reject(ack, segment, index, "RXD must follow an ORC segment")
+				continue
+			}
+			// RXD is a dispense of the order placed in ORC-2
+			timestamp, err := parseHL7DateTime(message.component(segment, 3, 1))
+			if err != nil {
+				hl7Reject(ack, segment, index, "RXD-3 "+err.Error())
+				continue
+			}
+			expDate := 0
+			if end := message.component(rxe, 1, 5); end != "" {
+				if expDate, err = parseHL7DateTime(end); err != nil {
+					hl7Reject(ack, segment, index, "RXE-1.5 "+err.Error())
+					continue
+				}
+			}
+			pharmacist := strings.TrimSpace(message.component(segment, 10, 3) + " " + message.component(segment, 10, 2))
+
+			hl7Result(ack, segment, index, "fillRx", t.fillRx(stub, []string{
+				patientID,
+				message.component(orc, 2, 1),
+				strconv.Itoa(timestamp),
+				pharmacist,
+				message.component(segment, 10, 1),
+				hl7CodedText(message, segment, 2),
+				hl7Number(message.component(segment, 8, 1)),
+				strconv.Itoa(expDate),
+				"filled",
+			}))
+		}
+	}
+
+	if len(ack.Accepted)+len(ack.Rejected) == 0 {
+		hl7Reject(ack, message.Segments[0], 0, "message has no new order (ORC-1 NW with RXE) or dispense (RXD)")
+	}
+}
+
+// ingestHL7Vitals adds the LOINC coded heart rate and blood pressure OBX segments.
+// a systolic and a diastolic OBX observed at the same time are one blood pressure reading
+func (t *Chaincode) ingestHL7Vitals(stub shim.ChaincodeStubInterface, message *hl7Message, ack *hl7Ack) {
+	patientID, found := hl7PatientID(message)
+	if !found {
+		hl7Reject(ack, message.Segments[0], 0, "message has no PID segment with a patient id")
+		return
+	}
+
+	// OBX-14 is the observation time, OBR-7 is used for OBX segments without one
+	observationTime := ""
+	type pressure struct {
+		index, value int
+		segment      hl7Segment
+	}
+	systolic := map[int]pressure{}
+	diastolic := map[int]pressure{}
+	timestamps := []int{}
+
+	for index, segment := range message.Segments {
+		if segment.name() == "OBR" {
+			observationTime = message.component(segment, 7, 1)
+			continue
+		}
+		if segment.name() != "OBX" {
+			continue
+		}
+
+		if message.component(segment, 3, 3) != "LN" {
+			hl7Reject(ack, segment, index, "OBX-3 must be LOINC coded (LN)")
+			continue
+		}
+		value, err := strconv.ParseFloat(message.component(segment, 5, 1), 64)
+		if err != nil || message.component(segment, 2, 1) != "NM" {
+			hl7Reject(ack, segment, index, "OBX-5 must be a numeric (NM) value")
+			continue
+		}
+		observedAt := message.component(segment, 14, 1)
+		if observedAt == "" {
+			observedAt = observationTime
+		}
+		timestamp, err := parseHL7DateTime(observedAt)
+		if err != nil {
+			hl7Reject(ack, segment, index, "OBX-14 "+err.Error())
+			continue
+		}
+
+		code, unit := message.component(segment, 3, 1), message.component(segment, 6, 1)
+		switch code {
+		case loincHeartRate:
+			if unit != "" && unit != "/min" {
+				hl7Reject(ack, segment, index, "OBX-6 heart rate must be in /min")
+				continue
+			}
+			hl7Result(ack, segment, index, "newHeartRateMessage", t.newHeartRateMessage(stub, []string{
+				patientID, strconv.Itoa(int(value + 0.5)), strconv.Itoa(timestamp),
+			}))
+		case loincSystolic, loincDiastolic:
+			if unit != "" && unit != "mm[Hg]" {
+				hl7Reject(ack, segment, index, "OBX-6 blood pressure must be in mm[Hg]")
+				continue
+			}
+			reading := pressure{index: index, value: int(value + 0.5), segment: segment}
+			if _, seen := systolic[timestamp]; !seen {
+				if _, seen := diastolic[timestamp]; !seen {
+					timestamps = append(timestamps, timestamp)
+				}
+			}
+			if code == loincSystolic {
+				systolic[timestamp] = reading
+			} else {
+				diastolic[timestamp] = reading
+			}
+		default:
+			// any other vital sign in the registry measured as a single value
+			vt, found := lookupVitalTypeByCode(code)
+			if !found || len(vt.Components) > 0 {
+				hl7Reject(ack, segment, index, "OBX-3 "+code+" is not a supported vital sign")
+				continue
+			}
+			if unit != "" && unit != vt.Unit {
+				hl7Reject(ack, segment, index, "OBX-6 "+vt.Name+" must be in "+vt.Unit)
+				continue
+			}
+			hl7Result(ack, segment, index, "newVital", t.newVital(stub, []string{
+				patientID, vt.Name, strconv.Itoa(timestamp), strconv.FormatFloat(value, 'f', -1, 64),
+			}))
+		}
+	}
+
+	// blood pressure readings are applied once both halves are known
+	for _, timestamp := range timestamps {
+		high, hasHigh := systolic[timestamp]
+		low, hasLow := diastolic[timestamp]
+		if !hasHigh || !hasLow {
+			unpaired := high
+			if !hasHigh {
+				unpaired = low
+			}
+			hl7Reject(ack, unpaired.segment, unpaired.index, "blood pressure needs a systolic ("+loincSystolic+") and diastolic ("+loincDiastolic+") OBX with the same time")
+			continue
+		}
+		response := t.newBloodPressure(stub, []string{patientID, strconv.Itoa(high.value), strconv.Itoa(low.value), strconv.Itoa(timestamp)})
+		hl7Result(ack, high.segment, high.index, "newBloodPressure", response)
+		hl7Result(ack, low.segment, low.index, "newBloodPressure", response)
+	}
+
+	if len(ack.Accepted)+len(ack.Rejected) == 0 {
+		hl7Reject(ack, message.Segments[0], 0, "message has no OBX segments")
+	}
+}
+
+// hl7CodedText returns the text of a coded element (identifier^text^system), or the identifier
+func hl7CodedText(message *hl7Message, segment hl7Segment, n int) string {
+	if text := message.component(segment, n, 2); text != "" {
+		return text
+	}
+	return message.component(segment, n, 1)
+}
+
+// hl7Number returns the value or 0 for an empty numeric field
+func hl7Number(value string) string {
+	if value == "" {
+		return "0"
+	}
+	return value
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// hl7 joins segments with the carriage return HL7 uses as the segment separator
+func hl7(segments ...string) string {
+	return strings.Join(segments, "\r")
+}
+
+const hl7MSH = "MSH|^~\\&|EPIC|HOSP|EMRCC|BC|20181105120000||"
+
+func TestIngestHL7Patient(t *testing.T) {
+	stub := newTestStub(t)
+
+	register := hl7(hl7MSH+"ADT^A04^ADT_A01|MSG0001|P|2.5",
+		"EVN|A04|20181105120000",
+		"PID|1||P03^^^HOSP^MR||Roe^Jane||19900202|F|||1 Main St^^Springfield^IL^62701||^PRN^PH^^^222^2222222")
+	expectGolden(t, "ingestHL7-A04", mustInvoke(t, stub, "ingestHL7", register))
+	expectGolden(t, "ingestHL7-A04-person", mustInvoke(t, stub, "getPerson", "p03"))
+
+	// registering the patient again is rejected, the update is applied
+	var ack hl7Ack
+	json.Unmarshal(mustInvoke(t, stub, "ingestHL7", register), &ack)
+	if ack.AckCode != "AE" || len(ack.Rejected) != 1 || !strings.HasPrefix(ack.Rejected[0].Error, errCodeAlreadyExists) {
+		t.Errorf("expected the second A04 to be rejected, got %+v", ack)
+	}
+
+	update := hl7(hl7MSH+"ADT^A08^ADT_A01|MSG0002|P|2.5",
+		"PID|1||p03||Roe^Janet||19900202|F|||2 Main St^^Springfield^IL^62701||333-333-3333")
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "ingestHL7", update)
+	expectGolden(t, "ingestHL7-A08-person", mustInvoke(t, stub, "getPerson", "p03"))
+}
+
+func TestIngestHL7Order(t *testing.T) {
+	stub := newTestStub(t)
+
+	order := hl7(hl7MSH+"RDE^O11^RDE_O11|MSG0003|P|2.5",
+		"PID|1||p01",
+		"ORC|NW|rx01|||||||20181105175755|||doc01^Smith^Dr",
+		"RXE|^^^20181105^20191105|RX123^amoxicillin^LOCAL||||||||30||2")
+	expectGolden(t, "ingestHL7-RDE", mustInvoke(t, stub, "ingestHL7", order))
+
+	dispense := hl7(hl7MSH+"RDE^O11^RDE_O11|MSG0004|P|2.5",
+		"PID|1||p01",
+		"ORC|RE|rx01",
+		"RXE|^^^20181105^20191105|RX123^amoxicillin^LOCAL",
+		"RXD|1|RX123^amoxicillin^LOCAL|20181106090000|30||||1||ph01^Jones^Pat")
+	// the dispense is sent by the pharmacy in RXD-10
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	expectGolden(t, "ingestHL7-RDE-dispense", mustInvoke(t, stub, "ingestHL7", dispense))
+	expectGolden(t, "ingestHL7-RDE-rx", mustInvoke(t, stub, "getRxForPatient", "p01"))
+}
+
+func TestIngestHL7Vitals(t *testing.T) {
+	stub := newTestStub(t)
+
+	vitals := hl7(hl7MSH+"ORU^R01^ORU_R01|MSG0005|P|2.5",
+		"PID|1||p01",
+		"OBR|1|||85354-9^Blood pressure panel^LN|||20181105180000",
+		"OBX|1|NM|8867-4^Heart rate^LN||72|/min|||||F",
+		"OBX|2|NM|8480-6^Systolic^LN||120|mm[Hg]|||||F",
+		"OBX|3|NM|8462-4^Diastolic^LN||80|mm[Hg]|||||F",
+		"OBX|4|NM|8480-6^Systolic^LN||118|mm[Hg]|||||F|||20181105181500",
+		"OBX|5|NM|2093-3^Cholesterol^LN||180|mg/dL|||||F",
+		"OBX|6|ST|8867-4^Heart rate^LN||fast|/min|||||F",
+		"OBX|7|NM|2339-0^Glucose^LN||95|mg/dL|||||F")
+	expectGolden(t, "ingestHL7-ORU", mustInvoke(t, stub, "ingestHL7", vitals))
+	expectGolden(t, "ingestHL7-ORU-heartRate", mustInvoke(t, stub, "getHeartRateHistory", "p01"))
+	expectGolden(t, "ingestHL7-ORU-bloodPressure", mustInvoke(t, stub, "getBloodPressureHistory", "p01"))
+	expectGolden(t, "ingestHL7-ORU-glucose", mustInvoke(t, stub, "getVitals", "p01", "glucose"))
+}
+
+func TestIngestHL7Rejected(t *testing.T) {
+	stub := newTestStub(t)
+
+	// unsupported message types are rejected without writes
+	var ack hl7Ack
+	json.Unmarshal(mustInvoke(t, stub, "ingestHL7", hl7(hl7MSH+"ADT^A03^ADT_A03|MSG0006|P|2.5", "PID|1||p01")), &ack)
+	if ack.AckCode != "AR" || !strings.Contains(ack.Ack, "MSA|AR|MSG0006|unsupported message type: ADT\\S\\A03") {
+		t.Errorf("expected AR, got %+v", ack)
+	}
+
+	// a message for an unknown patient is acknowledged with an error
+	json.Unmarshal(mustInvoke(t, stub, "ingestHL7", hl7(hl7MSH+"ORU^R01^ORU_R01|MSG0007|P|2.5",
+		"PID|1||p99", "OBX|1|NM|8867-4^Heart rate^LN||72|/min|||||F|||20181105180000")), &ack)
+	if ack.AckCode != "AE" || len(ack.Rejected) != 1 || !strings.HasPrefix(ack.Rejected[0].Error, errCodeNotFound) {
+		t.Errorf("expected AE with NOT_FOUND, got %+v", ack)
+	}
+
+	expectInvalidArgs(t, "ingestHL7", []argCase{
+		{"no args", nil, ""},
+		{"empty message", []string{""}, "message"},
+		{"not hl7", []string{`{"resourceType": "Bundle"}`}, "message"},
+	})
+}
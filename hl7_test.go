@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHL7(t *testing.T) {
+	message, err := parseHL7("MSH|^~\\&|EPIC|HOSP|EMRCC|BC|20181105120000||ADT^A04^ADT_A01|MSG0001|P|2.5\n" +
+		"PID|1||P03^^^HOSP^MR||Roe^Jane||19900202|F|||1 Main St^^Springfield^IL^62701||222-222-2222~333-333-3333\n" +
+		"NTE|1||tab \\T\\ note \\F\\ with \\S\\ escapes\\E\\\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := message.messageType(); got != "ADT^A04" {
+		t.Errorf("messageType: expected ADT^A04, got %s", got)
+	}
+	if got := message.controlID(); got != "MSG0001" {
+		t.Errorf("controlID: expected MSG0001, got %s", got)
+	}
+
+	pid, _ := message.segment("PID")
+	for _, c := range []struct {
+		field, component int
+		expected         string
+	}{
+		{3, 1, "P03"},
+		{3, 4, "HOSP"},
+		{5, 2, "Jane"},
+		{11, 3, "Springfield"},
+		{13, 1, "222-222-2222"}, // first repetition
+		{30, 1, ""},
+	} {
+		if got := message.component(pid, c.field, c.component); got != c.expected {
+			t.Errorf("PID-%d.%d: expected %q, got %q", c.field, c.component, c.expected, got)
+		}
+	}
+
+	nte, _ := message.segment("NTE")
+	if got := message.component(nte, 3, 1); got != "tab & note | with ^ escapes\\" {
+		t.Errorf("unescape: got %q", got)
+	}
+	if got := message.escape("a|b^c\\d"); got != "a\\F\\b\\S\\c\\E\\d" {
+		t.Errorf("escape: got %q", got)
+	}
+
+	for _, invalid := range []string{"", "PID|1", "MSH|^~\\&\rPIDX|1"} {
+		if _, err := parseHL7(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseHL7DateTime(t *testing.T) {
+	for value, expected := range map[string]time.Time{
+		"20181105":              time.Date(2018, 11, 5, 0, 0, 0, 0, time.UTC),
+		"201811051730":          time.Date(2018, 11, 5, 17, 30, 0, 0, time.UTC),
+		"20181105173055":        time.Date(2018, 11, 5, 17, 30, 55, 0, time.UTC),
+		"20181105173055.318":    time.Date(2018, 11, 5, 17, 30, 55, 0, time.UTC),
+		"20181105123055-0500":   time.Date(2018, 11, 5, 17, 30, 55, 0, time.UTC),
+		"20181105183055.1+0100": time.Date(2018, 11, 5, 17, 30, 55, 0, time.UTC),
+	} {
+		got, err := parseHL7DateTime(value)
+		if err != nil {
+			t.Errorf("%s: %v", value, err)
+			continue
+		}
+		if want := int(expected.UnixNano() / int64(time.Millisecond)); got != want {
+			t.Errorf("%s: expected %d, got %d", value, want, got)
+		}
+	}
+
+	for _, invalid := range []string{"", "2018", "20181305", "yesterday"} {
+		if _, err := parseHL7DateTime(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// attributes read from the caller's enrollment certificate, set when the user is registered with the CA
+const (
+	attrRole      = "role"      // one of the role constants
+	attrLicense   = "license"   // license number of a doctor or pharmacist
+	attrPatientID = "patientID" // patientID of a patient
+	attrPharmacy  = "pharmacy"  // license of the pharmacy a pharmacist works for
+	attrPlans     = "plans"     // comma separated insurance plans an insurer administers
+)
+
+// callerAttributes are the attributes getCaller reads, in the order the local gateway names its identities by
+var callerAttributes = []string{attrRole, attrLicense, attrPatientID, attrPharmacy, attrPlans}
+
+// roles of the callers
+const (
+	roleAdmin      = "admin"
+	roleDoctor     = "doctor"
+	rolePharmacist = "pharmacist"
+	rolePatient    = "patient"
+	roleInsurer    = "insurer"
+)
+
+// caller
+// summary: identity of the client that submitted the transaction
+type caller struct {
+	ID        string `json:"id"` // unique id of the certificate, from cid.GetID
+	MSPID     string `json:"mspID"`
+	Role      string `json:"role,omitempty"`
+	License   string `json:"license,omitempty"`
+	PatientID string `json:"patientID,omitempty"`
+	Pharmacy  string `json:"pharmacy,omitempty"`
+	Plans     string `json:"plans,omitempty"`
+}
+
+// getCaller
+// input: stub of the transaction
+// output: the caller's identity and attributes or an error if the creator has no X.509 identity
+func getCaller(stub shim.ChaincodeStubInterface) (caller, *chaincodeError) {
+	identity, err := cid.New(stub)
+	if err != nil {
+		return caller{}, newError(errCodePermissionDenied, "caller identity is not available").withDetail("cause", err.Error())
+	}
+
+	id, err := identity.GetID()
+	if err != nil {
+		return caller{}, newError(errCodePermissionDenied, "caller id is not available").withDetail("cause", err.Error())
+	}
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return caller{}, newError(errCodePermissionDenied, "caller msp id is not available").withDetail("cause", err.Error())
+	}
+
+	c := caller{ID: id, MSPID: mspID}
+	c.Role, _, _ = identity.GetAttributeValue(attrRole)
+	c.License, _, _ = identity.GetAttributeValue(attrLicense)
+	c.PatientID, _, _ = identity.GetAttributeValue(attrPatientID)
+	c.PatientID = strings.ToLower(c.PatientID)
+	c.Pharmacy, _, _ = identity.GetAttributeValue(attrPharmacy)
+	c.Plans, _, _ = identity.GetAttributeValue(attrPlans)
+
+	return c, nil
+}
+
+// requireRole
+// input: stub of the transaction and the roles allowed to call the function
+// output: the caller or a PERMISSION_DENIED error if the caller has none of the roles
+func requireRole(stub shim.ChaincodeStubInterface, roles ...string) (caller, *chaincodeError) {
+	c, cerr := getCaller(stub)
+	if cerr != nil {
+		return caller{}, cerr
+	}
+
+	if !containsString(roles, c.Role) {
+		return caller{}, newError(errCodePermissionDenied, "caller must have role "+strings.Join(roles, " or ")).
+			withDetail("role", c.Role).
+			withDetail("required", strings.Join(roles, ","))
+	}
+
+	return c, nil
+}
+
+// requirePatient
+// input: stub of the transaction and the patientID the call acts on
+// output: the caller or a PERMISSION_DENIED error if the caller is not that patient
+func requirePatient(stub shim.ChaincodeStubInterface, patientID string) (caller, *chaincodeError) {
+	c, cerr := requireRole(stub, rolePatient)
+	if cerr != nil {
+		return caller{}, cerr
+	}
+
+	if c.PatientID != strings.ToLower(patientID) {
+		return caller{}, newError(errCodePermissionDenied, "patients may only act on their own record").
+			withDetail("patientID", c.PatientID)
+	}
+
+	return c, nil
+}
+
+// requirePharmacy
+// input: stub of the transaction
+// output: the caller or a PERMISSION_DENIED error if the caller is not a pharmacist of a pharmacy
+// summary: prescriptions are held by pharmacies, every pharmacist of the pharmacy acts for it
+func requirePharmacy(stub shim.ChaincodeStubInterface) (caller, *chaincodeError) {
+	c, cerr := requireRole(stub, rolePharmacist)
+	if cerr != nil {
+		return caller{}, cerr
+	}
+
+	if c.Pharmacy == "" {
+		return caller{}, newError(errCodePermissionDenied, "caller must have the pharmacy attribute").
+			withDetail("license", c.License)
+	}
+
+	return c, nil
+}
+
+// requireInsurer
+// input: stub of the transaction and the plan the call acts on
+// output: the caller or a PERMISSION_DENIED error if the caller is not an insurer of the plan
+func requireInsurer(stub shim.ChaincodeStubInterface, plan string) (caller, *chaincodeError) {
+	c, cerr := requireRole(stub, roleInsurer)
+	if cerr != nil {
+		return caller{}, cerr
+	}
+
+	if !c.administers(plan) {
+		return caller{}, newError(errCodePermissionDenied, "insurers may only act on the plans they administer").
+			withDetail("plan", plan).
+			withDetail("plans", c.Plans)
+	}
+
+	return c, nil
+}
+
+// administers reports whether the plan is one of the caller's plans, plans are compared like the plan keys
+func (c caller) administers(plan string) bool {
+	plan = strings.ToLower(strings.TrimSpace(plan))
+	if plan == "" {
+		return false
+	}
+	for _, administered := range strings.Split(c.Plans, ",") {
+		if strings.ToLower(strings.TrimSpace(administered)) == plan {
+			return true
+		}
+	}
+	return false
+}
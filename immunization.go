@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// immunization
+// summary: one administered vaccine dose, coded with CVX
+type immunization struct {
+	ImmunizationID string `json:"immunizationID"`
+	CVXCode        string `json:"cvxCode"`        // CDC CVX vaccine code, e.g. 03 for MMR
+	LotNumber      string `json:"lotNumber"`      // manufacturer's lot number of the dose
+	Provider       string `json:"provider"`       // administering provider
+	Date           int    `json:"date"`           // timestamp of when the dose was administered
+	Site           string `json:"site,omitempty"` // body site, e.g. left deltoid
+	TxID           string `json:"txID"`           // transaction that recorded the dose, to verify it against the ledger
+}
+
+// immunizationSchedule
+// summary: the vaccine series patients are due for by age, configured by an admin with setImmunizationSchedule
+type immunizationSchedule struct {
+	ObjectType string               `json:"objType"`
+	Series     []immunizationSeries `json:"series"`
+}
+
+// immunizationSeries
+// summary: the doses of one vaccine, any of the CVX codes counts as a dose of the series
+type immunizationSeries struct {
+	Name     string         `json:"name"` // e.g. MMR
+	CVXCodes []string       `json:"cvxCodes"`
+	Doses    []scheduleDose `json:"doses"`
+}
+
+// scheduleDose
+// summary: when a dose of a series is due
+type scheduleDose struct {
+	MinAgeMonths    int `json:"minAgeMonths"`              // age the dose is due at
+	MaxAgeMonths    int `json:"maxAgeMonths,omitempty"`    // age after which the dose is overdue, 0 for never
+	MinIntervalDays int `json:"minIntervalDays,omitempty"` // days that must pass after the previous dose
+}
+
+// dueImmunization
+// summary: the next dose of a series the patient has not completed
+type dueImmunization struct {
+	Series      string `json:"series"`
+	Dose        int    `json:"dose"`                  // number of the dose in the series, starting at 1
+	Status      string `json:"status"`                // upcoming, due or overdue
+	DueDate     int    `json:"dueDate"`               // timestamp the dose is due from
+	OverdueDate int    `json:"overdueDate,omitempty"` // timestamp the dose is overdue from
+}
+
+// status values of a dueImmunization
+const (
+	immunizationUpcoming = "upcoming"
+	immunizationDue      = "due"
+	immunizationOverdue  = "overdue"
+)
+
+// immunizationScheduleKey is the key the single immunization schedule is stored under
+const immunizationScheduleKey = "immunizationSchedule"
+
+// recordImmunization
+// input: patientID, immunizationID, CVX code, lot number, administering provider, date, site
+// output: confirmation of record saved
+// summary: add an administered dose to the patient's immunization history
+func (t *Chaincode) recordImmunization(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1					2			3			4			5		6
+	// "patientID", "immunizationID", "cvxCode", "lotNumber", "provider", date, "site"
+	if len(args) < 7 {
+		return incorrectArgCount("7")
+	}
+
+	fmt.Println("- start recordImmunization")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("immunizationID", "2nd argument must be a non-empty string")
+	}
+
+	cvxCode, ok := normalizeCVX(args[2])
+	if !ok {
+		return invalidArgument("cvxCode", "3rd argument must be a CVX code, e.g. 03")
+	}
+
+	if len(args[3]) <= 0 {
+		return invalidArgument("lotNumber", "4th argument must be a non-empty string")
+	}
+	if len(args[4]) <= 0 {
+		return invalidArgument("provider", "5th argument must be a non-empty string")
+	}
+
+	date, err := strconv.Atoi(args[5])
+	if err != nil {
+		return invalidArgument("date", "6th argument must be an integer string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	if dob, err := time.Parse(emrDateFormat, patientRecord.DOB); err == nil && date < millis(dob) {
+		return invalidArgument("date", "6th argument must not be before the patient's date of birth")
+	}
+
+	for _, existing := range patientRecord.Immunizations {
+		if existing.ImmunizationID == args[1] {
+			return alreadyExists("immunizationID already exists: "+existing.ImmunizationID, existing.ImmunizationID)
+		}
+	}
+
+	patientRecord.Immunizations = append(patientRecord.Immunizations, immunization{
+		ImmunizationID: args[1],
+		CVXCode:        cvxCode,
+		LotNumber:      strings.ToUpper(args[3]),
+		Provider:       args[4],
+		Date:           date,
+		Site:           strings.ToLower(args[6]),
+		TxID:           stub.GetTxID(),
+	})
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	fmt.Println("- end recordImmunization (success)")
+	return shim.Success(nil)
+}
+
+// getImmunizations
+// input: patientID
+// output: the patient's immunization history
+func (t *Chaincode) getImmunizations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "patientID"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	// get current state of the given patient record
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID     string         `json:"patientID"`
+		Immunizations []immunization `json:"immunizations"`
+	}{
+		PatientID:     patientRecord.PatientID,
+		Immunizations: patientRecord.Immunizations,
+	}
+	if response.Immunizations == nil {
+		response.Immunizations = []immunization{}
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal immunizations response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// setImmunizationSchedule
+// input: the schedule as json, {"series": [{"name": "MMR", "cvxCodes": ["03"], "doses": [{"minAgeMonths": 12, "maxAgeMonths": 15}, ...]}]}
+// output: confirmation of record saved
+// summary: replace the immunization schedule, only callers with the admin role may change it
+func (t *Chaincode) setImmunizationSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "schedule"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if _, cerr := requireRole(stub, roleAdmin); cerr != nil {
+		return cerr.response()
+	}
+
+	schedule := immunizationSchedule{}
+	if err := json.Unmarshal([]byte(args[0]), &schedule); err != nil {
+		return invalidArgument("schedule", "1st argument must be a json immunization schedule: "+err.Error())
+	}
+	if len(schedule.Series) == 0 {
+		return invalidArgument("schedule", "schedule must have at least one series")
+	}
+
+	names := []string{}
+	for i, series := range schedule.Series {
+		field := "series[" + strconv.Itoa(i) + "]"
+		if series.Name == "" || containsString(names, series.Name) {
+			return invalidArgument(field, "series must have a unique name")
+		}
+		names = append(names, series.Name)
+
+		if len(series.CVXCodes) == 0 || len(series.Doses) == 0 {
+			return invalidArgument(field, "series "+series.Name+" must have cvxCodes and doses")
+		}
+		for j, code := range series.CVXCodes {
+			cvxCode, ok := normalizeCVX(code)
+			if !ok {
+				return invalidArgument(field, "series "+series.Name+" has an invalid CVX code: "+code)
+			}
+			schedule.Series[i].CVXCodes[j] = cvxCode
+		}
+		for _, dose := range series.Doses {
+			if dose.MinAgeMonths < 0 || dose.MinIntervalDays < 0 || (dose.MaxAgeMonths != 0 && dose.MaxAgeMonths < dose.MinAgeMonths) {
+				return invalidArgument(field, "series "+series.Name+" has a dose with an invalid age range or interval")
+			}
+		}
+	}
+
+	schedule.ObjectType = objTypeImmunizationSchedule
+	if cerr := t.putRecord(stub, immunizationScheduleKey, schedule); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getImmunizationSchedule
+// input: none
+// output: the configured immunization schedule
+func (t *Chaincode) getImmunizationSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	schedule := immunizationSchedule{}
+	if cerr := t.getRecord(stub, immunizationScheduleKey, objTypeImmunizationSchedule, &schedule); cerr != nil {
+		return cerr.response()
+	}
+
+	scheduleAsBytes, err := json.Marshal(schedule)
+	if err != nil {
+		return serializationError("unable to marshal immunization schedule", err)
+	}
+
+	return shim.Success(scheduleAsBytes)
+}
+
+// getDueImmunizations
+// input: patientID, optional asOf timestamp, the transaction time when empty
+// output: the next dose of every series the patient has not completed, with its status as of asOf
+// summary: compares the patient's immunization history with the schedule by age derived from EMR.DOB
+func (t *Chaincode) getDueImmunizations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)
+	// "patientID", asOf
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	var asOf int
+	if len(args) > 1 && len(args[1]) > 0 {
+		value, err := strconv.Atoi(args[1])
+		if err != nil {
+			return invalidArgument("asOf", "2nd argument must be empty or an integer string")
+		}
+		asOf = value
+	} else {
+		txTime, cerr := txMillis(stub)
+		if cerr != nil {
+			return cerr.response()
+		}
+		asOf = txTime
+	}
+
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	dob, err := time.Parse(emrDateFormat, patientRecord.DOB)
+	if err != nil {
+		return newError(errCodeFailedPrecondition, "patient's date of birth is not "+emrDateFormat+": "+patientRecord.DOB).
+			withDetail("id", patientID).response()
+	}
+
+	schedule := immunizationSchedule{}
+	if cerr := t.getRecord(stub, immunizationScheduleKey, objTypeImmunizationSchedule, &schedule); cerr != nil {
+		if cerr.Code == errCodeNotFound {
+			return failedPrecondition("no immunization schedule has been set", immunizationScheduleKey)
+		}
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID string            `json:"patientID"`
+		AsOf      int               `json:"asOf"`
+		AgeMonths int               `json:"ageMonths"`
+		Due       []dueImmunization `json:"due"`
+		Completed []string          `json:"completed"` // series with every dose given
+	}{
+		PatientID: patientID,
+		AsOf:      asOf,
+		AgeMonths: ageInMonths(dob, asOf),
+		Due:       []dueImmunization{},
+		Completed: []string{},
+	}
+
+	for _, series := range schedule.Series {
+		next, complete := nextDose(series, patientRecord.Immunizations, dob, asOf)
+		if complete {
+			response.Completed = append(response.Completed, series.Name)
+			continue
+		}
+		response.Due = append(response.Due, next)
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal due immunizations response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// nextDose returns the next dose of the series for a patient born on dob as of asOf,
+// or complete if every dose was given by asOf
+func nextDose(series immunizationSeries, history []immunization, dob time.Time, asOf int) (dueImmunization, bool) {
+	given := 0
+	lastDate := 0
+	for _, dose := range history {
+		if containsString(series.CVXCodes, dose.CVXCode) && dose.Date <= asOf {
+			given++
+			if dose.Date > lastDate {
+				lastDate = dose.Date
+			}
+		}
+	}
+
+	if given >= len(series.Doses) {
+		return dueImmunization{}, true
+	}
+
+	dose := series.Doses[given]
+	next := dueImmunization{
+		Series:  series.Name,
+		Dose:    given + 1,
+		DueDate: millis(dob.AddDate(0, dose.MinAgeMonths, 0)),
+	}
+
+	// the dose can not be given before the interval after the previous dose has passed
+	if given > 0 && dose.MinIntervalDays > 0 {
+		if earliest := lastDate + dose.MinIntervalDays*24*int(time.Hour/time.Millisecond); earliest > next.DueDate {
+			next.DueDate = earliest
+		}
+	}
+	if dose.MaxAgeMonths > 0 {
+		next.OverdueDate = millis(dob.AddDate(0, dose.MaxAgeMonths, 0))
+	}
+
+	switch {
+	case asOf < next.DueDate:
+		next.Status = immunizationUpcoming
+	case next.OverdueDate > 0 && asOf > next.OverdueDate:
+		next.Status = immunizationOverdue
+	default:
+		next.Status = immunizationDue
+	}
+
+	return next, false
+}
+
+// ageInMonths returns the completed months between dob and the timestamp
+func ageInMonths(dob time.Time, timestamp int) int {
+	at := time.Unix(0, int64(timestamp)*int64(time.Millisecond)).UTC()
+	months := (at.Year()-dob.Year())*12 + int(at.Month()) - int(dob.Month())
+	if at.Day() < dob.Day() {
+		months--
+	}
+	return months
+}
+
+// normalizeCVX returns the CVX code with at least two digits, e.g. 3 becomes 03
+func normalizeCVX(code string) (string, bool) {
+	value, err := strconv.Atoi(strings.TrimSpace(code))
+	if err != nil || value <= 0 || value > 999 {
+		return "", false
+	}
+	return fmt.Sprintf("%02d", value), true
+}
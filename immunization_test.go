@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// a schedule with a two dose MMR series and a three dose hepatitis B series
+const testImmunizationSchedule = `{"series": [
+	{"name": "MMR", "cvxCodes": ["3", "94"], "doses": [
+		{"minAgeMonths": 12, "maxAgeMonths": 15},
+		{"minAgeMonths": 48, "maxAgeMonths": 72, "minIntervalDays": 28}]},
+	{"name": "HepB", "cvxCodes": ["08", "45"], "doses": [
+		{"minAgeMonths": 0, "maxAgeMonths": 2},
+		{"minAgeMonths": 1, "maxAgeMonths": 4, "minIntervalDays": 28},
+		{"minAgeMonths": 6, "maxAgeMonths": 18, "minIntervalDays": 56}]}
+]}`
+
+// day returns the millisecond timestamp of midnight UTC on the day
+func day(year int, month time.Month, d int) string {
+	return strconv.Itoa(millis(time.Date(year, month, d, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestRecordImmunization(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "recordImmunization", "P01", "imm01", "3", "m123a", "dr smith", day(2001, time.January, 15), "Left Deltoid")
+	mustInvoke(t, stub, "recordImmunization", "p01", "imm02", "08", "hb77", "nurse jones", day(2000, time.January, 2), "")
+	expectError(t, invoke(stub, "recordImmunization", "p01", "imm01", "3", "m123a", "dr smith", day(2001, time.January, 15), ""), errCodeAlreadyExists)
+	expectError(t, invoke(stub, "recordImmunization", "p99", "imm01", "3", "m123a", "dr smith", day(2001, time.January, 15), ""), errCodeNotFound)
+
+	expectGolden(t, "getImmunizations", mustInvoke(t, stub, "getImmunizations", "p01"))
+
+	expectInvalidArgs(t, "recordImmunization", []argCase{
+		{"too few args", []string{"p01", "imm03"}, ""},
+		{"bad cvxCode", []string{"p01", "imm03", "MMR", "lot", "dr", "1000000000000", ""}, "cvxCode"},
+		{"empty lotNumber", []string{"p01", "imm03", "03", "", "dr", "1000000000000", ""}, "lotNumber"},
+		{"empty provider", []string{"p01", "imm03", "03", "lot", "", "1000000000000", ""}, "provider"},
+		{"bad date", []string{"p01", "imm03", "03", "lot", "dr", "today", ""}, "date"},
+		{"before birth", []string{"p01", "imm03", "03", "lot", "dr", day(1999, time.December, 31), ""}, "date"},
+	})
+}
+
+func TestImmunizationSchedule(t *testing.T) {
+	stub := newTestStub(t)
+
+	// only admins may set the schedule
+	expectError(t, invoke(stub, "setImmunizationSchedule", testImmunizationSchedule), errCodePermissionDenied)
+	setRole(t, stub, roleDoctor, nil)
+	cerr := expectError(t, invoke(stub, "setImmunizationSchedule", testImmunizationSchedule), errCodePermissionDenied)
+	if cerr.Details["role"] != roleDoctor {
+		t.Errorf("expected the caller's role in the details, got %v", cerr.Details)
+	}
+
+	// the schedule must be set before anything is due
+	expectError(t, invoke(stub, "getDueImmunizations", "p01", day(2004, time.June, 1)), errCodeFailedPrecondition)
+
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "setImmunizationSchedule", testImmunizationSchedule)
+	expectGolden(t, "getImmunizationSchedule", mustInvoke(t, stub, "getImmunizationSchedule"))
+
+	for _, c := range []struct {
+		name  string
+		args  []string
+		field string
+	}{
+		{"not json", []string{"{"}, "schedule"},
+		{"no series", []string{`{"series": []}`}, "schedule"},
+		{"duplicate name", []string{`{"series": [{"name": "a", "cvxCodes": ["03"], "doses": [{}]}, {"name": "a", "cvxCodes": ["03"], "doses": [{}]}]}`}, "series[1]"},
+		{"bad cvx", []string{`{"series": [{"name": "a", "cvxCodes": ["x"], "doses": [{}]}]}`}, "series[0]"},
+		{"bad ages", []string{`{"series": [{"name": "a", "cvxCodes": ["03"], "doses": [{"minAgeMonths": 12, "maxAgeMonths": 6}]}]}`}, "series[0]"},
+	} {
+		cerr := expectError(t, invoke(stub, "setImmunizationSchedule", c.args...), errCodeInvalidArgument)
+		if cerr.Field != c.field {
+			t.Errorf("%s: expected field %s, got %s", c.name, c.field, cerr.Field)
+		}
+	}
+}
+
+func TestGetDueImmunizations(t *testing.T) {
+	stub := newTestStub(t)
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "setImmunizationSchedule", testImmunizationSchedule)
+
+	// p01 was born on 01/01/2000
+	mustInvoke(t, stub, "recordImmunization", "p01", "imm01", "03", "m123a", "dr smith", day(2001, time.January, 15), "left deltoid")
+	mustInvoke(t, stub, "recordImmunization", "p01", "imm02", "08", "hb77", "nurse jones", day(2000, time.January, 2), "")
+
+	// at 53 months the second MMR dose is due and the second hepatitis B dose is overdue
+	expectGolden(t, "getDueImmunizations", mustInvoke(t, stub, "getDueImmunizations", "p01", day(2004, time.June, 1)))
+
+	// doses given after asOf do not count
+	mustInvoke(t, stub, "recordImmunization", "p01", "imm03", "94", "m456b", "dr smith", day(2004, time.June, 2), "")
+	expectGolden(t, "getDueImmunizations", mustInvoke(t, stub, "getDueImmunizations", "p01", day(2004, time.June, 1)))
+
+	var due struct {
+		Due       []dueImmunization
+		Completed []string
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "getDueImmunizations", "p01", day(2004, time.June, 2)), &due)
+	if len(due.Completed) != 1 || due.Completed[0] != "MMR" || len(due.Due) != 1 {
+		t.Errorf("expected MMR to be complete, got %+v", due)
+	}
+
+	// the second hepatitis B dose is upcoming until the minimum interval after the first has passed
+	mustInvoke(t, stub, "recordImmunization", "p02", "imm04", "08", "hb77", "nurse jones", day(2000, time.January, 20), "")
+	mustUnmarshal(t, mustInvoke(t, stub, "getDueImmunizations", "p02", day(2000, time.February, 5)), &due)
+	if next := due.Due[1]; next.Series != "HepB" || next.Dose != 2 || next.Status != immunizationUpcoming || next.DueDate != 950745600000 {
+		t.Errorf("unexpected next hepatitis B dose %+v", next)
+	}
+
+	expectInvalidArgs(t, "getDueImmunizations", []argCase{
+		{"no args", nil, ""},
+		{"bad asOf", []string{"p01", "today"}, "asOf"},
+	})
+}
+
+func TestAgeInMonths(t *testing.T) {
+	dob := time.Date(2000, time.January, 15, 0, 0, 0, 0, time.UTC)
+	for at, expected := range map[time.Time]int{
+		time.Date(2000, time.January, 15, 0, 0, 0, 0, time.UTC):  0,
+		time.Date(2000, time.February, 14, 0, 0, 0, 0, time.UTC): 0,
+		time.Date(2000, time.February, 15, 0, 0, 0, 0, time.UTC): 1,
+		time.Date(2004, time.June, 1, 0, 0, 0, 0, time.UTC):      52,
+	} {
+		if got := ageInMonths(dob, millis(at)); got != expected {
+			t.Errorf("%s: expected %d months, got %d", at.Format(fhirDateFormat), expected, got)
+		}
+	}
+}
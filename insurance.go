@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -11,28 +13,44 @@ import (
 
 type insurance struct {
 	Name           string `json:"insuranceName,omitempty"`
-	ExpirationDate int    `json:"expDate,omitempty"`
+	ExpirationDate int    `json:"expDate,omitempty"` // end of the coverage, 0 for none
 	PolicyID       string `json:"policyID,omitempty"`
+	Priority       int    `json:"priority,omitempty"`       // order of benefits, 1 is the primary policy
+	Subscriber     string `json:"subscriber,omitempty"`     // name or id of the policy holder
+	Relationship   string `json:"relationship,omitempty"`   // of the patient to the subscriber, one of insuranceRelationships
+	EffectiveDate  int    `json:"effectiveDate,omitempty"`  // start of the coverage, 0 for none
+	TerminatedDate int    `json:"terminatedDate,omitempty"` // set by terminateInsurance, coverage ends on it
+	Status         string `json:"status,omitempty"`         // expired once expireRecords marked the policy, cleared by a renewal
 }
 
-// TODO ASAP
+// insuranceRelationships are the relationships of a patient to the subscriber of a policy
+var insuranceRelationships = []string{"self", "spouse", "child", "other"}
+
+// insertInsurance
+// input: patientID, insurance name, expiration date, policyID and optionally priority, subscriber,
+// relationship and effective date
+// output: confirmation of record saved
+// summary: add a policy to the patient's coverages or renew the policy with the same policyID.
+// a policy inserted at a priority moves the policies at and after it down one, without a priority
+// a new policy is added last and a renewed one keeps its place. a renewal without a subscriber,
+// relationship or effective date keeps those of the policy
 func (t *Chaincode) insertInsurance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	//	0			1		2					3
-	// "patientID", "name", expirationDate, "policyID"
+	//	0			1		2				3			4 (optional)	5 (optional)	6 (optional)	7 (optional)
+	// "patientID", "name", expirationDate, "policyID", priority,		"subscriber",	"relationship",	effectiveDate
 
 	if len(args) < 4 {
-		return shim.Error("Incorrect number of arguements, Expecting 4")
+		return incorrectArgCount("4")
 	}
 
 	fmt.Println("---start insertInsurance----")
 	if len(args[0]) <= 0 {
-		return shim.Error("1st arguement must be non-empty string")
+		return invalidArgument("patientID", "1st arguement must be non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return shim.Error("2nd arguement must be a non-empty string")
+		return invalidArgument("name", "2nd arguement must be a non-empty string")
 	}
 	if len(args[3]) <= 0 {
-		return shim.Error("3rd arguement must be a non-empty string")
+		return invalidArgument("policyID", "4th arguement must be a non-empty string")
 	}
 
 	patientID := args[0]
@@ -40,110 +58,327 @@ func (t *Chaincode) insertInsurance(stub shim.ChaincodeStubInterface, args []str
 
 	expirationDate, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("unable to convert 3rd aguement to integer")
+		return invalidArgument("expirationDate", "unable to convert 3rd aguement to integer")
 	}
 
 	policyID := args[3]
 
-	patientRecord := EMR{}
+	priority := 0
+	if len(args) > 4 && len(args[4]) > 0 {
+		if priority, err = strconv.Atoi(args[4]); err != nil || priority < 1 {
+			return invalidArgument("priority", "5th argument must be empty or a positive integer string")
+		}
+	}
 
-	patientRecordAsBytes, err := stub.GetState(patientID)
-	if err != nil {
-		return shim.Error(err.Error())
+	// empty subscriber, relationship and effective date keep those of a renewed policy
+	subscriber := ""
+	if len(args) > 5 {
+		subscriber = args[5]
 	}
 
-	if err := json.Unmarshal(patientRecordAsBytes, &patientRecord); err != nil {
-		return shim.Error("Patient record does not exist")
+	relationship := ""
+	if len(args) > 6 && len(args[6]) > 0 {
+		relationship = strings.ToLower(args[6])
+		if !containsString(insuranceRelationships, relationship) {
+			return invalidArgument("relationship", "7th argument must be empty or one of "+strings.Join(insuranceRelationships, ", "))
+		}
+	}
+
+	effectiveDate := 0
+	if len(args) > 7 && len(args[7]) > 0 {
+		if effectiveDate, err = strconv.Atoi(args[7]); err != nil {
+			return invalidArgument("effectiveDate", "8th argument must be empty or an integer string")
+		}
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// a new or renewed policy changes the expiration dates
+	previous := patientRecord.expirationEntries(patientRecord.PatientID)
+
+	policies := patientRecord.policies()
+	index := -1
+	for i, policy := range policies {
+		if policy.PolicyID == policyID {
+			index = i
+		}
+	}
+
+	if index >= 0 {
+		existing := policies[index]
+		if subscriber == "" {
+			subscriber = existing.Subscriber
+		}
+		if relationship == "" {
+			relationship = existing.Relationship
+		}
+		if len(args) <= 7 || len(args[7]) == 0 {
+			effectiveDate = existing.EffectiveDate
+		}
+	}
+	if relationship == "" {
+		relationship = "self"
+	}
+	if relationship != "self" && subscriber == "" {
+		return invalidArgument("subscriber", "6th argument must name the subscriber when the patient is not the subscriber")
+	}
+	if expirationDate != 0 && expirationDate < effectiveDate {
+		return invalidArgument("expirationDate", "3rd argument must not be before the effective date")
 	}
 
 	newInsurance := insurance{
 		Name:           insuranceName,
 		ExpirationDate: expirationDate,
 		PolicyID:       policyID,
+		Priority:       priority,
+		Subscriber:     subscriber,
+		Relationship:   relationship,
+		EffectiveDate:  effectiveDate,
+	}
+
+	if index >= 0 {
+		existing := policies[index]
+		if existing.ExpirationDate == newInsurance.ExpirationDate && existing.TerminatedDate == 0 &&
+			(priority == 0 || priority == existing.Priority) {
+			return alreadyExists("Insurance policy already exists: "+newInsurance.PolicyID, newInsurance.PolicyID)
+		}
+		if newInsurance.Priority == 0 {
+			newInsurance.Priority = existing.Priority
+		}
+		policies = append(policies[:index], policies[index+1:]...)
+	}
+	if newInsurance.Priority == 0 {
+		newInsurance.Priority = len(policies) + 1
 	}
 
-	if patientRecord.Insurance.PolicyID == newInsurance.PolicyID && patientRecord.Insurance.ExpirationDate == newInsurance.ExpirationDate {
-		return shim.Error("Insurance policy already exists: " + newInsurance.PolicyID)
+	patientRecord.InsuranceList = orderPolicies(policies, newInsurance)
+	// the single policy kept before patients could have several is now part of the list
+	patientRecord.Insurance = insurance{}
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+	if cerr := t.indexExpirations(stub, patientRecord.PatientID, previous, patientRecord); cerr != nil {
+		return cerr.response()
 	}
 
-	patientRecord.Insurance = newInsurance
+	return shim.Success(nil)
+}
 
-	patientRecordAsBytes, err = json.Marshal(patientRecord)
+// terminateInsurance
+// input: patientID, policyID, termination date
+// output: confirmation of record saved
+// summary: end a policy's coverage on the termination date, it stays on the patient's list
+func (t *Chaincode) terminateInsurance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1			2
+	// "patientID", "policyID", terminatedDate
+	if len(args) < 3 {
+		return incorrectArgCount("3")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("policyID", "2nd argument must be a non-empty string")
+	}
+
+	terminatedDate, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("Error attempting to marshal insurance")
+		return invalidArgument("terminatedDate", "3rd argument must be an integer string")
+	}
+
+	patientID := args[0]
+	policyID := args[1]
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
 	}
 
+	// a terminated policy no longer expires
+	previous := patientRecord.expirationEntries(patientRecord.PatientID)
+
+	policies := patientRecord.policies()
+	index := -1
+	for i, policy := range policies {
+		if policy.PolicyID == policyID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return notFound("policyID does not exist: "+policyID, policyID)
+	}
+	if policies[index].TerminatedDate != 0 {
+		return failedPrecondition("insurance policy is already terminated: "+policyID, policyID)
+	}
+	if terminatedDate < policies[index].EffectiveDate {
+		return invalidArgument("terminatedDate", "3rd argument must not be before the effective date")
+	}
+
+	policies[index].TerminatedDate = terminatedDate
+	patientRecord.InsuranceList = policies
+	patientRecord.Insurance = insurance{}
+
 	// put record to state ledger
-	if err = stub.PutState(patientRecord.PatientID, patientRecordAsBytes); err != nil {
-		return shim.Error("unable to put insurance to state")
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+	if cerr := t.indexExpirations(stub, patientRecord.PatientID, previous, patientRecord); cerr != nil {
+		return cerr.response()
 	}
 
 	return shim.Success(nil)
 }
 
+// getInsurance
+// input: patientID, optional asOf timestamp, the transaction time when empty
+// output: the policies active at asOf in order of benefits, insurance is the primary one
 func (t *Chaincode) getInsurance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	// 0
-	// "patientID"
+	//	0			1 (optional)
+	// "patientID", asOf
 
 	if len(args) < 1 {
-		return shim.Error("Expecting 1 arguement: patientID")
+		return incorrectArgCount("1")
 	}
 
 	if len(args[0]) <= 0 {
-		return shim.Error("1st arguement must be a non empty string")
+		return invalidArgument("patientID", "1st arguement must be a non empty string")
 	}
 
 	patientID := args[0]
 
-	patientRecord := EMR{}
+	asOf := 0
+	if len(args) > 1 && len(args[1]) > 0 {
+		value, err := strconv.Atoi(args[1])
+		if err != nil {
+			return invalidArgument("asOf", "2nd argument must be empty or an integer string")
+		}
+		asOf = value
+	} else {
+		now, cerr := txMillis(stub)
+		if cerr != nil {
+			return cerr.response()
+		}
+		asOf = now
+	}
 
 	// get current state of the given patient record
-	patientRecordAsBytes, err := stub.GetState(patientID)
-	if err != nil {
-		return shim.Error("Unable to get record: " + err.Error())
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
 	}
 
-	// convert patient record as bytes to struct
-	if err := json.Unmarshal(patientRecordAsBytes, &patientRecord); err != nil {
-		return shim.Error(err.Error())
-	}
+	active := patientRecord.activePolicies(asOf)
 
 	// create custom struct for response of insurance for a patient
 	response := struct {
-		PatientID string    `json:"patientID"`
-		Insurance insurance `json:"insurance,omitempty"`
+		PatientID string      `json:"patientID"`
+		AsOf      int         `json:"asOf"`
+		Insurance *insurance  `json:"insurance,omitempty"` // primary policy
+		Coverages []insurance `json:"coverages"`
 	}{
 		PatientID: patientRecord.PatientID,
-		Insurance: patientRecord.Insurance,
+		AsOf:      asOf,
+		Coverages: active,
+	}
+	if len(active) > 0 {
+		response.Insurance = &active[0]
 	}
 
 	// convert reponse to bytes
 	responseAsBytes, err := json.Marshal(response)
 	if err != nil {
-		return shim.Error(err.Error())
+		return serializationError("unable to marshal insurance response", err)
 	}
 
 	// return results
 	return shim.Success(responseAsBytes)
 }
 
-// TODO sprint 2
-func (t *Chaincode) getInsuranceHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	return shim.Success(nil)
+// policies returns every policy of the patient in order of benefits,
+// including the single policy of a record written before patients could have several
+func (e EMR) policies() []insurance {
+	policies := append([]insurance{}, e.InsuranceList...)
+
+	if e.Insurance.PolicyID != "" {
+		legacy := e.Insurance
+		legacy.Priority = len(policies) + 1
+		for _, policy := range policies {
+			if policy.PolicyID == legacy.PolicyID {
+				return policies
+			}
+		}
+		policies = append(policies, legacy)
+	}
+
+	return policies
 }
 
-// TODO sprint 2
-func (t *Chaincode) newClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// activePolicies returns the policies covering the timestamp in order of benefits
+func (e EMR) activePolicies(timestamp int) []insurance {
+	active := []insurance{}
+	for _, policy := range e.policies() {
+		if policy.activeAt(timestamp) {
+			active = append(active, policy)
+		}
+	}
+	return active
+}
 
-	return shim.Success(nil)
+// primaryPolicy returns the first policy covering the timestamp
+func (e EMR) primaryPolicy(timestamp int) (insurance, bool) {
+	active := e.activePolicies(timestamp)
+	if len(active) == 0 {
+		return insurance{}, false
+	}
+	return active[0], true
 }
 
-// TODO sprint 2
-func (t *Chaincode) getClaim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	return shim.Success(nil)
+// activeAt reports whether the policy covers the timestamp, dates of 0 do not bound the coverage
+func (i insurance) activeAt(timestamp int) bool {
+	if i.EffectiveDate != 0 && timestamp < i.EffectiveDate {
+		return false
+	}
+	if i.ExpirationDate != 0 && timestamp > i.ExpirationDate {
+		return false
+	}
+	if i.TerminatedDate != 0 && timestamp > i.TerminatedDate {
+		return false
+	}
+	return true
+}
+
+// orderPolicies inserts the policy at its priority, the policies at and after it move down one,
+// and numbers the result from 1
+func orderPolicies(policies []insurance, policy insurance) []insurance {
+	sort.SliceStable(policies, func(i, j int) bool { return policies[i].Priority < policies[j].Priority })
+
+	position := len(policies)
+	for i, existing := range policies {
+		if existing.Priority >= policy.Priority {
+			position = i
+			break
+		}
+	}
+
+	ordered := append([]insurance{}, policies[:position]...)
+	ordered = append(ordered, policy)
+	ordered = append(ordered, policies[position:]...)
+	for i := range ordered {
+		ordered[i].Priority = i + 1
+	}
+
+	return ordered
 }
 
 // TODO sprint 2
-func (t *Chaincode) getClaimHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *Chaincode) getInsuranceHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	return shim.Success(nil)
 }
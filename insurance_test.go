@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestInsertInsurance(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1572976675318", "pol01")
+	expectError(t, invoke(stub, "insertInsurance", "p01", "aetna", "1572976675318", "pol01"), errCodeAlreadyExists)
+
+	// a renewed policy replaces the current one
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1604599075318", "pol01")
+
+	expectGolden(t, "getInsurance", mustInvoke(t, stub, "getInsurance", "p01"))
+
+	expectInvalidArgs(t, "insertInsurance", []argCase{
+		{"too few args", []string{"p01", "aetna"}, ""},
+		{"empty patientID", []string{"", "aetna", "1", "pol01"}, "patientID"},
+		{"empty name", []string{"p01", "", "1", "pol01"}, "name"},
+		{"bad expirationDate", []string{"p01", "aetna", "never", "pol01"}, "expirationDate"},
+		{"empty policyID", []string{"p01", "aetna", "1", ""}, "policyID"},
+	})
+}
+
+func TestGetInsurance(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "getInsurance-empty", mustInvoke(t, stub, "getInsurance", "p02"))
+	expectError(t, invoke(stub, "getInsurance", "p99"), errCodeNotFound)
+
+	expectInvalidArgs(t, "getInsurance", []argCase{
+		{"no args", nil, ""},
+		{"empty patientID", []string{""}, "patientID"},
+	})
+}
+
+func TestCoordinationOfBenefits(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1604599075318", "pol01")
+	mustInvoke(t, stub, "insertInsurance", "p01", "cigna", "0", "pol02", "", "mary jane", "spouse", "1546300800000")
+	// a policy inserted at a priority moves the others down
+	mustInvoke(t, stub, "insertInsurance", "p01", "medicaid", "0", "pol03", "1")
+
+	active := func(asOf string) []string {
+		var response struct{ Coverages []insurance }
+		mustUnmarshal(t, mustInvoke(t, stub, "getInsurance", "p01", asOf), &response)
+		ids := []string{}
+		for _, policy := range response.Coverages {
+			ids = append(ids, policy.PolicyID+":"+strconv.Itoa(policy.Priority))
+		}
+		return ids
+	}
+
+	for _, c := range []struct {
+		asOf     string
+		expected string
+	}{
+		{"1541440675318", "pol03:1 pol01:2"},         // before pol02 is effective
+		{"1550000000000", "pol03:1 pol01:2 pol02:3"}, // all three
+		{"1610000000000", "pol03:1 pol02:3"},         // after pol01 expired
+	} {
+		if got := strings.Join(active(c.asOf), " "); got != c.expected {
+			t.Errorf("as of %s: expected %s, got %s", c.asOf, c.expected, got)
+		}
+	}
+
+	expectGolden(t, "getInsurance-coordination", mustInvoke(t, stub, "getInsurance", "p01", "1550000000000"))
+
+	// a terminated policy stops covering after its termination date
+	mustInvoke(t, stub, "terminateInsurance", "p01", "pol03", "1560000000000")
+	expectError(t, invoke(stub, "terminateInsurance", "p01", "pol03", "1560000000000"), errCodeFailedPrecondition)
+	expectError(t, invoke(stub, "terminateInsurance", "p01", "pol99", "1560000000000"), errCodeNotFound)
+	if got := strings.Join(active("1570000000000"), " "); got != "pol01:2 pol02:3" {
+		t.Errorf("expected pol03 to be terminated, got %s", got)
+	}
+
+	// a renewal keeps the policy's place
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1704599075318", "pol01")
+	if got := strings.Join(active("1610000000000"), " "); got != "pol01:2 pol02:3" {
+		t.Errorf("expected the renewed pol01 to stay secondary, got %s", got)
+	}
+
+	// a renewal with the four arguments of a single policy keeps the subscriber, relationship and effective date
+	mustInvoke(t, stub, "insertInsurance", "p01", "cigna", "1704599075318", "pol02")
+	var response struct{ Coverages []insurance }
+	mustUnmarshal(t, mustInvoke(t, stub, "getInsurance", "p01", "1610000000000"), &response)
+	if renewed := response.Coverages[1]; renewed.PolicyID != "pol02" || renewed.Subscriber != "mary jane" ||
+		renewed.Relationship != "spouse" || renewed.EffectiveDate != 1546300800000 || renewed.ExpirationDate != 1704599075318 {
+		t.Errorf("expected the renewed pol02 to keep its subscriber, got %+v", renewed)
+	}
+
+	expectInvalidArgs(t, "insertInsurance", []argCase{
+		{"bad priority", []string{"p01", "aetna", "1", "pol01", "0"}, "priority"},
+		{"bad relationship", []string{"p01", "aetna", "1", "pol01", "", "john", "cousin"}, "relationship"},
+		{"no subscriber", []string{"p01", "aetna", "1", "pol01", "", "", "child"}, "subscriber"},
+		{"expires before effective", []string{"p01", "aetna", "1", "pol01", "", "", "", "2"}, "expirationDate"},
+	})
+	expectInvalidArgs(t, "terminateInsurance", []argCase{
+		{"too few args", []string{"p01", "pol01"}, ""},
+		{"bad date", []string{"p01", "pol01", "now"}, "terminatedDate"},
+	})
+}
+
+// a record written before patients could have several policies keeps its policy as the primary one
+func TestLegacyInsurance(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "p01", `{"objType":"emr","id":"p01","firstName":"john","lastName":"doe",`+
+		`"insurance":{"insuranceName":"aetna","expDate":1604599075318,"policyID":"pol01"}}`)
+
+	var response struct{ Insurance insurance }
+	mustUnmarshal(t, mustInvoke(t, stub, "getInsurance", "p01"), &response)
+	if response.Insurance.PolicyID != "pol01" || response.Insurance.Priority != 1 {
+		t.Errorf("expected the legacy policy to be primary, got %+v", response.Insurance)
+	}
+
+	// the next change moves it to the list
+	mustInvoke(t, stub, "insertInsurance", "p01", "cigna", "0", "pol02")
+	var record EMR
+	mustUnmarshal(t, stub.State["p01"], &record)
+	if record.Insurance.PolicyID != "" || len(record.InsuranceList) != 2 || record.InsuranceList[0].PolicyID != "pol01" {
+		t.Errorf("expected the legacy policy to be moved to the list, got %+v %+v", record.Insurance, record.InsuranceList)
+	}
+}
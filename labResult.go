@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// labResult
+// summary: one LOINC coded lab value, e.g. HbA1c, LDL cholesterol or INR.
+// lab results are not kept on the EMR, each one is its own record under
+// the composite key labResult~patientID~code~timestamp~resultID so they can be range queried.
+// the index labResultID~patientID~resultID keeps the result ids of a patient unique
+type labResult struct {
+	ObjectType     string          `json:"objType"`
+	ResultID       string          `json:"resultID"`
+	PatientID      string          `json:"patientID"`
+	Code           string          `json:"code"` // LOINC code, e.g. 4548-4 for HbA1c
+	Value          float64         `json:"value"`
+	Unit           string          `json:"unit,omitempty"` // UCUM unit, e.g. %
+	ReferenceRange *referenceRange `json:"referenceRange,omitempty"`
+	AbnormalFlag   string          `json:"abnormalFlag,omitempty"` // HL7 abnormal flag, N, L, H, LL, HH or A
+	PerformingLab  string          `json:"performingLab"`
+	Timestamp      int             `json:"timestamp"` // timestamp of when the specimen was collected
+}
+
+// referenceRange
+// summary: the normal range of a lab value, either bound may be missing
+type referenceRange struct {
+	Low  *float64 `json:"low,omitempty"`
+	High *float64 `json:"high,omitempty"`
+}
+
+// indexLabResultID is the index of the result ids of each patient
+const indexLabResultID = "labResultID"
+
+// abnormalLabResultEvent is the name of the chaincode event sent for a result flagged as abnormal
+const abnormalLabResultEvent = "abnormalLabResult"
+
+// abnormalFlags are the accepted HL7 abnormal flags, N is normal
+var abnormalFlags = []string{"N", "L", "H", "LL", "HH", "A"}
+
+// loincPattern matches a LOINC code, digits and a check digit, e.g. 2093-3
+var loincPattern = regexp.MustCompile(`^[0-9]{1,7}-[0-9]$`)
+
+// newLabResult
+// input: patientID, resultID, LOINC code, value, unit, reference range low and high, abnormal flag,
+// performing lab and timestamp. the range bounds and the flag may be empty
+// output: confirmation of record saved
+// summary: store a lab result, the result id must be new for the patient. the flag is derived from the reference range when it is not given.
+// an abnormal result sends the abnormalLabResult chaincode event with the result as payload
+func (t *Chaincode) newLabResult(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1			2		3		4		5				6				7				8				9
+	// "patientID", "resultID", "code", value, "unit", referenceLow, referenceHigh, "abnormalFlag", "performingLab", timestamp
+	if len(args) < 10 {
+		return incorrectArgCount("10")
+	}
+
+	fmt.Println("- start newLabResult")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("resultID", "2nd argument must be a non-empty string")
+	}
+	if !loincPattern.MatchString(args[2]) {
+		return invalidArgument("code", "3rd argument must be a LOINC code, e.g. 4548-4")
+	}
+
+	value, err := strconv.ParseFloat(args[3], 64)
+	if err != nil {
+		return invalidArgument("value", "4th argument must be a numeric string")
+	}
+
+	result := labResult{
+		ObjectType:    objTypeLabResult,
+		ResultID:      args[1],
+		PatientID:     strings.ToLower(args[0]),
+		Code:          args[2],
+		Value:         value,
+		Unit:          args[4],
+		AbnormalFlag:  strings.ToUpper(args[7]),
+		PerformingLab: args[8],
+	}
+
+	// the reference range is optional, either bound may be given on its own
+	bounds := &referenceRange{}
+	if len(args[5]) > 0 {
+		low, err := strconv.ParseFloat(args[5], 64)
+		if err != nil {
+			return invalidArgument("referenceLow", "6th argument must be empty or a numeric string")
+		}
+		bounds.Low = &low
+	}
+	if len(args[6]) > 0 {
+		high, err := strconv.ParseFloat(args[6], 64)
+		if err != nil {
+			return invalidArgument("referenceHigh", "7th argument must be empty or a numeric string")
+		}
+		bounds.High = &high
+	}
+	if bounds.Low != nil && bounds.High != nil && *bounds.Low > *bounds.High {
+		return invalidArgument("referenceHigh", "7th argument must not be lower than the 6th")
+	}
+	if bounds.Low != nil || bounds.High != nil {
+		result.ReferenceRange = bounds
+	}
+
+	if result.AbnormalFlag == "" {
+		result.AbnormalFlag = result.ReferenceRange.flag(value)
+	} else if !containsString(abnormalFlags, result.AbnormalFlag) {
+		return invalidArgument("abnormalFlag", "8th argument must be empty or one of "+strings.Join(abnormalFlags, ", "))
+	}
+
+	if len(args[8]) <= 0 {
+		return invalidArgument("performingLab", "9th argument must be a non-empty string")
+	}
+
+	result.Timestamp, err = strconv.Atoi(args[9])
+	if err != nil || result.Timestamp < 0 {
+		return invalidArgument("timestamp", "10th argument must be a non-negative integer string")
+	}
+
+	// the patient must exist, fails if the record is missing, corrupt or not an EMR
+	if _, cerr := t.getEMR(stub, result.PatientID); cerr != nil {
+		return cerr.response()
+	}
+
+	// the record key holds the code and timestamp as well, a result id is looked up through its own index
+	idKey, err := stub.CreateCompositeKey(indexLabResultID, []string{result.PatientID, result.ResultID})
+	if err != nil {
+		return ledgerError("unable to create lab result id key", err)
+	}
+	existing, err := stub.GetState(idKey)
+	if err != nil {
+		return ledgerError("unable to get lab result id", err)
+	}
+	if len(existing) > 0 {
+		return alreadyExists("lab result already exists: "+result.ResultID, result.ResultID)
+	}
+	if err := t.createIndex(stub, indexLabResultID, []string{result.PatientID, result.ResultID}); err != nil {
+		return ledgerError("unable to create lab result id index", err)
+	}
+
+	resultKey, err := labResultKey(stub, result)
+	if err != nil {
+		return ledgerError("unable to create lab result key", err)
+	}
+
+	if cerr := t.putRecord(stub, resultKey, result); cerr != nil {
+		return cerr.response()
+	}
+
+	if result.abnormal() {
+		resultAsBytes, err := json.Marshal(result)
+		if err != nil {
+			return serializationError("unable to marshal abnormal lab result event", err)
+		}
+		if err := stub.SetEvent(abnormalLabResultEvent, resultAsBytes); err != nil {
+			return ledgerError("unable to set abnormal lab result event", err)
+		}
+	}
+
+	fmt.Println("- end newLabResult (success)")
+	return shim.Success(nil)
+}
+
+// getLabResults
+// input: patientID, optional LOINC code, optional from and to timestamps (inclusive)
+// output: the patient's lab results oldest first, all codes when no code is given
+func (t *Chaincode) getLabResults(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)	2 (optional)	3 (optional)
+	// "patientID", "code", 		from, 			to
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	code := ""
+	if len(args) > 1 {
+		code = args[1]
+	}
+	if code != "" && !loincPattern.MatchString(code) {
+		return invalidArgument("code", "2nd argument must be empty or a LOINC code, e.g. 4548-4")
+	}
+
+	from, to, cerr := timeRangeArgs(args, 2, 3)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// the patient must exist, fails if the record is missing, corrupt or not an EMR
+	if _, cerr := t.getEMR(stub, patientID); cerr != nil {
+		return cerr.response()
+	}
+
+	results, cerr := t.labResults(stub, patientID, code, from, to)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID  string      `json:"patientID"`
+		LabResults []labResult `json:"labResults"`
+	}{
+		PatientID:  patientID,
+		LabResults: results,
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal lab results response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// labResults
+// input: patientID, LOINC code or empty for every code, from and to timestamps (inclusive)
+// output: the matching lab results sorted by timestamp
+func (t *Chaincode) labResults(stub shim.ChaincodeStubInterface, patientID string, code string, from int, to int) ([]labResult, *chaincodeError) {
+	attributes := []string{patientID}
+	if code != "" {
+		attributes = append(attributes, code)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objTypeLabResult, attributes)
+	if err != nil {
+		return nil, newError(errCodeLedger, "unable to query lab results").withDetail("cause", err.Error())
+	}
+	defer resultsIterator.Close()
+
+	results := []labResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, newError(errCodeLedger, "error iterating lab results").withDetail("cause", err.Error())
+		}
+
+		result := labResult{}
+		if cerr := decodeRecord(queryResponse.Key, queryResponse.Value, objTypeLabResult, &result); cerr != nil {
+			return nil, cerr
+		}
+
+		if result.Timestamp >= from && result.Timestamp <= to {
+			results = append(results, result)
+		}
+	}
+
+	// keys are ordered by code first, list the results of every code by time
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Timestamp < results[j].Timestamp })
+
+	return results, nil
+}
+
+// labResultKey returns the composite key of a lab result
+// the timestamp is zero padded so the keys of one code sort by time
+func labResultKey(stub shim.ChaincodeStubInterface, result labResult) (string, error) {
+	return stub.CreateCompositeKey(objTypeLabResult, []string{result.PatientID, result.Code, fmt.Sprintf("%013d", result.Timestamp), result.ResultID})
+}
+
+// flag returns L or H for a value outside the range, N inside it and empty without a range
+func (r *referenceRange) flag(value float64) string {
+	switch {
+	case r == nil:
+		return ""
+	case r.Low != nil && value < *r.Low:
+		return "L"
+	case r.High != nil && value > *r.High:
+		return "H"
+	default:
+		return "N"
+	}
+}
+
+// abnormal reports whether the result is flagged as anything but normal
+func (r labResult) abnormal() bool {
+	return r.AbnormalFlag != "" && r.AbnormalFlag != "N"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewLabResult(t *testing.T) {
+	stub := newTestStub(t)
+
+	// HbA1c with a range, LDL above its upper bound only, INR flagged by the lab
+	mustInvoke(t, stub, "newLabResult", "P01", "lab01", "4548-4", "5.4", "%", "4", "5.6", "", "quest", "1541440675318")
+	mustInvoke(t, stub, "newLabResult", "p01", "lab02", "13457-7", "162", "mg/dL", "", "100", "", "quest", "1541440675318")
+	mustInvoke(t, stub, "newLabResult", "p01", "lab03", "6301-6", "3.1", "{INR}", "", "", "hh", "labcorp", "1541440600000")
+	mustInvoke(t, stub, "newLabResult", "p01", "lab04", "4548-4", "7.2", "%", "4", "5.6", "", "quest", "1549440675318")
+	expectError(t, invoke(stub, "newLabResult", "p01", "lab01", "4548-4", "5.4", "%", "4", "5.6", "", "quest", "1541440675318"), errCodeAlreadyExists)
+	// the id is taken whatever the code and time of the new result
+	expectError(t, invoke(stub, "newLabResult", "p01", "lab01", "13457-7", "98", "mg/dL", "", "100", "", "quest", "1549440675318"), errCodeAlreadyExists)
+	expectError(t, invoke(stub, "newLabResult", "p99", "lab01", "4548-4", "5.4", "%", "4", "5.6", "", "quest", "1541440675318"), errCodeNotFound)
+
+	expectGolden(t, "getLabResults", mustInvoke(t, stub, "getLabResults", "p01"))
+
+	// one event per abnormal result, the normal HbA1c sent none
+	flags := []string{}
+	for _, event := range stub.events {
+		if event.EventName != abnormalLabResultEvent {
+			t.Fatalf("unexpected event %s", event.EventName)
+		}
+		result := labResult{}
+		mustUnmarshal(t, event.Payload, &result)
+		flags = append(flags, result.ResultID+":"+result.AbnormalFlag)
+	}
+	if got := len(flags); got != 3 || flags[0] != "lab02:H" || flags[1] != "lab03:HH" || flags[2] != "lab04:H" {
+		t.Errorf("unexpected abnormal events %v", flags)
+	}
+
+	expectInvalidArgs(t, "newLabResult", []argCase{
+		{"too few args", []string{"p01", "lab01"}, ""},
+		{"empty resultID", []string{"p01", "", "4548-4", "5.4", "%", "", "", "", "quest", "1"}, "resultID"},
+		{"not loinc", []string{"p01", "lab05", "HBA1C", "5.4", "%", "", "", "", "quest", "1"}, "code"},
+		{"bad value", []string{"p01", "lab05", "4548-4", "high", "%", "", "", "", "quest", "1"}, "value"},
+		{"bad referenceLow", []string{"p01", "lab05", "4548-4", "5.4", "%", "low", "", "", "quest", "1"}, "referenceLow"},
+		{"inverted range", []string{"p01", "lab05", "4548-4", "5.4", "%", "6", "4", "", "quest", "1"}, "referenceHigh"},
+		{"bad abnormalFlag", []string{"p01", "lab05", "4548-4", "5.4", "%", "", "", "X", "quest", "1"}, "abnormalFlag"},
+		{"empty performingLab", []string{"p01", "lab05", "4548-4", "5.4", "%", "", "", "", "", "1"}, "performingLab"},
+		{"bad timestamp", []string{"p01", "lab05", "4548-4", "5.4", "%", "", "", "", "quest", "now"}, "timestamp"},
+	})
+}
+
+func TestGetLabResults(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "newLabResult", "p01", "lab01", "4548-4", "5.4", "%", "4", "5.6", "", "quest", "1541440675318")
+	mustInvoke(t, stub, "newLabResult", "p01", "lab02", "13457-7", "162", "mg/dL", "", "100", "", "quest", "1541440675318")
+	mustInvoke(t, stub, "newLabResult", "p01", "lab04", "4548-4", "7.2", "%", "4", "5.6", "", "quest", "1549440675318")
+	mustInvoke(t, stub, "newLabResult", "p02", "lab05", "4548-4", "6.0", "%", "4", "5.6", "", "quest", "1541440675318")
+
+	for _, c := range []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{"by code", []string{"p01", "4548-4"}, []string{"lab01", "lab04"}},
+		{"from", []string{"p01", "", "1541440675319"}, []string{"lab04"}},
+		{"to", []string{"p01", "4548-4", "", "1541440675318"}, []string{"lab01"}},
+		{"other patient", []string{"p02"}, []string{"lab05"}},
+		{"none", []string{"p01", "6301-6"}, []string{}},
+	} {
+		var response struct{ LabResults []labResult }
+		mustUnmarshal(t, mustInvoke(t, stub, "getLabResults", c.args...), &response)
+		ids := []string{}
+		for _, result := range response.LabResults {
+			ids = append(ids, result.ResultID)
+		}
+		if len(ids) != len(c.expected) || (len(ids) > 0 && ids[0] != c.expected[0]) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, ids)
+		}
+	}
+
+	expectError(t, invoke(stub, "getLabResults", "p99"), errCodeNotFound)
+	expectInvalidArgs(t, "getLabResults", []argCase{
+		{"no args", nil, ""},
+		{"not loinc", []string{"p01", "HBA1C"}, "code"},
+		{"bad from", []string{"p01", "", "yesterday"}, "from"},
+		{"bad to", []string{"p01", "", "", "tomorrow"}, "to"},
+		{"from after to", []string{"p01", "", "2", "1"}, "from"},
+	})
+}
@@ -22,18 +22,17 @@ type EMR struct {
 	DOB           string           `json:"dob"`                     // format of MM/DD/YYYY
 	Address       string           `json:"address"`                 // format is street address city, state, zip
 	Phone         string           `json:"phone"`                   // format is ###-###-####
-	HeartRate     heartRateMessage `json:"heartRate,omitempty"`     // current heart rate message
+	HeartRate     heartRateMessage `json:"heartRate,omitempty"`     // last heart rate message recorded before vital signs had their own keys
 	RxList        []rx             `json:"rxList,omitempty"`        // list of prescriptions that the patient has currently
-	Insurance     insurance        `json:"insurance,omitempty"`     // current insurance
-	BloodPressure bloodPressure    `json:"bloodPressure,omitempty"` // current blood pressure
-}
-
-// Main
-func main() {
-	err := shim.Start(new(Chaincode))
-	if err != nil {
-		fmt.Printf("Error starting File Trace chaincode: %s", err)
-	}
+	Insurance     insurance        `json:"insurance,omitempty"`     // legacy single policy, read through policies() and merged into InsuranceList
+	InsuranceList []insurance      `json:"insuranceList,omitempty"` // every policy of the patient in order of benefits
+	BloodPressure bloodPressure    `json:"bloodPressure,omitempty"` // last blood pressure recorded before vital signs had their own keys
+	Allergies     []allergy        `json:"allergies,omitempty"`     // allergies and intolerances, checked by insertRx
+	ProblemList   []diagnosis      `json:"problemList,omitempty"`   // active and resolved diagnoses
+	Immunizations []immunization   `json:"immunizations,omitempty"` // administered vaccine doses
+	PriorAuths    []priorAuth      `json:"priorAuths,omitempty"`    // prior authorization requests sent to the insurer
+	RxTransfers   []rxTransfer     `json:"rxTransfers,omitempty"`   // prescriptions moved between pharmacies
+	ModifiedBy    *caller          `json:"modifiedBy,omitempty"`    // identity that wrote this version, set by putRecord
 }
 
 // Init initializes chaincode
@@ -76,6 +75,8 @@ func (t *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	} else if function == "getPerson" {
 		// TESTED OK
 		return t.getPerson(stub, args)
+	} else if function == "updatePerson" {
+		return t.updatePerson(stub, args) // replace the demographics of an existing patient
 	} else if function == "getPeople" {
 		// TESTED OK
 		return t.getPeople(stub, args)
@@ -85,6 +86,68 @@ func (t *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	} else if function == "insertInsurance" {
 		// TESTED OK
 		return t.insertInsurance(stub, args)
+	} else if function == "terminateInsurance" {
+		return t.terminateInsurance(stub, args)
+	} else if function == "publishFormulary" {
+		return t.publishFormulary(stub, args) // insurers only, replaces the plan's formulary
+	} else if function == "getFormulary" {
+		return t.getFormulary(stub, args)
+	} else if function == "checkCoverage" {
+		return t.checkCoverage(stub, args) // is a prescription covered by the patient's insurance
+	} else if function == "requestPriorAuth" {
+		return t.requestPriorAuth(stub, args) // doctors only
+	} else if function == "approvePriorAuth" {
+		return t.approvePriorAuth(stub, args) // insurers only
+	} else if function == "denyPriorAuth" {
+		return t.denyPriorAuth(stub, args) // insurers only
+	} else if function == "getPriorAuths" {
+		return t.getPriorAuths(stub, args)
+	} else if function == "getRxHistory" {
+		return t.getRxHistory(stub, args) // field level changes of one rx
+	} else if function == "getRecordChanges" {
+		return t.getRecordChanges(stub, args) // JSON patch changes of a patient record
+	} else if function == "getPersonAsOf" {
+		return t.getPersonAsOf(stub, args) // patient record at a point in time
+	} else if function == "cancelRx" {
+		return t.cancelRx(stub, args) // the prescribing doctor or an admin
+	} else if function == "discontinueRx" {
+		return t.discontinueRx(stub, args) // the prescribing doctor or an admin, notifies the holding pharmacy
+	} else if function == "expireRecords" {
+		return t.expireRecords(stub, args) // admins only, marks expired prescriptions and policies
+	} else if function == "getExpirations" {
+		return t.getExpirations(stub, args)
+	} else if function == "reindexExpirations" {
+		return t.reindexExpirations(stub, args) // admins only
+	} else if function == "transferRx" {
+		return t.transferRx(stub, args) // pharmacists and the patient, moves an rx and its refills to another pharmacy
+	} else if function == "respondRxTransfer" {
+		return t.respondRxTransfer(stub, args) // the holding pharmacist only
+	} else if function == "getRxTransfers" {
+		return t.getRxTransfers(stub, args)
+	} else if function == "newClaim" {
+		return t.newClaim(stub, args) // pharmacists only
+	} else if function == "getClaim" {
+		return t.getClaim(stub, args)
+	} else if function == "getClaimHistory" {
+		return t.getClaimHistory(stub, args)
+	} else if function == "reviewClaim" {
+		return t.reviewClaim(stub, args) // insurers only, releases or rejects a claim held for review
+	} else if function == "getFlaggedClaims" {
+		return t.getFlaggedClaims(stub, args)
+	} else if function == "registerProvider" {
+		return t.registerProvider(stub, args) // admins only
+	} else if function == "revokeProvider" {
+		return t.revokeProvider(stub, args) // admins only
+	} else if function == "getProvider" {
+		return t.getProvider(stub, args)
+	} else if function == "setPlanRules" {
+		return t.setPlanRules(stub, args) // insurers only
+	} else if function == "getPlanRules" {
+		return t.getPlanRules(stub, args)
+	} else if function == "adjudicateClaim" {
+		return t.adjudicateClaim(stub, args) // insurers only, prices the claim and records the explanation of benefits
+	} else if function == "getAccumulators" {
+		return t.getAccumulators(stub, args)
 	} else if function == "newBloodPressure" {
 		// TESTED OK
 		return t.newBloodPressure(stub, args)
@@ -95,10 +158,62 @@ func (t *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.isHacked(stub, args)
 	} else if function == "hack" {
 		return t.hack(stub, args)
+	} else if function == "addAllergy" {
+		return t.addAllergy(stub, args) // record an allergy or intolerance
+	} else if function == "removeAllergy" {
+		return t.removeAllergy(stub, args)
+	} else if function == "getAllergies" {
+		return t.getAllergies(stub, args)
+	} else if function == "addDiagnosis" {
+		return t.addDiagnosis(stub, args) // add an ICD-10 coded diagnosis to the problem list
+	} else if function == "resolveDiagnosis" {
+		return t.resolveDiagnosis(stub, args)
+	} else if function == "getProblemList" {
+		return t.getProblemList(stub, args)
+	} else if function == "linkRxToDiagnosis" {
+		return t.linkRxToDiagnosis(stub, args) // record the diagnosis that justifies a prescription
+	} else if function == "recordImmunization" {
+		return t.recordImmunization(stub, args) // add an administered vaccine dose
+	} else if function == "getImmunizations" {
+		return t.getImmunizations(stub, args)
+	} else if function == "getDueImmunizations" {
+		return t.getDueImmunizations(stub, args) // next doses due by the immunization schedule
+	} else if function == "setImmunizationSchedule" {
+		return t.setImmunizationSchedule(stub, args) // admin only
+	} else if function == "getImmunizationSchedule" {
+		return t.getImmunizationSchedule(stub, args)
+	} else if function == "newVital" {
+		return t.newVital(stub, args) // record a reading of any vital sign in the vitalTypes registry
+	} else if function == "getVitals" {
+		return t.getVitals(stub, args)
+	} else if function == "getVitalTypes" {
+		return t.getVitalTypes(stub, args)
+	} else if function == "getVitalsSummary" {
+		return t.getVitalsSummary(stub, args)
+	} else if function == "submitQuestionnaire" {
+		return t.submitQuestionnaire(stub, args) // patients only, scored against the questionnaires registry
+	} else if function == "submitSymptom" {
+		return t.submitSymptom(stub, args) // patients only
+	} else if function == "getPatientReports" {
+		return t.getPatientReports(stub, args)
+	} else if function == "getQuestionnaires" {
+		return t.getQuestionnaires(stub, args)
+	} else if function == "newLabResult" {
+		return t.newLabResult(stub, args) // store a LOINC coded lab value, abnormal values send an event
+	} else if function == "getLabResults" {
+		return t.getLabResults(stub, args)
+	} else if function == "exportFHIR" {
+		return t.exportFHIR(stub, args) // export the patient's record as a FHIR R4 bundle
+	} else if function == "importFHIR" {
+		return t.importFHIR(stub, args) // create or update patients, prescriptions, insurance and vitals from a FHIR R4 bundle
+	} else if function == "ingestHL7" {
+		return t.ingestHL7(stub, args) // apply an HL7 v2 ADT, RDE or ORU message and return the ACK
+	} else if function == "getErrorCodes" {
+		return t.getErrorCodes(stub, args) // list the error codes returned in error responses
 	}
 
 	fmt.Println("invoke did not find func: " + function) //error
-	return shim.Error("Received unknown function invocation")
+	return newError(errCodeUnknownFunction, "Received unknown function invocation").withDetail("function", function).response()
 }
 
 // createIndex - create search index for ledger
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// run go test -update to rewrite the golden files in testdata from the current responses
+var update = flag.Bool("update", false, "update golden files")
+
+// steppingClock returns a clock starting at a fixed time that advances a minute on every call
+// so transaction timestamps in responses are the same on every run
+func steppingClock() func() time.Time {
+	clock := time.Date(2018, time.November, 5, 12, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+}
+
+// newTestStub creates a history stub running Init so p01 and p02 exist
+func newTestStub(t *testing.T) *historyStub {
+	stub := newHistoryStub("emrcc", new(Chaincode))
+	stub.now = steppingClock()
+	if response := stub.MockInit(stub.nextTxID(), nil); response.Status != shim.OK {
+		t.Fatalf("Init failed: %s", response.Message)
+	}
+	return stub
+}
+
+// setRole makes the stub submit transactions as a user with the role and the other attributes of their
+// certificate, attrLicense for doctors and pharmacists, attrPatientID for patients and attrPlans for insurers
+func setRole(t *testing.T, stub *historyStub, role string, attrs map[string]string) {
+	t.Helper()
+	certAttrs := map[string]string{attrRole: role}
+	commonName := role
+	for name, value := range attrs {
+		certAttrs[name] = value
+	}
+	for _, name := range []string{attrLicense, attrPatientID} {
+		if value, found := attrs[name]; found {
+			commonName += "-" + value
+		}
+	}
+	if err := stub.setIdentity("Org1MSP", commonName, certAttrs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rxFillArgs are the arguments of a fill of rx01 by the pharmacy
+func rxFillArgs(license string, timestamp string) []string {
+	return []string{"p01", "rx01", timestamp, "ph " + license, license, "amoxicillin", "1", "1572976675318", "filled"}
+}
+
+// fillRxAt fills rx01 at each of the timestamps as the pharmacist of the license,
+// the stub keeps submitting transactions as that pharmacist
+func fillRxAt(t *testing.T, stub *historyStub, license string, timestamps ...string) {
+	t.Helper()
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: license, attrPharmacy: license})
+	for _, timestamp := range timestamps {
+		mustInvoke(t, stub, "fillRx", rxFillArgs(license, timestamp)...)
+	}
+}
+
+// testFormulary covers amoxicillin in tiers 1 and 2 and restricts adalimumab with a prior authorization
+const testFormulary = `{"drugs": [
+	{"prescription": "Amoxicillin", "tier": 1, "quantityLimit": 30},
+	{"prescription": "amoxicillin 875mg", "tier": 2},
+	{"prescription": "adalimumab", "tier": 5, "priorAuth": true, "quantityLimit": 2}
+]}`
+
+// testPlanRules are a $50 deductible, $10 and $30 copays for tiers 1 and 2, 20% coinsurance and a $100 out of pocket maximum
+const testPlanRules = `{"deductible": 5000, "copays": {"1": 1000, "2": 3000}, "coinsurance": 20, "outOfPocketMax": 10000}`
+
+// aetnaInsurer are the attributes of an insurer of the aetna plan
+var aetnaInsurer = map[string]string{attrPlans: "aetna"}
+
+// newPlanStub returns a stub where p01 has the aetna policy pol01, rx01 and the restricted rx02 and the aetna plan
+// has the test formulary. the stub keeps submitting transactions as the insurer
+func newPlanStub(t *testing.T) *historyStub {
+	t.Helper()
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertInsurance", "p01", "aetna", "1572976675318", "pol01")
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	mustInvoke(t, stub, "insertRx", "p01", "rx02", "1541440675318", "dr smith", "doc01", "adalimumab 40mg", "2", "2", "1572976675318", "prescribed")
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	mustInvoke(t, stub, "publishFormulary", "aetna", testFormulary)
+	return stub
+}
+
+// newClaimStub returns a plan stub where the aetna plan has the rules unless they are empty, rx01 and rx02 are
+// linked to the diagnosis dx01 and the registered pharmacy ph01 filled rx01 at each of the fills.
+// the stub keeps submitting transactions as ph01's pharmacist
+func newClaimStub(t *testing.T, rules string, fills ...string) *historyStub {
+	t.Helper()
+	stub := newPlanStub(t)
+	if rules != "" {
+		mustInvoke(t, stub, "setPlanRules", "aetna", rules)
+	}
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "addDiagnosis", "p01", "dx01", "M06.9", "rheumatoid arthritis", "1541440675318", "dr smith", "doc01")
+	mustInvoke(t, stub, "linkRxToDiagnosis", "p01", "rx01", "dx01")
+	mustInvoke(t, stub, "linkRxToDiagnosis", "p01", "rx02", "dx01")
+	mustInvoke(t, stub, "registerProvider", "ph01", "Jones Pharmacy")
+	fillRxAt(t, stub, "ph01", fills...)
+	return stub
+}
+
+// invoke calls function with args in its own transaction
+func invoke(stub *historyStub, function string, args ...string) pb.Response {
+	invokeArgs := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		invokeArgs = append(invokeArgs, []byte(arg))
+	}
+	return stub.MockInvoke(stub.nextTxID(), invokeArgs)
+}
+
+// mustInvoke calls function and fails the test if it does not succeed
+func mustInvoke(t *testing.T, stub *historyStub, function string, args ...string) []byte {
+	t.Helper()
+	response := invoke(stub, function, args...)
+	if response.Status != shim.OK {
+		t.Fatalf("%s failed: %s", function, response.Message)
+	}
+	return response.Payload
+}
+
+// mustUnmarshal decodes a json payload and fails the test if it is not valid
+func mustUnmarshal(t *testing.T, payload []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Fatalf("invalid json %s: %v", payload, err)
+	}
+}
+
+// putRaw writes value directly to state to set up records the chaincode would never write
+func putRaw(stub *historyStub, key string, value string) {
+	txID := stub.nextTxID()
+	stub.MockTransactionStart(txID)
+	stub.PutState(key, []byte(value))
+	stub.MockTransactionEnd(txID)
+}
+
+// expectSuccess fails the test if the response is not a success
+func expectSuccess(t *testing.T, response pb.Response) {
+	t.Helper()
+	if response.Status != shim.OK {
+		t.Fatalf("expected success, got %d: %s", response.Status, response.Message)
+	}
+}
+
+// expectError fails the test if the response is not an error with the given code
+func expectError(t *testing.T, response pb.Response, code string) chaincodeError {
+	t.Helper()
+	if response.Status == shim.OK {
+		t.Fatalf("expected %s error, got success: %s", code, string(response.Payload))
+	}
+	cerr := chaincodeError{}
+	if err := json.Unmarshal([]byte(response.Message), &cerr); err != nil {
+		t.Fatalf("error message is not a json error: %s", response.Message)
+	}
+	if cerr.Code != code {
+		t.Fatalf("expected error code %s, got %s: %s", code, cerr.Code, cerr.Message)
+	}
+	return cerr
+}
+
+// expectGolden compares the json payload with testdata/<name>.json
+func expectGolden(t *testing.T, name string, payload []byte) {
+	t.Helper()
+	indented := bytes.Buffer{}
+	if err := json.Indent(&indented, payload, "", "  "); err != nil {
+		t.Fatalf("payload is not json: %s", string(payload))
+	}
+	indented.WriteByte('\n')
+
+	goldenFile := filepath.Join("testdata", name+".json")
+	if *update {
+		if err := ioutil.WriteFile(goldenFile, indented.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("unable to read golden file, run go test -update to create it: %v", err)
+	}
+	if !bytes.Equal(expected, indented.Bytes()) {
+		t.Errorf("%s does not match golden file\nexpected:\n%s\ngot:\n%s", name, expected, indented.String())
+	}
+}
+
+// argCase is a call that must fail validation on field
+type argCase struct {
+	name  string
+	args  []string
+	field string
+}
+
+// expectInvalidArgs checks that every case fails with INVALID_ARGUMENT for its field
+func expectInvalidArgs(t *testing.T, function string, cases []argCase) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			cerr := expectError(t, invoke(stub, function, c.args...), errCodeInvalidArgument)
+			if cerr.Field != c.field {
+				t.Errorf("expected field %q, got %q", c.field, cerr.Field)
+			}
+		})
+	}
+}
+
+func TestUnknownFunction(t *testing.T) {
+	stub := newTestStub(t)
+
+	cerr := expectError(t, invoke(stub, "doesNotExist"), errCodeUnknownFunction)
+	if cerr.Details["function"] != "doesNotExist" {
+		t.Errorf("expected function detail, got %v", cerr.Details)
+	}
+}
+
+func TestGetErrorCodes(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "getErrorCodes", mustInvoke(t, stub, "getErrorCodes"))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// questionnaire
+// summary: a standard instrument patients answer, every item is scored from MinAnswer to MaxAnswer
+// and the total score is the sum of the items
+type questionnaire struct {
+	Name      string      `json:"name"`
+	Display   string      `json:"display"`
+	Code      string      `json:"code"` // LOINC code of the total score
+	Items     int         `json:"items"`
+	MinAnswer int         `json:"minAnswer"`
+	MaxAnswer int         `json:"maxAnswer"`
+	Bands     []scoreBand `json:"bands"` // interpretation of the total score, lowest first
+}
+
+// scoreBand
+// summary: the interpretation of total scores from Min up to the Min of the next band
+type scoreBand struct {
+	Min      int    `json:"min"`
+	Severity string `json:"severity"`
+}
+
+// questionnaires is the registry of instruments patients can submit, add an entry here to accept a new one
+var questionnaires = []questionnaire{
+	{Name: "PHQ-9", Display: "Patient Health Questionnaire 9 item", Code: "44261-6", Items: 9, MinAnswer: 0, MaxAnswer: 3, Bands: []scoreBand{
+		{0, "minimal"}, {5, "mild"}, {10, "moderate"}, {15, "moderately severe"}, {20, "severe"},
+	}},
+	{Name: "GAD-7", Display: "Generalized Anxiety Disorder 7 item", Code: "70274-6", Items: 7, MinAnswer: 0, MaxAnswer: 3, Bands: []scoreBand{
+		{0, "minimal"}, {5, "mild"}, {10, "moderate"}, {15, "severe"},
+	}},
+	{Name: "painScore", Display: "Pain severity 0-10 numeric rating scale", Code: "72514-3", Items: 1, MinAnswer: 0, MaxAnswer: 10, Bands: []scoreBand{
+		{0, "none"}, {1, "mild"}, {4, "moderate"}, {7, "severe"},
+	}},
+}
+
+// kinds of patient reports
+const (
+	reportQuestionnaire = "questionnaire"
+	reportSymptom       = "symptom"
+)
+
+// symptomSeverities are the severities a patient may give a symptom
+var symptomSeverities = []string{"mild", "moderate", "severe"}
+
+// indexPatientReportID is the index of the report ids of each patient
+const indexPatientReportID = "patientReportID"
+
+// patientReport
+// summary: a questionnaire or symptom diary entry submitted by the patient, stored under the composite key
+// patientReport~patientID~timestamp~reportID so the reports of a patient can be range queried.
+// the index patientReportID~patientID~reportID keeps the report ids of a patient unique
+type patientReport struct {
+	ObjectType  string `json:"objType"`
+	ReportID    string `json:"reportID"`
+	PatientID   string `json:"patientID"`
+	Kind        string `json:"kind"`                 // questionnaire or symptom
+	Instrument  string `json:"instrument,omitempty"` // name of the questionnaire
+	Answers     []int  `json:"answers,omitempty"`
+	Score       *int   `json:"score,omitempty"`    // total score of a questionnaire
+	Severity    string `json:"severity,omitempty"` // band of the score or the severity the patient gave a symptom
+	Text        string `json:"text,omitempty"`     // the patient's description of a symptom
+	RXID        string `json:"rxid,omitempty"`     // prescription the symptom is linked to
+	Timestamp   int    `json:"timestamp"`
+	SubmittedBy string `json:"submittedBy"` // id of the patient's certificate
+}
+
+// lookupQuestionnaire returns the registered questionnaire with the name, case insensitive
+func lookupQuestionnaire(name string) (questionnaire, bool) {
+	for _, q := range questionnaires {
+		if strings.EqualFold(q.Name, name) {
+			return q, true
+		}
+	}
+	return questionnaire{}, false
+}
+
+// questionnaireNames returns the names of the registered questionnaires
+func questionnaireNames() []string {
+	names := []string{}
+	for _, q := range questionnaires {
+		names = append(names, q.Name)
+	}
+	return names
+}
+
+// score returns the total score of the answers and its severity band
+func (q questionnaire) score(answers []int) (int, string) {
+	total := 0
+	for _, answer := range answers {
+		total += answer
+	}
+
+	severity := ""
+	for _, band := range q.Bands {
+		if total >= band.Min {
+			severity = band.Severity
+		}
+	}
+
+	return total, severity
+}
+
+// submitQuestionnaire
+// input: patientID, reportID, questionnaire name, answers as a json array of item scores, timestamp
+// output: confirmation of record saved
+// summary: store the patient's answers with their total score and severity, only the patient may submit
+func (t *Chaincode) submitQuestionnaire(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1			2				3			4
+	// "patientID", "reportID", "instrument",	"answers",	timestamp
+	if len(args) < 5 {
+		return incorrectArgCount("5")
+	}
+
+	fmt.Println("- start submitQuestionnaire")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("reportID", "2nd argument must be a non-empty string")
+	}
+
+	q, found := lookupQuestionnaire(args[2])
+	if !found {
+		return invalidArgument("instrument", "3rd argument must be one of "+strings.Join(questionnaireNames(), ", "))
+	}
+
+	answers := []int{}
+	if err := json.Unmarshal([]byte(args[3]), &answers); err != nil {
+		return invalidArgument("answers", "4th argument must be a json array of integers")
+	}
+	if len(answers) != q.Items {
+		return invalidArgument("answers", q.Name+" takes "+strconv.Itoa(q.Items)+" answers")
+	}
+	for _, answer := range answers {
+		if answer < q.MinAnswer || answer > q.MaxAnswer {
+			return invalidArgument("answers", q.Name+" answers must be between "+strconv.Itoa(q.MinAnswer)+" and "+strconv.Itoa(q.MaxAnswer))
+		}
+	}
+
+	timestamp, err := strconv.Atoi(args[4])
+	if err != nil || timestamp < 0 {
+		return invalidArgument("timestamp", "5th argument must be a non-negative integer string")
+	}
+
+	patientID := strings.ToLower(args[0])
+	c, cerr := requirePatient(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	score, severity := q.score(answers)
+	report := patientReport{
+		ObjectType:  objTypePatientReport,
+		ReportID:    args[1],
+		PatientID:   patientID,
+		Kind:        reportQuestionnaire,
+		Instrument:  q.Name,
+		Answers:     answers,
+		Score:       &score,
+		Severity:    severity,
+		Timestamp:   timestamp,
+		SubmittedBy: c.ID,
+	}
+
+	// the patient must exist, fails if the record is missing, corrupt or not an EMR
+	if _, cerr := t.getEMR(stub, patientID); cerr != nil {
+		return cerr.response()
+	}
+
+	if cerr := t.putPatientReport(stub, report); cerr != nil {
+		return cerr.response()
+	}
+
+	fmt.Println("- end submitQuestionnaire (success)")
+	return shim.Success(nil)
+}
+
+// submitSymptom
+// input: patientID, reportID, description, severity (mild, moderate, severe or empty), rxid or empty, timestamp
+// output: confirmation of record saved
+// summary: add a free text entry to the patient's symptom diary, optionally linked to one of their prescriptions.
+// only the patient may submit
+func (t *Chaincode) submitSymptom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1			2			3			4		5
+	// "patientID", "reportID", "text",		"severity", "rxid", timestamp
+	if len(args) < 6 {
+		return incorrectArgCount("6")
+	}
+
+	fmt.Println("- start submitSymptom")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("reportID", "2nd argument must be a non-empty string")
+	}
+	if len(strings.TrimSpace(args[2])) <= 0 {
+		return invalidArgument("text", "3rd argument must be a non-empty string")
+	}
+
+	severity := strings.ToLower(args[3])
+	if severity != "" && !containsString(symptomSeverities, severity) {
+		return invalidArgument("severity", "4th argument must be empty or one of "+strings.Join(symptomSeverities, ", "))
+	}
+
+	timestamp, err := strconv.Atoi(args[5])
+	if err != nil || timestamp < 0 {
+		return invalidArgument("timestamp", "6th argument must be a non-negative integer string")
+	}
+
+	patientID := strings.ToLower(args[0])
+	c, cerr := requirePatient(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	report := patientReport{
+		ObjectType:  objTypePatientReport,
+		ReportID:    args[1],
+		PatientID:   patientID,
+		Kind:        reportSymptom,
+		Severity:    severity,
+		Text:        strings.TrimSpace(args[2]),
+		RXID:        args[4],
+		Timestamp:   timestamp,
+		SubmittedBy: c.ID,
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	if report.RXID != "" {
+		IfExists := false
+		for _, tempRx := range patientRecord.RxList {
+			if tempRx.RXID == report.RXID {
+				IfExists = true
+			}
+		}
+		if IfExists == false {
+			return notFound("RXID does not exist: "+report.RXID, report.RXID)
+		}
+	}
+
+	if cerr := t.putPatientReport(stub, report); cerr != nil {
+		return cerr.response()
+	}
+
+	fmt.Println("- end submitSymptom (success)")
+	return shim.Success(nil)
+}
+
+// putPatientReport stores a new report, fails if the patient already has a report with the id
+func (t *Chaincode) putPatientReport(stub shim.ChaincodeStubInterface, report patientReport) *chaincodeError {
+	// the record key holds the timestamp as well, a report id is looked up through its own index
+	idKey, err := stub.CreateCompositeKey(indexPatientReportID, []string{report.PatientID, report.ReportID})
+	if err != nil {
+		return newError(errCodeLedger, "unable to create patient report id key").withDetail("cause", err.Error())
+	}
+	existing, err := stub.GetState(idKey)
+	if err != nil {
+		return newError(errCodeLedger, "unable to get patient report id").withDetail("cause", err.Error())
+	}
+	if len(existing) > 0 {
+		return newError(errCodeAlreadyExists, "patient report already exists: "+report.ReportID).withDetail("id", report.ReportID)
+	}
+	if err := t.createIndex(stub, indexPatientReportID, []string{report.PatientID, report.ReportID}); err != nil {
+		return newError(errCodeLedger, "unable to create patient report id index").withDetail("cause", err.Error())
+	}
+
+	reportKey, err := stub.CreateCompositeKey(objTypePatientReport, []string{report.PatientID, fmt.Sprintf("%013d", report.Timestamp), report.ReportID})
+	if err != nil {
+		return newError(errCodeLedger, "unable to create patient report key").withDetail("cause", err.Error())
+	}
+
+	return t.putRecord(stub, reportKey, report)
+}
+
+// getPatientReports
+// input: patientID, optional from and to timestamps (inclusive)
+// output: the patient's questionnaires and symptom entries oldest first
+func (t *Chaincode) getPatientReports(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)	2 (optional)
+	// "patientID", from, 			to
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	from, to, cerr := timeRangeArgs(args, 1, 2)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// the patient must exist, fails if the record is missing, corrupt or not an EMR
+	if _, cerr := t.getEMR(stub, patientID); cerr != nil {
+		return cerr.response()
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objTypePatientReport, []string{patientID})
+	if err != nil {
+		return ledgerError("unable to query patient reports", err)
+	}
+	defer resultsIterator.Close()
+
+	reports := []patientReport{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError("error iterating patient reports", err)
+		}
+
+		report := patientReport{}
+		if cerr := decodeRecord(queryResponse.Key, queryResponse.Value, objTypePatientReport, &report); cerr != nil {
+			return cerr.response()
+		}
+
+		// keys are ordered by timestamp
+		if report.Timestamp >= from && report.Timestamp <= to {
+			reports = append(reports, report)
+		}
+	}
+
+	response := struct {
+		PatientID string          `json:"patientID"`
+		Reports   []patientReport `json:"reports"`
+	}{
+		PatientID: patientID,
+		Reports:   reports,
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal patient reports response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// getQuestionnaires
+// input: none
+// output: the registered questionnaires with their items and score bands
+func (t *Chaincode) getQuestionnaires(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	questionnairesAsBytes, err := json.Marshal(questionnaires)
+	if err != nil {
+		return serializationError("unable to marshal questionnaires", err)
+	}
+
+	return shim.Success(questionnairesAsBytes)
+}
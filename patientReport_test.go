@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSubmitQuestionnaire(t *testing.T) {
+	stub := newTestStub(t)
+
+	// only the patient may submit their reports
+	phq9 := []string{"p01", "r01", "PHQ-9", "[1,2,1,1,2,0,1,2,1]", "1541440675318"}
+	expectError(t, invoke(stub, "submitQuestionnaire", phq9...), errCodePermissionDenied)
+	setRole(t, stub, rolePatient, map[string]string{attrPatientID: "p02"})
+	expectError(t, invoke(stub, "submitQuestionnaire", phq9...), errCodePermissionDenied)
+
+	setRole(t, stub, rolePatient, map[string]string{attrPatientID: "p01"})
+	mustInvoke(t, stub, "submitQuestionnaire", phq9...)
+	mustInvoke(t, stub, "submitQuestionnaire", "p01", "r02", "painscore", "[7]", "1541440735318")
+	expectError(t, invoke(stub, "submitQuestionnaire", phq9...), errCodeAlreadyExists)
+	// the id is taken whatever the time and kind of the new report
+	expectError(t, invoke(stub, "submitSymptom", "p01", "r01", "headache", "mild", "", "1541440795318"), errCodeAlreadyExists)
+
+	var response struct{ Reports []patientReport }
+	mustUnmarshal(t, mustInvoke(t, stub, "getPatientReports", "p01"), &response)
+	if len(response.Reports) != 2 {
+		t.Fatalf("expected 2 reports, got %+v", response.Reports)
+	}
+	if r := response.Reports[0]; *r.Score != 11 || r.Severity != "moderate" || r.Instrument != "PHQ-9" {
+		t.Errorf("unexpected PHQ-9 score %+v", r)
+	}
+	if r := response.Reports[1]; *r.Score != 7 || r.Severity != "severe" || r.Instrument != "painScore" {
+		t.Errorf("unexpected pain score %+v", r)
+	}
+
+	expectInvalidArgs(t, "submitQuestionnaire", []argCase{
+		{"too few args", []string{"p01", "r03", "PHQ-9", "[]"}, ""},
+		{"unknown instrument", []string{"p01", "r03", "BDI", "[1]", "1"}, "instrument"},
+		{"not json", []string{"p01", "r03", "PHQ-9", "1,2,3", "1"}, "answers"},
+		{"too few answers", []string{"p01", "r03", "PHQ-9", "[1,2,3]", "1"}, "answers"},
+		{"answer out of range", []string{"p01", "r03", "GAD-7", "[1,2,3,4,0,0,0]", "1"}, "answers"},
+		{"bad timestamp", []string{"p01", "r03", "painScore", "[1]", "now"}, "timestamp"},
+	})
+}
+
+func TestQuestionnaireScore(t *testing.T) {
+	phq9, _ := lookupQuestionnaire("PHQ-9")
+	for _, c := range []struct {
+		answers  []int
+		score    int
+		severity string
+	}{
+		{[]int{0, 0, 0, 0, 0, 0, 0, 0, 0}, 0, "minimal"},
+		{[]int{1, 1, 1, 1, 0, 0, 0, 0, 0}, 4, "minimal"},
+		{[]int{1, 1, 1, 1, 1, 0, 0, 0, 0}, 5, "mild"},
+		{[]int{3, 3, 3, 3, 3, 0, 0, 0, 0}, 15, "moderately severe"},
+		{[]int{3, 3, 3, 3, 3, 3, 3, 3, 3}, 27, "severe"},
+	} {
+		if score, severity := phq9.score(c.answers); score != c.score || severity != c.severity {
+			t.Errorf("%v: expected %d %s, got %d %s", c.answers, c.score, c.severity, score, severity)
+		}
+	}
+}
+
+func TestGetQuestionnaires(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "getQuestionnaires", mustInvoke(t, stub, "getQuestionnaires"))
+}
+
+func TestSubmitSymptom(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+
+	expectError(t, invoke(stub, "submitSymptom", "p01", "s01", "rash", "mild", "", "1541440675318"), errCodePermissionDenied)
+
+	setRole(t, stub, rolePatient, map[string]string{attrPatientID: "p01"})
+	mustInvoke(t, stub, "submitSymptom", "p01", "s01", " rash on both arms ", "Mild", "rx01", "1541440675318")
+	mustInvoke(t, stub, "submitSymptom", "p01", "s02", "headache", "", "", "1541440615318")
+	mustInvoke(t, stub, "submitQuestionnaire", "p01", "r01", "GAD-7", "[0,1,0,1,0,1,0]", "1541440735318")
+	expectError(t, invoke(stub, "submitSymptom", "p01", "s03", "nausea", "", "rx99", "1541440675318"), errCodeNotFound)
+
+	expectGolden(t, "getPatientReports", mustInvoke(t, stub, "getPatientReports", "p01"))
+
+	var response struct{ Reports []patientReport }
+	mustUnmarshal(t, mustInvoke(t, stub, "getPatientReports", "p01", "1541440675318", "1541440675318"), &response)
+	if len(response.Reports) != 1 || response.Reports[0].ReportID != "s01" {
+		t.Errorf("expected only s01 in the range, got %+v", response.Reports)
+	}
+
+	expectError(t, invoke(stub, "getPatientReports", "p99"), errCodeNotFound)
+	expectInvalidArgs(t, "submitSymptom", []argCase{
+		{"too few args", []string{"p01", "s03", "rash", "", ""}, ""},
+		{"empty text", []string{"p01", "s03", " ", "", "", "1"}, "text"},
+		{"bad severity", []string{"p01", "s03", "rash", "awful", "", "1"}, "severity"},
+		{"bad timestamp", []string{"p01", "s03", "rash", "", "", "now"}, "timestamp"},
+	})
+	expectInvalidArgs(t, "getPatientReports", []argCase{
+		{"no args", nil, ""},
+		{"bad to", []string{"p01", "", "tomorrow"}, "to"},
+	})
+}
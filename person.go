@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"strconv"
 	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -16,10 +17,15 @@ func (t *Chaincode) initPerson(stub shim.ChaincodeStubInterface, args []string)
 	//		0			1			2			3		4		5
 	//	"patientID", "firstName", "lastName", "dob", "address", "phone"
 
+	if len(args) < 6 {
+		return incorrectArgCount("6")
+	}
+
 	// Input Sanitation
-	for key, value := range args {
+	argNames := []string{"patientID", "firstName", "lastName", "dob", "address", "phone"}
+	for key, value := range args[:6] {
 		if len(value) <= 0 {
-			return shim.Error(string(key) + "argument must be a non empty string")
+			return invalidArgument(argNames[key], strconv.Itoa(key+1)+" argument must be a non empty string")
 		}
 	}
 
@@ -35,15 +41,15 @@ func (t *Chaincode) initPerson(stub shim.ChaincodeStubInterface, args []string)
 	personRecordAsBytes, err := stub.GetState(patientID)
 	if err != nil {
 		// error if failed to get record
-		return shim.Error("Failed to get person record: " + err.Error())
+		return ledgerError("Failed to get person record", err)
 	} else if personRecordAsBytes != nil {
 		// error if record exists
-		return shim.Error("This person's record already exists: " + patientID)
+		return alreadyExists("This person's record already exists: "+patientID, patientID)
 	}
 
 	// create a person struct with all arguments
 	newPersonRecord := EMR{
-		ObjectType: "emr",
+		ObjectType: objTypeEMR,
 		PatientID:  patientID,
 		FirstName:  firstName,
 		LastName:   lastName,
@@ -52,24 +58,63 @@ func (t *Chaincode) initPerson(stub shim.ChaincodeStubInterface, args []string)
 		Phone:      phone,
 	}
 
-	// convert struct to json bytes
-	newPersonRecordAsBytes, err := json.Marshal(newPersonRecord)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
 	// Create Index key to query for all people
 	// allows us to query against all people
 	indexName := "people"
 	err = t.createIndex(stub, indexName, []string{"people", patientID})
 	if err != nil {
-		shim.Error(err.Error())
+		return ledgerError("error creating people index", err)
 	}
 
-	// submit person record as bytes to ledger
-	err = stub.PutState(patientID, newPersonRecordAsBytes)
-	if err != nil {
-		return shim.Error("Error putting state in to ledger: " + err.Error())
+	// submit person record to ledger
+	if cerr := t.putRecord(stub, patientID, newPersonRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// updatePerson
+// input: patientID, firstname, last name, date of birth, address, and phone
+// output: success or failure
+// replace the demographics of an existing patient record, everything else on the record is kept.
+// only callers with the admin or doctor role may update, also through importFHIR and ingestHL7
+func (t *Chaincode) updatePerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//		0			1			2			3		4		5
+	//	"patientID", "firstName", "lastName", "dob", "address", "phone"
+	if len(args) < 6 {
+		return incorrectArgCount("6")
+	}
+
+	// Input Sanitation
+	argNames := []string{"patientID", "firstName", "lastName", "dob", "address", "phone"}
+	for key, value := range args[:6] {
+		if len(value) <= 0 {
+			return invalidArgument(argNames[key], strconv.Itoa(key+1)+" argument must be a non empty string")
+		}
+	}
+
+	if _, cerr := requireRole(stub, roleAdmin, roleDoctor); cerr != nil {
+		return cerr.response()
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// convert all arguments to lower case like initPerson
+	patientRecord.FirstName = strings.ToLower(args[1])
+	patientRecord.LastName = strings.ToLower(args[2])
+	patientRecord.DOB = strings.ToLower(args[3])
+	patientRecord.Address = strings.ToLower(args[4])
+	patientRecord.Phone = strings.ToLower(args[5])
+
+	if cerr := t.putRecord(stub, patientID, patientRecord); cerr != nil {
+		return cerr.response()
 	}
 
 	return shim.Success(nil)
@@ -82,24 +127,19 @@ func (t *Chaincode) getPerson(stub shim.ChaincodeStubInterface, args []string) p
 	//	0
 	//	personID
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguements. Expected 1")
+		return incorrectArgCount("1")
 	}
 
 	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non empty string")
+		return invalidArgument("patientID", "1st argument must be a non empty string")
 	}
 
 	id := args[0]
 
-	patientRecordAsBytes, err := stub.GetState(id)
-	if err != nil {
-		return shim.Error("Failed to get record: " + err.Error())
-	}
-
-	initialEMR := EMR{}
-
-	if err := json.Unmarshal(patientRecordAsBytes, &initialEMR); err != nil {
-		return shim.Error(err.Error())
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	initialEMR, cerr := t.getEMR(stub, id)
+	if cerr != nil {
+		return cerr.response()
 	}
 
 	newPatientRecord := struct {
@@ -121,12 +161,80 @@ func (t *Chaincode) getPerson(stub shim.ChaincodeStubInterface, args []string) p
 	// Marshal patient record to bytes
 	newPatientRecordAsBytes, err := json.Marshal(newPatientRecord)
 	if err != nil {
-		return shim.Error(err.Error())
+		return serializationError("error marshalling patient record", err)
 	}
 
 	return shim.Success(newPatientRecordAsBytes)
 }
 
+// getPersonAsOf
+// input: patientID, timestamp
+// output: the patient record as it was after the last transaction at or before the timestamp, the id and time of
+// that transaction and the latest reading of each vital sign recorded at or before the timestamp
+// summary: walks the history of the patient record, NOT_FOUND if the record did not exist or was deleted at that time.
+// vital signs are on their own keys and are picked by the same rule from the history of their keys, see latestVitalsAsOf
+func (t *Chaincode) getPersonAsOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1
+	// "patientID", "timestamp"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	asOf, err := strconv.Atoi(args[1])
+	if err != nil {
+		return invalidArgument("timestamp", "2nd argument must be an integer string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	// the versions are oldest first, the last one written at or before asOf is the state at asOf
+	var found *emrVersion
+	cerr := walkEMRHistory(stub, patientID, func(version emrVersion) *chaincodeError {
+		if version.Timestamp <= asOf {
+			found = &version
+		}
+		return nil
+	})
+	if cerr != nil {
+		return cerr.response()
+	}
+	if found == nil || found.IsDelete {
+		return notFound("patient record did not exist at "+args[1]+": "+patientID, patientID)
+	}
+
+	latestVitals, cerr := t.latestVitalsAsOf(stub, patientID, asOf)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID    string          `json:"patientID"`
+		AsOf         int             `json:"asOf"`
+		TxID         string          `json:"txID"`      // transaction that wrote the version
+		Timestamp    int             `json:"timestamp"` // time of that transaction
+		Record       EMR             `json:"record"`
+		LatestVitals []recordedVital `json:"latestVitals"`
+	}{
+		PatientID:    patientID,
+		AsOf:         asOf,
+		TxID:         found.TxID,
+		Timestamp:    found.Timestamp,
+		Record:       found.Record,
+		LatestVitals: latestVitals,
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal patient record", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
 // getPeople
 // input: none
 // output: all people in the database
@@ -137,7 +245,7 @@ func (t *Chaincode) getPeople(stub shim.ChaincodeStubInterface, args []string) p
 
 	personIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{"people"})
 	if err != nil {
-		return shim.Error("error getting people query result: " + err.Error())
+		return ledgerError("error getting people query result", err)
 	}
 	defer personIterator.Close()
 
@@ -154,20 +262,21 @@ func (t *Chaincode) getPeople(stub shim.ChaincodeStubInterface, args []string) p
 	for personIterator.HasNext() {
 		response, err := personIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return ledgerError("error iterating people index", err)
 		}
 
 		_, components, err := stub.SplitCompositeKey(response.Key)
+		if err != nil || len(components) < 2 {
+			return newError(errCodeCorruptRecord, "invalid people index key").
+				withDetail("key", response.Key).response()
+		}
 
 		patientID := components[1]
 
 		// get person record
-		tempPersonRecordAsBytes, err := stub.GetState(patientID)
-
-		tempPersonRecord := EMR{}
-
-		if err := json.Unmarshal(tempPersonRecordAsBytes, &tempPersonRecord); err != nil {
-			return shim.Error(err.Error())
+		tempPersonRecord, cerr := t.getEMR(stub, patientID)
+		if cerr != nil {
+			return cerr.response()
 		}
 
 		responseStruct.People = append(responseStruct.People,
@@ -181,7 +290,7 @@ func (t *Chaincode) getPeople(stub shim.ChaincodeStubInterface, args []string) p
 
 	responseJSONAsBytes, err := json.Marshal(responseStruct)
 	if err != nil {
-		return shim.Error("error marshalling people json bytes: " + err.Error())
+		return serializationError("error marshalling people json bytes", err)
 	}
 
 	return shim.Success(responseJSONAsBytes)
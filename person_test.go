@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInitPerson(t *testing.T) {
+	stub := newTestStub(t)
+	cc := new(Chaincode)
+
+	stub.MockTransactionStart(stub.nextTxID())
+	expectSuccess(t, cc.initPerson(stub, []string{"P03", "Jane", "Roe", "02/02/1990", "1 Main St Springfield, IL, 62701", "222-222-2222"}))
+	expectError(t, cc.initPerson(stub, []string{"p03", "jane", "roe", "02/02/1990", "1 main st", "222-222-2222"}), errCodeAlreadyExists)
+	expectError(t, cc.initPerson(stub, []string{"p04", "jane"}), errCodeInvalidArgument)
+	// arguments after the phone are ignored, even empty ones
+	expectSuccess(t, cc.initPerson(stub, []string{"p05", "jane", "roe", "02/02/1990", "1 main st", "222-222-2222", ""}))
+	cerr := expectError(t, cc.initPerson(stub, []string{"p04", "", "roe", "02/02/1990", "1 main st", "222-222-2222"}), errCodeInvalidArgument)
+	if cerr.Field != "firstName" {
+		t.Errorf("expected field firstName, got %s", cerr.Field)
+	}
+	stub.MockTransactionEnd(stub.TxID)
+
+	expectGolden(t, "getPerson-p03", mustInvoke(t, stub, "getPerson", "p03"))
+}
+
+// the first version of a patient record tells who created it
+func TestInitPersonModifiedBy(t *testing.T) {
+	stub := newTestStub(t)
+	setRole(t, stub, roleAdmin, nil)
+	stub.MockTransactionStart(stub.nextTxID())
+	expectSuccess(t, new(Chaincode).initPerson(stub, []string{"p03", "jane", "roe", "02/02/1990", "1 main st", "222-222-2222"}))
+	stub.MockTransactionEnd(stub.TxID)
+
+	var response struct{ Changes []recordChange }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRecordChanges", "p03"), &response)
+	if len(response.Changes) != 1 || response.Changes[0].ModifiedBy == nil || response.Changes[0].ModifiedBy.Role != roleAdmin {
+		t.Errorf("expected the creation to be modified by the admin, got %+v", response.Changes)
+	}
+}
+
+func TestGetPerson(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "getPerson", mustInvoke(t, stub, "getPerson", "p01"))
+	expectError(t, invoke(stub, "getPerson", "p99"), errCodeNotFound)
+
+	expectInvalidArgs(t, "getPerson", []argCase{
+		{"no args", nil, ""},
+		{"empty patientID", []string{""}, "patientID"},
+	})
+}
+
+func TestGetPeople(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "getPeople", mustInvoke(t, stub, "getPeople"))
+}
+
+func TestGetPeopleCorruptRecord(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "p01", "{not json")
+
+	expectError(t, invoke(stub, "getPeople"), errCodeCorruptRecord)
+}
+
+func TestGetPersonAsOf(t *testing.T) {
+	stub := newTestStub(t)
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	mustInvoke(t, stub, "newVital", "p01", "glucose", "1541419200000", "95")
+	mustInvoke(t, stub, "newVital", "p01", "glucose", "1541419400000", "110")
+	mustInvoke(t, stub, "newVital", "p01", "temperature", "1541419400000", "37.2")
+	mustInvoke(t, stub, "updatePerson", "p01", "john", "doe", "01/01/2000", "222 address city, state, zip", "222-222-2222")
+
+	// after insertRx and the glucose readings, before the temperature and the update
+	expectGolden(t, "getPersonAsOf", mustInvoke(t, stub, "getPersonAsOf", "P01", "1541419450000"))
+
+	// the first glucose reading was taken before but recorded after the timestamp
+	var beforeVitals struct {
+		Record       EMR
+		LatestVitals []recordedVital
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "getPersonAsOf", "p01", "1541419350000"), &beforeVitals)
+	if len(beforeVitals.Record.RxList) != 1 || len(beforeVitals.LatestVitals) != 0 {
+		t.Errorf("expected the record written by insertRx and no vitals, got %+v", beforeVitals)
+	}
+
+	var response struct {
+		TxID   string
+		Record EMR
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "getPersonAsOf", "p01", "1541419260000"), &response)
+	if len(response.Record.RxList) != 0 || response.Record.Address != "111 address city, state, zip" {
+		t.Errorf("expected the record written by Init, got %+v", response.Record)
+	}
+	mustUnmarshal(t, mustInvoke(t, stub, "getPersonAsOf", "p01", "9999999999999"), &response)
+	if response.Record.Address != "222 address city, state, zip" {
+		t.Errorf("expected the updated record, got %+v", response.Record)
+	}
+
+	expectError(t, invoke(stub, "getPersonAsOf", "p01", "1541419259999"), errCodeNotFound)
+	expectError(t, invoke(stub, "getPersonAsOf", "p99", "9999999999999"), errCodeNotFound)
+	expectInvalidArgs(t, "getPersonAsOf", []argCase{
+		{"too few args", []string{"p01"}, ""},
+		{"empty patientID", []string{"", "1"}, "patientID"},
+		{"timestamp not an integer", []string{"p01", "today"}, "timestamp"},
+	})
+}
+
+// a deleted record did not exist after the delete
+func TestGetPersonAsOfDeleted(t *testing.T) {
+	stub := newTestStub(t)
+	txID := stub.nextTxID()
+	stub.MockTransactionStart(txID)
+	stub.DelState("p01")
+	stub.MockTransactionEnd(txID)
+
+	expectError(t, invoke(stub, "getPersonAsOf", "p01", "9999999999999"), errCodeNotFound)
+	expectSuccess(t, invoke(stub, "getPersonAsOf", "p01", "1541419260000"))
+}
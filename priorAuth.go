@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// priorAuth
+// summary: a prescriber's request for the insurer to approve a prescription of a drug
+// the patient's formulary marks as needing prior authorization, and the insurer's decision
+type priorAuth struct {
+	PriorAuthID   string `json:"priorAuthID"`
+	RXID          string `json:"rxid"`
+	Prescription  string `json:"prescription"`
+	DiagnosisID   string `json:"diagnosisID"`   // active diagnosis that justifies the prescription
+	Justification string `json:"justification"` // the prescriber's clinical justification
+	Plan          string `json:"plan"`          // insurance plan and policy the request was sent to
+	PolicyID      string `json:"policyID"`
+	Status        string `json:"status"`      // pending, approved or denied
+	RequestedBy   string `json:"requestedBy"` // license of the prescriber
+	RequestedAt   int    `json:"requestedAt"` // timestamp of the request transaction
+	DecidedBy     string `json:"decidedBy,omitempty"`
+	DecidedAt     int    `json:"decidedAt,omitempty"`
+	Reason        string `json:"reason,omitempty"`    // the insurer's reason for the decision
+	ValidFrom     int    `json:"validFrom,omitempty"` // window an approval allows fills in (inclusive)
+	ValidTo       int    `json:"validTo,omitempty"`
+}
+
+// status values of a prior authorization
+const (
+	priorAuthPending  = "pending"
+	priorAuthApproved = "approved"
+	priorAuthDenied   = "denied"
+)
+
+// requestPriorAuth
+// input: patientID, priorAuthID, rxid, clinical justification, diagnosisID or empty for the diagnosis linked to the rx
+// output: confirmation of record saved
+// summary: ask the patient's insurer to approve a prescription, only callers with the doctor role may request
+func (t *Chaincode) requestPriorAuth(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1				2		3				4
+	// "patientID", "priorAuthID", "rxid", "justification", "diagnosisID"
+	if len(args) < 5 {
+		return incorrectArgCount("5")
+	}
+
+	fmt.Println("- start requestPriorAuth")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("priorAuthID", "2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return invalidArgument("rxid", "3rd argument must be a non-empty string")
+	}
+	if len(strings.TrimSpace(args[3])) <= 0 {
+		return invalidArgument("justification", "4th argument must be a non-empty string")
+	}
+
+	c, cerr := requireRole(stub, roleDoctor)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	patientID := args[0]
+	priorAuthID := args[1]
+	rxid := args[2]
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	if patientRecord.priorAuthIndex(priorAuthID) >= 0 {
+		return alreadyExists("priorAuthID already exists: "+priorAuthID, priorAuthID)
+	}
+
+	index := patientRecord.rxIndex(rxid)
+	if index < 0 {
+		return notFound("RXID does not exist: "+rxid, rxid)
+	}
+	prescription := patientRecord.RxList[index]
+
+	// the justification must be backed by an active diagnosis
+	diagnosisID := args[4]
+	if diagnosisID == "" {
+		diagnosisID = prescription.DiagnosisID
+	}
+	if diagnosisID == "" {
+		return invalidArgument("diagnosisID", "5th argument must be given when the rx is not linked to a diagnosis")
+	}
+	diagnosisIndex := patientRecord.diagnosisIndex(diagnosisID)
+	if diagnosisIndex < 0 {
+		return notFound("diagnosisID does not exist: "+diagnosisID, diagnosisID)
+	}
+	if patientRecord.ProblemList[diagnosisIndex].Status != diagnosisActive {
+		return failedPrecondition("diagnosis is not active: "+diagnosisID, diagnosisID)
+	}
+
+	// one open request per prescription
+	for _, existing := range patientRecord.PriorAuths {
+		if existing.RXID == rxid && existing.Status == priorAuthPending {
+			return failedPrecondition("rx already has a pending prior authorization: "+existing.PriorAuthID, existing.PriorAuthID)
+		}
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// the request goes to the insurer of the primary policy
+	policy, active := patientRecord.primaryPolicy(now)
+	if !active {
+		return failedPrecondition("patient has no active insurance: "+patientRecord.PatientID, patientRecord.PatientID)
+	}
+
+	requestedBy := c.License
+	if requestedBy == "" {
+		requestedBy = c.ID
+	}
+
+	patientRecord.PriorAuths = append(patientRecord.PriorAuths, priorAuth{
+		PriorAuthID:   priorAuthID,
+		RXID:          rxid,
+		Prescription:  prescription.Prescription,
+		DiagnosisID:   diagnosisID,
+		Justification: strings.TrimSpace(args[3]),
+		Plan:          strings.ToLower(policy.Name),
+		PolicyID:      policy.PolicyID,
+		Status:        priorAuthPending,
+		RequestedBy:   requestedBy,
+		RequestedAt:   now,
+	})
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	fmt.Println("- end requestPriorAuth (success)")
+	return shim.Success(nil)
+}
+
+// approvePriorAuth
+// input: patientID, priorAuthID, validFrom, validTo, reason
+// output: confirmation of record saved
+// summary: approve a pending request, fillRx accepts fills submitted inside the validity window.
+// only insurers of the request's plan may decide
+func (t *Chaincode) approvePriorAuth(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1				2			3		4
+	// "patientID", "priorAuthID", validFrom, validTo, "reason"
+	if len(args) < 5 {
+		return incorrectArgCount("5")
+	}
+
+	validFrom, err := strconv.Atoi(args[2])
+	if err != nil {
+		return invalidArgument("validFrom", "3rd argument must be an integer string")
+	}
+	validTo, err := strconv.Atoi(args[3])
+	if err != nil {
+		return invalidArgument("validTo", "4th argument must be an integer string")
+	}
+	if validTo < validFrom {
+		return invalidArgument("validTo", "4th argument must not be before the 3rd")
+	}
+
+	return t.decidePriorAuth(stub, args, priorAuthApproved, func(p *priorAuth) {
+		p.ValidFrom = validFrom
+		p.ValidTo = validTo
+	})
+}
+
+// denyPriorAuth
+// input: patientID, priorAuthID, reason
+// output: confirmation of record saved
+// summary: deny a pending request, only insurers of the request's plan may decide
+func (t *Chaincode) denyPriorAuth(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1				2
+	// "patientID", "priorAuthID", "reason"
+	if len(args) < 3 {
+		return incorrectArgCount("3")
+	}
+	if len(strings.TrimSpace(args[2])) <= 0 {
+		return invalidArgument("reason", "3rd argument must be a non-empty string")
+	}
+
+	return t.decidePriorAuth(stub, args, priorAuthDenied, func(p *priorAuth) {})
+}
+
+// decidePriorAuth records the insurer's decision on a pending request, the reason is the last argument
+func (t *Chaincode) decidePriorAuth(stub shim.ChaincodeStubInterface, args []string, status string, apply func(*priorAuth)) pb.Response {
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("priorAuthID", "2nd argument must be a non-empty string")
+	}
+
+	patientID := args[0]
+	priorAuthID := args[1]
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	index := patientRecord.priorAuthIndex(priorAuthID)
+	if index < 0 {
+		return notFound("priorAuthID does not exist: "+priorAuthID, priorAuthID)
+	}
+
+	// only an insurer of the plan the request was sent to decides
+	c, cerr := requireInsurer(stub, patientRecord.PriorAuths[index].Plan)
+	if cerr != nil {
+		return cerr.response()
+	}
+	if patientRecord.PriorAuths[index].Status != priorAuthPending {
+		return failedPrecondition("prior authorization is already "+patientRecord.PriorAuths[index].Status+": "+priorAuthID, priorAuthID)
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	decided := &patientRecord.PriorAuths[index]
+	decided.Status = status
+	decided.DecidedBy = c.ID
+	decided.DecidedAt = now
+	decided.Reason = strings.TrimSpace(args[len(args)-1])
+	apply(decided)
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getPriorAuths
+// input: patientID, optional rxid
+// output: the patient's prior authorization requests, all of them when no rxid is given
+func (t *Chaincode) getPriorAuths(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)
+	// "patientID", "rxid"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	rxid := ""
+	if len(args) > 1 {
+		rxid = args[1]
+	}
+
+	// get current state of the given patient record
+	patientRecord, cerr := t.getEMR(stub, args[0])
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID  string      `json:"patientID"`
+		PriorAuths []priorAuth `json:"priorAuths"`
+	}{
+		PatientID:  patientRecord.PatientID,
+		PriorAuths: []priorAuth{},
+	}
+	for _, p := range patientRecord.PriorAuths {
+		if rxid == "" || p.RXID == rxid {
+			response.PriorAuths = append(response.PriorAuths, p)
+		}
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal prior authorizations response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// checkPriorAuth
+// input: patient record, the rx being filled and the time of the fill, the tx timestamp for fillRx
+// output: nil or a PRIOR_AUTH_REQUIRED error if the patient's formulary restricts the prescribed drug
+// and no approval of the rx is valid at that time
+func (t *Chaincode) checkPriorAuth(stub shim.ChaincodeStubInterface, patientRecord EMR, filled rx, filledAt int) *chaincodeError {
+	result, cerr := t.coverageOf(stub, patientRecord, filled.Prescription, filled.Quantity, filledAt)
+	if cerr != nil {
+		return cerr
+	}
+
+	// only drugs on the formulary of a current policy can be restricted
+	if !result.Eligible || result.Tier == 0 || !result.PriorAuthRequired {
+		return nil
+	}
+
+	for _, p := range patientRecord.PriorAuths {
+		if p.RXID == filled.RXID && p.Status == priorAuthApproved && p.ValidFrom <= filledAt && filledAt <= p.ValidTo {
+			return nil
+		}
+	}
+
+	return newError(errCodePriorAuthRequired, "prescription needs an approved prior authorization: "+filled.Prescription).
+		withField("prescription").
+		withDetail("rxid", filled.RXID).
+		withDetail("plan", result.Plan)
+}
+
+// priorAuthIndex returns the position of the prior authorization in the patient's list or -1
+func (e EMR) priorAuthIndex(priorAuthID string) int {
+	for index, p := range e.PriorAuths {
+		if p.PriorAuthID == priorAuthID {
+			return index
+		}
+	}
+	return -1
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newPriorAuthStub returns a stub where p01's plan restricts adalimumab, rx02, and covers amoxicillin, rx01
+func newPriorAuthStub(t *testing.T) *historyStub {
+	stub := newPlanStub(t)
+	mustInvoke(t, stub, "addDiagnosis", "p01", "d01", "M06.9", "rheumatoid arthritis", "1541440675318", "dr smith", "doc01")
+	return stub
+}
+
+func TestPriorAuthApproval(t *testing.T) {
+	stub := newPriorAuthStub(t)
+	fillArgs := []string{"p01", "rx02", "1541500000000", "ph jones", "ph01", "adalimumab 40mg", "1", "1572976675318", "filled"}
+
+	// restricted drugs can not be filled without an approval, others are not affected
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	cerr := expectError(t, invoke(stub, "fillRx", fillArgs...), errCodePriorAuthRequired)
+	if cerr.Details["rxid"] != "rx02" || cerr.Details["plan"] != "aetna" {
+		t.Errorf("unexpected prior auth error %+v", cerr)
+	}
+	mustInvoke(t, stub, "fillRx", "p01", "rx01", "1541500000000", "ph jones", "ph01", "amoxicillin", "1", "1572976675318", "filled")
+
+	// only doctors request and only insurers decide
+	expectError(t, invoke(stub, "requestPriorAuth", "p01", "pa01", "rx02", "failed methotrexate", "d01"), errCodePermissionDenied)
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	mustInvoke(t, stub, "requestPriorAuth", "p01", "pa01", "rx02", "failed methotrexate", "d01")
+	expectError(t, invoke(stub, "requestPriorAuth", "p01", "pa02", "rx02", "again", "d01"), errCodeFailedPrecondition)
+	expectError(t, invoke(stub, "approvePriorAuth", "p01", "pa01", "1541400000000", "1541600000000", "meets criteria"), errCodePermissionDenied)
+
+	setRole(t, stub, roleInsurer, map[string]string{attrPlans: "cigna"})
+	expectError(t, invoke(stub, "approvePriorAuth", "p01", "pa01", "1541400000000", "1541600000000", "meets criteria"), errCodePermissionDenied)
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	mustInvoke(t, stub, "approvePriorAuth", "p01", "pa01", "1541400000000", "1541600000000", "meets criteria")
+	expectError(t, invoke(stub, "denyPriorAuth", "p01", "pa01", "changed our mind"), errCodeFailedPrecondition)
+	expectGolden(t, "getPriorAuths", mustInvoke(t, stub, "getPriorAuths", "p01", "rx02"))
+
+	// the approval only allows fills inside its validity window
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "fillRx", fillArgs...)
+
+	// another name for the drug does not get around the formulary
+	renamed := append([]string{}, fillArgs...)
+	renamed[5] = "humira"
+	if cerr := expectError(t, invoke(stub, "fillRx", renamed...), errCodeInvalidArgument); cerr.Field != "prescription" {
+		t.Errorf("expected field prescription, got %s", cerr.Field)
+	}
+
+	// the window is checked at the time of the transaction, a backdated fill is refused once it has passed
+	stub.now = func() time.Time { return time.Unix(0, 1541700000000*int64(time.Millisecond)) }
+	expectError(t, invoke(stub, "fillRx", fillArgs...), errCodePriorAuthRequired)
+}
+
+func TestPriorAuthDenial(t *testing.T) {
+	stub := newPriorAuthStub(t)
+	mustInvoke(t, stub, "linkRxToDiagnosis", "p01", "rx02", "d01")
+
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	// the diagnosis linked to the rx is used when none is given
+	mustInvoke(t, stub, "requestPriorAuth", "p01", "pa01", "rx02", "failed methotrexate", "")
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	mustInvoke(t, stub, "denyPriorAuth", "p01", "pa01", "step therapy not met")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	expectError(t, invoke(stub, "fillRx", "p01", "rx02", "1541500000000", "ph jones", "ph01", "adalimumab 40mg", "1", "1572976675318", "filled"), errCodePriorAuthRequired)
+
+	var response struct{ PriorAuths []priorAuth }
+	mustUnmarshal(t, mustInvoke(t, stub, "getPriorAuths", "p01"), &response)
+	if p := response.PriorAuths[0]; p.Status != priorAuthDenied || p.DiagnosisID != "d01" || p.Reason != "step therapy not met" || p.RequestedBy != "doc01" {
+		t.Errorf("unexpected denied prior auth %+v", p)
+	}
+
+	// a denied request can be followed by a new one
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	mustInvoke(t, stub, "requestPriorAuth", "p01", "pa02", "rx02", "failed methotrexate and leflunomide", "d01")
+	expectError(t, invoke(stub, "requestPriorAuth", "p01", "pa02", "rx02", "again", "d01"), errCodeAlreadyExists)
+	expectError(t, invoke(stub, "requestPriorAuth", "p01", "pa03", "rx99", "why", "d01"), errCodeNotFound)
+	expectError(t, invoke(stub, "requestPriorAuth", "p01", "pa03", "rx01", "why", "d99"), errCodeNotFound)
+	expectError(t, invoke(stub, "requestPriorAuth", "p02", "pa03", "rx01", "why", "d01"), errCodeNotFound)
+	if cerr := expectError(t, invoke(stub, "requestPriorAuth", "p01", "pa03", "rx01", "why", ""), errCodeInvalidArgument); cerr.Field != "diagnosisID" {
+		t.Errorf("expected field diagnosisID, got %s", cerr.Field)
+	}
+
+	expectInvalidArgs(t, "requestPriorAuth", []argCase{
+		{"too few args", []string{"p01", "pa03", "rx01", "why"}, ""},
+		{"empty justification", []string{"p01", "pa03", "rx01", " ", "d01"}, "justification"},
+	})
+	setRole(t, stub, roleInsurer, aetnaInsurer)
+	expectInvalidArgs(t, "approvePriorAuth", []argCase{
+		{"too few args", []string{"p01", "pa02", "1", "2"}, ""},
+		{"bad validFrom", []string{"p01", "pa02", "now", "2", "ok"}, "validFrom"},
+		{"window reversed", []string{"p01", "pa02", "2", "1", "ok"}, "validTo"},
+	})
+	expectInvalidArgs(t, "denyPriorAuth", []argCase{
+		{"empty reason", []string{"p01", "pa02", ""}, "reason"},
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// provider
+// summary: a licensed pharmacy or prescriber allowed to file claims, stored under the composite key provider~license
+type provider struct {
+	ObjectType   string `json:"objType"`
+	License      string `json:"license"`
+	Name         string `json:"name"`
+	Status       string `json:"status"` // active or revoked
+	RegisteredBy string `json:"registeredBy"`
+	Timestamp    int    `json:"timestamp"` // timestamp of the last change
+}
+
+// status values of a provider
+const (
+	providerActive  = "active"
+	providerRevoked = "revoked"
+)
+
+// registerProvider
+// input: license, name
+// output: confirmation of record saved
+// summary: add a provider to the registry or reactivate a revoked one, only callers with the admin role may register
+func (t *Chaincode) registerProvider(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1
+	// "license", "name"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	fmt.Println("- start registerProvider")
+	if len(args[0]) <= 0 {
+		return invalidArgument("license", "1st argument must be a non-empty string")
+	}
+	if len(strings.TrimSpace(args[1])) <= 0 {
+		return invalidArgument("name", "2nd argument must be a non-empty string")
+	}
+
+	return t.setProvider(stub, args[0], strings.TrimSpace(args[1]), providerActive)
+}
+
+// revokeProvider
+// input: license
+// output: confirmation of record saved
+// summary: mark a registered provider as revoked, claims it files are flagged for review.
+// only callers with the admin role may revoke
+func (t *Chaincode) revokeProvider(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "license"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("license", "1st argument must be a non-empty string")
+	}
+
+	return t.setProvider(stub, args[0], "", providerRevoked)
+}
+
+// setProvider writes the registry entry of a license, an empty name keeps the registered one
+func (t *Chaincode) setProvider(stub shim.ChaincodeStubInterface, license string, name string, status string) pb.Response {
+	c, cerr := requireRole(stub, roleAdmin)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	key, err := providerKey(stub, license)
+	if err != nil {
+		return ledgerError("unable to create provider key", err)
+	}
+
+	registered := provider{}
+	cerr = t.getRecord(stub, key, objTypeProvider, &registered)
+	if cerr != nil && cerr.Code != errCodeNotFound {
+		return cerr.response()
+	}
+	if cerr != nil && status == providerRevoked {
+		return notFound("provider is not registered: "+license, license)
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	registered.ObjectType = objTypeProvider
+	registered.License = license
+	if name != "" {
+		registered.Name = name
+	}
+	registered.Status = status
+	registered.RegisteredBy = c.ID
+	registered.Timestamp = now
+
+	if cerr := t.putRecord(stub, key, registered); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getProvider
+// input: license
+// output: the registry entry of the license
+func (t *Chaincode) getProvider(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0
+	// "license"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("license", "1st argument must be a non-empty string")
+	}
+
+	key, err := providerKey(stub, args[0])
+	if err != nil {
+		return ledgerError("unable to create provider key", err)
+	}
+
+	registered := provider{}
+	if cerr := t.getRecord(stub, key, objTypeProvider, &registered); cerr != nil {
+		return cerr.response()
+	}
+
+	providerAsBytes, err := json.Marshal(registered)
+	if err != nil {
+		return serializationError("unable to marshal provider", err)
+	}
+
+	return shim.Success(providerAsBytes)
+}
+
+// providerStatus returns the registry status of a license, empty when it is not registered
+func (t *Chaincode) providerStatus(stub shim.ChaincodeStubInterface, license string) (string, *chaincodeError) {
+	key, err := providerKey(stub, license)
+	if err != nil {
+		return "", newError(errCodeLedger, "unable to create provider key").withDetail("cause", err.Error())
+	}
+
+	registered := provider{}
+	cerr := t.getRecord(stub, key, objTypeProvider, &registered)
+	if cerr != nil && cerr.Code == errCodeNotFound {
+		return "", nil
+	} else if cerr != nil {
+		return "", cerr
+	}
+
+	return registered.Status, nil
+}
+
+// providerKey returns the composite key of a provider's registry entry
+func providerKey(stub shim.ChaincodeStubInterface, license string) (string, error) {
+	return stub.CreateCompositeKey(objTypeProvider, []string{license})
+}
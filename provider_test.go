@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRegisterProvider(t *testing.T) {
+	stub := newTestStub(t)
+	expectError(t, invoke(stub, "registerProvider", "ph01", "Jones Pharmacy"), errCodePermissionDenied)
+
+	setRole(t, stub, roleAdmin, nil)
+	expectError(t, invoke(stub, "getProvider", "ph01"), errCodeNotFound)
+	expectError(t, invoke(stub, "revokeProvider", "ph01"), errCodeNotFound)
+	mustInvoke(t, stub, "registerProvider", "ph01", "Jones Pharmacy")
+	mustInvoke(t, stub, "revokeProvider", "ph01")
+	expectGolden(t, "getProvider", mustInvoke(t, stub, "getProvider", "ph01"))
+
+	// registering again reactivates the provider
+	mustInvoke(t, stub, "registerProvider", "ph01", "Jones Pharmacy")
+	var registered provider
+	mustUnmarshal(t, mustInvoke(t, stub, "getProvider", "ph01"), &registered)
+	if registered.Status != providerActive || registered.Name != "Jones Pharmacy" {
+		t.Errorf("expected an active provider, got %+v", registered)
+	}
+
+	expectInvalidArgs(t, "registerProvider", []argCase{
+		{"too few args", []string{"ph01"}, ""},
+		{"empty license", []string{"", "Jones Pharmacy"}, "license"},
+		{"empty name", []string{"ph01", " "}, "name"},
+	})
+	expectInvalidArgs(t, "getProvider", []argCase{
+		{"too few args", []string{}, ""},
+		{"empty license", []string{""}, "license"},
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// objType values stored on each record so a key can be checked against the record it should hold
+const (
+	objTypeEMR                  = "emr"
+	objTypeLabResult            = "labResult"
+	objTypeVitalSign            = "vitalSign"
+	objTypeImmunizationSchedule = "immunizationSchedule"
+	objTypePatientReport        = "patientReport"
+	objTypeFormulary            = "formulary"
+	objTypeClaim                = "claim"
+	objTypePlanRules            = "planRules"
+	objTypeAccumulator          = "accumulator"
+	objTypeProvider             = "provider"
+)
+
+// recordHeader
+// summary: the attributes shared by every record, read before the full record is unmarshalled
+type recordHeader struct {
+	ObjectType string `json:"objType"`
+}
+
+// getRecord
+// input: key of the record, the objType it must have and a pointer to unmarshal into
+// output: nil or an error that tells apart a missing, corrupt or wrong type record
+func (t *Chaincode) getRecord(stub shim.ChaincodeStubInterface, key string, objType string, record interface{}) *chaincodeError {
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return newError(errCodeLedger, "unable to get record: "+key).
+			withDetail("id", key).
+			withDetail("cause", err.Error())
+	}
+
+	// GetState returns nil for a key that was never written or has been deleted
+	if len(recordAsBytes) == 0 {
+		return newError(errCodeNotFound, objType+" record does not exist: "+key).
+			withDetail("id", key).
+			withDetail("objType", objType)
+	}
+
+	return decodeRecord(key, recordAsBytes, objType, record)
+}
+
+// decodeRecord
+// input: key and value of a record, the objType it must have and a pointer to unmarshal into
+// output: nil or an error if the value is corrupt or of another type, used for records read by range queries
+func decodeRecord(key string, recordAsBytes []byte, objType string, record interface{}) *chaincodeError {
+	// read the objType first so a record of another type is not partially unmarshalled
+	header := recordHeader{}
+	if err := json.Unmarshal(recordAsBytes, &header); err != nil {
+		return newError(errCodeCorruptRecord, "record is not valid json: "+key).
+			withDetail("id", key).
+			withDetail("cause", err.Error())
+	}
+
+	if header.ObjectType != objType {
+		return newError(errCodeWrongRecordType, "record is not of type "+objType+": "+key).
+			withDetail("id", key).
+			withDetail("expected", objType).
+			withDetail("actual", header.ObjectType)
+	}
+
+	if err := json.Unmarshal(recordAsBytes, record); err != nil {
+		return newError(errCodeCorruptRecord, "record does not match type "+objType+": "+key).
+			withDetail("id", key).
+			withDetail("cause", err.Error())
+	}
+
+	return nil
+}
+
+// putRecord
+// input: key of the record and the record to store
+// output: nil or an error if the record could not be marshalled or written
+// summary: a patient record is stamped with the caller in ModifiedBy. the identity is optional, writing does not
+// need one and functions that do check it with requireRole, so a transaction without an X.509 creator leaves it empty
+func (t *Chaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record interface{}) *chaincodeError {
+	if patientRecord, isEMR := record.(EMR); isEMR {
+		// each version of a patient record tells who wrote it, when it is known
+		patientRecord.ModifiedBy = nil
+		if c, cerr := getCaller(stub); cerr == nil {
+			patientRecord.ModifiedBy = &c
+		}
+		record = patientRecord
+	}
+
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return newError(errCodeSerialization, "unable to marshal record: "+key).
+			withDetail("id", key).
+			withDetail("cause", err.Error())
+	}
+
+	if err := stub.PutState(key, recordAsBytes); err != nil {
+		return newError(errCodeLedger, "unable to put record: "+key).
+			withDetail("id", key).
+			withDetail("cause", err.Error())
+	}
+
+	return nil
+}
+
+// getEMR
+// input: patientID
+// output: the patient's EMR or an error if it is missing, corrupt or not an EMR
+func (t *Chaincode) getEMR(stub shim.ChaincodeStubInterface, patientID string) (EMR, *chaincodeError) {
+	patientRecord := EMR{}
+	if cerr := t.getRecord(stub, patientID, objTypeEMR, &patientRecord); cerr != nil {
+		return EMR{}, cerr
+	}
+
+	return patientRecord, nil
+}
+
+// rxIndex returns the position of the prescription in the patient's list or -1
+func (e EMR) rxIndex(rxid string) int {
+	for index, r := range e.RxList {
+		if r.RXID == rxid {
+			return index
+		}
+	}
+	return -1
+}
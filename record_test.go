@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetRecord(t *testing.T) {
+	stub := newTestStub(t)
+	cc := new(Chaincode)
+	putRaw(stub, "corrupt", "{not json")
+	putRaw(stub, "wrongType", `{"objType":"hack","isHacked":"false"}`)
+
+	tests := []struct {
+		key  string
+		code string
+	}{
+		{"p01", ""},
+		{"missing", errCodeNotFound},
+		{"corrupt", errCodeCorruptRecord},
+		{"wrongType", errCodeWrongRecordType},
+	}
+
+	for _, test := range tests {
+		record := EMR{}
+		cerr := cc.getRecord(stub, test.key, objTypeEMR, &record)
+		if test.code == "" {
+			if cerr != nil {
+				t.Errorf("%s: unexpected error %v", test.key, cerr)
+			} else if record.PatientID != test.key {
+				t.Errorf("%s: unexpected record %v", test.key, record)
+			}
+			continue
+		}
+		if cerr == nil || cerr.Code != test.code {
+			t.Errorf("%s: expected %s, got %v", test.key, test.code, cerr)
+		}
+	}
+}
+
+// every function that reads a patient record must tell apart missing, corrupt and wrong type records
+func TestReadsDistinguishRecordState(t *testing.T) {
+	functions := []struct {
+		name string
+		args []string
+	}{
+		{"getPerson", nil},
+		{"getInsurance", nil},
+		{"insertInsurance", []string{"aetna", "1600000000000", "pol01"}},
+		{"getRxForPatient", nil},
+		{"insertRx", []string{"rx01", "1", "dr who", "doc01", "amoxicillin", "1", "30", "1600000000000", "prescribed"}},
+		{"fillRx", []string{"rx01", "2", "ph one", "ph01", "amoxicillin", "0", "1600000000000", "filled"}},
+		{"approveRx", []string{"rx01", "3", "true"}},
+		{"newHeartRateMessage", []string{"70", "1"}},
+		{"newBloodPressure", []string{"120", "80", "1"}},
+	}
+
+	records := []struct {
+		name  string
+		value string
+		code  string
+	}{
+		{"missing", "", errCodeNotFound},
+		{"corrupt", "{not json", errCodeCorruptRecord},
+		{"wrongType", `{"objType":"hack","isHacked":"false"}`, errCodeWrongRecordType},
+		{"mismatched", `{"objType":"emr","id":"p10","rxList":"none"}`, errCodeCorruptRecord},
+	}
+
+	for _, record := range records {
+		for _, function := range functions {
+			stub := newTestStub(t)
+			if record.value != "" {
+				putRaw(stub, "p10", record.value)
+			}
+
+			setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+			response := invoke(stub, function.name, append([]string{"p10"}, function.args...)...)
+			t.Run(record.name+"/"+function.name, func(t *testing.T) {
+				cerr := expectError(t, response, record.code)
+				if cerr.Details["id"] != "p10" {
+					t.Errorf("expected id detail p10, got %v", cerr.Details)
+				}
+			})
+		}
+	}
+}
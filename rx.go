@@ -18,41 +18,56 @@ type rx struct {
 	DocLicense   string  `json:"docLicense,omitempty"`
 	Pharmacist   string  `json:"pharmacist,omitempty"`
 	PhLicense    string  `json:"phLicense,omitempty"`
+	Pharmacy     string  `json:"pharmacy,omitempty"`     // license of the pharmacy that holds the prescription, see transferRx
 	Prescription string  `json:"prescription,omitempty"` // prescription name
 	Refills      int     `json:"refills,omitempty"`      // number of refills
 	Quantity     float64 `json:"quantity,omitempty"`
 	ExpirateDate int     `json:"expDate,omitempty"`
 	Status       string  `json:"status,omitempty"` // current status of the prescription
 	Approved     string  `json:"approved,omitempty"`
+	// reason given by the doctor for prescribing despite a matching allergy
+	AllergyOverride string `json:"allergyOverride,omitempty"`
+	DiagnosisID     string `json:"diagnosisID,omitempty"` // diagnosis on the problem list that justifies the prescription
+	// set when the prescriber cancels or discontinues the prescription, see stopRx
+	StopReason string `json:"stopReason,omitempty"`
+	StopNote   string `json:"stopNote,omitempty"`
+	StoppedBy  string `json:"stoppedBy,omitempty"`
+	StoppedAt  int    `json:"stoppedAt,omitempty"`
 }
 
+// index of fills, rxFill~patientID~rxid~timestamp
+const indexRxFill = "rxFill"
+
 // initPrescription: create a new prescription
 func (t *Chaincode) insertRx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	//   0       		1      2     	3		   4	       	5				6		7			8		9
-	// "patientID", "rxid", timestamp, "doctor", "docLicense", "prescription", refills, quantity, expDate,  "status"
+	//   0       		1      2     	3		   4	       	5				6		7			8		9			10 (optional)
+	// "patientID", "rxid", timestamp, "doctor", "docLicense", "prescription", refills, quantity, expDate,  "status", "allergyOverride"
 	if len(args) < 10 {
-		return shim.Error("Incorrect number of arguments. Expecting 10")
+		return incorrectArgCount("10")
 	}
 
 	// ==== Input sanitation ====
 	fmt.Println("- start init inserRx")
 	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
 	}
 	if len(args[3]) <= 0 {
-		return shim.Error("4th argument must be a non-empty string")
+		return invalidArgument("doctor", "4th argument must be a non-empty string")
 	}
 	if len(args[4]) <= 0 {
-		return shim.Error("5th argument must be a non-empty string")
+		return invalidArgument("docLicense", "5th argument must be a non-empty string")
 	}
 	if len(args[5]) <= 0 {
-		return shim.Error("6th argument must be a non-empty string")
+		return invalidArgument("prescription", "6th argument must be a non-empty string")
 	}
 	if len(args[9]) <= 0 {
-		return shim.Error("10th arguement must be a non-empty string")
+		return invalidArgument("status", "10th arguement must be a non-empty string")
+	}
+	if isStopStatus(args[9]) {
+		return invalidArgument("status", "10th argument must not be "+args[9]+", prescriptions are stopped with cancelRx or discontinueRx")
 	}
 
 	patientID := args[0]
@@ -60,7 +75,7 @@ func (t *Chaincode) insertRx(stub shim.ChaincodeStubInterface, args []string) pb
 
 	timestamp, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("3rd arguement must be non empty integer string")
+		return invalidArgument("timestamp", "3rd arguement must be non empty integer string")
 	}
 
 	doctor := args[3]
@@ -69,38 +84,36 @@ func (t *Chaincode) insertRx(stub shim.ChaincodeStubInterface, args []string) pb
 
 	refills, err := strconv.Atoi(args[6])
 	if err != nil {
-		return shim.Error("7th arguement must be a non empty integer string")
+		return invalidArgument("refills", "7th arguement must be a non empty integer string")
 	}
 
 	quantity, err := strconv.ParseFloat(args[7], 64)
 	if err != nil {
-		return shim.Error("7th arguement must be a non empty integer string")
+		return invalidArgument("quantity", "8th arguement must be a non empty numeric string")
 	}
 
 	expDate, err := strconv.Atoi(args[8])
 	if err != nil {
-		return shim.Error("6th arguement must be a non empty integer string")
+		return invalidArgument("expDate", "9th arguement must be a non empty integer string")
 	}
 
 	status := args[9]
 
-	// get patient Record
-	patientRecord := EMR{}
-
-	// retrieve patient record as bytes
-	patientRecordAsBytes, err := stub.GetState(patientID)
-	if err != nil {
-		return shim.Error(err.Error())
+	allergyOverride := ""
+	if len(args) > 10 {
+		allergyOverride = strings.TrimSpace(args[10])
 	}
 
-	// convert patient record as bytes to struct
-	if err := json.Unmarshal(patientRecordAsBytes, &patientRecord); err != nil {
-		return shim.Error(err.Error())
+	// get patient Record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
 	}
 
-	// return error if the patient record does not exist
-	if patientRecordAsBytes == nil {
-		return shim.Error("Patient Record does not exist: " + err.Error())
+	// a prescription matching an allergy needs the doctor's reason for prescribing it anyway
+	conflicts := allergyConflicts(patientRecord.Allergies, prescription)
+	if len(conflicts) > 0 && allergyOverride == "" {
+		return allergyConflictError(prescription, conflicts).response()
 	}
 
 	newRx := rx{
@@ -116,113 +129,148 @@ func (t *Chaincode) insertRx(stub shim.ChaincodeStubInterface, args []string) pb
 		Approved:     "false",
 	}
 
+	// the override is only kept when it was needed
+	if len(conflicts) > 0 {
+		newRx.AllergyOverride = allergyOverride
+	}
+
 	// see if rxid already exists in patient record
 	for _, tempRX := range patientRecord.RxList {
 		if tempRX.RXID == newRx.RXID {
-			return shim.Error("RXID already exists: " + tempRX.RXID)
+			return alreadyExists("RXID already exists: "+tempRX.RXID, tempRX.RXID)
 		}
 	}
 
 	// add new prescription to patient record
+	previous := patientRecord.expirationEntries(patientRecord.PatientID)
 	patientRecord.RxList = append(patientRecord.RxList, newRx)
 
-	// convert record to JSON bytes
-	patientRecordAsBytes, err = json.Marshal(patientRecord)
-	if err != nil {
-		return shim.Error("Error attempting to marshal rx: " + err.Error())
-	}
-	fmt.Printf("rx as json bytes: %s", string(patientRecordAsBytes))
-
 	// put record to state ledger
-	err = stub.PutState(patientRecord.PatientID, patientRecordAsBytes)
-	if err != nil {
-		return shim.Error("Error putting prescription to ledger: " + err.Error())
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+	if cerr := t.indexExpirations(stub, patientRecord.PatientID, previous, patientRecord); cerr != nil {
+		return cerr.response()
 	}
-	fmt.Printf("Entered state")
 
 	fmt.Println("- end insertObject (success)")
 	return shim.Success(nil)
 }
 
-// fillRx: modifies existing prescription
+// fillRx: modifies existing prescription, only the pharmacist of phLicense may fill
 func (t *Chaincode) fillRx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	//   0       	1      	2     		3		   		4			5	       		6		7		8
 	// "patientid", "rxid", timestamp, "pharmacist", "phLicense", "prescription", refills, expDate, "status"
 	if len(args) < 9 {
-		return shim.Error("Incorrect number of arguments. Expecting 9")
+		return incorrectArgCount("9")
 	}
 
 	// ==== Input sanitation ====
 	fmt.Println("- start init modifyObject")
 	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
 	}
 
 	if len(args[3]) <= 0 {
-		return shim.Error("4th argument must be a non-empty string")
+		return invalidArgument("pharmacist", "4th argument must be a non-empty string")
 	}
 	if len(args[4]) <= 0 {
-		return shim.Error("5th argument must be a non-empty string")
+		return invalidArgument("phLicense", "5th argument must be a non-empty string")
 	}
 	if len(args[5]) <= 0 {
-		return shim.Error("6th argument must be a non-empty string")
+		return invalidArgument("prescription", "6th argument must be a non-empty string")
 	}
 	if len(args[7]) <= 0 {
-		return shim.Error("8th argument must be a non-empty string")
+		return invalidArgument("expDate", "8th argument must be a non-empty string")
 	}
 	if len(args[8]) <= 0 {
-		return shim.Error("9th arguement must be a non empty string")
+		return invalidArgument("status", "9th arguement must be a non empty string")
+	}
+	if isStopStatus(args[8]) {
+		return invalidArgument("status", "9th argument must not be "+args[8]+", prescriptions are stopped with cancelRx or discontinueRx")
 	}
 
 	patientID := args[0]
 	rxid := args[1]
 	timestamp, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error(err.Error())
+		return invalidArgument("timestamp", "3rd argument must be an integer string")
 	}
 
 	pharmacist := args[3]
-	phLicense := args[4]
 	prescription := args[5]
 
 	refills, err := strconv.Atoi(args[6])
 	if err != nil {
-		return shim.Error(err.Error())
+		return invalidArgument("refills", "7th argument must be an integer string")
 	}
 
 	expDate, err := strconv.Atoi(args[7])
 	if err != nil {
-		return shim.Error(err.Error())
+		return invalidArgument("expDate", "8th argument must be an integer string")
 	}
 
 	status := args[8]
 
-	// retrieve patient record
-	patientRecordAsBytes, err := stub.GetState(patientID)
-	if err != nil {
-		return shim.Error("Failed to get record: " + patientID)
-	} else if patientRecordAsBytes == nil {
-		return shim.Error("patient record does not exist: " + patientID)
+	// only pharmacists fill, under their own license and for the pharmacy they work for
+	c, cerr := requirePharmacy(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+	if c.License != args[4] {
+		return newError(errCodePermissionDenied, "phLicense must be the caller's license").
+			withField("phLicense").
+			withDetail("license", c.License).response()
 	}
 
-	// create a patient record interface to load bytes into
-	patientRecord := EMR{}
-	err = json.Unmarshal(patientRecordAsBytes, &patientRecord)
-	if err != nil {
-		return shim.Error(err.Error())
+	phLicense := c.License
+
+	// retrieve patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
 	}
 
+	// the fill sets the expiration date
+	previous := patientRecord.expirationEntries(patientRecord.PatientID)
+
 	// check if prescription record exists
 	IfExists := false
 	for key, tempRx := range patientRecord.RxList {
 		// update rx record with new details
 		if tempRx.RXID == rxid {
+			// a cancelled or discontinued prescription can not be filled
+			if tempRx.stopped() {
+				return failedPrecondition("rx is "+tempRx.Status+": "+rxid, rxid)
+			}
+			// nor can one past its expiration date
+			if tempRx.statusAt(now) == statusExpired {
+				return failedPrecondition("rx is expired: "+rxid, rxid)
+			}
+			// the pharmacy dispenses the drug that was prescribed
+			if !strings.EqualFold(prescription, tempRx.Prescription) {
+				return newError(errCodeInvalidArgument, "prescription must be the prescribed drug "+tempRx.Prescription).
+					withField("prescription").
+					withDetail("id", rxid).response()
+			}
+			// drugs the patient's formulary restricts need an approved prior authorization
+			if cerr := t.checkPriorAuth(stub, patientRecord, tempRx, now); cerr != nil {
+				return cerr.response()
+			}
+			// only the pharmacy holding the prescription may fill it
+			if cerr := patientRecord.checkRxHolder(key, c.Pharmacy, now); cerr != nil {
+				return cerr.response()
+			}
 			patientRecord.RxList[key].Pharmacist = pharmacist
 			patientRecord.RxList[key].PhLicense = phLicense
-			patientRecord.RxList[key].Prescription = prescription
 			patientRecord.RxList[key].Refills = refills
 			patientRecord.RxList[key].Status = status
 			patientRecord.RxList[key].Timestamp = timestamp
@@ -232,19 +280,21 @@ func (t *Chaincode) fillRx(stub shim.ChaincodeStubInterface, args []string) pb.R
 	}
 
 	if IfExists == false {
-		return shim.Error("RXID does not exist: " + rxid)
+		return notFound("RXID does not exist: "+rxid, rxid)
 	}
 
-	// convert struct to json bytes
-	patientRecordAsBytes, err = json.Marshal(patientRecord)
-	if err != nil {
-		return shim.Error(err.Error())
+	// send rx record to state ledger
+	if cerr := t.putRecord(stub, patientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+	if cerr := t.indexExpirations(stub, patientID, previous, patientRecord); cerr != nil {
+		return cerr.response()
 	}
 
-	// send rx record to state ledger
-	err = stub.PutState(patientID, patientRecordAsBytes)
+	// claims are matched to the fill through the index
+	err = t.createIndex(stub, indexRxFill, []string{patientRecord.PatientID, rxid, fmt.Sprintf("%013d", timestamp)})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError("unable to create rx fill index", err)
 	}
 
 	fmt.Println("- end modifyObject (success)")
@@ -256,44 +306,35 @@ func (t *Chaincode) approveRx(stub shim.ChaincodeStubInterface, args []string) p
 	//   0       	1      	2     		3
 	// "patientid", "rxid", timestamp,  "approved"
 	if len(args) < 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 9")
+		return incorrectArgCount("4")
 	}
 
 	// ==== Input sanitation ====
 	fmt.Println("- start init modifyObject")
 	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
 	}
 
 	if len(args[3]) <= 0 {
-		return shim.Error("4th argument must be a non-empty string")
+		return invalidArgument("approved", "4th argument must be a non-empty string")
 	}
 
 	patientID := args[0]
 	rxid := args[1]
 	timestamp, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error(err.Error())
+		return invalidArgument("timestamp", "3rd argument must be an integer string")
 	}
 
 	approved := args[3]
 
-	// retrieve patient record
-	patientRecordAsBytes, err := stub.GetState(patientID)
-	if err != nil {
-		return shim.Error("Failed to get record: " + patientID)
-	} else if patientRecordAsBytes == nil {
-		return shim.Error("patient record does not exist: " + patientID)
-	}
-
-	// create a patient record interface to load bytes into
-	patientRecord := EMR{}
-	err = json.Unmarshal(patientRecordAsBytes, &patientRecord)
-	if err != nil {
-		return shim.Error(err.Error())
+	// retrieve patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
 	}
 
 	// check if prescription record exists
@@ -301,6 +342,10 @@ func (t *Chaincode) approveRx(stub shim.ChaincodeStubInterface, args []string) p
 	for key, tempRx := range patientRecord.RxList {
 		// update rx record with new details
 		if tempRx.RXID == rxid {
+			// a cancelled or discontinued prescription stays as its prescriber left it
+			if tempRx.stopped() {
+				return failedPrecondition("rx is "+tempRx.Status+": "+rxid, rxid)
+			}
 			patientRecord.RxList[key].Timestamp = timestamp
 			patientRecord.RxList[key].Approved = approved
 			IfExists = true
@@ -308,19 +353,12 @@ func (t *Chaincode) approveRx(stub shim.ChaincodeStubInterface, args []string) p
 	}
 
 	if IfExists == false {
-		return shim.Error("RXID does not exist: " + rxid)
-	}
-
-	// convert struct to json bytes
-	patientRecordAsBytes, err = json.Marshal(patientRecord)
-	if err != nil {
-		return shim.Error(err.Error())
+		return notFound("RXID does not exist: "+rxid, rxid)
 	}
 
 	// send rx record to state ledger
-	err = stub.PutState(patientID, patientRecordAsBytes)
-	if err != nil {
-		return shim.Error(err.Error())
+	if cerr := t.putRecord(stub, patientID, patientRecord); cerr != nil {
+		return cerr.response()
 	}
 
 	fmt.Println("- end modifyObject (success)")
@@ -334,19 +372,12 @@ func (t *Chaincode) getRxHistoryOfPatient(stub shim.ChaincodeStubInterface, args
 
 	// check for args of RXID
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments, expecting 1")
+		return incorrectArgCount("1")
 	}
 
 	// convert patientID to lowercase
 	patientID := strings.ToLower(args[0])
 
-	// retrieve iterator of the history for a patient record
-	resultsIterator, err := stub.GetHistoryForKey(patientID)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	defer resultsIterator.Close()
-
 	// create struct that returns a history of past rx transactions
 	// RxHistory is a list that contains a point in time for every time the patients
 	// records prescription list changed
@@ -357,20 +388,9 @@ func (t *Chaincode) getRxHistoryOfPatient(stub shim.ChaincodeStubInterface, args
 		PatientID: patientID,
 	}
 
-	// check for results in the iterator
-	for resultsIterator.HasNext() {
-		// retrieve the results
-		response, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// create a temporary patient record to hold the iterators values
-		tempPatientRecord := EMR{}
-
-		// unmarshal bytes to temporary patient record
-		if err := json.Unmarshal(response.Value, &tempPatientRecord); err != nil {
-			return shim.Error(err.Error())
-		}
+	// walk the versions of the patient record
+	cerr := walkEMRHistory(stub, patientID, func(version emrVersion) *chaincodeError {
+		tempPatientRecord := version.Record
 
 		// check if the length of th last rxList is the same as the temporary
 		// patients record list
@@ -379,30 +399,29 @@ func (t *Chaincode) getRxHistoryOfPatient(stub shim.ChaincodeStubInterface, args
 		// else iterate through each prescription to see if it changed
 
 		if len(rxHistoryResponse.RxHistory) >= 0 && len(tempPatientRecord.RxList) == 0 {
-			continue
+			return nil
 		} else if len(rxHistoryResponse.RxHistory) == 0 && len(tempPatientRecord.RxList) >= 1 {
 			rxHistoryResponse.RxHistory = append(rxHistoryResponse.RxHistory, tempPatientRecord.RxList)
 		} else if len(rxHistoryResponse.RxHistory[len(rxHistoryResponse.RxHistory)-1]) != len(tempPatientRecord.RxList) {
 			rxHistoryResponse.RxHistory = append(rxHistoryResponse.RxHistory, tempPatientRecord.RxList)
 		} else {
+			// one snapshot per version however many prescriptions changed in it
 			for key, tempPatientRx := range tempPatientRecord.RxList {
 				if rxHistoryResponse.RxHistory[len(rxHistoryResponse.RxHistory)-1][key] != tempPatientRx {
 					rxHistoryResponse.RxHistory = append(rxHistoryResponse.RxHistory, tempPatientRecord.RxList)
+					break
 				}
 			}
 		}
-		// else {
-		// 	for key, rx := range tempPatientRecord.RxList {
-		// 		if rx != rxHistoryResponse.RxHistory[len(rxHistoryResponse.RxHistory)-1][key] {
-		// 			rxHistoryResponse.RxHistory = append(rxHistoryResponse.RxHistory, tempPatientRecord.RxList)
-		// 		}
-		// 	}
-		// }
+		return nil
+	})
+	if cerr != nil {
+		return cerr.response()
 	}
 
 	rxHistoryResponseAsBytes, err := json.Marshal(rxHistoryResponse)
 	if err != nil {
-		return shim.Error(err.Error())
+		return serializationError("unable to marshal rx history", err)
 	}
 
 	return shim.Success(rxHistoryResponseAsBytes)
@@ -414,27 +433,29 @@ func (t *Chaincode) getRxForPatient(stub shim.ChaincodeStubInterface, args []str
 	// "patientID"
 
 	if len(args) < 1 {
-		return shim.Error("Expectin 1 arguement: patientID")
+		return incorrectArgCount("1")
 	}
 
 	if len(args[0]) <= 0 {
-		return shim.Error("1st arguement must be a non empty string")
+		return invalidArgument("patientID", "1st arguement must be a non empty string")
 	}
 
 	patientID := args[0]
 
-	// create empty patient record interface
-	patientRecord := EMR{}
-
 	// get current state of the given patient record
-	patientRecordAsBytes, err := stub.GetState(patientID)
-	if err != nil {
-		return shim.Error("Unable to get record: " + err.Error())
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
 	}
 
-	// convert patient record as bytes to struct
-	if err := json.Unmarshal(patientRecordAsBytes, &patientRecord); err != nil {
-		return shim.Error(err.Error())
+	// prescriptions past their expiration date are shown as expired before expireRecords marks them
+	for key, prescription := range patientRecord.RxList {
+		patientRecord.RxList[key].Status = prescription.statusAt(now)
 	}
 
 	// create custom struct for response of list of prescriptions for a given patient
@@ -449,7 +470,7 @@ func (t *Chaincode) getRxForPatient(stub shim.ChaincodeStubInterface, args []str
 	// convert reponse to bytes
 	responseAsBytes, err := json.Marshal(response)
 	if err != nil {
-		return shim.Error(err.Error())
+		return serializationError("unable to marshal rx response", err)
 	}
 
 	// return results
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// rxChange
+// summary: one transaction that changed a prescription
+type rxChange struct {
+	TxID       string        `json:"txID"`
+	Timestamp  int           `json:"timestamp"`            // time of the transaction
+	ModifiedBy *caller       `json:"modifiedBy,omitempty"` // identity that submitted the transaction, empty when it had none
+	Change     string        `json:"change"`               // added, modified or removed
+	Fields     []fieldChange `json:"fields"`
+}
+
+// fieldChange
+// summary: the value of one field before and after a change, a missing value was not set
+type fieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+// kinds of rx changes
+const (
+	rxAdded    = "added"
+	rxModified = "modified"
+	rxRemoved  = "removed"
+)
+
+// getRxHistory
+// input: patientID, rxid
+// output: every change of the prescription oldest first with the fields it changed
+// summary: walks the history of the patient record and compares each version of the rx with the one before,
+// versions that did not change the rx are left out
+func (t *Chaincode) getRxHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1
+	// "patientID", "rxid"
+	if len(args) < 2 {
+		return incorrectArgCount("2")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+	rxid := args[1]
+
+	response := struct {
+		PatientID string     `json:"patientID"`
+		RXID      string     `json:"rxid"`
+		Changes   []rxChange `json:"changes"`
+	}{
+		PatientID: patientID,
+		RXID:      rxid,
+		Changes:   []rxChange{},
+	}
+
+	var previous *rx
+	cerr := walkEMRHistory(stub, patientID, func(version emrVersion) *chaincodeError {
+		var current *rx
+		if index := version.Record.rxIndex(rxid); index >= 0 {
+			current = &version.Record.RxList[index]
+		}
+
+		change := rxChange{
+			TxID:       version.TxID,
+			Timestamp:  version.Timestamp,
+			ModifiedBy: version.Record.ModifiedBy,
+		}
+		switch {
+		case previous == nil && current == nil:
+			return nil
+		case previous == nil:
+			change.Change = rxAdded
+			change.Fields = fieldChanges(nil, *current)
+		case current == nil:
+			change.Change = rxRemoved
+			change.Fields = fieldChanges(*previous, nil)
+		case *previous == *current:
+			return nil
+		default:
+			change.Change = rxModified
+			change.Fields = fieldChanges(*previous, *current)
+		}
+		response.Changes = append(response.Changes, change)
+		previous = current
+		return nil
+	})
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	if len(response.Changes) == 0 {
+		return notFound("RXID does not exist: "+rxid, rxid)
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal rx history", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// fieldChanges
+// input: two versions of a record, nil for a record that does not exist
+// output: the json fields whose values differ, sorted by name
+func fieldChanges(before interface{}, after interface{}) []fieldChange {
+	beforeFields := jsonFields(before)
+	afterFields := jsonFields(after)
+
+	names := []string{}
+	for name := range beforeFields {
+		names = append(names, name)
+	}
+	for name := range afterFields {
+		if _, seen := beforeFields[name]; !seen {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []fieldChange{}
+	for _, name := range names {
+		if !reflect.DeepEqual(beforeFields[name], afterFields[name]) {
+			changes = append(changes, fieldChange{Field: name, From: beforeFields[name], To: afterFields[name]})
+		}
+	}
+	return changes
+}
+
+// jsonFields returns the fields of the record as it is stored
+func jsonFields(record interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return fields
+	}
+	if err := json.Unmarshal(recordAsBytes, &fields); err != nil {
+		return map[string]interface{}{}
+	}
+	return fields
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetRxHistory(t *testing.T) {
+	stub := newTestStub(t)
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	// changes of other prescriptions are left out
+	mustInvoke(t, stub, "insertRx", "p01", "rx02", "1541440675318", "dr smith", "doc01", "ibuprofen", "1", "20", "1572976675318", "prescribed")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "fillRx", rxFillArgs("ph01", "1541500000000")...)
+	mustInvoke(t, stub, "approveRx", "p01", "rx01", "1541500000001", "true")
+
+	expectGolden(t, "getRxHistory", mustInvoke(t, stub, "getRxHistory", "P01", "rx01"))
+
+	var response struct{ Changes []rxChange }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRxHistory", "p01", "rx02"), &response)
+	if len(response.Changes) != 1 || response.Changes[0].Change != rxAdded || response.Changes[0].ModifiedBy.License != "doc01" {
+		t.Errorf("expected rx02 to be added by doc01, got %+v", response.Changes)
+	}
+
+	expectError(t, invoke(stub, "getRxHistory", "p01", "rx99"), errCodeNotFound)
+	expectInvalidArgs(t, "getRxHistory", []argCase{
+		{"too few args", []string{"p01"}, ""},
+		{"empty rxid", []string{"p01", ""}, "rxid"},
+	})
+}
+
+// a version that changes several prescriptions is one snapshot
+func TestGetRxHistoryOfPatientSnapshots(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "p01", `{"objType":"emr","id":"p01","rxList":[{"rxid":"rx01","status":"prescribed"},{"rxid":"rx02","status":"prescribed"}]}`)
+	putRaw(stub, "p01", `{"objType":"emr","id":"p01","rxList":[{"rxid":"rx01","status":"filled"},{"rxid":"rx02","status":"filled"}]}`)
+
+	var response struct{ RxHistory [][]rx }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRxHistoryOfPatient", "p01"), &response)
+	if len(response.RxHistory) != 2 {
+		t.Errorf("expected 2 snapshots, got %d", len(response.RxHistory))
+	}
+}
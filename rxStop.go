@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// statuses of a prescription that was stopped by its prescriber, fillRx refuses both
+const (
+	rxCancelled    = "cancelled"    // stopped before it was ever filled
+	rxDiscontinued = "discontinued" // therapy stopped after fills
+)
+
+// rxStoppedEvent is the name of the chaincode event sent to the pharmacy holding a stopped prescription
+const rxStoppedEvent = "rxStopped"
+
+// reasons a prescriber may give for stopping a prescription
+var rxStopReasons = []string{
+	"adverseReaction",  // the patient reacted to the drug
+	"ineffective",      // the drug did not work
+	"duplicateTherapy", // another prescription treats the same problem
+	"prescribingError", // the prescription was written wrong
+	"patientRequest",   // the patient asked to stop
+	"therapyCompleted", // the patient no longer needs the drug
+	"other",            // explained in the note
+}
+
+// rxStopped
+// summary: payload of the rxStopped event
+type rxStopped struct {
+	PatientID  string `json:"patientID"`
+	RXID       string `json:"rxid"`
+	Pharmacy   string `json:"pharmacy"` // license of the pharmacy holding the prescription
+	Status     string `json:"status"`
+	StopReason string `json:"stopReason"`
+	StopNote   string `json:"stopNote,omitempty"`
+	StoppedBy  string `json:"stoppedBy"`
+	StoppedAt  int    `json:"stoppedAt"`
+}
+
+// cancelRx
+// input: patientID, rxid, reason code, note
+// output: confirmation of record saved
+// summary: stop a prescription that was never filled, only the prescribing doctor or an admin may cancel
+func (t *Chaincode) cancelRx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.stopRx(stub, args, rxCancelled)
+}
+
+// discontinueRx
+// input: patientID, rxid, reason code, note
+// output: confirmation of record saved
+// summary: stop the therapy of a prescription, the pharmacy holding it gets the rxStopped event.
+// only the prescribing doctor or an admin may discontinue
+func (t *Chaincode) discontinueRx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.stopRx(stub, args, rxDiscontinued)
+}
+
+// stopRx sets the status of a prescription to cancelled or discontinued and declines its pending transfer
+func (t *Chaincode) stopRx(stub shim.ChaincodeStubInterface, args []string, status string) pb.Response {
+	//	0			1		2			3
+	// "patientID", "rxid", "reason", "note"
+	if len(args) < 4 {
+		return incorrectArgCount("4")
+	}
+
+	fmt.Println("- start stopRx " + status)
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
+	}
+	if !containsString(rxStopReasons, args[2]) {
+		return invalidArgument("reason", "3rd argument must be one of "+strings.Join(rxStopReasons, ", "))
+	}
+	note := strings.TrimSpace(args[3])
+	if args[2] == "other" && note == "" {
+		return invalidArgument("note", "4th argument must be a non-empty string when the reason is other")
+	}
+
+	c, cerr := requireRole(stub, roleDoctor, roleAdmin)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, strings.ToLower(args[0]))
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	rxid := args[1]
+	index := patientRecord.rxIndex(rxid)
+	if index < 0 {
+		return notFound("RXID does not exist: "+rxid, rxid)
+	}
+	// a stopped prescription no longer expires
+	previous := patientRecord.expirationEntries(patientRecord.PatientID)
+	stopped := &patientRecord.RxList[index]
+
+	if c.Role == roleDoctor && c.License != stopped.DocLicense {
+		return newError(errCodePermissionDenied, "only the prescribing doctor may stop the prescription").
+			withDetail("docLicense", stopped.DocLicense).response()
+	}
+	if stopped.stopped() {
+		return failedPrecondition("rx is already "+stopped.Status+": "+rxid, rxid)
+	}
+	if status == rxCancelled && stopped.holder() != "" {
+		return failedPrecondition("rx was filled and can only be discontinued: "+rxid, rxid)
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	stoppedBy := c.License
+	if stoppedBy == "" {
+		stoppedBy = c.ID
+	}
+
+	stopped.Status = status
+	stopped.StopReason = args[2]
+	stopped.StopNote = note
+	stopped.StoppedBy = stoppedBy
+	stopped.StoppedAt = now
+
+	if pending := patientRecord.pendingRxTransfer(rxid); pending >= 0 {
+		patientRecord.RxTransfers[pending].Status = rxTransferDeclined
+		patientRecord.RxTransfers[pending].DecidedAt = now
+		patientRecord.RxTransfers[pending].Reason = "rx " + status
+	}
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+	if cerr := t.indexExpirations(stub, patientRecord.PatientID, previous, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	// the pharmacy holding the prescription must stop dispensing it
+	if holder := stopped.holder(); holder != "" {
+		eventAsBytes, err := json.Marshal(rxStopped{
+			PatientID:  patientRecord.PatientID,
+			RXID:       rxid,
+			Pharmacy:   holder,
+			Status:     status,
+			StopReason: stopped.StopReason,
+			StopNote:   note,
+			StoppedBy:  stoppedBy,
+			StoppedAt:  now,
+		})
+		if err != nil {
+			return serializationError("unable to marshal rx stopped event", err)
+		}
+		if err := stub.SetEvent(rxStoppedEvent, eventAsBytes); err != nil {
+			return ledgerError("unable to set rx stopped event", err)
+		}
+	}
+
+	fmt.Println("- end stopRx (success)")
+	return shim.Success(nil)
+}
+
+// stopped is true for a prescription its prescriber cancelled or discontinued
+func (r rx) stopped() bool {
+	return isStopStatus(r.Status)
+}
+
+// isStopStatus is true for the statuses only stopRx may set
+func isStopStatus(status string) bool {
+	return status == rxCancelled || status == rxDiscontinued
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCancelRx(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+
+	expectError(t, invoke(stub, "cancelRx", "p01", "rx01", "prescribingError", ""), errCodePermissionDenied)
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc02"})
+	expectError(t, invoke(stub, "cancelRx", "p01", "rx01", "prescribingError", ""), errCodePermissionDenied)
+
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	expectError(t, invoke(stub, "cancelRx", "p01", "rx99", "prescribingError", ""), errCodeNotFound)
+	mustInvoke(t, stub, "cancelRx", "P01", "rx01", "prescribingError", "wrong strength")
+	expectError(t, invoke(stub, "cancelRx", "p01", "rx01", "prescribingError", ""), errCodeFailedPrecondition)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	expectError(t, invoke(stub, "fillRx", "p01", "rx01", "1541500000000", "ph jones", "ph01", "amoxicillin", "1", "1572976675318", "filled"), errCodeFailedPrecondition)
+
+	// nobody held the prescription, so nobody is notified
+	if len(stub.events) != 0 {
+		t.Errorf("expected no events, got %v", stub.events)
+	}
+	expectGolden(t, "getRxForPatient-cancelled", mustInvoke(t, stub, "getRxForPatient", "p01", "rx01"))
+
+	expectInvalidArgs(t, "cancelRx", []argCase{
+		{"too few args", []string{"p01", "rx01", "other"}, ""},
+		{"empty rxid", []string{"p01", "", "other", "note"}, "rxid"},
+		{"unknown reason", []string{"p01", "rx01", "tooExpensive", ""}, "reason"},
+		{"other without note", []string{"p01", "rx01", "other", " "}, "note"},
+	})
+}
+
+func TestDiscontinueRx(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	setRole(t, stub, roleAdmin, nil)
+	for _, license := range []string{"ph01", "ph02"} {
+		mustInvoke(t, stub, "registerProvider", license, "pharmacy "+license)
+	}
+	fillRxAt(t, stub, "ph01", "1541500000000")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph01", "ph02")
+
+	// a filled prescription can only be discontinued
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	expectError(t, invoke(stub, "cancelRx", "p01", "rx01", "ineffective", ""), errCodeFailedPrecondition)
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "discontinueRx", "p01", "rx01", "adverseReaction", "rash")
+
+	if len(stub.events) != 1 || stub.events[0].EventName != rxStoppedEvent {
+		t.Fatalf("expected one rxStopped event, got %v", stub.events)
+	}
+	event := rxStopped{}
+	mustUnmarshal(t, stub.events[0].Payload, &event)
+	if event.Pharmacy != "ph01" || event.Status != rxDiscontinued || event.StopReason != "adverseReaction" {
+		t.Errorf("expected the holding pharmacy ph01 to be notified, got %+v", event)
+	}
+
+	var response struct{ Transfers []rxTransfer }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRxTransfers", "p01", "rx01"), &response)
+	if len(response.Transfers) != 1 || response.Transfers[0].Status != rxTransferDeclined {
+		t.Errorf("expected the pending transfer to be declined, got %+v", response.Transfers)
+	}
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	expectError(t, invoke(stub, "fillRx", rxFillArgs("ph01", "1541500000001")...), errCodeFailedPrecondition)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph01", "ph02"), errCodeFailedPrecondition)
+
+	if status := fhirMedicationRequestStatus(rxDiscontinued); status != "stopped" {
+		t.Errorf("expected a discontinued rx to export as stopped, got %s", status)
+	}
+}
+
+// the stop statuses are only set by cancelRx and discontinueRx, with their checks, reason and event
+func TestStopStatusOnlyThroughStopRx(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+
+	for _, status := range []string{rxCancelled, rxDiscontinued} {
+		inserted := append([]string{}, insertRxArgs...)
+		inserted[1], inserted[9] = "rx02", status
+		if cerr := expectError(t, invoke(stub, "insertRx", inserted...), errCodeInvalidArgument); cerr.Field != "status" {
+			t.Errorf("insertRx %s: expected field status, got %s", status, cerr.Field)
+		}
+		filled := rxFillArgs("ph01", "1541500000000")
+		filled[8] = status
+		setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+		if cerr := expectError(t, invoke(stub, "fillRx", filled...), errCodeInvalidArgument); cerr.Field != "status" {
+			t.Errorf("fillRx %s: expected field status, got %s", status, cerr.Field)
+		}
+	}
+
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	mustInvoke(t, stub, "cancelRx", "p01", "rx01", "prescribingError", "")
+	expectError(t, invoke(stub, "approveRx", "p01", "rx01", "1541500000000", "true"), errCodeFailedPrecondition)
+}
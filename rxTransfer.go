@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// rxTransfer
+// summary: moving a prescription and its remaining refills from the pharmacy that holds it to another one
+type rxTransfer struct {
+	RXID        string `json:"rxid"`
+	From        string `json:"from"` // license of the pharmacy that held the rx
+	To          string `json:"to"`   // license of the pharmacy the rx moves to
+	Refills     int    `json:"refills"`
+	Status      string `json:"status"`      // pending, completed or declined
+	RequestedBy string `json:"requestedBy"` // id of the caller that asked for the transfer
+	RequestedAt int    `json:"requestedAt"`
+	DecidedBy   string `json:"decidedBy,omitempty"` // id of the caller that decided, empty when the transfer was accepted automatically
+	DecidedAt   int    `json:"decidedAt,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// status values of a transfer
+const (
+	rxTransferPending   = "pending"
+	rxTransferCompleted = "completed"
+	rxTransferDeclined  = "declined"
+)
+
+// time the holding pharmacy has to answer a transfer before the receiving pharmacy's next fill accepts it
+const rxTransferResponseWindow = 72 * 60 * 60 * 1000
+
+// transferRx
+// input: patientID, rxid, license of the pharmacy holding the rx, license of the pharmacy it moves to
+// output: the transfer
+// summary: move a prescription to another pharmacy, the remaining refills move with it. the transfer completes
+// at once when the holding pharmacy's registration was revoked, otherwise it waits for the holding pharmacy's
+// answer with respondRxTransfer. the receiving pharmacist and the patient may ask for a transfer
+func (t *Chaincode) transferRx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1		2				3
+	// "patientID", "rxid", "fromPharmacy", "toPharmacy"
+	if len(args) < 4 {
+		return incorrectArgCount("4")
+	}
+
+	fmt.Println("- start transferRx")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return invalidArgument("fromPharmacy", "3rd argument must be a non-empty string")
+	}
+	if len(args[3]) <= 0 {
+		return invalidArgument("toPharmacy", "4th argument must be a non-empty string")
+	}
+	if args[2] == args[3] {
+		return invalidArgument("toPharmacy", "4th argument must not be the 3rd")
+	}
+
+	patientID := strings.ToLower(args[0])
+	rxid := args[1]
+	from := args[2]
+	to := args[3]
+
+	c, cerr := requireRole(stub, rolePharmacist, rolePatient)
+	if cerr != nil {
+		return cerr.response()
+	}
+	if c.Role == rolePatient && c.PatientID != patientID {
+		return newError(errCodePermissionDenied, "patients may only transfer their own prescriptions").
+			withDetail("patientID", patientID).response()
+	}
+	if c.Role == rolePharmacist && c.Pharmacy != to {
+		return newError(errCodePermissionDenied, "pharmacists may only ask for transfers to their own pharmacy").
+			withField("toPharmacy").
+			withDetail("pharmacy", c.Pharmacy).response()
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, patientID)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	index := patientRecord.rxIndex(rxid)
+	if index < 0 {
+		return notFound("RXID does not exist: "+rxid, rxid)
+	}
+	transferred := patientRecord.RxList[index]
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	if holder := transferred.holder(); holder != from {
+		return newError(errCodeFailedPrecondition, "rx is not held by "+from).
+			withField("fromPharmacy").
+			withDetail("id", rxid).
+			withDetail("holder", holder).response()
+	}
+	if status := transferred.statusAt(now); transferred.stopped() || status == statusExpired {
+		return failedPrecondition("rx is "+status+": "+rxid, rxid)
+	}
+	if transferred.Refills <= 0 {
+		return failedPrecondition("rx has no refills left to transfer: "+rxid, rxid)
+	}
+	if patientRecord.pendingRxTransfer(rxid) >= 0 {
+		return failedPrecondition("rx already has a pending transfer: "+rxid, rxid)
+	}
+
+	// the receiving pharmacy must be an active provider
+	receiving, cerr := t.providerStatus(stub, to)
+	if cerr != nil {
+		return cerr.response()
+	}
+	if receiving != providerActive {
+		return newError(errCodeFailedPrecondition, "pharmacy is not an active provider: "+to).
+			withField("toPharmacy").
+			withDetail("id", to).response()
+	}
+
+	transfer := rxTransfer{
+		RXID:        rxid,
+		From:        from,
+		To:          to,
+		Refills:     transferred.Refills,
+		Status:      rxTransferPending,
+		RequestedBy: c.ID,
+		RequestedAt: now,
+	}
+
+	// a revoked holding pharmacy can not answer, one that never registered still holds the rx
+	holding, cerr := t.providerStatus(stub, from)
+	if cerr != nil {
+		return cerr.response()
+	}
+	if holding == providerRevoked {
+		transfer.Reason = "holding pharmacy was revoked"
+		patientRecord.completeRxTransfer(index, &transfer, now)
+	}
+	patientRecord.RxTransfers = append(patientRecord.RxTransfers, transfer)
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	transferAsBytes, err := json.Marshal(transfer)
+	if err != nil {
+		return serializationError("unable to marshal transfer", err)
+	}
+
+	fmt.Println("- end transferRx (success)")
+	return shim.Success(transferAsBytes)
+}
+
+// respondRxTransfer
+// input: patientID, rxid, decision (accept or decline), reason
+// output: confirmation of record saved
+// summary: answer the pending transfer of a prescription, only a pharmacist of the pharmacy holding the rx may answer
+func (t *Chaincode) respondRxTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1		2			3
+	// "patientID", "rxid", "decision", "reason"
+	if len(args) < 4 {
+		return incorrectArgCount("4")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return invalidArgument("rxid", "2nd argument must be a non-empty string")
+	}
+	decision := strings.ToLower(args[2])
+	if decision != "accept" && decision != "decline" {
+		return invalidArgument("decision", "3rd argument must be accept or decline")
+	}
+	if decision == "decline" && len(strings.TrimSpace(args[3])) <= 0 {
+		return invalidArgument("reason", "4th argument must be a non-empty string when declining")
+	}
+
+	c, cerr := requirePharmacy(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// get patient record, fails if it is missing, corrupt or not an EMR
+	patientRecord, cerr := t.getEMR(stub, strings.ToLower(args[0]))
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	rxid := args[1]
+	pending := patientRecord.pendingRxTransfer(rxid)
+	if pending < 0 {
+		return notFound("rx has no pending transfer: "+rxid, rxid)
+	}
+	transfer := &patientRecord.RxTransfers[pending]
+	if c.Pharmacy != transfer.From {
+		return newError(errCodePermissionDenied, "only the holding pharmacy may answer a transfer").
+			withDetail("holder", transfer.From).response()
+	}
+
+	now, cerr := txMillis(stub)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	transfer.DecidedBy = c.ID
+	transfer.Reason = strings.TrimSpace(args[3])
+	if decision == "accept" {
+		patientRecord.completeRxTransfer(patientRecord.rxIndex(rxid), transfer, now)
+	} else {
+		transfer.Status = rxTransferDeclined
+		transfer.DecidedAt = now
+	}
+
+	// put record to state ledger
+	if cerr := t.putRecord(stub, patientRecord.PatientID, patientRecord); cerr != nil {
+		return cerr.response()
+	}
+
+	return shim.Success(nil)
+}
+
+// getRxTransfers
+// input: patientID, optional rxid
+// output: the transfers of the patient's prescriptions, all of them when no rxid is given
+func (t *Chaincode) getRxTransfers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)
+	// "patientID", "rxid"
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	rxid := ""
+	if len(args) > 1 {
+		rxid = args[1]
+	}
+
+	// get current state of the given patient record
+	patientRecord, cerr := t.getEMR(stub, strings.ToLower(args[0]))
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID string       `json:"patientID"`
+		Transfers []rxTransfer `json:"transfers"`
+	}{
+		PatientID: patientRecord.PatientID,
+		Transfers: []rxTransfer{},
+	}
+	for _, transfer := range patientRecord.RxTransfers {
+		if rxid == "" || transfer.RXID == rxid {
+			response.Transfers = append(response.Transfers, transfer)
+		}
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal transfers response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// checkRxHolder
+// input: patient record, position of the rx being filled, license of the filling pharmacy and the tx timestamp
+// output: nil or a FAILED_PRECONDITION error if another pharmacy holds the rx
+// summary: the first fill makes the filling pharmacy the holder. a pending transfer to the filling pharmacy
+// the holder did not answer within rxTransferResponseWindow is accepted by the fill
+func (e *EMR) checkRxHolder(index int, pharmacy string, now int) *chaincodeError {
+	filled := e.RxList[index]
+	holder := filled.holder()
+	if holder == "" || holder == pharmacy {
+		e.RxList[index].Pharmacy = pharmacy
+		return nil
+	}
+
+	if pending := e.pendingRxTransfer(filled.RXID); pending >= 0 {
+		transfer := &e.RxTransfers[pending]
+		if transfer.To == pharmacy && now-transfer.RequestedAt >= rxTransferResponseWindow {
+			transfer.Reason = "holding pharmacy did not answer"
+			e.completeRxTransfer(index, transfer, now)
+			return nil
+		}
+	}
+
+	return newError(errCodeFailedPrecondition, "rx is held by another pharmacy: "+filled.RXID).
+		withDetail("id", filled.RXID).
+		withDetail("holder", holder)
+}
+
+// completeRxTransfer moves the rx at index to the transfer's receiving pharmacy
+func (e *EMR) completeRxTransfer(index int, transfer *rxTransfer, now int) {
+	transfer.Status = rxTransferCompleted
+	transfer.DecidedAt = now
+	transfer.Refills = e.RxList[index].Refills
+	e.RxList[index].Pharmacy = transfer.To
+}
+
+// pendingRxTransfer returns the position of the rx's pending transfer or -1
+func (e EMR) pendingRxTransfer(rxid string) int {
+	for index, transfer := range e.RxTransfers {
+		if transfer.RXID == rxid && transfer.Status == rxTransferPending {
+			return index
+		}
+	}
+	return -1
+}
+
+// holder returns the license of the pharmacy that holds the rx. prescriptions filled before transfers were
+// recorded only have the license of the pharmacist, they are held by no pharmacy until their next fill
+func (r rx) holder() string {
+	return r.Pharmacy
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTransferStub returns a stub where rx01 was filled by ph01 and ph01, ph02 and ph03 are registered
+func newTransferStub(t *testing.T) *historyStub {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	setRole(t, stub, roleAdmin, nil)
+	for _, license := range []string{"ph01", "ph02", "ph03"} {
+		mustInvoke(t, stub, "registerProvider", license, "pharmacy "+license)
+	}
+	fillRxAt(t, stub, "ph01", "1541500000000")
+	return stub
+}
+
+func TestTransferRx(t *testing.T) {
+	stub := newTransferStub(t)
+
+	// the first fill made ph01 the holder, pharmacists only fill for their own license
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	cerr := expectError(t, invoke(stub, "fillRx", rxFillArgs("ph01", "1541500000001")...), errCodePermissionDenied)
+	if cerr.Field != "phLicense" {
+		t.Errorf("expected field phLicense, got %+v", cerr)
+	}
+	cerr = expectError(t, invoke(stub, "fillRx", rxFillArgs("ph02", "1541500000001")...), errCodeFailedPrecondition)
+	if cerr.Details["holder"] != "ph01" {
+		t.Errorf("expected the fill to be refused for the holder ph01, got %+v", cerr)
+	}
+
+	setRole(t, stub, roleAdmin, nil)
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph01", "ph02"), errCodePermissionDenied)
+
+	// the receiving pharmacy asks, the transfer waits for the holder
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph01", "ph03"), errCodePermissionDenied)
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph03", "ph02"), errCodeFailedPrecondition)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph09", attrPharmacy: "ph09"})
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph01", "ph09"), errCodeFailedPrecondition)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph01", "ph02")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph03", attrPharmacy: "ph03"})
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph01", "ph03"), errCodeFailedPrecondition)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	expectError(t, invoke(stub, "fillRx", rxFillArgs("ph02", "1541500000001")...), errCodeFailedPrecondition)
+	expectError(t, invoke(stub, "respondRxTransfer", "p01", "rx01", "accept", ""), errCodePermissionDenied)
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "respondRxTransfer", "p01", "rx01", "accept", "")
+	expectError(t, invoke(stub, "respondRxTransfer", "p01", "rx01", "accept", ""), errCodeNotFound)
+	expectError(t, invoke(stub, "fillRx", rxFillArgs("ph01", "1541500000001")...), errCodeFailedPrecondition)
+	fillRxAt(t, stub, "ph02", "1541500000001")
+
+	// the patient asks, the holder declines
+	setRole(t, stub, rolePatient, map[string]string{attrPatientID: "p02"})
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph02", "ph03"), errCodePermissionDenied)
+	setRole(t, stub, rolePatient, map[string]string{attrPatientID: "p01"})
+	mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph02", "ph03")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	mustInvoke(t, stub, "respondRxTransfer", "p01", "rx01", "decline", "controlled substance, patient must call")
+
+	// only the receiving pharmacy asks, the holder answers
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph02", "ph03"), errCodePermissionDenied)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph03", attrPharmacy: "ph03"})
+	mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph02", "ph03")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	mustInvoke(t, stub, "respondRxTransfer", "p01", "rx01", "accept", "")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph03", attrPharmacy: "ph03"})
+	mustInvoke(t, stub, "fillRx", "p01", "rx01", "1541500000002", "ph ph03", "ph03", "amoxicillin", "0", "1572976675318", "filled")
+	// no refills are left to move
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	expectError(t, invoke(stub, "transferRx", "p01", "rx01", "ph03", "ph01"), errCodeFailedPrecondition)
+
+	expectGolden(t, "getRxTransfers", mustInvoke(t, stub, "getRxTransfers", "p01", "rx01"))
+
+	expectInvalidArgs(t, "transferRx", []argCase{
+		{"too few args", []string{"p01", "rx01", "ph01"}, ""},
+		{"empty rxid", []string{"p01", "", "ph01", "ph02"}, "rxid"},
+		{"empty fromPharmacy", []string{"p01", "rx01", "", "ph02"}, "fromPharmacy"},
+		{"same pharmacy", []string{"p01", "rx01", "ph01", "ph01"}, "toPharmacy"},
+	})
+	expectInvalidArgs(t, "respondRxTransfer", []argCase{
+		{"too few args", []string{"p01", "rx01", "accept"}, ""},
+		{"unknown decision", []string{"p01", "rx01", "maybe", ""}, "decision"},
+		{"decline without reason", []string{"p01", "rx01", "decline", " "}, "reason"},
+	})
+}
+
+func TestTransferRxAutomaticAcceptance(t *testing.T) {
+	stub := newTransferStub(t)
+
+	// a revoked holder can not answer
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "revokeProvider", "ph01")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	var transfer rxTransfer
+	mustUnmarshal(t, mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph01", "ph02"), &transfer)
+	if transfer.Status != rxTransferCompleted || transfer.Refills != 1 {
+		t.Errorf("expected a completed transfer of 1 refill, got %+v", transfer)
+	}
+
+	// a holder that does not answer in time
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph03", attrPharmacy: "ph03"})
+	mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph02", "ph03")
+	expectError(t, invoke(stub, "fillRx", rxFillArgs("ph03", "1541500000001")...), errCodeFailedPrecondition)
+	next := stub.now
+	stub.now = func() time.Time { return next().Add(rxTransferResponseWindow * time.Millisecond) }
+	mustInvoke(t, stub, "fillRx", rxFillArgs("ph03", "1541500000001")...)
+
+	var response struct{ Transfers []rxTransfer }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRxTransfers", "p01"), &response)
+	if len(response.Transfers) != 2 || response.Transfers[1].Status != rxTransferCompleted || response.Transfers[1].DecidedBy != "" {
+		t.Errorf("expected the fill to accept the transfer, got %+v", response.Transfers)
+	}
+}
+
+// a holder that never registered is asked like an active one
+func TestTransferRxUnregisteredHolder(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	setRole(t, stub, roleAdmin, nil)
+	mustInvoke(t, stub, "registerProvider", "ph02", "pharmacy ph02")
+	fillRxAt(t, stub, "ph01", "1541500000000")
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	var transfer rxTransfer
+	mustUnmarshal(t, mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph01", "ph02"), &transfer)
+	if transfer.Status != rxTransferPending {
+		t.Errorf("expected the transfer to wait for ph01, got %+v", transfer)
+	}
+}
+
+// the rx is held by the pharmacy, not by the pharmacist that filled it
+func TestTransferRxOtherPharmacistOfHolder(t *testing.T) {
+	stub := newTransferStub(t)
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "rph07"})
+	expectError(t, invoke(stub, "fillRx", rxFillArgs("rph07", "1541500000001")...), errCodePermissionDenied)
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "rph07", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "fillRx", rxFillArgs("rph07", "1541500000001")...)
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	mustInvoke(t, stub, "transferRx", "p01", "rx01", "ph01", "ph02")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "rph07", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "respondRxTransfer", "p01", "rx01", "accept", "")
+
+	var prescriptions struct{ RxList []rx }
+	mustUnmarshal(t, mustInvoke(t, stub, "getRxForPatient", "p01"), &prescriptions)
+	if held := prescriptions.RxList[0]; held.Pharmacy != "ph02" || held.PhLicense != "rph07" {
+		t.Errorf("expected rx01 filled by rph07 to move to ph02, got %+v", held)
+	}
+}
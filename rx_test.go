@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+// rx01 prescribed by doc01 for p01
+var insertRxArgs = []string{"p01", "rx01", "1541440675318", "dr smith", "doc01", "amoxicillin", "2", "30", "1572976675318", "prescribed"}
+
+func TestInsertRx(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	expectError(t, invoke(stub, "insertRx", insertRxArgs...), errCodeAlreadyExists)
+
+	expectGolden(t, "getRxForPatient-inserted", mustInvoke(t, stub, "getRxForPatient", "p01"))
+
+	expectInvalidArgs(t, "insertRx", []argCase{
+		{"too few args", []string{"p01", "rx01"}, ""},
+		{"empty patientID", []string{"", "rx01", "1", "dr", "doc01", "amoxicillin", "2", "30", "1", "prescribed"}, "patientID"},
+		{"empty rxid", []string{"p01", "", "1", "dr", "doc01", "amoxicillin", "2", "30", "1", "prescribed"}, "rxid"},
+		{"bad timestamp", []string{"p01", "rx01", "now", "dr", "doc01", "amoxicillin", "2", "30", "1", "prescribed"}, "timestamp"},
+		{"empty doctor", []string{"p01", "rx01", "1", "", "doc01", "amoxicillin", "2", "30", "1", "prescribed"}, "doctor"},
+		{"empty docLicense", []string{"p01", "rx01", "1", "dr", "", "amoxicillin", "2", "30", "1", "prescribed"}, "docLicense"},
+		{"empty prescription", []string{"p01", "rx01", "1", "dr", "doc01", "", "2", "30", "1", "prescribed"}, "prescription"},
+		{"bad refills", []string{"p01", "rx01", "1", "dr", "doc01", "amoxicillin", "two", "30", "1", "prescribed"}, "refills"},
+		{"bad quantity", []string{"p01", "rx01", "1", "dr", "doc01", "amoxicillin", "2", "lots", "1", "prescribed"}, "quantity"},
+		{"bad expDate", []string{"p01", "rx01", "1", "dr", "doc01", "amoxicillin", "2", "30", "soon", "prescribed"}, "expDate"},
+		{"empty status", []string{"p01", "rx01", "1", "dr", "doc01", "amoxicillin", "2", "30", "1", ""}, "status"},
+	})
+}
+
+func TestFillRx(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	fillArgs := []string{"p01", "rx01", "1541440700000", "ph jones", "ph01", "amoxicillin", "1", "1572976675318", "filled"}
+
+	// only pharmacists fill, and only as the pharmacy of their license
+	expectError(t, invoke(stub, "fillRx", fillArgs...), errCodePermissionDenied)
+	setRole(t, stub, roleDoctor, map[string]string{attrLicense: "doc01"})
+	expectError(t, invoke(stub, "fillRx", fillArgs...), errCodePermissionDenied)
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph02", attrPharmacy: "ph02"})
+	expectError(t, invoke(stub, "fillRx", fillArgs...), errCodePermissionDenied)
+
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	expectError(t, invoke(stub, "fillRx", "p01", "rx02", "1541440700000", "ph jones", "ph01", "amoxicillin", "1", "1572976675318", "filled"), errCodeNotFound)
+
+	expectInvalidArgs(t, "fillRx", []argCase{
+		{"too few args", []string{"p01", "rx01"}, ""},
+		{"empty rxid", []string{"p01", "", "1", "ph", "ph01", "amoxicillin", "1", "1", "filled"}, "rxid"},
+		{"empty pharmacist", []string{"p01", "rx01", "1", "", "ph01", "amoxicillin", "1", "1", "filled"}, "pharmacist"},
+		{"empty phLicense", []string{"p01", "rx01", "1", "ph", "", "amoxicillin", "1", "1", "filled"}, "phLicense"},
+		{"bad refills", []string{"p01", "rx01", "1", "ph", "ph01", "amoxicillin", "one", "1", "filled"}, "refills"},
+		{"empty status", []string{"p01", "rx01", "1", "ph", "ph01", "amoxicillin", "1", "1", ""}, "status"},
+	})
+}
+
+func TestApproveRx(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectError(t, invoke(stub, "approveRx", "p01", "rx01", "1541440690000", "true"), errCodeNotFound)
+
+	expectInvalidArgs(t, "approveRx", []argCase{
+		{"too few args", []string{"p01"}, ""},
+		{"empty rxid", []string{"p01", "", "1", "true"}, "rxid"},
+		{"bad timestamp", []string{"p01", "rx01", "now", "true"}, "timestamp"},
+		{"empty approved", []string{"p01", "rx01", "1", ""}, "approved"},
+	})
+}
+
+func TestGetRxForPatient(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "getRxForPatient-empty", mustInvoke(t, stub, "getRxForPatient", "p01"))
+	expectError(t, invoke(stub, "getRxForPatient", "p99"), errCodeNotFound)
+
+	expectInvalidArgs(t, "getRxForPatient", []argCase{
+		{"no args", nil, ""},
+		{"empty patientID", []string{""}, "patientID"},
+	})
+}
+
+// a prescription moves from the doctor through the insurer to the pharmacy
+func TestRxScenario(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "insertRx", insertRxArgs...)
+	mustInvoke(t, stub, "approveRx", "p01", "rx01", "1541440690000", "true")
+	setRole(t, stub, rolePharmacist, map[string]string{attrLicense: "ph01", attrPharmacy: "ph01"})
+	mustInvoke(t, stub, "fillRx", "p01", "rx01", "1541440700000", "ph jones", "ph01", "amoxicillin", "1", "1572976675318", "filled")
+
+	expectGolden(t, "getRxForPatient-filled", mustInvoke(t, stub, "getRxForPatient", "p01"))
+	expectGolden(t, "getRxHistoryOfPatient", mustInvoke(t, stub, "getRxHistoryOfPatient", "p01"))
+
+	// the other patient is not affected
+	expectGolden(t, "getRxForPatient-p02", mustInvoke(t, stub, "getRxForPatient", "p02"))
+}
+
+func TestGetRxHistoryOfPatient(t *testing.T) {
+	stub := newTestStub(t)
+
+	expectGolden(t, "getRxHistoryOfPatient-empty", mustInvoke(t, stub, "getRxHistoryOfPatient", "p01"))
+	expectError(t, invoke(stub, "getRxHistoryOfPatient"), errCodeInvalidArgument)
+}
@@ -0,0 +1,19 @@
+//go:build !gateway
+// +build !gateway
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Main
+// starts the chaincode on the peer, see gateway.go for running it locally
+func main() {
+	err := shim.Start(new(Chaincode))
+	if err != nil {
+		fmt.Printf("Error starting File Trace chaincode: %s", err)
+	}
+}
@@ -0,0 +1,271 @@
+//go:build !gateway
+// +build !gateway
+
+package main
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// historyStub
+// summary: in-memory stub used by the unit tests and the local gateway. it is kept in a test file so it is
+// left out of the chaincode built for the peer, gatewayStub.go is the copy go generate makes for the gateway.
+// MockStub does not implement GetHistoryForKey, so this stub records every write
+// per key the way the peer's history database would and replays it in commit order.
+// transactions get sequential ids and their timestamp from now, which the tests
+// replace with a clock that advances one minute per transaction.
+// the chaincode event of each committed transaction is kept in events.
+// transactions are submitted by the identity set with setIdentity
+type historyStub struct {
+	*shim.MockStub
+	cc      shim.Chaincode
+	args    [][]byte
+	txCount int
+	now     func() time.Time
+	history map[string][]*queryresult.KeyModification
+	event   *pb.ChaincodeEvent   // event set by the running transaction
+	events  []*pb.ChaincodeEvent // events of committed transactions, oldest first
+	creator []byte               // serialized identity of the submitting client
+}
+
+// newHistoryStub creates a history stub for the chaincode
+func newHistoryStub(name string, cc shim.Chaincode) *historyStub {
+	return &historyStub{
+		MockStub: shim.NewMockStub(name, cc),
+		cc:       cc,
+		now:      time.Now,
+		history:  map[string][]*queryresult.KeyModification{},
+	}
+}
+
+// GetArgs returns the arguments of the current transaction
+func (s *historyStub) GetArgs() [][]byte {
+	return s.args
+}
+
+// GetStringArgs returns the arguments of the current transaction as strings
+func (s *historyStub) GetStringArgs() []string {
+	stringArgs := []string{}
+	for _, arg := range s.args {
+		stringArgs = append(stringArgs, string(arg))
+	}
+	return stringArgs
+}
+
+// GetFunctionAndParameters splits the arguments into the function name and its parameters
+func (s *historyStub) GetFunctionAndParameters() (string, []string) {
+	stringArgs := s.GetStringArgs()
+	if len(stringArgs) == 0 {
+		return "", []string{}
+	}
+	return stringArgs[0], stringArgs[1:]
+}
+
+// MockTransactionStart starts a transaction with its timestamp taken from the stub's clock
+func (s *historyStub) MockTransactionStart(txID string) {
+	s.MockStub.MockTransactionStart(txID)
+	s.TxTimestamp, _ = ptypes.TimestampProto(s.now())
+	s.event = nil
+}
+
+// MockInit calls Init of the chaincode with this stub in a new transaction
+func (s *historyStub) MockInit(txID string, args [][]byte) pb.Response {
+	s.args = args
+	s.MockTransactionStart(txID)
+	response := s.cc.Init(s)
+	s.MockTransactionEnd(txID)
+	return response
+}
+
+// MockInvoke calls Invoke of the chaincode with this stub in a new transaction.
+// like a peer, nothing the function wrote is kept if it returns an error
+func (s *historyStub) MockInvoke(txID string, args [][]byte) pb.Response {
+	restore := s.snapshot(txID)
+
+	s.args = args
+	s.MockTransactionStart(txID)
+	response := s.cc.Invoke(s)
+	s.MockTransactionEnd(txID)
+
+	if response.Status != shim.OK {
+		restore()
+	} else if s.event != nil {
+		s.events = append(s.events, s.event)
+	}
+	return response
+}
+
+// MockQuery calls Invoke of the chaincode like a query on a peer, the response is
+// returned but nothing the function writes is kept
+func (s *historyStub) MockQuery(txID string, args [][]byte) pb.Response {
+	restore := s.snapshot(txID)
+
+	s.args = args
+	s.MockTransactionStart(txID)
+	response := s.cc.Invoke(s)
+	s.MockTransactionEnd(txID)
+
+	restore()
+	return response
+}
+
+// snapshot copies the world state and the sorted key list and returns a function
+// that puts them back and drops the history written by txID
+func (s *historyStub) snapshot(txID string) func() {
+	state := map[string][]byte{}
+	for key, value := range s.State {
+		state[key] = value
+	}
+	keys := list.New()
+	keys.PushBackList(s.Keys)
+
+	return func() {
+		s.State = state
+		s.Keys = keys
+		for key, keyHistory := range s.history {
+			if len(keyHistory) > 0 && keyHistory[len(keyHistory)-1].TxId == txID {
+				s.history[key] = keyHistory[:len(keyHistory)-1]
+			}
+		}
+	}
+}
+
+// nextTxID returns a unique sequential transaction id
+func (s *historyStub) nextTxID() string {
+	s.txCount++
+	return fmt.Sprintf("tx%03d", s.txCount)
+}
+
+// PutState writes the value and records it in the key's history
+func (s *historyStub) PutState(key string, value []byte) error {
+	if err := s.MockStub.PutState(key, value); err != nil {
+		return err
+	}
+	s.recordHistory(key, value, false)
+	return nil
+}
+
+// DelState deletes the key and records a delete marker in the key's history
+func (s *historyStub) DelState(key string) error {
+	if err := s.MockStub.DelState(key); err != nil {
+		return err
+	}
+	s.recordHistory(key, nil, true)
+	return nil
+}
+
+// recordHistory keeps one modification per key per transaction, like the peer does
+func (s *historyStub) recordHistory(key string, value []byte, isDelete bool) {
+	modification := &queryresult.KeyModification{
+		TxId:      s.TxID,
+		Value:     value,
+		Timestamp: s.TxTimestamp,
+		IsDelete:  isDelete,
+	}
+
+	keyHistory := s.history[key]
+	if len(keyHistory) > 0 && keyHistory[len(keyHistory)-1].TxId == s.TxID {
+		keyHistory[len(keyHistory)-1] = modification
+		return
+	}
+	s.history[key] = append(keyHistory, modification)
+}
+
+// SetEvent sets the event of the transaction, like the peer a transaction has at most
+// one event so a later call replaces the earlier one
+func (s *historyStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty")
+	}
+	s.event = &pb.ChaincodeEvent{ChaincodeId: s.Name, TxId: s.TxID, EventName: name, Payload: payload}
+	return nil
+}
+
+// GetCreator returns the serialized identity set with setIdentity, nil if none was set
+func (s *historyStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+// attrOID is the X.509 extension the Fabric CA stores enrollment attributes in
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// setIdentity makes the following transactions run as a client of mspID with a self-signed
+// certificate for commonName carrying attrs the way the Fabric CA adds them, e.g. role=doctor
+func (s *historyStub) setIdentity(mspID string, commonName string, attrs map[string]string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	attrsAsBytes, err := json.Marshal(map[string]map[string]string{"attrs": attrs})
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:       time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:        time.Date(2038, time.January, 1, 0, 0, 0, 0, time.UTC),
+		ExtraExtensions: []pkix.Extension{{Id: attrOID, Value: attrsAsBytes}},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	identity := &msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}),
+	}
+	s.creator, err = proto.Marshal(identity)
+	return err
+}
+
+// GetHistoryForKey returns an iterator over every committed modification of the key
+func (s *historyStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: s.history[key]}, nil
+}
+
+// historyIterator iterates a key's modifications oldest first
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+	position      int
+}
+
+// HasNext returns true if there are modifications left
+func (i *historyIterator) HasNext() bool {
+	return i.position < len(i.modifications)
+}
+
+// Next returns the next modification
+func (i *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if !i.HasNext() {
+		return nil, fmt.Errorf("no more history")
+	}
+	i.position++
+	return i.modifications[i.position-1], nil
+}
+
+// Close closes the iterator
+func (i *historyIterator) Close() error {
+	return nil
+}
@@ -2,5 +2,9 @@
 clear
 
 printf "newBloodPressure\n"
-curl -H "Content-type:application/json" -X POST http://localhost:4001 -d '{"channel": "testchannel", "chaincode": "emrcc", "chaincodeVer": "v1", "method": "newBloodPressure", "args": ["p01", "10", "12", "1541440675318"]}'
-printf "\n"
\ No newline at end of file
+curl -H "Content-type:application/json" -X POST http://localhost:4001 -d '{"channel": "testchannel", "chaincode": "emrcc", "chaincodeVer": "v1", "method": "newBloodPressure", "args": ["p01", "120", "80", "1541440675318"]}'
+printf "\n"
+
+printf "getBloodPressureHistory\n"
+curl -H "Content-type:application/json" -X POST http://localhost:4001/bcsgw/rest/v1/transaction/query -d '{"channel": "testchannel", "chaincode": "emrcc", "chaincodeVer": "v1", "method": "getBloodPressureHistory", "args": ["p01"]}'
+printf "\n"
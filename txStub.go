@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// txStub
+// summary: stub that reads its own writes.
+// on a peer GetState returns the value committed before the transaction started, so a
+// function that runs several others in one transaction, e.g. creating a patient and then
+// their prescriptions, wraps the stub in a txStub so later steps see the earlier writes
+type txStub struct {
+	shim.ChaincodeStubInterface
+	writes map[string][]byte // values written in this transaction, nil for deleted keys
+}
+
+// newTxStub wraps stub so writes made through it are visible to reads made through it
+func newTxStub(stub shim.ChaincodeStubInterface) *txStub {
+	return &txStub{
+		ChaincodeStubInterface: stub,
+		writes:                 map[string][]byte{},
+	}
+}
+
+// GetState returns the value written in this transaction, or the committed value
+func (s *txStub) GetState(key string) ([]byte, error) {
+	if value, written := s.writes[key]; written {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+// PutState writes the value to the ledger and remembers it for later reads
+func (s *txStub) PutState(key string, value []byte) error {
+	if err := s.ChaincodeStubInterface.PutState(key, value); err != nil {
+		return err
+	}
+	s.writes[key] = value
+	return nil
+}
+
+// DelState deletes the key from the ledger and remembers it as deleted for later reads
+func (s *txStub) DelState(key string) error {
+	if err := s.ChaincodeStubInterface.DelState(key); err != nil {
+		return err
+	}
+	s.writes[key] = nil
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// millis returns the time as a millisecond timestamp
+func millis(t time.Time) int {
+	return int(t.UnixNano() / int64(time.Millisecond))
+}
+
+// txMillis returns the timestamp of the transaction in milliseconds
+func txMillis(stub shim.ChaincodeStubInterface) (int, *chaincodeError) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, newError(errCodeLedger, "unable to get transaction timestamp").withDetail("cause", err.Error())
+	}
+	txTime, err := ptypes.Timestamp(txTimestamp)
+	if err != nil {
+		return 0, newError(errCodeLedger, "invalid transaction timestamp").withDetail("cause", err.Error())
+	}
+	return millis(txTime), nil
+}
+
+// modificationMillis returns the timestamp of the transaction that made the modification in milliseconds
+func modificationMillis(modification *queryresult.KeyModification) int {
+	txTime, err := ptypes.Timestamp(modification.Timestamp)
+	if err != nil {
+		return 0
+	}
+	return millis(txTime)
+}
+
+// maxTimestamp is the end of time for range queries
+const maxTimestamp = int(^uint(0) >> 1)
+
+// timeRangeArgs reads the optional from and to timestamps at the given positions,
+// a missing or empty from is the start of time and a missing or empty to is the end
+func timeRangeArgs(args []string, fromIndex int, toIndex int) (int, int, *chaincodeError) {
+	from, to := 0, maxTimestamp
+
+	if len(args) > fromIndex && len(args[fromIndex]) > 0 {
+		value, err := strconv.Atoi(args[fromIndex])
+		if err != nil {
+			return 0, 0, newError(errCodeInvalidArgument, "from must be empty or an integer string").withField("from")
+		}
+		from = value
+	}
+	if len(args) > toIndex && len(args[toIndex]) > 0 {
+		value, err := strconv.Atoi(args[toIndex])
+		if err != nil {
+			return 0, 0, newError(errCodeInvalidArgument, "to must be empty or an integer string").withField("to")
+		}
+		to = value
+	}
+	if from > to {
+		return 0, 0, newError(errCodeInvalidArgument, "from must not be after to").withField("from")
+	}
+
+	return from, to, nil
+}
+
+// containsString reports whether the value is in the list
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
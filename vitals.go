@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// vitalType
+// summary: a kind of vital sign the chaincode accepts, with its LOINC code, UCUM unit and valid range.
+// a vital sign measured as several values, e.g. blood pressure, lists them as components
+type vitalType struct {
+	Name       string           `json:"name"`
+	Code       string           `json:"code"` // LOINC code
+	Display    string           `json:"display"`
+	Unit       string           `json:"unit"` // UCUM unit every value is recorded in
+	Min        float64          `json:"min,omitempty"`
+	Max        float64          `json:"max,omitempty"`
+	Components []vitalComponent `json:"components,omitempty"`
+}
+
+// vitalComponent
+// summary: one value of a vital sign measured as several values
+type vitalComponent struct {
+	Name    string  `json:"name"`
+	Code    string  `json:"code"` // LOINC code
+	Display string  `json:"display"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+}
+
+// names of the vital types the compatibility functions record
+const (
+	vitalHeartRate     = "heartRate"
+	vitalBloodPressure = "bloodPressure"
+)
+
+// vitalTypes is the registry of vital signs, add an entry here to accept a new vital sign.
+// the ranges reject values that can only be entry or device errors, not abnormal readings
+var vitalTypes = []vitalType{
+	{Name: vitalHeartRate, Code: loincHeartRate, Display: "Heart rate", Unit: "/min", Min: 20, Max: 300},
+	{Name: vitalBloodPressure, Code: loincBloodPressurePanel, Display: "Blood pressure panel", Unit: "mm[Hg]", Components: []vitalComponent{
+		{Name: "systolic", Code: loincSystolic, Display: "Systolic blood pressure", Min: 40, Max: 300},
+		{Name: "diastolic", Code: loincDiastolic, Display: "Diastolic blood pressure", Min: 20, Max: 200},
+	}},
+	{Name: "glucose", Code: "2339-0", Display: "Glucose [Mass/volume] in Blood", Unit: "mg/dL", Min: 10, Max: 1000},
+	{Name: "spo2", Code: "59408-5", Display: "Oxygen saturation in Arterial blood by Pulse oximetry", Unit: "%", Min: 50, Max: 100},
+	{Name: "temperature", Code: "8310-5", Display: "Body temperature", Unit: "Cel", Min: 25, Max: 45},
+	{Name: "weight", Code: "29463-7", Display: "Body weight", Unit: "kg", Min: 0.2, Max: 650},
+	{Name: "height", Code: "8302-2", Display: "Body height", Unit: "cm", Min: 20, Max: 280},
+	{Name: "bmi", Code: "39156-5", Display: "Body mass index (BMI) [Ratio]", Unit: "kg/m2", Min: 5, Max: 150},
+	{Name: "respiratoryRate", Code: "9279-1", Display: "Respiratory rate", Unit: "/min", Min: 2, Max: 80},
+}
+
+// vitalSign
+// summary: one reading of a vital sign, stored under the composite key vitalSign~patientID~type~timestamp.
+// a second reading with the same type and timestamp is refused
+type vitalSign struct {
+	ObjectType string             `json:"objType"`
+	PatientID  string             `json:"patientID"`
+	Type       string             `json:"type"`                 // name of the vitalType
+	Value      float64            `json:"value,omitempty"`      // value of a vital sign without components
+	Components map[string]float64 `json:"components,omitempty"` // values by component name
+	Unit       string             `json:"unit"`
+	Timestamp  int                `json:"timestamp"`
+}
+
+// recordedVital
+// summary: a vital sign reading with the transaction that recorded it
+type recordedVital struct {
+	TxID      string    `json:"txID"`
+	Timestamp int       `json:"timestamp"` // time of the transaction
+	Vital     vitalSign `json:"vital"`
+}
+
+// lookupVitalType returns the registered vital type with the name
+func lookupVitalType(name string) (vitalType, bool) {
+	for _, vt := range vitalTypes {
+		if vt.Name == name {
+			return vt, true
+		}
+	}
+	return vitalType{}, false
+}
+
+// lookupVitalTypeByCode returns the registered vital type with the LOINC code
+func lookupVitalTypeByCode(code string) (vitalType, bool) {
+	for _, vt := range vitalTypes {
+		if vt.Code == code {
+			return vt, true
+		}
+	}
+	return vitalType{}, false
+}
+
+// vitalTypeNames returns the names of the registered vital types
+func vitalTypeNames() []string {
+	names := []string{}
+	for _, vt := range vitalTypes {
+		names = append(names, vt.Name)
+	}
+	return names
+}
+
+// newVital
+// input: patientID, vital type, timestamp and the value, or one value per component in registry order
+// output: confirmation of record saved
+// summary: record a reading of any registered vital sign, e.g. newVital p01 glucose 1541440675318 95
+// or newVital p01 bloodPressure 1541440675318 120 80
+func (t *Chaincode) newVital(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1		2			3...
+	// "patientID", "type", timestamp, values...
+	if len(args) < 4 {
+		return incorrectArgCount("at least 4")
+	}
+
+	fmt.Println("- start newVital")
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	vt, found := lookupVitalType(args[1])
+	if !found {
+		return invalidArgument("type", "2nd argument must be one of "+strings.Join(vitalTypeNames(), ", "))
+	}
+
+	timestamp, err := strconv.Atoi(args[2])
+	if err != nil || timestamp < 0 {
+		return invalidArgument("timestamp", "3rd argument must be a non-negative integer string")
+	}
+
+	values := []float64{}
+	for _, arg := range args[3:] {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return invalidArgument("value", "values must be numeric strings")
+		}
+		values = append(values, value)
+	}
+
+	if cerr := t.recordVital(stub, strings.ToLower(args[0]), vt, timestamp, values); cerr != nil {
+		return cerr.response()
+	}
+
+	fmt.Println("- end newVital (success)")
+	return shim.Success(nil)
+}
+
+// recordVital
+// input: patientID, vital type, timestamp and the values of the reading
+// output: nil or an error if a value is out of range, the patient does not exist, a reading of the type
+// was already recorded at the timestamp or the write failed
+func (t *Chaincode) recordVital(stub shim.ChaincodeStubInterface, patientID string, vt vitalType, timestamp int, values []float64) *chaincodeError {
+	reading := vitalSign{
+		ObjectType: objTypeVitalSign,
+		PatientID:  patientID,
+		Type:       vt.Name,
+		Unit:       vt.Unit,
+		Timestamp:  timestamp,
+	}
+
+	if len(vt.Components) == 0 {
+		if len(values) != 1 {
+			return newError(errCodeInvalidArgument, vt.Name+" takes 1 value").withField("value")
+		}
+		if values[0] < vt.Min || values[0] > vt.Max {
+			return vitalOutOfRange(vt.Name, vt.Name, vt.Min, vt.Max, vt.Unit)
+		}
+		reading.Value = values[0]
+	} else {
+		if len(values) != len(vt.Components) {
+			return newError(errCodeInvalidArgument, vt.Name+" takes "+strconv.Itoa(len(vt.Components))+" values").withField("value")
+		}
+		reading.Components = map[string]float64{}
+		for i, component := range vt.Components {
+			if values[i] < component.Min || values[i] > component.Max {
+				return vitalOutOfRange(component.Name, vt.Name+" "+component.Name, component.Min, component.Max, vt.Unit)
+			}
+			reading.Components[component.Name] = values[i]
+		}
+	}
+
+	// the patient must exist, fails if the record is missing, corrupt or not an EMR
+	if _, cerr := t.getEMR(stub, patientID); cerr != nil {
+		return cerr
+	}
+
+	readingKey, err := stub.CreateCompositeKey(objTypeVitalSign, []string{patientID, vt.Name, fmt.Sprintf("%013d", timestamp)})
+	if err != nil {
+		return newError(errCodeLedger, "unable to create vital sign key").withDetail("cause", err.Error())
+	}
+
+	existing, err := stub.GetState(readingKey)
+	if err != nil {
+		return newError(errCodeLedger, "unable to get vital sign").withDetail("cause", err.Error())
+	}
+	if len(existing) > 0 {
+		return newError(errCodeAlreadyExists, vt.Name+" was already recorded at "+strconv.Itoa(timestamp)).
+			withField("timestamp").
+			withDetail("type", vt.Name)
+	}
+
+	return t.putRecord(stub, readingKey, reading)
+}
+
+// vitalOutOfRange returns the error for a value outside the valid range of its vital sign
+func vitalOutOfRange(field string, name string, min float64, max float64, unit string) *chaincodeError {
+	minText := strconv.FormatFloat(min, 'f', -1, 64)
+	maxText := strconv.FormatFloat(max, 'f', -1, 64)
+	return newError(errCodeInvalidArgument, name+" must be between "+minText+" and "+maxText+" "+unit).
+		withField(field).
+		withDetail("min", minText).
+		withDetail("max", maxText).
+		withDetail("unit", unit)
+}
+
+// getVitals
+// input: patientID, optional vital type, optional from and to timestamps (inclusive)
+// output: the patient's vital sign readings oldest first, every type when no type is given
+func (t *Chaincode) getVitals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1 (optional)	2 (optional)	3 (optional)
+	// "patientID", "type", 		from, 			to
+	if len(args) < 1 {
+		return incorrectArgCount("1")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	vitalName := ""
+	if len(args) > 1 {
+		vitalName = args[1]
+	}
+	if _, found := lookupVitalType(vitalName); vitalName != "" && !found {
+		return invalidArgument("type", "2nd argument must be empty or one of "+strings.Join(vitalTypeNames(), ", "))
+	}
+
+	from, to, cerr := timeRangeArgs(args, 2, 3)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	// the patient must exist, fails if the record is missing, corrupt or not an EMR
+	if _, cerr := t.getEMR(stub, patientID); cerr != nil {
+		return cerr.response()
+	}
+
+	readings, cerr := t.vitals(stub, patientID, vitalName, from, to)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID string      `json:"patientID"`
+		Vitals    []vitalSign `json:"vitals"`
+	}{
+		PatientID: patientID,
+		Vitals:    readings,
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal vitals response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// getVitalTypes
+// input: none
+// output: the registered vital types with their codes, units and valid ranges
+func (t *Chaincode) getVitalTypes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	vitalTypesAsBytes, err := json.Marshal(vitalTypes)
+	if err != nil {
+		return serializationError("unable to marshal vital types", err)
+	}
+
+	return shim.Success(vitalTypesAsBytes)
+}
+
+// vitals
+// input: patientID, vital type or empty for every type, from and to timestamps (inclusive)
+// output: the matching readings, by type in registry order and oldest first within a type
+func (t *Chaincode) vitals(stub shim.ChaincodeStubInterface, patientID string, vitalName string, from int, to int) ([]vitalSign, *chaincodeError) {
+	names := []string{vitalName}
+	if vitalName == "" {
+		names = vitalTypeNames()
+	}
+
+	readings := []vitalSign{}
+	for _, name := range names {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(objTypeVitalSign, []string{patientID, name})
+		if err != nil {
+			return nil, newError(errCodeLedger, "unable to query vital signs").withDetail("cause", err.Error())
+		}
+
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, newError(errCodeLedger, "error iterating vital signs").withDetail("cause", err.Error())
+			}
+
+			reading := vitalSign{}
+			if cerr := decodeRecord(queryResponse.Key, queryResponse.Value, objTypeVitalSign, &reading); cerr != nil {
+				resultsIterator.Close()
+				return nil, cerr
+			}
+
+			if reading.Timestamp >= from && reading.Timestamp <= to {
+				readings = append(readings, reading)
+			}
+		}
+		resultsIterator.Close()
+	}
+
+	return readings, nil
+}
+
+// latestVitalsAsOf
+// input: patientID, timestamp
+// output: the latest reading of each vital type as it was after the last transaction at or before the
+// timestamp, in registry order
+// summary: walks the history of each reading's key like getPersonAsOf walks the patient record, a reading
+// recorded after the timestamp is left out even if it was taken before it
+func (t *Chaincode) latestVitalsAsOf(stub shim.ChaincodeStubInterface, patientID string, asOf int) ([]recordedVital, *chaincodeError) {
+	latest := []recordedVital{}
+	for _, name := range vitalTypeNames() {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(objTypeVitalSign, []string{patientID, name})
+		if err != nil {
+			return nil, newError(errCodeLedger, "unable to query vital signs").withDetail("cause", err.Error())
+		}
+
+		// keys are ordered by the time the reading was taken, the last one recorded by asOf is the latest
+		var found *recordedVital
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, newError(errCodeLedger, "error iterating vital signs").withDetail("cause", err.Error())
+			}
+
+			version, cerr := vitalVersionAsOf(stub, queryResponse.Key, asOf)
+			if cerr != nil {
+				resultsIterator.Close()
+				return nil, cerr
+			}
+			if version != nil {
+				found = version
+			}
+		}
+		resultsIterator.Close()
+
+		if found != nil {
+			latest = append(latest, *found)
+		}
+	}
+
+	return latest, nil
+}
+
+// vitalVersionAsOf returns the reading stored under the key after the last transaction at or before asOf,
+// nil if the key was not written yet or was deleted then
+func vitalVersionAsOf(stub shim.ChaincodeStubInterface, key string, asOf int) (*recordedVital, *chaincodeError) {
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, newError(errCodeLedger, "unable to get vital sign history").withDetail("cause", err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var found *recordedVital
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, newError(errCodeLedger, "error iterating vital sign history").withDetail("cause", err.Error())
+		}
+
+		txTime := modificationMillis(modification)
+		if txTime > asOf {
+			continue
+		}
+		if modification.IsDelete {
+			found = nil
+			continue
+		}
+
+		version := recordedVital{TxID: modification.TxId, Timestamp: txTime}
+		if cerr := decodeRecord(key, modification.Value, objTypeVitalSign, &version.Vital); cerr != nil {
+			return nil, cerr
+		}
+		found = &version
+	}
+
+	return found, nil
+}
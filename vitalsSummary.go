@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// bucketSizes are the lengths in milliseconds of the buckets getVitalsSummary groups readings by
+var bucketSizes = map[string]int{
+	"hour": 60 * 60 * 1000,
+	"day":  24 * 60 * 60 * 1000,
+	"week": 7 * 24 * 60 * 60 * 1000,
+}
+
+// weekStart is the timestamp of Monday 01/05/1970 00:00 UTC, weeks start on Mondays
+const weekStart = 4 * 24 * 60 * 60 * 1000
+
+// vitalStats
+// summary: the statistics of one value over the readings of a bucket.
+// trend is the slope of the least squares line through the readings in unit per bucket, 0 for a single reading
+type vitalStats struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Trend float64 `json:"trend"`
+}
+
+// vitalBucket
+// summary: the readings of one hour, day or week, from start (inclusive) to end (exclusive).
+// a vital sign without components has its statistics in value, otherwise in components by component name
+type vitalBucket struct {
+	Start      int                   `json:"start"`
+	End        int                   `json:"end"`
+	Count      int                   `json:"count"`
+	Value      *vitalStats           `json:"value,omitempty"`
+	Components map[string]vitalStats `json:"components,omitempty"`
+}
+
+// getVitalsSummary
+// input: patientID, vital type, from and to timestamps (inclusive, empty for no bound), bucket (hour, day or week)
+// output: count, min, max, mean and trend of the readings in every bucket that has readings, oldest first
+// summary: buckets are aligned to UTC, weeks start on Monday. heartRate and bloodPressure include
+// the readings recorded before vital signs had their own keys, like their history functions
+func (t *Chaincode) getVitalsSummary(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//	0			1		2		3	4
+	// "patientID", "type", from,	to, "bucket"
+	if len(args) < 5 {
+		return incorrectArgCount("5")
+	}
+
+	if len(args[0]) <= 0 {
+		return invalidArgument("patientID", "1st argument must be a non-empty string")
+	}
+
+	patientID := strings.ToLower(args[0])
+
+	vt, found := lookupVitalType(args[1])
+	if !found {
+		return invalidArgument("type", "2nd argument must be one of "+strings.Join(vitalTypeNames(), ", "))
+	}
+
+	from, to, cerr := timeRangeArgs(args, 2, 3)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	bucket := strings.ToLower(args[4])
+	size, found := bucketSizes[bucket]
+	if !found {
+		return invalidArgument("bucket", "5th argument must be hour, day or week")
+	}
+
+	// the patient must exist, fails if the record is missing, corrupt or not an EMR
+	if _, cerr := t.getEMR(stub, patientID); cerr != nil {
+		return cerr.response()
+	}
+
+	readings, cerr := t.summaryReadings(stub, patientID, vt.Name, from, to)
+	if cerr != nil {
+		return cerr.response()
+	}
+
+	response := struct {
+		PatientID string        `json:"patientID"`
+		Type      string        `json:"type"`
+		Unit      string        `json:"unit"`
+		Bucket    string        `json:"bucket"`
+		Buckets   []vitalBucket `json:"buckets"`
+	}{
+		PatientID: patientID,
+		Type:      vt.Name,
+		Unit:      vt.Unit,
+		Bucket:    bucket,
+		Buckets:   summarizeVitals(vt, readings, size),
+	}
+
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return serializationError("unable to marshal vitals summary response", err)
+	}
+
+	return shim.Success(responseAsBytes)
+}
+
+// summaryReadings
+// input: patientID, vital type, from and to timestamps (inclusive)
+// output: the readings to summarize sorted by timestamp, with the readings kept on the patient record for heartRate and bloodPressure
+func (t *Chaincode) summaryReadings(stub shim.ChaincodeStubInterface, patientID string, vitalName string, from int, to int) ([]vitalSign, *chaincodeError) {
+	readings := []vitalSign{}
+
+	switch vitalName {
+	case vitalHeartRate:
+		history, cerr := t.heartRateHistory(stub, patientID)
+		if cerr != nil {
+			return nil, cerr
+		}
+		for _, message := range history {
+			readings = append(readings, vitalSign{Type: vitalName, Value: float64(message.HeartRate), Timestamp: message.Timestamp})
+		}
+	case vitalBloodPressure:
+		history, cerr := t.bloodPressureHistory(stub, patientID)
+		if cerr != nil {
+			return nil, cerr
+		}
+		for _, reading := range history {
+			readings = append(readings, vitalSign{
+				Type:       vitalName,
+				Components: map[string]float64{"systolic": float64(reading.High), "diastolic": float64(reading.Low)},
+				Timestamp:  reading.Timestamp,
+			})
+		}
+	default:
+		return t.vitals(stub, patientID, vitalName, from, to)
+	}
+
+	inRange := []vitalSign{}
+	for _, reading := range readings {
+		if reading.Timestamp >= from && reading.Timestamp <= to {
+			inRange = append(inRange, reading)
+		}
+	}
+	sort.SliceStable(inRange, func(i, j int) bool { return inRange[i].Timestamp < inRange[j].Timestamp })
+
+	return inRange, nil
+}
+
+// summarizeVitals groups readings sorted by timestamp into buckets of size milliseconds
+func summarizeVitals(vt vitalType, readings []vitalSign, size int) []vitalBucket {
+	buckets := []vitalBucket{}
+
+	for start := 0; start < len(readings); {
+		bucketStart := bucketStartOf(readings[start].Timestamp, size)
+		end := start
+		for end < len(readings) && readings[end].Timestamp < bucketStart+size {
+			end++
+		}
+		bucketReadings := readings[start:end]
+
+		b := vitalBucket{Start: bucketStart, End: bucketStart + size, Count: len(bucketReadings)}
+		if len(vt.Components) == 0 {
+			stats := bucketStats(bucketReadings, size, func(reading vitalSign) float64 { return reading.Value })
+			b.Value = &stats
+		} else {
+			b.Components = map[string]vitalStats{}
+			for _, component := range vt.Components {
+				name := component.Name
+				b.Components[name] = bucketStats(bucketReadings, size, func(reading vitalSign) float64 { return reading.Components[name] })
+			}
+		}
+
+		buckets = append(buckets, b)
+		start = end
+	}
+
+	return buckets
+}
+
+// bucketStartOf returns the start of the bucket of size milliseconds the timestamp falls in
+func bucketStartOf(timestamp int, size int) int {
+	offset := 0
+	if size == bucketSizes["week"] {
+		offset = weekStart
+	}
+	start := timestamp - (timestamp-offset)%size
+	if start > timestamp {
+		start -= size
+	}
+	return start
+}
+
+// bucketStats returns the statistics of the value of the readings, trend in unit per size milliseconds
+func bucketStats(readings []vitalSign, size int, value func(vitalSign) float64) vitalStats {
+	stats := vitalStats{Min: value(readings[0]), Max: value(readings[0])}
+
+	var sumX, sumY float64
+	for _, reading := range readings {
+		v := value(reading)
+		if v < stats.Min {
+			stats.Min = v
+		}
+		if v > stats.Max {
+			stats.Max = v
+		}
+		sumX += float64(reading.Timestamp-readings[0].Timestamp) / float64(size)
+		sumY += v
+	}
+	n := float64(len(readings))
+	stats.Mean = sumY / n
+
+	// least squares slope with time measured in buckets from the first reading
+	meanX := sumX / n
+	var covariance, variance float64
+	for _, reading := range readings {
+		dx := float64(reading.Timestamp-readings[0].Timestamp)/float64(size) - meanX
+		covariance += dx * (value(reading) - stats.Mean)
+		variance += dx * dx
+	}
+	if variance > 0 {
+		stats.Trend = covariance / variance
+	}
+
+	return stats
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// 2018-11-05 00:00 UTC, a Monday
+const summaryMonday = 1541376000000
+
+func hoursAfterMonday(hours int) string {
+	return strconv.Itoa(summaryMonday + hours*bucketSizes["hour"])
+}
+
+func TestGetVitalsSummary(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "newVital", "p01", "glucose", hoursAfterMonday(1), "90")
+	mustInvoke(t, stub, "newVital", "p01", "glucose", hoursAfterMonday(2), "100")
+	mustInvoke(t, stub, "newVital", "p01", "glucose", hoursAfterMonday(3), "110")
+	mustInvoke(t, stub, "newVital", "p01", "glucose", hoursAfterMonday(25), "120")
+	mustInvoke(t, stub, "newVital", "p01", "glucose", hoursAfterMonday(24*7), "80")
+
+	expectGolden(t, "getVitalsSummary", mustInvoke(t, stub, "getVitalsSummary", "p01", "glucose", "", "", "day"))
+
+	for _, c := range []struct {
+		name    string
+		args    []string
+		buckets []int // count of every bucket
+		trend   float64
+	}{
+		{"hour", []string{"p01", "glucose", "", "", "hour"}, []int{1, 1, 1, 1, 1}, 0},
+		{"day", []string{"p01", "glucose", "", "", "day"}, []int{3, 1, 1}, 240},
+		{"week", []string{"p01", "glucose", "", "", "week"}, []int{4, 1}, 153.78056426332287},
+		{"range", []string{"p01", "glucose", hoursAfterMonday(2), hoursAfterMonday(3), "DAY"}, []int{2}, 240},
+		{"none", []string{"p01", "spo2", "", "", "day"}, []int{}, 0},
+	} {
+		var response struct{ Buckets []vitalBucket }
+		mustUnmarshal(t, mustInvoke(t, stub, "getVitalsSummary", c.args...), &response)
+		if len(response.Buckets) != len(c.buckets) {
+			t.Errorf("%s: expected %d buckets, got %+v", c.name, len(c.buckets), response.Buckets)
+			continue
+		}
+		for i, count := range c.buckets {
+			if response.Buckets[i].Count != count {
+				t.Errorf("%s: expected %d readings in bucket %d, got %d", c.name, count, i, response.Buckets[i].Count)
+			}
+		}
+		if len(response.Buckets) > 0 && math.Abs(response.Buckets[0].Value.Trend-c.trend) > 1e-6 {
+			t.Errorf("%s: expected a trend of %v, got %v", c.name, c.trend, response.Buckets[0].Value.Trend)
+		}
+	}
+
+	expectError(t, invoke(stub, "getVitalsSummary", "p99", "glucose", "", "", "day"), errCodeNotFound)
+	expectInvalidArgs(t, "getVitalsSummary", []argCase{
+		{"too few args", []string{"p01", "glucose", "", ""}, ""},
+		{"unknown type", []string{"p01", "mood", "", "", "day"}, "type"},
+		{"bad from", []string{"p01", "glucose", "monday", "", "day"}, "from"},
+		{"bad bucket", []string{"p01", "glucose", "", "", "month"}, "bucket"},
+	})
+}
+
+// blood pressure summaries have one set of statistics per component and include the
+// readings stored on the patient record before vital signs had their own keys
+func TestGetVitalsSummaryComponents(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "p01", `{"objType":"emr","id":"p01","firstName":"john","lastName":"doe",`+
+		`"bloodPressure":{"low":70,"high":110,"timestamp":`+hoursAfterMonday(1)+`}}`)
+	mustInvoke(t, stub, "newBloodPressure", "p01", "130", "90", hoursAfterMonday(3))
+
+	var response struct{ Buckets []vitalBucket }
+	mustUnmarshal(t, mustInvoke(t, stub, "getVitalsSummary", "p01", "bloodPressure", "", "", "day"), &response)
+	if len(response.Buckets) != 1 || response.Buckets[0].Count != 2 || response.Buckets[0].Value != nil {
+		t.Fatalf("expected one bucket of two readings, got %+v", response.Buckets)
+	}
+	if systolic := response.Buckets[0].Components["systolic"]; systolic.Min != 110 || systolic.Max != 130 || systolic.Mean != 120 || systolic.Trend != 240 {
+		t.Errorf("unexpected systolic statistics %+v", systolic)
+	}
+	if diastolic := response.Buckets[0].Components["diastolic"]; diastolic.Mean != 80 || diastolic.Trend != 240 {
+		t.Errorf("unexpected diastolic statistics %+v", diastolic)
+	}
+}
+
+func TestBucketStartOf(t *testing.T) {
+	for _, c := range []struct {
+		timestamp int
+		bucket    string
+		expected  int
+	}{
+		{summaryMonday + 1, "hour", summaryMonday},
+		{summaryMonday + bucketSizes["day"] - 1, "day", summaryMonday},
+		{summaryMonday + 6*bucketSizes["day"], "week", summaryMonday},
+		{summaryMonday - 1, "week", summaryMonday - bucketSizes["week"]},
+		{0, "week", weekStart - bucketSizes["week"]},
+	} {
+		if start := bucketStartOf(c.timestamp, bucketSizes[c.bucket]); start != c.expected {
+			t.Errorf("%d by %s: expected %d, got %d", c.timestamp, c.bucket, c.expected, start)
+		}
+	}
+}
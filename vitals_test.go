@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewVital(t *testing.T) {
+	stub := newTestStub(t)
+
+	mustInvoke(t, stub, "newVital", "P01", "glucose", "1541440675318", "95")
+	mustInvoke(t, stub, "newVital", "p01", "temperature", "1541440675318", "37.2")
+	mustInvoke(t, stub, "newVital", "p01", "bloodPressure", "1541440675318", "120", "80")
+	mustInvoke(t, stub, "newVital", "p01", "glucose", "1541440735318", "110")
+	// a second reading with the same timestamp does not replace the first
+	cerr := expectError(t, invoke(stub, "newVital", "p01", "glucose", "1541440735318", "105"), errCodeAlreadyExists)
+	if cerr.Field != "timestamp" {
+		t.Errorf("expected field timestamp, got %s", cerr.Field)
+	}
+	expectError(t, invoke(stub, "newVital", "p99", "glucose", "1541440675318", "95"), errCodeNotFound)
+
+	expectGolden(t, "getVitals", mustInvoke(t, stub, "getVitals", "p01"))
+
+	cerr = expectError(t, invoke(stub, "newVital", "p01", "spo2", "1541440675318", "101"), errCodeInvalidArgument)
+	if cerr.Field != "spo2" || cerr.Details["max"] != "100" || cerr.Details["unit"] != "%" {
+		t.Errorf("unexpected range error %+v", cerr)
+	}
+
+	expectInvalidArgs(t, "newVital", []argCase{
+		{"too few args", []string{"p01", "glucose", "1"}, ""},
+		{"unknown type", []string{"p01", "mood", "1", "5"}, "type"},
+		{"bad timestamp", []string{"p01", "glucose", "now", "95"}, "timestamp"},
+		{"bad value", []string{"p01", "glucose", "1", "high"}, "value"},
+		{"too many values", []string{"p01", "glucose", "1", "95", "96"}, "value"},
+		{"missing component", []string{"p01", "bloodPressure", "1", "120"}, "value"},
+		{"component out of range", []string{"p01", "bloodPressure", "1", "120", "8"}, "diastolic"},
+	})
+}
+
+func TestGetVitals(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "newVital", "p01", "weight", "1541440675318", "80.5")
+	mustInvoke(t, stub, "newVital", "p01", "weight", "1543440675318", "79")
+	mustInvoke(t, stub, "newVital", "p01", "respiratoryRate", "1541440675318", "16")
+	mustInvoke(t, stub, "newVital", "p02", "weight", "1541440675318", "60")
+
+	for _, c := range []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		{"all", []string{"p01"}, 3},
+		{"by type", []string{"p01", "weight"}, 2},
+		{"from", []string{"p01", "weight", "1542000000000"}, 1},
+		{"to", []string{"p01", "", "", "1542000000000"}, 2},
+		{"none", []string{"p01", "bmi"}, 0},
+	} {
+		var response struct{ Vitals []vitalSign }
+		mustUnmarshal(t, mustInvoke(t, stub, "getVitals", c.args...), &response)
+		if len(response.Vitals) != c.expected {
+			t.Errorf("%s: expected %d readings, got %v", c.name, c.expected, response.Vitals)
+		}
+	}
+
+	expectGolden(t, "getVitalTypes", mustInvoke(t, stub, "getVitalTypes"))
+	expectError(t, invoke(stub, "getVitals", "p99"), errCodeNotFound)
+	expectInvalidArgs(t, "getVitals", []argCase{
+		{"no args", nil, ""},
+		{"unknown type", []string{"p01", "mood"}, "type"},
+		{"bad from", []string{"p01", "", "yesterday"}, "from"},
+	})
+}
+
+// the compatibility functions record vital signs and their histories still include
+// the readings stored on the patient record before vital signs had their own keys
+func TestVitalsCompatibility(t *testing.T) {
+	stub := newTestStub(t)
+	putRaw(stub, "p01", `{"objType":"emr","id":"p01","firstName":"john","lastName":"doe",`+
+		`"heartRate":{"heartRate":64,"timestamp":1541000000000},"bloodPressure":{"low":70,"high":110,"timestamp":1541000000000}}`)
+
+	mustInvoke(t, stub, "newHeartRateMessage", "p01", "72", "1541440675318")
+	mustInvoke(t, stub, "newBloodPressure", "p01", "120", "80", "1541440675318")
+
+	expectGolden(t, "getHeartRateHistory-legacy", mustInvoke(t, stub, "getHeartRateHistory", "p01"))
+	expectGolden(t, "getBloodPressureHistory-legacy", mustInvoke(t, stub, "getBloodPressureHistory", "p01"))
+
+	var response struct{ Vitals []vitalSign }
+	mustUnmarshal(t, mustInvoke(t, stub, "getVitals", "p01"), &response)
+	if len(response.Vitals) != 2 || response.Vitals[0].Type != vitalHeartRate || response.Vitals[1].Components["systolic"] != 120 {
+		t.Errorf("expected the readings as vital signs, got %+v", response.Vitals)
+	}
+
+	// range errors are reported with the argument names of the compatibility functions
+	cerr := expectError(t, invoke(stub, "newBloodPressure", "p01", "400", "80", "1541440675318"), errCodeInvalidArgument)
+	if cerr.Field != "high" {
+		t.Errorf("expected field high, got %s", cerr.Field)
+	}
+	cerr = expectError(t, invoke(stub, "newHeartRateMessage", "p01", "0", "1541440675318"), errCodeInvalidArgument)
+	if cerr.Field != "heartRate" {
+		t.Errorf("expected field heartRate, got %s", cerr.Field)
+	}
+}
+
+// vital signs without a function of their own are exported and imported as FHIR Observations
+func TestVitalsFHIR(t *testing.T) {
+	stub := newTestStub(t)
+	mustInvoke(t, stub, "newVital", "p01", "spo2", "1541440675318", "97")
+
+	exported := mustInvoke(t, stub, "exportFHIR", "p01")
+	if !strings.Contains(string(exported), `"id":"p01-spo2-1541440675318"`) {
+		t.Fatalf("expected an spo2 Observation in %s", exported)
+	}
+
+	other := newTestStub(t)
+	setRole(t, other, roleAdmin, nil)
+	mustInvoke(t, other, "importFHIR", string(exported))
+	if expected, got := mustInvoke(t, stub, "getVitals", "p01"), mustInvoke(t, other, "getVitals", "p01"); string(got) != string(expected) {
+		t.Errorf("vitals differ after round trip\nexpected: %s\ngot: %s", expected, got)
+	}
+}
@@ -1,3 +1,4 @@
 #!/bin/bash
 #zip emrcc.zip bloodPressure.go hack.go heartRate.go insurance.go person.go rx.go main.go
-zip emrcc.zip *.go
+# tests are not installed to OBCS
+zip emrcc.zip $(ls *.go | grep -v _test.go)